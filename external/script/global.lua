@@ -5,6 +5,7 @@
 addHotkey('c', true, false, false, true, false, 'toggleClsnDraw()')
 addHotkey('d', true, false, false, true, false, 'toggleDebugDraw()')
 addHotkey('d', false, false, true, true, false, 'toggleDebugDraw(true)')
+addHotkey('s', true, true, false, true, false, 'toggleSoundDebugDraw()')
 addHotkey('w', true, false, false, true, false, 'toggleWireframeDraw()')
 addHotkey('s', true, false, false, true, true, 'changeSpeed()')
 addHotkey('KP_PLUS', true, false, false, true, true, 'changeSpeed(1)')
@@ -42,6 +43,7 @@ addHotkey('i', true, false, false, true, true, 'stand(1);stand(2);stand(3);stand
 addHotkey('PAUSE', false, false, false, true, false, 'togglePause();closeMenu()')
 addHotkey('PAUSE', true, false, false, true, false, 'step()')
 addHotkey('SCROLLLOCK', false, false, false, true, false, 'step()')
+addHotkey('r', true, true, false, true, false, 'toggleAudioRecording()')
 
 local speedMul = 1
 local speedAdd = 0
@@ -150,7 +152,8 @@ function boolToInt(bool)
 end
 
 function engineInfo()
-	return string.format('Frames: %d, VSync: %d; Speed: %d/%d%%; FPS: %.3f', tickcount(), vsync(), gameLogicSpeed(), gamespeed(), gamefps())
+	local dropped, stolen = soundchannelstats()
+	return string.format('Frames: %d, VSync: %d; Speed: %d/%d%%; FPS: %.3f; Sounds dropped/stolen: %d/%d', tickcount(), vsync(), gameLogicSpeed(), gamespeed(), gamefps(), dropped, stolen)
 end
 
 function playerInfo()
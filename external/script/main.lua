@@ -1316,6 +1316,11 @@ if main.debugLog then main.f_printTable(main.flags, "debug/flags.txt") end
 
 loadDebugFont(config.DebugFont, config.DebugFontScale)
 
+--named PalFX presets, usable through the preset key of PalFX tables
+if main.f_fileExists('data/palfx.def') then
+	loadPalFXPresets('data/palfx.def')
+end
+
 --;===========================================================
 --; COMMAND LINE QUICK VS
 --;===========================================================
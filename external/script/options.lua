@@ -103,7 +103,7 @@ options.t_itemname = {
 			config.AIRandomColor = false
 			config.AISurvivalColor = true
 			config.AudioDucking = false
-			--config.AudioSampleRate = 44100
+			--config.AudioSampleRate = 48000
 			config.AutoGuard = false
 			--config.BackgroundLoading = false
 			config.BarGuard = false
@@ -6,6 +6,7 @@ import (
 	"math"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"unsafe"
 )
@@ -2620,17 +2621,9 @@ func (be BytecodeExp) run_ex(c *Char, i *int, oc *Char) {
 		sys.bcStack.PushB(c.reversalDefAttr(*(*int32)(unsafe.Pointer(&be[*i]))))
 		*i += 4
 	case OC_ex_bgmlength:
-		if sys.bgm.streamer == nil {
-			sys.bcStack.PushI(0)
-		} else {
-			sys.bcStack.PushI(int32(sys.bgm.streamer.Len()))
-		}
+		sys.bcStack.PushI(int32(sys.bgm.Length()))
 	case OC_ex_bgmposition:
-		if sys.bgm.streamer == nil {
-			sys.bcStack.PushI(0)
-		} else {
-			sys.bcStack.PushI(int32(sys.bgm.streamer.Position()))
-		}
+		sys.bcStack.PushI(int32(sys.bgm.Position()))
 	case OC_ex_airjumpcount:
 		sys.bcStack.PushI(c.airJumpCount)
 	case OC_ex_envshakevar_time:
@@ -3355,6 +3348,7 @@ const (
 	playSnd_loopstart
 	playSnd_loopend
 	playSnd_startposition
+	playSnd_startms
 	playSnd_loopcount
 	playSnd_stopongethit
 	playSnd_stoponchangestate
@@ -3367,7 +3361,7 @@ func (sc playSnd) Run(c *Char, _ []int32) bool {
 	crun := c
 	f, lw, lp, stopgh, stopcs := "", false, false, false, false
 	var g, n, ch, vo, pri, lc int32 = -1, 0, -1, 100, 0, 0
-	var loopstart, loopend, startposition = 0, 0, 0
+	var loopstart, loopend, startposition, startms = 0, 0, 0, 0
 	var p, fr float32 = 0, 1
 	x := &c.pos[0]
 	ls := c.localscl
@@ -3408,6 +3402,8 @@ func (sc playSnd) Run(c *Char, _ []int32) bool {
 			loopend = int(exp[0].evalI64(c))
 		case playSnd_startposition:
 			startposition = int(exp[0].evalI64(c))
+		case playSnd_startms:
+			startms = int(exp[0].evalI(c))
 		case playSnd_loopcount:
 			lc = exp[0].evalI(c)
 		case playSnd_stopongethit:
@@ -3428,13 +3424,13 @@ func (sc playSnd) Run(c *Char, _ []int32) bool {
 	// Read the loop parameter if loopcount not specified
 	if lc == 0 {
 		if lp {
-			crun.playSound(f, lw, -1, g, n, ch, vo, p, fr, ls, x, true, pri, loopstart, loopend, startposition, stopgh, stopcs)
+			crun.playSound(f, lw, -1, g, n, ch, vo, p, fr, ls, x, true, pri, loopstart, loopend, startposition, startms, stopgh, stopcs)
 		} else {
-			crun.playSound(f, lw, 0, g, n, ch, vo, p, fr, ls, x, true, pri, loopstart, loopend, startposition, stopgh, stopcs)
+			crun.playSound(f, lw, 0, g, n, ch, vo, p, fr, ls, x, true, pri, loopstart, loopend, startposition, startms, stopgh, stopcs)
 		}
 		// Use the loopcount directly if it's been specified
 	} else {
-		crun.playSound(f, lw, lc, g, n, ch, vo, p, fr, ls, x, true, pri, loopstart, loopend, startposition, stopgh, stopcs)
+		crun.playSound(f, lw, lc, g, n, ch, vo, p, fr, ls, x, true, pri, loopstart, loopend, startposition, startms, stopgh, stopcs)
 	}
 	return false
 }
@@ -4178,6 +4174,12 @@ const (
 	palFX_invertall
 	palFX_invertblend
 	palFX_hue
+	palFX_contrast
+	palFX_gamma
+	palFX_posterize
+	palFX_pausemode
+	palFX_palrange
+	palFX_huedeg
 	palFX_last = iota - 1
 	palFX_redirectid
 )
@@ -4190,7 +4192,19 @@ func (sc palFX) runSub(c *Char, pfd *PalFXDef,
 	case palFX_color:
 		pfd.color = exp[0].evalF(c) / 256
 	case palFX_hue:
-		pfd.hue = exp[0].evalF(c) / 256
+		pfd.hue = wrapHue(exp[0].evalF(c) * palFXHueUnit)
+	case palFX_huedeg:
+		pfd.hue = wrapHue(exp[0].evalF(c))
+	case palFX_contrast:
+		pfd.contrast = MaxF(0, exp[0].evalF(c)/256)
+	case palFX_gamma:
+		pfd.gamma = MaxF(0, exp[0].evalF(c)/256)
+	case palFX_posterize:
+		if v := exp[0].evalI(c); v > 0 {
+			pfd.posterize = Clamp(v, 2, 256)
+		} else {
+			pfd.posterize = 0
+		}
 	case palFX_add:
 		pfd.add[0] = exp[0].evalI(c)
 		pfd.add[1] = exp[1].evalI(c)
@@ -4202,55 +4216,72 @@ func (sc palFX) runSub(c *Char, pfd *PalFXDef,
 	case palFX_sinadd:
 		var side int32 = 1
 		if len(exp) > 3 {
-			if exp[3].evalI(c) < 0 {
-				pfd.cycletime[0] = -exp[3].evalI(c)
+			if exp[3].evalF(c) < 0 {
+				pfd.cycletime[0] = -exp[3].evalF(c)
 				side = -1
 			} else {
-				pfd.cycletime[0] = exp[3].evalI(c)
+				pfd.cycletime[0] = exp[3].evalF(c)
 			}
 		}
 		pfd.sinadd[0] = exp[0].evalI(c) * side
 		pfd.sinadd[1] = exp[1].evalI(c) * side
 		pfd.sinadd[2] = exp[2].evalI(c) * side
+		if len(exp) > 4 {
+			pfd.sinphase[0] = exp[4].evalF(c)
+		}
 	case palFX_sinmul:
 		var side int32 = 1
 		if len(exp) > 3 {
-			if exp[3].evalI(c) < 0 {
-				pfd.cycletime[1] = -exp[3].evalI(c)
+			if exp[3].evalF(c) < 0 {
+				pfd.cycletime[1] = -exp[3].evalF(c)
 				side = -1
 			} else {
-				pfd.cycletime[1] = exp[3].evalI(c)
+				pfd.cycletime[1] = exp[3].evalF(c)
 			}
 		}
 		pfd.sinmul[0] = exp[0].evalI(c) * side
 		pfd.sinmul[1] = exp[1].evalI(c) * side
 		pfd.sinmul[2] = exp[2].evalI(c) * side
+		if len(exp) > 4 {
+			pfd.sinphase[1] = exp[4].evalF(c)
+		}
 	case palFX_sincolor:
 		var side int32 = 1
 		if len(exp) > 1 {
-			if exp[1].evalI(c) < 0 {
-				pfd.cycletime[2] = -exp[1].evalI(c)
+			if exp[1].evalF(c) < 0 {
+				pfd.cycletime[2] = -exp[1].evalF(c)
 				side = -1
 			} else {
-				pfd.cycletime[2] = exp[1].evalI(c)
+				pfd.cycletime[2] = exp[1].evalF(c)
 			}
 		}
 		pfd.sincolor = exp[0].evalI(c) * side
+		if len(exp) > 2 {
+			pfd.sinphase[2] = exp[2].evalF(c)
+		}
 	case palFX_sinhue:
 		var side int32 = 1
 		if len(exp) > 1 {
-			if exp[1].evalI(c) < 0 {
-				pfd.cycletime[3] = -exp[1].evalI(c)
+			if exp[1].evalF(c) < 0 {
+				pfd.cycletime[3] = -exp[1].evalF(c)
 				side = -1
 			} else {
-				pfd.cycletime[3] = exp[1].evalI(c)
+				pfd.cycletime[3] = exp[1].evalF(c)
 			}
 		}
 		pfd.sinhue = exp[0].evalI(c) * side
+		if len(exp) > 2 {
+			pfd.sinphase[3] = exp[2].evalF(c)
+		}
+	case palFX_pausemode:
+		pfd.pausemode = PalFXPauseMode(Clamp(exp[0].evalI(c), int32(PalFXPauseRun), int32(PalFXPauseSuper)))
+	case palFX_palrange:
+		pfd.palrange[0] = Clamp(exp[0].evalI(c), 0, 255)
+		pfd.palrange[1] = Clamp(exp[1].evalI(c), 0, 255)
 	case palFX_invertall:
 		pfd.invertall = exp[0].evalB(c)
 	case palFX_invertblend:
-		pfd.invertblend = Clamp(exp[0].evalI(c), -1, 2)
+		pfd.invertblend = clampInvertBlend(exp[0].evalI(c), InvertBlendAdd1, InvertBlendSubAdd1)
 	default:
 		return false
 	}
@@ -4279,7 +4310,7 @@ func (sc palFX) Run(c *Char, _ []int32) bool {
 			pf.clear2(true)
 			// Mugen 1.1 behavior if invertblend param is omitted (Only if char mugenversion = 1.1)
 			if c.stWgi().mugenver[0] == 1 && c.stWgi().mugenver[1] == 1 && c.stWgi().ikemenver[0] == 0 && c.stWgi().ikemenver[1] == 0 {
-				pf.invertblend = -2
+				pf.invertblend = InvertBlendMugen11
 			}
 			doOnce = true
 		}
@@ -4296,7 +4327,7 @@ func (sc allPalFX) Run(c *Char, _ []int32) bool {
 	StateControllerBase(sc).run(c, func(id byte, exp []BytecodeExp) bool {
 		palFX(sc).runSub(c, &sys.allPalFX.PalFXDef, id, exp)
 		// Forcing 1.1 kind behavior
-		sys.allPalFX.invertblend = Clamp(sys.allPalFX.invertblend, 0, 1)
+		sys.allPalFX.invertblend = clampInvertBlend(int32(sys.allPalFX.invertblend), InvertBlendNone, InvertBlendSub)
 		return true
 	})
 	return false
@@ -4307,10 +4338,10 @@ type bgPalFX palFX
 func (sc bgPalFX) Run(c *Char, _ []int32) bool {
 	sys.bgPalFX.clear()
 	// Forcing 1.1 behavior
-	sys.bgPalFX.invertblend = -2
+	sys.bgPalFX.invertblend = InvertBlendMugen11
 	StateControllerBase(sc).run(c, func(id byte, exp []BytecodeExp) bool {
 		palFX(sc).runSub(c, &sys.bgPalFX.PalFXDef, id, exp)
-		sys.bgPalFX.invertblend = -3
+		sys.bgPalFX.invertblend = InvertBlendBg
 		return true
 	})
 	return false
@@ -4367,6 +4398,8 @@ const (
 	explod_interpolate_pfx_add
 	explod_interpolate_pfx_color
 	explod_interpolate_pfx_hue
+	explod_interpolate_pfx_contrast
+	explod_interpolate_pfx_gamma
 	explod_interpolation
 	explod_redirectid
 )
@@ -4560,7 +4593,7 @@ func (sc explod) Run(c *Char, _ []int32) bool {
 			e.window = [4]float32{exp[0].evalF(c) * lclscround, exp[1].evalF(c) * lclscround, exp[2].evalF(c) * lclscround, exp[3].evalF(c) * lclscround}
 		default:
 			if c.stWgi().mugenver[0] == 1 && c.stWgi().mugenver[1] == 1 && c.stWgi().ikemenver[0] == 0 && c.stWgi().ikemenver[1] == 0 {
-				e.palfxdef.invertblend = -2
+				e.palfxdef.invertblend = InvertBlendMugen11
 			}
 			palFX(sc).runSub(c, &e.palfxdef, id, exp)
 
@@ -4648,7 +4681,11 @@ func (sc explod) setInterpolation(c *Char, e *Explod,
 	case explod_interpolate_pfx_color:
 		pfd.icolor[0] = exp[0].evalF(c) / 256
 	case explod_interpolate_pfx_hue:
-		pfd.ihue[0] = exp[0].evalF(c) / 256
+		pfd.ihue[0] = wrapHue(exp[0].evalF(c) * palFXHueUnit)
+	case explod_interpolate_pfx_contrast:
+		pfd.icontrast[0] = MaxF(0, exp[0].evalF(c)/256)
+	case explod_interpolate_pfx_gamma:
+		pfd.igamma[0] = MaxF(0, exp[0].evalF(c)/256)
 	default:
 	}
 	return true
@@ -5164,7 +5201,7 @@ func (sc afterImage) Run(c *Char, _ []int32) bool {
 			crun.aimg.clear()
 			// Mugen 1.1 behavior if invertblend param is omitted (Only if char mugenversion = 1.1)
 			if c.stWgi().mugenver[0] == 1 && c.stWgi().mugenver[1] == 1 && c.stWgi().ikemenver[0] == 0 && c.stWgi().ikemenver[1] == 0 {
-				crun.aimg.palfx[0].invertblend = -2
+				crun.aimg.palfx[0].invertblend = InvertBlendMugen11
 			}
 			crun.aimg.time = 1
 			doOnce = true
@@ -5627,7 +5664,7 @@ func (sc hitDef) Run(c *Char, _ []int32) bool {
 		}
 		// Mugen 1.1 behavior if invertblend param is omitted (Only if char mugenversion = 1.1)
 		if c.stWgi().mugenver[0] == 1 && c.stWgi().mugenver[1] == 1 && c.stWgi().ikemenver[0] == 0 && c.stWgi().ikemenver[1] == 0 {
-			crun.hitdef.palfx.invertblend = -2
+			crun.hitdef.palfx.invertblend = InvertBlendMugen11
 		}
 		sc.runSub(c, &crun.hitdef, id, exp)
 		return true
@@ -6839,7 +6876,7 @@ func (sc superPause) Run(c *Char, _ []int32) bool {
 			vo := int32(100)
 			ffx := string(*(*[]byte)(unsafe.Pointer(&exp[0])))
 			crun.playSound(ffx, false, 0, exp[1].evalI(c), n, -1,
-				vo, 0, 1, 1, nil, false, 0, 0, 0, 0, false, false)
+				vo, 0, 1, 1, nil, false, 0, 0, 0, 0, 0, false, false)
 		case superPause_redirectid:
 			if rid := sys.playerID(exp[0].evalI(c)); rid != nil {
 				crun = rid
@@ -9017,12 +9054,18 @@ const (
 	modifyBgm_position
 	modifyBgm_freqmul
 	modifyBgm_redirectid
+	modifyBgm_freqmulglide
+	modifyBgm_slot
+	modifyBgm_timestretch
 )
 
 func (sc modifyBgm) Run(c *Char, _ []int32) bool {
 	var volumeSet, loopStartSet, loopEndSet, posSet, freqSet = false, false, false, false, false
 	var volume, loopstart, loopend, position int = 100, 0, 0, 0
 	var freqmul float32 = 1.0
+	var glide int32 = 0
+	timeStretch := sys.bgmTimeStretch
+	bgm := &sys.bgm
 	StateControllerBase(sc).run(c, func(id byte, exp []BytecodeExp) bool {
 		switch id {
 		case modifyBgm_volume:
@@ -9040,6 +9083,16 @@ func (sc modifyBgm) Run(c *Char, _ []int32) bool {
 		case modifyBgm_freqmul:
 			freqmul = float32(exp[0].evalF(c))
 			freqSet = true
+		case modifyBgm_freqmulglide:
+			glide = exp[0].evalI(c)
+		case modifyBgm_timestretch:
+			timeStretch = exp[0].evalB(c)
+		case modifyBgm_slot:
+			slot := int(exp[0].evalI(c))
+			if bgm = sys.bgmSlot(slot); bgm == nil {
+				sys.appendToConsole(c.warn() + "invalid ModifyBGM slot: " + strconv.Itoa(slot))
+				bgm = &sys.bgm
+			}
 		case modifyBgm_redirectid:
 			if rid := sys.playerID(exp[0].evalI(c)); rid != nil {
 
@@ -9049,23 +9102,30 @@ func (sc modifyBgm) Run(c *Char, _ []int32) bool {
 		}
 		return true
 	})
-	if sys.bgm.ctrl != nil {
+	if bgm.ctrl != nil {
 		// Set values that are different only
 		if volumeSet {
 			volumeScaled := int(float64(volume) / 100.0 * float64(sys.maxBgmVolume))
-			sys.bgm.bgmVolume = int(Min(int32(volumeScaled), int32(sys.maxBgmVolume)))
-			sys.bgm.UpdateVolume()
+			bgm.bgmVolume = int(Min(int32(volumeScaled), int32(sys.maxBgmVolume)))
+			bgm.UpdateVolume()
 		}
 		if posSet {
-			sys.bgm.Seek(position)
+			bgm.Seek(position)
 		}
-		if sl, ok := sys.bgm.volctrl.Streamer.(*StreamLooper); ok {
+		if sl, ok := bgm.volctrl.Streamer.(*StreamLooper); ok {
 			if (loopStartSet && sl.loopstart != loopstart) || (loopEndSet && sl.loopend != loopend) {
-				sys.bgm.SetLoopPoints(loopstart, loopend)
+				// Keep the point that wasn't given
+				if !loopStartSet {
+					loopstart = sl.loopstart
+				}
+				if !loopEndSet {
+					loopend = sl.loopend
+				}
+				bgm.SetLoopPoints(loopstart, loopend)
 			}
 		}
-		if freqSet && sys.bgm.freqmul != freqmul {
-			sys.bgm.SetFreqMul(freqmul)
+		if freqSet {
+			bgm.SetFreqMul(freqmul, glide, timeStretch)
 		}
 	}
 	return false
@@ -9089,6 +9149,7 @@ const (
 	modifySnd_loopcount
 	modifySnd_stopongethit
 	modifySnd_stoponchangestate
+	modifySnd_freqmulglide
 )
 
 func (sc modifySnd) Run(c *Char, _ []int32) bool {
@@ -9097,7 +9158,7 @@ func (sc modifySnd) Run(c *Char, _ []int32) bool {
 	}
 	crun := c
 	snd := crun.soundChannels.Get(-1)
-	var ch, pri int32 = -1, 0
+	var ch, pri, glide int32 = -1, 0, 0
 	var vo, fr float32 = 100, 1.0
 	stopgh, stopcs := false, false
 	freqMulSet, volumeSet, prioritySet, panSet, loopStartSet, loopEndSet, posSet, lcSet, loopSet := false, false, false, false, false, false, false, false, false
@@ -9127,6 +9188,8 @@ func (sc modifySnd) Run(c *Char, _ []int32) bool {
 		case modifySnd_freqmul:
 			fr = ClampF(exp[0].evalF(c), 0.01, 5)
 			freqMulSet = true
+		case modifySnd_freqmulglide:
+			glide = exp[0].evalI(c)
 		case modifySnd_priority:
 			pri = exp[0].evalI(c)
 			prioritySet = true
@@ -9197,13 +9260,13 @@ func (sc modifySnd) Run(c *Char, _ []int32) bool {
 			}
 
 			// Now set the values if they're different
-			if snd.sfx.freqmul != fr {
-				snd.SetFreqMul(fr)
+			if freqMulSet {
+				snd.SetFreqMul(fr, glide)
 			}
 			if pri != snd.sfx.priority {
 				snd.SetPriority(pri)
 			}
-			if posSet {
+			if posSet && snd.streamer != nil {
 				snd.streamer.Seek(position)
 			}
 			if lcSet || loopSet {
@@ -9245,6 +9308,9 @@ const (
 	playBgm_startposition
 	playBgm_freqmul
 	playBgm_redirectid
+	playBgm_slot
+	playBgm_savepos
+	playBgm_resume
 )
 
 func (sc playBgm) Run(c *Char, _ []int32) bool {
@@ -9253,8 +9319,14 @@ func (sc playBgm) Run(c *Char, _ []int32) bool {
 	var bgm string
 	var loop, volume, loopstart, loopend, startposition int = 1, 100, 0, 0, 0
 	var freqmul float32 = 1.0
+	var savepos, resume bool
+	target := &sys.bgm
 	StateControllerBase(sc).run(c, func(id byte, exp []BytecodeExp) bool {
 		switch id {
+		case playBgm_savepos:
+			savepos = exp[0].evalB(c)
+		case playBgm_resume:
+			resume = exp[0].evalB(c)
 		case playBgm_bgm:
 			if bgm = string(*(*[]byte)(unsafe.Pointer(&exp[0]))); bgm != "" {
 				bgm = SearchFile(bgm, []string{crun.gi().def, "", "sound/"})
@@ -9263,8 +9335,8 @@ func (sc playBgm) Run(c *Char, _ []int32) bool {
 		case playBgm_volume:
 			volume = int(exp[0].evalI(c))
 			if !b {
-				sys.bgm.bgmVolume = int(Min(int32(volume), int32(sys.maxBgmVolume)))
-				sys.bgm.UpdateVolume()
+				target.bgmVolume = int(Min(int32(volume), int32(sys.maxBgmVolume)))
+				target.UpdateVolume()
 			}
 		case playBgm_loop:
 			loop = int(exp[0].evalI(c))
@@ -9276,6 +9348,12 @@ func (sc playBgm) Run(c *Char, _ []int32) bool {
 			startposition = int(exp[0].evalI(c))
 		case playBgm_freqmul:
 			freqmul = exp[0].evalF(c)
+		case playBgm_slot:
+			slot := int(exp[0].evalI(c))
+			if target = sys.bgmSlot(slot); target == nil {
+				sys.appendToConsole(c.warn() + "invalid PlayBGM slot: " + strconv.Itoa(slot))
+				target = &sys.bgm
+			}
 		case playBgm_redirectid:
 			if rid := sys.playerID(exp[0].evalI(c)); rid != nil {
 				crun = rid
@@ -9286,7 +9364,15 @@ func (sc playBgm) Run(c *Char, _ []int32) bool {
 		return true
 	})
 	if b {
-		sys.bgm.Open(bgm, loop, volume, loopstart, loopend, startposition, freqmul)
+		// Save the music being replaced, for a later resume to go back to
+		if savepos {
+			target.SavePosition()
+		}
+		if resume {
+			target.Resume(bgm, loop, volume, loopstart, loopend, freqmul, 0)
+		} else {
+			target.Open(bgm, loop, volume, loopstart, loopend, startposition, freqmul, 0)
+		}
 		sys.playBgmFlg = true
 	}
 	return false
@@ -9476,6 +9562,8 @@ const (
 	text_pos
 	text_scale
 	text_color
+	text_fadein
+	text_fadeout
 	text_redirectid
 )
 
@@ -9548,6 +9636,10 @@ func (sc text) Run(c *Char, _ []int32) bool {
 				}
 			}
 			ts.SetColor(r, g, b)
+		case text_fadein:
+			ts.fadein = exp[0].evalI(c)
+		case text_fadeout:
+			ts.fadeout = exp[0].evalI(c)
 		case text_redirectid:
 			if rid := sys.playerID(exp[0].evalI(c)); rid != nil {
 				crun = rid
@@ -53,6 +53,7 @@ type stageCamera struct {
 	roundstart              bool
 	maxRight                float32
 	minLeft                 float32
+	panningwidth            float32 // width sounds pan across, 0 for the screen's
 }
 
 func newStageCamera() *stageCamera {
@@ -1,11 +1,14 @@
 package main
 
 import (
+	"encoding/binary"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"math"
 	"os"
 	"strings"
+	"sync"
 )
 
 const MaxPalNo = 12
@@ -193,7 +196,7 @@ func (cr ClsnRect) draw(trans int32) {
 			sys.clsnSpr.Tex, paltex, sys.clsnSpr.Size,
 			-c[0] * sys.widthScale, -c[1] * sys.heightScale, notiling,
 			c[2] * sys.widthScale, c[2] * sys.widthScale, c[3] * sys.heightScale, 1, 0,
-			1, 1, Rotation{}, 0, trans, -1, nil, &sys.scrrect, 0, 0, 0, 0, 0, 0,
+			1, 1, Rotation{}, 0, trans, -1, nil, -1, &sys.scrrect, 0, 0, 0, 0, 0, 0,
 		}
 		RenderSprite(params)
 	}
@@ -721,6 +724,7 @@ func (hd *HitDef) clear() {
 		p2clsnrequire:  -1,
 	}
 	hd.palfx.mul, hd.palfx.color, hd.palfx.hue = [...]int32{255, 255, 255}, 1, 0
+	hd.palfx.contrast, hd.palfx.gamma = 1, 1
 	hd.fall.setDefault()
 }
 
@@ -926,8 +930,10 @@ func (ai *AfterImage) clear() {
 	if len(ai.palfx) > 0 {
 		ai.palfx[0].eColor = 1
 		ai.palfx[0].eHue = 0
+		ai.palfx[0].eContrast = 1
+		ai.palfx[0].eGamma = 1
 		ai.palfx[0].eInvertall = false
-		ai.palfx[0].eInvertblend = 0
+		ai.palfx[0].eInvertblend = InvertBlendNone
 		ai.palfx[0].eAdd = [...]int32{30, 30, 30}
 		ai.palfx[0].eMul = [...]int32{120, 120, 220}
 	}
@@ -950,7 +956,7 @@ func (ai *AfterImage) setPalColor(color int32) {
 }
 func (ai *AfterImage) setPalHueShift(huesh int32) {
 	if len(ai.palfx) > 0 {
-		ai.palfx[0].eHue = (float32(Clamp(huesh, -256, 256)) / 256)
+		ai.palfx[0].eHue = float32(Clamp(huesh, -256, 256)) * palFXHueUnit
 	}
 }
 func (ai *AfterImage) setPalInvertall(invertall bool) {
@@ -960,7 +966,7 @@ func (ai *AfterImage) setPalInvertall(invertall bool) {
 }
 func (ai *AfterImage) setPalInvertblend(invertblend int32) {
 	if len(ai.palfx) > 0 {
-		ai.palfx[0].invertblend = invertblend
+		ai.palfx[0].invertblend = clampInvertBlend(invertblend, InvertBlendBg, InvertBlendSubAdd1)
 	}
 }
 func (ai *AfterImage) setPalBrightR(addr int32) {
@@ -995,23 +1001,93 @@ func (ai *AfterImage) setPalContrastB(mulb int32) {
 }
 func (ai *AfterImage) setupPalFX() {
 	pb := ai.postbright
-	if ai.palfx[0].invertblend <= -2 && ai.palfx[0].eInvertall {
-		ai.palfx[0].eInvertblend = 3
+	if ai.palfx[0].invertblend <= InvertBlendMugen11 && ai.palfx[0].eInvertall {
+		ai.palfx[0].eInvertblend = InvertBlendInverted
 	} else {
 		ai.palfx[0].eInvertblend = ai.palfx[0].invertblend
 	}
 	for i := 1; i < len(ai.palfx); i++ {
-		ai.palfx[i].eColor = ai.palfx[i-1].eColor
-		ai.palfx[i].eHue = ai.palfx[i-1].eHue
-		ai.palfx[i].eInvertall = ai.palfx[i-1].eInvertall
-		ai.palfx[i].eInvertblend = ai.palfx[i-1].eInvertblend
-		for j := range pb {
-			ai.palfx[i].eAdd[j] = ai.palfx[i-1].eAdd[j] + ai.add[j] + pb[j]
-			ai.palfx[i].eMul[j] = int32(float32(ai.palfx[i-1].eMul[j]) * ai.mul[j])
-		}
+		ai.nextPalFX(&ai.palfx[i], &ai.palfx[i-1], pb)
 		pb = [3]int32{}
 	}
 }
+
+// Derives the effect of the next afterimage frame from the previous one.
+func (ai *AfterImage) nextPalFX(dst, prev *PalFX, pb [3]int32) {
+	dst.eColor = prev.eColor
+	dst.eHue = prev.eHue
+	dst.eContrast = prev.eContrast
+	dst.eGamma = prev.eGamma
+	dst.eInvertall = prev.eInvertall
+	dst.eInvertblend = prev.eInvertblend
+	for j := range pb {
+		dst.eAdd[j] = prev.eAdd[j] + ai.add[j] + pb[j]
+		dst.eMul[j] = int32(float32(prev.eMul[j]) * ai.mul[j])
+	}
+}
+
+type afterImagePalKey struct {
+	base                        uint64
+	frames                      int
+	color, hue, contrast, gamma float32
+	posterize                   int32
+	invertall                   bool
+	invertblend                 InvertBlend
+	palrange                    [2]int32
+	add0, mul0, add, postbright [3]int32
+	mul                         [3]float32
+}
+
+// Afterimages are set up from every char, so the cache is shared under a lock
+var (
+	afterImagePalCache = make(map[afterImagePalKey][][]uint32)
+	afterImagePalMu    sync.Mutex
+)
+
+// Returns the palettes of n afterimage frames derived from base, applying
+// the palbright/palcontrast ramp of ai cumulatively from frame to frame.
+// Frame 0 uses the first step as is. Results are cached per base palette and
+// parameters since afterimages are retriggered constantly; callers must not
+// modify the returned slices.
+func (ai *AfterImage) palettes(base []uint32, n int) [][]uint32 {
+	if len(ai.palfx) == 0 || n <= 0 {
+		return nil
+	}
+	first := &ai.palfx[0]
+	key := afterImagePalKey{frames: n, color: first.eColor, hue: first.eHue,
+		contrast: first.eContrast, gamma: first.eGamma, posterize: first.ePosterize,
+		invertall: first.eInvertall, invertblend: first.eInvertblend, palrange: first.palrange,
+		add0: first.eAdd, mul0: first.eMul, add: ai.add, postbright: ai.postbright, mul: ai.mul}
+	h := fnv.New64a()
+	var b [4]byte
+	for _, c := range base {
+		binary.LittleEndian.PutUint32(b[:], c)
+		h.Write(b[:])
+	}
+	key.base = h.Sum64()
+	afterImagePalMu.Lock()
+	defer afterImagePalMu.Unlock()
+	if pals, ok := afterImagePalCache[key]; ok {
+		return pals
+	}
+	if len(afterImagePalCache) >= 64 {
+		afterImagePalCache = make(map[afterImagePalKey][][]uint32)
+	}
+	pals := make([][]uint32, n)
+	pf, pb := *first, ai.postbright
+	pf.enable = true
+	for i := range pals {
+		if i > 0 {
+			prev := pf
+			ai.nextPalFX(&pf, &prev, pb)
+			pb = [3]int32{}
+		}
+		pals[i] = pf.applyFxPal(nil, base, false)
+	}
+	afterImagePalCache[key] = pals
+	return pals
+}
+
 func (ai *AfterImage) recAfterImg(sd *SprData, hitpause bool) {
 	if ai.time == 0 {
 		ai.reccount, ai.timegap = 0, 0
@@ -1063,7 +1139,7 @@ func (ai *AfterImage) recAndCue(sd *SprData, rec bool, hitpause bool) {
 			ai.palfx[i/ai.framegap-1].remap = sd.fx.remap
 			sys.sprites.add(&SprData{&img.anim, &ai.palfx[i/ai.framegap-1], img.pos,
 				img.scl, ai.alpha, sd.priority - 2, img.rot, img.ascl,
-				false, sd.bright, sd.oldVer, sd.facing, sd.posLocalscl, img.projection, img.fLength, sd.window}, 0, 0, 0, 0)
+				false, sd.bright, sd.oldVer, sd.facing, sd.posLocalscl, img.projection, img.fLength, sd.window, sd.team}, 0, 0, 0, 0)
 		}
 	}
 	if rec || hitpause && ai.ignorehitpause {
@@ -1376,7 +1452,7 @@ func (e *Explod) update(oldVer bool, playerNo int) {
 	var ewin = [4]float32{e.window[0] * e.localscl * facing, e.window[1] * e.localscl * e.vfacing, e.window[2] * e.localscl * facing, e.window[3] * e.localscl * e.vfacing}
 	sprs.add(&SprData{e.anim, pfx, epos, [...]float32{(facing * scale[0]) * e.localscl,
 		(e.vfacing * scale[1]) * e.localscl}, alp, e.sprpriority, rot, [...]float32{1, 1},
-		e.space == Space_screen, playerNo == sys.superplayer, oldVer, facing, 1, int32(e.projection), fLength, ewin},
+		e.space == Space_screen, playerNo == sys.superplayer, oldVer, facing, 1, int32(e.projection), fLength, ewin, int32(sys.chars[playerNo][0].teamside)},
 		e.shadow[0]<<16|e.shadow[1]&0xff<<8|e.shadow[2]&0xff, sdwalp, 0, 0)
 	if sys.tickNextFrame() {
 
@@ -1492,6 +1568,8 @@ func (e *Explod) setStartParams(pfd *PalFXDef) {
 		if e.ownpal {
 			pfd.color = 1
 			pfd.hue = 0
+			pfd.contrast = 1
+			pfd.gamma = 1
 		}
 	}
 }
@@ -1513,6 +1591,8 @@ func (e *Explod) resetInterpolation(pfd *PalFXDef) {
 				if j == 0 && e.ownpal {
 					pfd.icolor[i] = pfd.color
 					pfd.ihue[i] = pfd.hue
+					pfd.icontrast[i] = pfd.contrast
+					pfd.igamma[i] = pfd.gamma
 				}
 			}
 		}
@@ -1799,7 +1879,8 @@ func (p *Projectile) cueDraw(oldVer bool, playerNo int) {
 		sd := &SprData{p.ani, p.palfx, [...]float32{p.pos[0] * p.localscl, p.pos[1] * p.localscl},
 			[...]float32{p.facing * p.scale[0] * p.localscl, p.scale[1] * p.localscl}, [2]int32{-1},
 			p.sprpriority, Rotation{p.facing * p.angle, 0, 0}, [...]float32{1, 1}, false, playerNo == sys.superplayer,
-			sys.cgi[playerNo].mugenver[0] != 1, p.facing, 1, 0, 0, [4]float32{0, 0, 0, 0}}
+			sys.cgi[playerNo].mugenver[0] != 1, p.facing, 1, 0, 0, [4]float32{0, 0, 0, 0},
+			int32(sys.chars[playerNo][0].teamside)}
 		p.aimg.recAndCue(sd, sys.tickNextFrame() && notpause, false)
 		sys.sprites.add(sd,
 			p.shadow[0]<<16|p.shadow[1]&255<<8|p.shadow[2]&255, 256, 0, 0)
@@ -3522,7 +3603,7 @@ func (c *Char) palfxvar(x int32) int32 {
 	if c.palfx != nil && c.palfx.enable {
 		switch x {
 		case -2:
-			n = c.palfx.eInvertblend
+			n = int32(c.palfx.eInvertblend)
 		case -1:
 			n = Btoi(c.palfx.eInvertall)
 		case 0:
@@ -3555,7 +3636,8 @@ func (c *Char) palfxvar2(x int32) float32 {
 		case 1:
 			n = c.palfx.eColor
 		case 2:
-			n = c.palfx.eHue
+			// Reported in the legacy scale, 256 being half a turn
+			n = c.palfx.eHue / 180
 		default:
 			n = 0
 		}
@@ -3736,19 +3818,19 @@ func (c *Char) winType(wt WinType) bool {
 	return c.win() && sys.winTrigger[c.playerNo&1] == wt
 }
 func (c *Char) playSound(ffx string, lowpriority bool, loopCount int32, g, n, chNo, vol int32,
-	p, freqmul, ls float32, x *float32, log bool, priority int32, loopstart, loopend, startposition int, stopgh, stopcs bool) {
+	p, freqmul, ls float32, x *float32, log bool, priority int32, loopstart, loopend, startposition, startms int, stopgh, stopcs bool) {
 	if g < 0 {
 		return
 	}
-	var s *Sound
+	var snd *Snd
 	if ffx == "" || ffx == "s" {
-		if c.gi().snd != nil {
-			s = c.gi().snd.Get([...]int32{g, n})
-		}
-	} else {
-		if sys.ffx[ffx] != nil && sys.ffx[ffx].fsnd != nil {
-			s = sys.ffx[ffx].fsnd.Get([...]int32{g, n})
-		}
+		snd = c.gi().snd
+	} else if sys.ffx[ffx] != nil {
+		snd = sys.ffx[ffx].fsnd
+	}
+	var s *Sound
+	if snd != nil {
+		s = snd.Get([...]int32{g, n})
 	}
 	if s == nil {
 		if log {
@@ -3769,14 +3851,11 @@ func (c *Char) playSound(ffx string, lowpriority bool, loopCount int32, g, n, ch
 			return
 		}
 	}
-	crun := c
-	if c.inheritChannels == 1 && c.parent() != nil {
-		crun = c.parent()
-	} else if c.inheritChannels == 2 && c.root() != nil {
-		crun = c.root()
-	}
+	crun := c.soundChannelsChar()
 	if ch := crun.soundChannels.New(chNo, lowpriority, priority); ch != nil {
-		ch.Play(s, loopCount, freqmul, loopstart, loopend, startposition)
+		ch.Play(s, loopCount, freqmul, loopstart, loopend, startposition, startms)
+		ch.setSource(snd, [...]int32{g, n})
+		ch.SetOwner(c.playerNo + 1)
 		vol = Clamp(vol, -25600, 25600)
 		//if c.gi().mugenver[0] == 1 {
 		if ffx != "" {
@@ -3786,9 +3865,10 @@ func (c *Char) playSound(ffx string, lowpriority bool, loopCount int32, g, n, ch
 		}
 		if chNo >= 0 {
 			ch.SetChannel(chNo)
-			if priority != 0 {
-				ch.SetPriority(priority)
-			}
+		}
+		// Also used when stealing channels from a full pool
+		if priority != 0 {
+			ch.SetPriority(priority)
 		}
 		//} else {
 		//	if f {
@@ -3799,10 +3879,42 @@ func (c *Char) playSound(ffx string, lowpriority bool, loopCount int32, g, n, ch
 		//}
 		ch.stopOnGetHit = stopgh
 		ch.stopOnChangeState = stopcs
+		ch.ownerId = c.id
 		ch.SetPan(p*c.facing, ls, x)
 	}
 }
 
+// Returns the char whose sound channels this char plays on.
+func (c *Char) soundChannelsChar() *Char {
+	if c.inheritChannels == 1 && c.parent() != nil {
+		return c.parent()
+	} else if c.inheritChannels == 2 && c.root() != nil {
+		return c.root()
+	}
+	return c
+}
+
+// Stops the sounds this char played with StopOnGetHit or StopOnChangeState,
+// including those on the channels of a parent or root it inherits.
+func (c *Char) stopFlaggedSounds(gethit, changestate bool) {
+	stop := func(sc *SoundChannels) {
+		for i := range sc.channels {
+			ch := &sc.channels[i]
+			if ch.ownerId != c.id {
+				continue
+			}
+			if gethit && ch.stopOnGetHit || changestate && ch.stopOnChangeState {
+				ch.Stop()
+				ch.stopOnGetHit, ch.stopOnChangeState = false, false
+			}
+		}
+	}
+	stop(&c.soundChannels)
+	if crun := c.soundChannelsChar(); crun != c {
+		stop(&crun.soundChannels)
+	}
+}
+
 func (c *Char) turn() {
 	if c.helperIndex == 0 {
 		if e := sys.charList.enemyNear(c, 0, true, true, false); c.rdDistX(e, c).ToF() < 0 && !e.asf(ASF_noturntarget) {
@@ -3915,12 +4027,7 @@ func (c *Char) stateChange2() bool {
 			}
 		}
 		// Stop flagged sound channels
-		for i := range c.soundChannels.channels {
-			if c.soundChannels.channels[i].stopOnChangeState {
-				c.soundChannels.channels[i].Stop()
-				c.soundChannels.channels[i].stopOnChangeState = false
-			}
-		}
+		c.stopFlaggedSounds(false, true)
 		c.stchtmp = false
 		return true
 	}
@@ -3994,6 +4101,8 @@ func (c *Char) destroy() {
 			}
 		}
 		c.children = c.children[:0]
+		// The sounds can't be stopped by their flags anymore
+		c.stopFlaggedSounds(true, true)
 		sys.charList.delete(c)
 		c.helperIndex = -1
 		c.setCSF(CSF_destroy)
@@ -4118,7 +4227,7 @@ func (c *Char) helperInit(h *Char, st int32, pt PosType, x, y float32,
 	}
 	// Mugen 1.1 behavior if invertblend param is omitted(Only if char mugenversion = 1.1)
 	if h.stWgi().mugenver[0] == 1 && h.stWgi().mugenver[1] == 1 && h.stWgi().ikemenver[0] == 0 && h.stWgi().ikemenver[1] == 0 {
-		h.palfx.invertblend = -2
+		h.palfx.invertblend = InvertBlendMugen11
 	}
 	h.changeStateEx(st, c.playerNo, 0, 1, "")
 	// Helper ID must be positive
@@ -4132,7 +4241,7 @@ func (c *Char) helperInit(h *Char, st int32, pt PosType, x, y float32,
 func (c *Char) newExplod() (*Explod, int) {
 	explinit := func(expl *Explod) *Explod {
 		expl.clear()
-		expl.id, expl.playerId, expl.palfx, expl.palfxdef = -1, c.id, c.getPalfx(), PalFXDef{color: 1, hue: 0, mul: [...]int32{256, 256, 256}}
+		expl.id, expl.playerId, expl.palfx, expl.palfxdef = -1, c.id, c.getPalfx(), PalFXDef{color: 1, hue: 0, mul: [...]int32{256, 256, 256}, contrast: 1, gamma: 1}
 		if c.stWgi().mugenver[0] == 1 && c.stWgi().mugenver[1] == 1 && c.stWgi().ikemenver[0] == 0 && c.stWgi().ikemenver[1] == 0 {
 			expl.projection = Projection_Perspective
 		} else {
@@ -5407,7 +5516,7 @@ func (c *Char) getPalfx() *PalFX {
 	c.palfx = newPalFX()
 	// Mugen 1.1 behavior if invertblend param is omitted(Only if char mugenversion = 1.1)
 	if c.stWgi().mugenver[0] == 1 && c.stWgi().mugenver[1] == 1 && c.stWgi().ikemenver[0] == 0 && c.stWgi().ikemenver[1] == 0 && c.palfx != nil {
-		c.palfx.PalFXDef.invertblend = -2
+		c.palfx.PalFXDef.invertblend = InvertBlendMugen11
 	}
 	return c.palfx
 }
@@ -5772,7 +5881,7 @@ func (c *Char) appendLifebarAction(text string, snd, spr [2]int32, anim, time in
 		return
 	}
 	if snd[0] != -1 {
-		sys.lifebar.snd.play(snd, 100, 0, 0, 0, 0)
+		sys.lifebar.snd.play(snd, 100, 0, 0, 0, 0, 0)
 	}
 	index := 0
 	if !top {
@@ -6887,7 +6996,7 @@ func (c *Char) update() {
 		} else {
 			if c.koEchoTime == 60 || c.koEchoTime == 120 {
 				vo := int32(100 * (240 - (c.koEchoTime + 60)) / 240)
-				c.playSound("", false, 0, 11, 0, -1, vo, 0, 1, c.localscl, &c.pos[0], false, 0, 0, 0, 0, false, false)
+				c.playSound("", false, 0, 11, 0, -1, vo, 0, 1, c.localscl, &c.pos[0], false, 0, 0, 0, 0, 0, false, false)
 			}
 			c.koEchoTime++
 		}
@@ -7055,7 +7164,7 @@ func (c *Char) tick() {
 			// KO sound
 			if !sys.gsf(GSF_nokosnd) && c.alive() {
 				vo := int32(100)
-				c.playSound("", false, 0, 11, 0, -1, vo, 0, 1, c.localscl, &c.pos[0], false, 0, 0, 0, 0, false, false)
+				c.playSound("", false, 0, 11, 0, -1, vo, 0, 1, c.localscl, &c.pos[0], false, 0, 0, 0, 0, 0, false, false)
 				if c.gi().data.ko.echo != 0 {
 					c.koEchoTime = 1
 				}
@@ -7264,7 +7373,7 @@ func (c *Char) cueDraw() {
 				scl, c.alpha, c.sprPriority, Rotation{agl, 0, 0}, c.angleScale, false,
 				c.playerNo == sys.superplayer, c.gi().mugenver[0] != 1, c.facing,
 				c.localcoord / sys.chars[c.animPN][0].localcoord, // https://github.com/ikemen-engine/Ikemen-GO/issues/1459 and 1778
-				0, 0, [4]float32{0, 0, 0, 0}}
+				0, 0, [4]float32{0, 0, 0, 0}, int32(c.teamside)}
 			if !c.csf(CSF_trans) {
 				sd.alpha[0] = -1
 			}
@@ -7636,12 +7745,7 @@ func (cl *CharList) hitDetection(getter *Char, proj bool) {
 		if hitType > 0 {
 			// Stop enemy's flagged sounds. In Mugen this only happens with channel 0
 			if hitType == 1 {
-				for i := range getter.soundChannels.channels {
-					if getter.soundChannels.channels[i].stopOnGetHit {
-						getter.soundChannels.channels[i].Stop()
-						getter.soundChannels.channels[i].stopOnGetHit = false
-					}
-				}
+				getter.stopFlaggedSounds(true, false)
 			}
 			if getter.bindToId == c.id {
 				getter.setBindTime(0)
@@ -8008,7 +8112,7 @@ func (cl *CharList) hitDetection(getter *Char, proj bool) {
 			if hd.hitsound[0] >= 0 {
 				vo := int32(100)
 				c.playSound(hd.hitsound_ffx, false, 0, hd.hitsound[0], hd.hitsound[1],
-					hd.hitsound_channel, vo, 0, 1, getter.localscl, &getter.pos[0], true, 0, 0, 0, 0, false, false)
+					hd.hitsound_channel, vo, 0, 1, getter.localscl, &getter.pos[0], true, 0, 0, 0, 0, 0, false, false)
 			}
 			if hitType > 0 {
 				c.powerAdd(hd.hitgetpower)
@@ -8046,7 +8150,7 @@ func (cl *CharList) hitDetection(getter *Char, proj bool) {
 			if hd.guardsound[0] >= 0 {
 				vo := int32(100)
 				c.playSound(hd.guardsound_ffx, false, 0, hd.guardsound[0], hd.guardsound[1],
-					hd.guardsound_channel, vo, 0, 1, getter.localscl, &getter.pos[0], true, 0, 0, 0, 0, false, false)
+					hd.guardsound_channel, vo, 0, 1, getter.localscl, &getter.pos[0], true, 0, 0, 0, 0, 0, false, false)
 			}
 			if hitType > 0 {
 				c.powerAdd(hd.guardgetpower)
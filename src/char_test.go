@@ -0,0 +1,105 @@
+package main
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestAfterImageSetupPalFX(t *testing.T) {
+	ai := &AfterImage{palfx: make([]PalFX, 4)}
+	ai.clear()
+	ai.postbright = [...]int32{5, 6, 7}
+	ai.setupPalFX()
+
+	// The first frame keeps the first step as it was set
+	if got, want := ai.palfx[0].eAdd, [...]int32{30, 30, 30}; got != want {
+		t.Errorf("frame 0 add = %v, want %v", got, want)
+	}
+	if got, want := ai.palfx[0].eMul, [...]int32{120, 120, 220}; got != want {
+		t.Errorf("frame 0 mul = %v, want %v", got, want)
+	}
+	// Each later frame adds palpostbright once, then paladd/palmul on top of
+	// the frame before
+	add, mul := ai.palfx[0].eAdd, ai.palfx[0].eMul
+	for i := 1; i < len(ai.palfx); i++ {
+		for j := range add {
+			add[j] += ai.add[j]
+			if i == 1 {
+				add[j] += ai.postbright[j]
+			}
+			mul[j] = int32(float32(mul[j]) * ai.mul[j])
+		}
+		if got := ai.palfx[i].eAdd; got != add {
+			t.Errorf("frame %v add = %v, want %v", i, got, add)
+		}
+		if got := ai.palfx[i].eMul; got != mul {
+			t.Errorf("frame %v mul = %v, want %v", i, got, mul)
+		}
+		if ai.palfx[i].eColor != ai.palfx[0].eColor || ai.palfx[i].eHue != ai.palfx[0].eHue {
+			t.Errorf("frame %v color/hue not carried over", i)
+		}
+	}
+}
+
+func TestAfterImagePalettes(t *testing.T) {
+	defer func() { afterImagePalCache = make(map[afterImagePalKey][][]uint32) }()
+	ai := &AfterImage{palfx: make([]PalFX, 1)}
+	ai.clear()
+	ai.postbright = [...]int32{5, 6, 7}
+	base := []uint32{0xff404040, 0x00000000}
+
+	pals := ai.palettes(base, 3)
+	if len(pals) != 3 {
+		t.Fatalf("got %v palettes, want 3", len(pals))
+	}
+	// Frame 0 is the base with add 30 and mul 120/120/220; frame 1 adds
+	// paladd and palpostbright and scales by palmul; frame 2 only adds paladd
+	want := [][]uint32{
+		{0xff502c2c, 0x00190e0e},
+		{0xff512121, 0x00270e0d},
+		{0xff481717, 0x00290a0a},
+	}
+	for i := range want {
+		for j := range want[i] {
+			if pals[i][j] != want[i][j] {
+				t.Errorf("frame %v color %v = %08x, want %08x", i, j, pals[i][j], want[i][j])
+			}
+		}
+	}
+	if base[0] != 0xff404040 {
+		t.Error("base palette was modified")
+	}
+
+	if again := ai.palettes(base, 3); &again[0][0] != &pals[0][0] {
+		t.Error("same base and parameters were not served from the cache")
+	}
+	ai.add[0] = 0
+	if other := ai.palettes(base, 3); &other[0][0] == &pals[0][0] || other[1][0] == pals[1][0] {
+		t.Error("changed parameters were served from the cache")
+	}
+	if other := ai.palettes([]uint32{0xff404041, 0}, 3); &other[0][0] == &pals[0][0] {
+		t.Error("changed base palette was served from the cache")
+	}
+	ai.palfx[0].palrange = [2]int32{1, 1}
+	if other := ai.palettes(base, 3); &other[0][0] == &pals[0][0] || other[0][0] != base[0] {
+		t.Error("changed palrange was served from the cache")
+	}
+	ai.palfx[0].palrange = [2]int32{}
+	ai.palfx[0].eInvertblend = InvertBlendInverted
+	if other := ai.palettes(base, 3); &other[0][0] == &pals[0][0] {
+		t.Error("changed invertblend was served from the cache")
+	}
+
+	// Chars set up their afterimages concurrently
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for n := 0; n < 100; n++ {
+				ai.palettes([]uint32{uint32(g*100 + n)}, 2)
+			}
+		}(g)
+	}
+	wg.Wait()
+}
@@ -17,12 +17,18 @@ const (
 )
 
 func Random() int32 {
-	w := sys.randseed / 127773
-	sys.randseed = (sys.randseed-w*127773)*16807 - w*2836
-	if sys.randseed <= 0 {
-		sys.randseed += IMax - Btoi(sys.randseed == 0)
+	return RandomSeed(&sys.randseed)
+}
+
+// RandomSeed steps the engine generator on a seed of its own, leaving
+// sys.randseed untouched
+func RandomSeed(seed *int32) int32 {
+	w := *seed / 127773
+	*seed = (*seed-w*127773)*16807 - w*2836
+	if *seed <= 0 {
+		*seed += IMax - Btoi(*seed == 0)
 	}
-	return sys.randseed
+	return *seed
 }
 func Srand(s int32)             { sys.randseed = s }
 func Rand(min, max int32) int32 { return min + Random()/(IMax/(max-min+1)+1) }
@@ -672,7 +678,7 @@ func (l *Layout) DrawAnim(r *[4]int32, x, y, scl float32, ln int16,
 		a.Draw(r, x+l.offset[0], y+l.offset[1]+float32(sys.gameHeight-240),
 			scl, scl, l.scale[0]*float32(l.facing), l.scale[0]*float32(l.facing),
 			l.scale[1]*float32(l.vfacing), 0, Rotation{l.angle, 0, 0},
-			float32(sys.gameWidth-320)/2, palfx, false, 1, false, 1, 0, 0)
+			float32(sys.gameWidth-320)/2, palfx, -1, false, 1, false, 1, 0, 0)
 	}
 }
 func (l *Layout) DrawText(x, y, scl float32, ln int16,
@@ -745,61 +751,85 @@ func (al *AnimLayout) ReadAnimPalfx(pre string, is IniSection) {
 	is.ReadI32(pre+"time", &al.palfx.time)
 	is.ReadI32(pre+"add", &al.palfx.add[0], &al.palfx.add[1], &al.palfx.add[2])
 	is.ReadI32(pre+"mul", &al.palfx.mul[0], &al.palfx.mul[1], &al.palfx.mul[2])
-	var s [4]int32
-	if is.ReadI32(pre+"sinadd", &s[0], &s[1], &s[2], &s[3]) {
+	var s [5]float32
+	if is.ReadF32(pre+"sinadd", &s[0], &s[1], &s[2], &s[3], &s[4]) {
 		if s[3] < 0 {
-			al.palfx.sinadd[0] = -s[0]
-			al.palfx.sinadd[1] = -s[1]
-			al.palfx.sinadd[2] = -s[2]
+			al.palfx.sinadd[0] = int32(-s[0])
+			al.palfx.sinadd[1] = int32(-s[1])
+			al.palfx.sinadd[2] = int32(-s[2])
 			al.palfx.cycletime[0] = -s[3]
 		} else {
-			al.palfx.sinadd[0] = s[0]
-			al.palfx.sinadd[1] = s[1]
-			al.palfx.sinadd[2] = s[2]
+			al.palfx.sinadd[0] = int32(s[0])
+			al.palfx.sinadd[1] = int32(s[1])
+			al.palfx.sinadd[2] = int32(s[2])
 			al.palfx.cycletime[0] = s[3]
 		}
+		al.palfx.sinphase[0] = s[4]
 	}
-	if is.ReadI32(pre+"sinmul", &s[0], &s[1], &s[2], &s[3]) {
+	s[4] = 0
+	if is.ReadF32(pre+"sinmul", &s[0], &s[1], &s[2], &s[3], &s[4]) {
 		if s[3] < 0 {
-			al.palfx.sinmul[0] = -s[0]
-			al.palfx.sinmul[1] = -s[1]
-			al.palfx.sinmul[2] = -s[2]
+			al.palfx.sinmul[0] = int32(-s[0])
+			al.palfx.sinmul[1] = int32(-s[1])
+			al.palfx.sinmul[2] = int32(-s[2])
 			al.palfx.cycletime[1] = -s[3]
 		} else {
-			al.palfx.sinmul[0] = s[0]
-			al.palfx.sinmul[1] = s[1]
-			al.palfx.sinmul[2] = s[2]
+			al.palfx.sinmul[0] = int32(s[0])
+			al.palfx.sinmul[1] = int32(s[1])
+			al.palfx.sinmul[2] = int32(s[2])
 			al.palfx.cycletime[1] = s[3]
 		}
+		al.palfx.sinphase[1] = s[4]
 	}
-	var s2 [2]int32
-	if is.ReadI32(pre+"sincolor", &s2[0], &s2[1]) {
+	var s2 [3]float32
+	if is.ReadF32(pre+"sincolor", &s2[0], &s2[1], &s2[2]) {
 		if s2[1] < 0 {
-			al.palfx.sincolor = -s2[0]
+			al.palfx.sincolor = int32(-s2[0])
 			al.palfx.cycletime[2] = -s2[1]
 		} else {
-			al.palfx.sincolor = s2[0]
+			al.palfx.sincolor = int32(s2[0])
 			al.palfx.cycletime[2] = s2[1]
 		}
+		al.palfx.sinphase[2] = s2[2]
 	}
-	if is.ReadI32(pre+"sinhue", &s2[0], &s2[1]) {
+	s2[2] = 0
+	if is.ReadF32(pre+"sinhue", &s2[0], &s2[1], &s2[2]) {
 		if s2[1] < 0 {
-			al.palfx.sinhue = -s2[0]
+			al.palfx.sinhue = int32(-s2[0])
 			al.palfx.cycletime[3] = -s2[1]
 		} else {
-			al.palfx.sinhue = s2[0]
+			al.palfx.sinhue = int32(s2[0])
 			al.palfx.cycletime[3] = s2[1]
 		}
+		al.palfx.sinphase[3] = s2[2]
 	}
 	is.ReadBool(pre+"invertall", &al.palfx.invertall)
-	is.ReadI32(pre+"invertblend", &al.palfx.invertblend)
+	var ib int32
+	if is.ReadI32(pre+"invertblend", &ib) {
+		al.palfx.invertblend = clampInvertBlend(ib, InvertBlendBg, InvertBlendSubAdd1)
+	}
 	var n float32
 	if is.ReadF32(pre+"color", &n) {
 		al.palfx.color = n / 256
 	}
 	if is.ReadF32(pre+"hue", &n) {
-		al.palfx.hue = n / 256
+		al.palfx.hue = wrapHue(n * palFXHueUnit)
+	}
+	if is.ReadF32(pre+"huedeg", &n) {
+		al.palfx.hue = wrapHue(n)
+	}
+	if is.ReadF32(pre+"contrast", &n) {
+		al.palfx.contrast = n / 256
+	}
+	if is.ReadF32(pre+"gamma", &n) {
+		al.palfx.gamma = n / 256
+	}
+	is.ReadI32(pre+"posterize", &al.palfx.posterize)
+	var pm int32
+	if is.ReadI32(pre+"pausemode", &pm) {
+		al.palfx.pausemode = PalFXPauseMode(Clamp(pm, int32(PalFXPauseRun), int32(PalFXPauseSuper)))
 	}
+	is.ReadI32(pre+"palrange", &al.palfx.palrange[0], &al.palfx.palrange[1])
 }
 
 type AnimTextSnd struct {
@@ -363,6 +363,10 @@ func (c *Compiler) playSnd(is IniSection, sc *StateControllerBase, _ int8) (Stat
 			playSnd_startposition, VT_Int, 1, false); err != nil {
 			return err
 		}
+		if err := c.paramValue(is, sc, "startms",
+			playSnd_startms, VT_Int, 1, false); err != nil {
+			return err
+		}
 		if err := c.paramValue(is, sc, "loopcount",
 			playSnd_loopcount, VT_Int, 1, false); err != nil {
 			return err
@@ -897,6 +901,14 @@ func (c *Compiler) explodInterpolate(is IniSection,
 		explod_interpolate_pfx_hue, VT_Float, 1, false); err != nil {
 		return err
 	}
+	if err := c.paramValue(is, sc, "interpolation.palfx.contrast",
+		explod_interpolate_pfx_contrast, VT_Float, 1, false); err != nil {
+		return err
+	}
+	if err := c.paramValue(is, sc, "interpolation.palfx.gamma",
+		explod_interpolate_pfx_gamma, VT_Float, 1, false); err != nil {
+		return err
+	}
 	return nil
 }
 func (c *Compiler) explod(is IniSection, sc *StateControllerBase,
@@ -1127,6 +1139,39 @@ func (c *Compiler) palFXSub(is IniSection,
 		palFX_hue, VT_Float, 1, false); err != nil {
 		return err
 	}
+	if err := c.paramValue(is, sc, prefix+"huedeg",
+		palFX_huedeg, VT_Float, 1, false); err != nil {
+		return err
+	}
+	if err := c.paramValue(is, sc, prefix+"contrast",
+		palFX_contrast, VT_Float, 1, false); err != nil {
+		return err
+	}
+	if err := c.paramValue(is, sc, prefix+"gamma",
+		palFX_gamma, VT_Float, 1, false); err != nil {
+		return err
+	}
+	if err := c.paramValue(is, sc, prefix+"posterize",
+		palFX_posterize, VT_Int, 1, false); err != nil {
+		return err
+	}
+	if err := c.paramValue(is, sc, prefix+"pausemode",
+		palFX_pausemode, VT_Int, 1, false); err != nil {
+		return err
+	}
+	if err := c.stateParam(is, prefix+"palrange", func(data string) error {
+		bes, err := c.exprs(data, VT_Int, 2)
+		if err != nil {
+			return err
+		}
+		if len(bes) < 2 {
+			return Error(prefix + "palrange - not enough arguments")
+		}
+		sc.add(palFX_palrange, bes)
+		return nil
+	}); err != nil {
+		return err
+	}
 	if err := c.stateParam(is, prefix+"add", func(data string) error {
 		bes, err := c.exprs(data, VT_Int, 3)
 		if err != nil {
@@ -1154,7 +1199,7 @@ func (c *Compiler) palFXSub(is IniSection,
 		return err
 	}
 	if err := c.stateParam(is, prefix+"sinadd", func(data string) error {
-		bes, err := c.exprs(data, VT_Int, 4)
+		bes, err := c.exprs(data, VT_Float, 5)
 		if err != nil {
 			return err
 		}
@@ -1167,7 +1212,7 @@ func (c *Compiler) palFXSub(is IniSection,
 		return err
 	}
 	if err := c.stateParam(is, prefix+"sinmul", func(data string) error {
-		bes, err := c.exprs(data, VT_Int, 4)
+		bes, err := c.exprs(data, VT_Float, 5)
 		if err != nil {
 			return err
 		}
@@ -1180,7 +1225,7 @@ func (c *Compiler) palFXSub(is IniSection,
 		return err
 	}
 	if err := c.stateParam(is, prefix+"sincolor", func(data string) error {
-		bes, err := c.exprs(data, VT_Int, 2)
+		bes, err := c.exprs(data, VT_Float, 3)
 		if err != nil {
 			return err
 		}
@@ -1193,7 +1238,7 @@ func (c *Compiler) palFXSub(is IniSection,
 		return err
 	}
 	if err := c.stateParam(is, prefix+"sinhue", func(data string) error {
-		bes, err := c.exprs(data, VT_Int, 2)
+		bes, err := c.exprs(data, VT_Float, 3)
 		if err != nil {
 			return err
 		}
@@ -4342,6 +4387,11 @@ func (c *Compiler) playBgm(is IniSection, sc *StateControllerBase, _ int8) (Stat
 			playBgm_redirectid, VT_Int, 1, false); err != nil {
 			return err
 		}
+		// Read before volume, which applies to the slot right away
+		if err := c.paramValue(is, sc, "slot",
+			playBgm_slot, VT_Int, 1, false); err != nil {
+			return err
+		}
 		if err := c.stateParam(is, "bgm", func(data string) error {
 			if len(data) < 2 || data[0] != '"' || data[len(data)-1] != '"' {
 				return Error("Not enclosed in \"")
@@ -4371,6 +4421,14 @@ func (c *Compiler) playBgm(is IniSection, sc *StateControllerBase, _ int8) (Stat
 			playBgm_startposition, VT_Int, 1, false); err != nil {
 			return err
 		}
+		if err := c.paramValue(is, sc, "savepos",
+			playBgm_savepos, VT_Bool, 1, false); err != nil {
+			return err
+		}
+		if err := c.paramValue(is, sc, "resume",
+			playBgm_resume, VT_Bool, 1, false); err != nil {
+			return err
+		}
 		return nil
 	})
 	return *ret, err
@@ -4483,6 +4541,10 @@ func (c *Compiler) modifySnd(is IniSection, sc *StateControllerBase, _ int8) (St
 			modifySnd_freqmul, VT_Float, 1, false); err != nil {
 			return err
 		}
+		if err := c.paramValue(is, sc, "freqmulglide",
+			modifySnd_freqmulglide, VT_Int, 1, false); err != nil {
+			return err
+		}
 		if err := c.paramValue(is, sc, "priority",
 			modifySnd_priority, VT_Int, 1, false); err != nil {
 			return err
@@ -4541,6 +4603,18 @@ func (c *Compiler) modifyBgm(is IniSection, sc *StateControllerBase, _ int8) (St
 			modifyBgm_freqmul, VT_Float, 1, false); err != nil {
 			return err
 		}
+		if err := c.paramValue(is, sc, "freqmulglide",
+			modifyBgm_freqmulglide, VT_Int, 1, false); err != nil {
+			return err
+		}
+		if err := c.paramValue(is, sc, "timestretch",
+			modifyBgm_timestretch, VT_Bool, 1, false); err != nil {
+			return err
+		}
+		if err := c.paramValue(is, sc, "slot",
+			modifyBgm_slot, VT_Int, 1, false); err != nil {
+			return err
+		}
 		if err := c.paramValue(is, sc, "position",
 			modifyBgm_position, VT_Int, 1, false); err != nil {
 			return err
@@ -4833,6 +4907,14 @@ func (c *Compiler) text(is IniSection, sc *StateControllerBase, _ int8) (StateCo
 			text_color, VT_Int, 3, false); err != nil {
 			return err
 		}
+		if err := c.paramValue(is, sc, "fadein",
+			text_fadein, VT_Int, 1, false); err != nil {
+			return err
+		}
+		if err := c.paramValue(is, sc, "fadeout",
+			text_fadeout, VT_Int, 1, false); err != nil {
+			return err
+		}
 		return nil
 	})
 	return *ret, err
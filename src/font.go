@@ -2,10 +2,20 @@ package main
 
 import (
 	"encoding/binary"
+	"encoding/xml"
+	"image"
+	"image/draw"
+	_ "image/png"
+	"io"
 	"math"
 	"os"
+	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
 )
 
 // FntCharImage stores sprite and position
@@ -34,22 +44,96 @@ type Fnt struct {
 	colors    int32
 	offset    [2]int32
 	ttf       TtfFont
-	paltex    *Texture
+	bankTex   map[int32]*Texture // palette texture per bank, set on the main thread
+	bankTexMu sync.Mutex
+	kerning   map[[2]rune]int32
+	bankColor map[int32][4]float32 // ttf fonts
+	// ttf outline and drop shadow, drawn as extra Printf passes
+	outline      int32
+	outlineColor [4]float32
+	shadowOffset [2]int32
+	shadowColor  [4]float32
+
+	// ttf face metrics, in pixels at the loaded height
+	ascent, descent int32
+}
+
+// FntMetrics holds the vertical metrics of a font, in font units
+type FntMetrics struct {
+	LineHeight int32 // distance between the tops of two lines
+	Baseline   int32 // distance from the top of a line to the y text is drawn at
+	Ascent     int32 // glyph extent above the baseline
+	Descent    int32 // glyph extent below the baseline
 }
 
 func newFnt() *Fnt {
 	return &Fnt{
 		images:   make(map[int32]map[rune]*FntCharImage),
 		BankType: "palette",
+		bankTex:  make(map[int32]*Texture),
 	}
 }
 
+// A font cache keyed by file and height. Every caller gets the same *Fnt,
+// which is read-only once loaded, except for the bank textures that the
+// main thread sets under bankTexMu. Nothing tracks when a font stops being
+// used, so entries stay until the file changes
+type FntCacheEntry struct {
+	fnt     *Fnt
+	modTime time.Time
+}
+
+type fntCacheKey struct {
+	filename string
+	height   int32
+}
+
+var FntCache = map[fntCacheKey]*FntCacheEntry{}
+var fntCacheMutex sync.Mutex
+
 func loadFnt(filename string, height int32) (*Fnt, error) {
-	if HasExtension(filename, ".fnt") {
-		return loadFntV1(filename)
+	key := fntCacheKey{filename, height}
+	if abs, err := filepath.Abs(filename); err == nil {
+		key.filename = abs
 	}
-
-	return loadFntV2(filename, height)
+	var modTime time.Time
+	if fi, err := os.Stat(filename); err == nil {
+		modTime = fi.ModTime()
+	}
+	// If this font is already in the cache and the file hasn't changed
+	// since, just return it
+	fntCacheMutex.Lock()
+	if cached, ok := FntCache[key]; ok {
+		if cached.modTime.Equal(modTime) {
+			fntCacheMutex.Unlock()
+			return cached.fnt, nil
+		}
+		delete(FntCache, key)
+	}
+	fntCacheMutex.Unlock()
+
+	var f *Fnt
+	var err error
+	if isBMFont(filename) {
+		f, err = loadBMFont(filename)
+	} else if HasExtension(filename, ".fnt") {
+		f, err = loadFntV1(filename)
+	} else {
+		f, err = loadFntV2(filename, height)
+	}
+	if err != nil {
+		return nil, err
+	}
+	fntCacheMutex.Lock()
+	// Two loads of the same font may have raced, keep the first
+	if cached, ok := FntCache[key]; ok && cached.modTime.Equal(modTime) {
+		fntCacheMutex.Unlock()
+		return cached.fnt, nil
+	}
+	FntCache[key] = &FntCacheEntry{f, modTime}
+	fntCacheMutex.Unlock()
+	f.queueBankPalTex()
+	return f, nil
 }
 
 func loadFntV1(filename string) (*Fnt, error) {
@@ -165,27 +249,17 @@ func loadFntV1(filename string) (*Fnt, error) {
 					}
 					cap := re.FindStringSubmatch(strings.SplitN(lines[i], ";", 2)[0])
 					if len(cap) > 0 {
-						var c rune
-						if len(cap[1]) >= 2 && cap[1][0] == '0' &&
-							(cap[1][1] == 'X' || cap[1][1] == 'x') {
-							hex := strings.ToLower(cap[1][2:])
-							for _, r := range hex {
-								if '0' <= r && r <= '9' {
-									c = c<<4 | (r - '0')
-								} else if 'a' <= r && r <= 'f' {
-									c = c<<4 | (r - 'a' + 10)
-								} else {
-									break
-								}
-							}
-						} else {
-							c = rune(cap[1][0])
+						c, ok := parseFntRune(cap[1])
+						if !ok {
+							sys.errLog.Printf("%v: invalid character in map: %v\n", filename, cap[1])
 						}
 						if len(cap[2]) > 0 {
 							ofs = I32ToU16(Atoi(cap[2]))
 						}
 						fci := &FntCharImage{ofs: ofs}
-						f.images[0][c] = fci
+						if ok {
+							f.images[0][c] = fci
+						}
 						if len(cap[3]) > 0 {
 							w = Atoi(cap[3])
 							if w < 0 {
@@ -250,6 +324,143 @@ func loadFntV1(filename string) (*Fnt, error) {
 	return f, nil
 }
 
+// bmfontTag is a line of a BMFont text descriptor, or an element of an XML
+// one, with its attributes
+type bmfontTag struct {
+	name string
+	attr map[string]string
+}
+
+func (t *bmfontTag) i32(name string) int32 {
+	return Atoi(t.attr[name])
+}
+
+// isBMFont tells whether a file is an AngelCode BMFont descriptor, in either
+// text or XML format
+func isBMFont(filename string) bool {
+	fp, err := os.Open(filename)
+	if err != nil {
+		return false
+	}
+	defer func() { chk(fp.Close()) }()
+	buf := make([]byte, 64)
+	n, _ := fp.Read(buf)
+	head := strings.TrimLeft(strings.TrimPrefix(string(buf[:n]), "\ufeff"), " \t\r\n")
+	return strings.HasPrefix(head, "info ") || strings.HasPrefix(head, "<?xml") ||
+		strings.HasPrefix(head, "<font")
+}
+
+func readBMFontTags(filename string) ([]bmfontTag, error) {
+	content, err := LoadText(filename)
+	if err != nil {
+		return nil, Error("File not found")
+	}
+	content = strings.TrimPrefix(content, "\ufeff")
+	var tags []bmfontTag
+	if strings.HasPrefix(strings.TrimSpace(content), "<") {
+		d := xml.NewDecoder(strings.NewReader(content))
+		for {
+			tok, err := d.Token()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+			if se, ok := tok.(xml.StartElement); ok {
+				t := bmfontTag{se.Name.Local, make(map[string]string)}
+				for _, a := range se.Attr {
+					t.attr[a.Name.Local] = a.Value
+				}
+				tags = append(tags, t)
+			}
+		}
+		return tags, nil
+	}
+	re := regexp.MustCompile(`(\w+)=("[^"]*"|\S*)`)
+	for _, line := range SplitAndTrim(content, "\n") {
+		name := strings.SplitN(line, " ", 2)[0]
+		if len(name) == 0 {
+			continue
+		}
+		t := bmfontTag{name, make(map[string]string)}
+		for _, m := range re.FindAllStringSubmatch(line, -1) {
+			t.attr[m[1]] = strings.Trim(m[2], "\"")
+		}
+		tags = append(tags, t)
+	}
+	return tags, nil
+}
+
+// loadBMFont loads an AngelCode BMFont. Each glyph is cut from its page image
+// into its own 32 bit sprite, and advances by its xadvance
+func loadBMFont(filename string) (*Fnt, error) {
+	tags, err := readBMFontTags(filename)
+	if err != nil {
+		return nil, err
+	}
+	f := newFnt()
+	f.Type = "bitmap"
+	f.images[0] = make(map[rune]*FntCharImage)
+	pages := make(map[int32]*image.RGBA)
+	for _, t := range tags {
+		switch t.name {
+		case "common":
+			// DrawText places the line top Size[1]-1-offset[1] above y,
+			// so y lands on the baseline
+			f.Size[1] = I32ToU16(t.i32("lineHeight"))
+			f.offset[1] = t.i32("lineHeight") - 1 - t.i32("base")
+		case "page":
+			page, err := loadBMFontPage(filename, t.attr["file"])
+			if err != nil {
+				return nil, err
+			}
+			pages[t.i32("id")] = page
+		case "char":
+			c := rune(t.i32("id"))
+			fci := &FntCharImage{w: I32ToU16(t.i32("xadvance")), img: make([]Sprite, 1)}
+			s := &fci.img[0]
+			*s = *newSprite()
+			s.coldepth = 32
+			s.Size = [...]uint16{I32ToU16(t.i32("width")), I32ToU16(t.i32("height"))}
+			s.Offset = [...]int16{int16(-t.i32("xoffset")), int16(-t.i32("yoffset"))}
+			if page := pages[t.i32("page")]; page != nil && s.Size[0] > 0 && s.Size[1] > 0 {
+				px := image.NewRGBA(image.Rect(0, 0, int(s.Size[0]), int(s.Size[1])))
+				draw.Draw(px, px.Bounds(), page, image.Pt(int(t.i32("x")), int(t.i32("y"))), draw.Src)
+				s.SetRaw(px.Pix, int32(s.Size[0]), int32(s.Size[1]), 32)
+			}
+			f.images[0][c] = fci
+			if c == ' ' {
+				f.Size[0] = fci.w
+			}
+		case "kerning":
+			if f.kerning == nil {
+				f.kerning = make(map[[2]rune]int32)
+			}
+			f.kerning[[2]rune{rune(t.i32("first")), rune(t.i32("second"))}] = t.i32("amount")
+		}
+	}
+	return f, nil
+}
+
+func loadBMFontPage(fontfile, filename string) (*image.RGBA, error) {
+	fp, err := os.Open(SearchFile(filename, []string{fontfile, "font/", sys.motifDir, "", "data/"}))
+	if err != nil {
+		return nil, err
+	}
+	defer func() { chk(fp.Close()) }()
+	img, _, err := image.Decode(fp)
+	if err != nil {
+		return nil, err
+	}
+	rgba, ok := img.(*image.RGBA)
+	if !ok {
+		rect := img.Bounds()
+		rgba = image.NewRGBA(rect)
+		draw.Draw(rgba, rect, img, rect.Min, draw.Src)
+	}
+	return rgba, nil
+}
+
 func loadFntV2(filename string, height int32) (*Fnt, error) {
 	f := newFnt()
 
@@ -268,17 +479,93 @@ func loadFntV2(filename string, height int32) (*Fnt, error) {
 		if len(name) > 0 {
 			is := NewIniSection()
 			i++
+			start := i
 			is.Parse(lines, &i)
 			i--
 			switch name {
 			case "def":
 				loadDefInfo(f, filename, is, height)
+			case "kerning":
+				loadKerning(f, lines[start:i+1])
+			case "colors":
+				loadBankColors(f, is)
 			}
 		}
 	}
 	return f, nil
 }
 
+// loadKerning reads the [Kerning] section lines, each one being
+// "left, right, adjust". Characters are given either as is or as 0x hex codes
+func loadKerning(f *Fnt, lines []string) {
+	for _, line := range lines {
+		ary := SplitAndTrim(strings.SplitN(line, ";", 2)[0], ",")
+		if len(ary) < 3 {
+			continue
+		}
+		l, ok1 := parseFntRune(ary[0])
+		r, ok2 := parseFntRune(ary[1])
+		if !ok1 || !ok2 {
+			continue
+		}
+		if f.kerning == nil {
+			f.kerning = make(map[[2]rune]int32)
+		}
+		f.kerning[[2]rune{l, r}] = Atoi(ary[2])
+	}
+}
+
+// loadBankColors reads the [Colors] section, which maps a bank number to
+// the "r, g, b[, a]" color that truetype fonts use for it
+func loadBankColors(f *Fnt, is IniSection) {
+	for k := range is {
+		bank, err := strconv.Atoi(k)
+		if err != nil {
+			continue
+		}
+		if f.bankColor == nil {
+			f.bankColor = make(map[int32][4]float32)
+		}
+		f.bankColor[int32(bank)] = readFntColor(is, k, [...]int32{255, 255, 255, 255})
+	}
+}
+
+// readFntColor reads a "r, g, b[, a]" color, with values from 0 to 255
+func readFntColor(is IniSection, name string, c [4]int32) (rgba [4]float32) {
+	is.ReadI32(name, &c[0], &c[1], &c[2], &c[3])
+	for i := range c {
+		rgba[i] = float32(Clamp(c[i], 0, 255)) / 255
+	}
+	return
+}
+
+// parseFntRune reads a character written in a font file as a 0x hex or
+// decimal code point, or as the character itself
+func parseFntRune(s string) (rune, bool) {
+	if len(s) > 2 && s[0] == '0' && (s[1] == 'x' || s[1] == 'X') {
+		c, err := strconv.ParseInt(s[2:], 16, 32)
+		return rune(c), err == nil && utf8.ValidRune(rune(c))
+	}
+	if utf8.RuneCountInString(s) == 1 {
+		c, size := utf8.DecodeRuneInString(s)
+		if c == utf8.RuneError && size == 1 {
+			// not utf-8, older fonts are latin-1
+			c = rune(s[0])
+		}
+		return c, true
+	}
+	// decimal code point, a single digit is the digit itself
+	if c, err := strconv.ParseInt(s, 10, 32); err == nil {
+		return rune(c), c >= 0 && utf8.ValidRune(rune(c))
+	}
+	return 0, false
+}
+
+// kern returns the spacing adjustment between two consecutive characters
+func (f *Fnt) kern(l, r rune) int32 {
+	return f.kerning[[2]rune{l, r}]
+}
+
 func loadDefInfo(f *Fnt, filename string, is IniSection, height int32) {
 	f.Type = strings.ToLower(is["type"])
 	if _, ok := is["banktype"]; ok {
@@ -306,6 +593,11 @@ func loadDefInfo(f *Fnt, filename string, is IniSection, height int32) {
 	if len(ary) > 1 && len(ary[1]) > 0 {
 		f.offset[1] = Atoi(ary[1])
 	}
+	is.ReadI32("outline", &f.outline)
+	f.outline = Clamp(f.outline, 0, 4)
+	f.outlineColor = readFntColor(is, "outlinecolor", [...]int32{0, 0, 0, 255})
+	is.ReadI32("shadowoffset", &f.shadowOffset[0], &f.shadowOffset[1])
+	f.shadowColor = readFntColor(is, "shadowcolor", [...]int32{0, 0, 0, 255})
 
 	if len(is["file"]) > 0 {
 		if f.Type == "truetype" {
@@ -390,15 +682,168 @@ func (f *Fnt) CharWidth(c rune, bt int32) int32 {
 }
 
 // TextWidth returns the width that has a specified text.
-// This depends on each char's width and font spacing
+// This depends on each char's width and font spacing. For multi-line
+// text the width of the widest line is returned
 func (f *Fnt) TextWidth(txt string, bank int32) (w int32) {
+	txt, _ = parseMarkup(txt)
+	return f.textWidth(txt, bank)
+}
+
+// textWidth is TextWidth for a text that has had its markup removed
+func (f *Fnt) textWidth(txt string, bank int32) (w int32) {
 	if f.BankType != "sprite" {
 		bank = 0
 	}
+	for _, line := range strings.Split(txt, "\n") {
+		w = Max(w, f.lineWidth(line, bank))
+	}
+	return
+}
+
+// textColor is a color change from inline markup in a text:
+//
+//	{color:N}         switches to bank N, which truetype fonts map to the
+//	                  bank's color from the [Colors] section
+//	{color:#RRGGBB}   switches truetype fonts to a color, alpha can follow
+//	{/color}          goes back to the color before the last switch
+//	{{                is a literal brace
+//
+// Anything else that starts with a brace is drawn as is
+type textColor struct {
+	pos  int   // byte offset in the text without markup
+	bank int32 // -1 when not a bank switch
+	rgba [4]float32
+	hex  bool
+}
+
+func (tc *textColor) isEnd() bool {
+	return tc.bank < 0 && !tc.hex
+}
+
+// parseMarkup returns the text without its markup, and the color changes
+// in it
+func parseMarkup(txt string) (string, []textColor) {
+	if !strings.Contains(txt, "{") {
+		return txt, nil
+	}
+	var sb strings.Builder
+	var colors []textColor
+	for i := 0; i < len(txt); i++ {
+		if txt[i] != '{' {
+			sb.WriteByte(txt[i])
+			continue
+		}
+		if strings.HasPrefix(txt[i:], "{{") {
+			sb.WriteByte('{')
+			i++
+			continue
+		}
+		if end := strings.IndexByte(txt[i:], '}'); end > 0 {
+			if tc, ok := parseColorTag(txt[i+1 : i+end]); ok {
+				tc.pos = sb.Len()
+				colors = append(colors, tc)
+				i += end
+				continue
+			}
+		}
+		sb.WriteByte('{')
+	}
+	return sb.String(), colors
+}
+
+func parseColorTag(tag string) (tc textColor, ok bool) {
+	tc.bank = -1
+	if tag == "/color" {
+		return tc, true
+	}
+	arg := strings.TrimPrefix(tag, "color:")
+	if len(arg) == len(tag) || len(arg) == 0 {
+		return tc, false
+	}
+	if arg[0] == '#' {
+		if len(arg) != 7 && len(arg) != 9 {
+			return tc, false
+		}
+		v, err := strconv.ParseUint(arg[1:], 16, 32)
+		if err != nil {
+			return tc, false
+		}
+		if len(arg) == 7 {
+			v = v<<8 | 0xff
+		}
+		for i := range tc.rgba {
+			tc.rgba[i] = float32(v>>(24-8*i)&0xff) / 255
+		}
+		tc.hex = true
+		return tc, true
+	}
+	b, err := strconv.Atoi(arg)
+	if err != nil || b < 0 {
+		return tc, false
+	}
+	tc.bank = int32(b)
+	return tc, true
+}
+
+// LineCount returns the number of lines that has a specified text
+func (f *Fnt) LineCount(txt string) int32 {
+	return int32(strings.Count(txt, "\n")) + 1
+}
+
+// TextHeight returns the height that has a specified text.
+// Each line takes the font height, with vertical spacing between lines
+func (f *Fnt) TextHeight(txt string) int32 {
+	n := f.LineCount(txt)
+	return n*int32(f.Size[1]) + (n-1)*f.Spacing[1]
+}
+
+// Metrics returns the vertical metrics of the font. Bitmap fonts derive them
+// from the font size and offset, truetype fonts take them from the face
+func (f *Fnt) Metrics() FntMetrics {
+	m := FntMetrics{LineHeight: int32(f.Size[1]) + f.Spacing[1]}
+	if f.Type == "truetype" {
+		m.Ascent, m.Descent = f.ascent, f.descent
+		if m.Ascent == 0 && m.Descent == 0 {
+			m.Ascent = int32(f.Size[1])
+		}
+		m.Baseline = m.Ascent
+	} else {
+		m.Baseline = int32(f.Size[1]) - 1 - f.offset[1]
+		m.Ascent = m.Baseline
+		m.Descent = int32(f.Size[1]) - m.Baseline
+	}
+	return m
+}
+
+// TextBounds returns the rectangle that a text covers when drawn left
+// aligned at 0,0, as x, y, width and height
+func (f *Fnt) TextBounds(txt string, bank int32, xscl, yscl float32) [4]float32 {
+	m := f.Metrics()
+	if f.Type == "truetype" {
+		scl := (xscl + yscl) / 2
+		return [...]float32{float32(f.offset[0]) * xscl, -float32(m.Ascent) * scl,
+			float32(f.TextWidth(txt, bank)) * scl,
+			float32(f.LineCount(txt)-1)*f.lineHeight(yscl) + float32(m.Ascent+m.Descent)*scl}
+	}
+	return [...]float32{float32(f.offset[0]) * xscl, -float32(m.Baseline) * yscl,
+		float32(f.TextWidth(txt, bank)) * xscl, float32(f.TextHeight(txt)) * yscl}
+}
+
+// lineHeight returns the distance between the tops of two lines
+func (f *Fnt) lineHeight(yscl float32) float32 {
+	return float32(int32(f.Size[1])+f.Spacing[1]) * yscl
+}
+
+func (f *Fnt) lineWidth(txt string, bank int32) (w int32) {
+	var prev rune
 	for i, c := range txt {
 		if f.Type == "truetype" {
 			w += int32(f.ttf.Width(1, string(c)))
 		} else {
+			if i > 0 {
+				w += f.kern(prev, c)
+			}
+			prev = c
 			cw := f.CharWidth(c, bank)
 			// in mugen negative spacing matching char width seems to skip calc,
 			// even for 1 symbol string (which normally shouldn't use spacing)
@@ -413,6 +858,104 @@ func (f *Fnt) TextWidth(txt string, bank int32) (w int32) {
 	return
 }
 
+// WrapText breaks a text into lines that are at most maxWidth wide.
+// Lines are broken on spaces, and words that don't fit on a line of their
+// own are broken where they overflow, never inside markup. Lines that
+// already fit are kept as is
+func (f *Fnt) WrapText(txt string, maxWidth int32, bank int32) (lines []string) {
+	for _, para := range strings.Split(txt, "\n") {
+		if maxWidth <= 0 || f.TextWidth(para, bank) <= maxWidth {
+			lines = append(lines, para)
+			continue
+		}
+		line := ""
+		for _, word := range strings.Fields(para) {
+			if len(line) > 0 {
+				if f.TextWidth(line+" "+word, bank) <= maxWidth {
+					line += " " + word
+					continue
+				}
+				lines = append(lines, line)
+			}
+			for f.TextWidth(word, bank) > maxWidth {
+				n := f.fitWidth(word, maxWidth, bank)
+				lines = append(lines, word[:n])
+				word = word[n:]
+			}
+			line = word
+		}
+		lines = append(lines, line)
+	}
+	return
+}
+
+// justifyLines wraps each paragraph of txt to maxWidth for justified text.
+// It also reports, line by line, which lines get stretched to the full
+// width, which all but the last line of a paragraph are
+func (f *Fnt) justifyLines(txt string, maxWidth int32, bank int32) (string, []bool) {
+	var lines []string
+	var stretch []bool
+	for _, para := range strings.Split(txt, "\n") {
+		wl := f.WrapText(para, maxWidth, bank)
+		for i := range wl {
+			stretch = append(stretch, i < len(wl)-1)
+		}
+		lines = append(lines, wl...)
+	}
+	return strings.Join(lines, "\n"), stretch
+}
+
+// textSpace returns the room that text drawn at x with the given align
+// has before reaching the window edges
+func textSpace(window *[4]int32, x float32, align int32) float32 {
+	left := float32(window[0])/sys.widthScale - float32(sys.gameWidth-320)/2
+	right := left + float32(window[2])/sys.widthScale
+	if align == 0 {
+		return 2 * MinF(x-left, right-x)
+	} else if align < 0 {
+		return x - left
+	}
+	return right - x
+}
+
+// fitWidth returns the byte length of the longest prefix of txt that is at
+// most maxWidth wide. At least one character is always taken. Markup is
+// never split, and color tags, being zero-width, always go with the text
+// before them
+func (f *Fnt) fitWidth(txt string, maxWidth int32, bank int32) (n int) {
+	var shown bool
+	for i := 0; i < len(txt); i = n {
+		end := i + markupLen(txt[i:])
+		tag := end > i && txt[i+1] != '{'
+		if end == i {
+			_, size := utf8.DecodeRuneInString(txt[i:])
+			end += size
+		}
+		if shown && !tag && f.TextWidth(txt[:end], bank) > maxWidth {
+			break
+		}
+		shown = shown || !tag
+		n = end
+	}
+	return
+}
+
+// markupLen returns the byte length of the markup txt starts with, a color
+// tag or a "{{" escaped brace, or 0 if it doesn't start with any
+func markupLen(txt string) int {
+	if strings.HasPrefix(txt, "{{") {
+		return 2
+	}
+	if len(txt) > 0 && txt[0] == '{' {
+		if end := strings.IndexByte(txt, '}'); end > 0 {
+			if _, ok := parseColorTag(txt[1:end]); ok {
+				return end + 1
+			}
+		}
+	}
+	return 0
+}
+
 func (f *Fnt) getCharSpr(c rune, bank, bt int32) *Sprite {
 	fci := f.images[bt][c]
 	if fci == nil {
@@ -426,13 +969,99 @@ func (f *Fnt) getCharSpr(c rune, bank, bt int32) *Sprite {
 	return &fci.img[0]
 }
 
+// queueBankPalTex queues the upload of every bank palette to the main
+// thread, like the glyph textures. The textures are shared by every glyph
+// drawn with the bank palette, and by every holder of the font
+func (f *Fnt) queueBankPalTex() {
+	for i := range f.palettes {
+		bank, pal := int32(i), f.palettes[i][:]
+		sys.mainThreadTask <- func() {
+			f.setBankPalTex(bank, PaletteToTexture(pal))
+		}
+	}
+}
+
+func (f *Fnt) setBankPalTex(bank int32, tex *Texture) {
+	f.bankTexMu.Lock()
+	defer f.bankTexMu.Unlock()
+	f.bankTex[bank] = tex
+}
+
+// bankPalTex returns the palette texture of a bank, or nil until the main
+// thread has uploaded it
+func (f *Fnt) bankPalTex(bank int32) *Texture {
+	f.bankTexMu.Lock()
+	defer f.bankTexMu.Unlock()
+	return f.bankTex[bank]
+}
+
+// TextTransform rotates and shears a whole text around an anchor, given
+// relative to the position the text is drawn at. Truetype text is printed
+// by glfont, which can't transform it, so it stays axis-aligned and the
+// sprite warns once instead
+type TextTransform struct {
+	angle     float32
+	xshear    float32
+	anchor    [2]float32
+	ttfWarned bool
+}
+
+func (tf *TextTransform) IsZero() bool {
+	return tf == nil || tf.angle == 0 && tf.xshear == 0
+}
+
+// TextEffects animates the characters of a text from the ticks elapsed
+// since it started. Shake offsets come from a generator seeded per text,
+// so they play back the same way in replays. Truetype text is printed a run
+// at a time, so only the typewriter applies to it
+type TextEffects struct {
+	tick       int32
+	cps        float32 // typewriter characters per tick, 0 shows everything
+	waveAmp    float32
+	wavePeriod int32 // ticks per wave cycle
+	shake      float32
+	seed       int32
+	alpha      float32 // opacity of the whole text, 0 counts as opaque
+}
+
+// revealed returns how many characters the typewriter shows, or -1 for all
+func (fx *TextEffects) revealed() int32 {
+	if fx == nil || fx.cps <= 0 {
+		return -1
+	}
+	return int32(float32(fx.tick) * fx.cps)
+}
+
+// offset returns how far the n-th character is moved, in font units
+func (fx *TextEffects) offset(n int32, seed *int32) (ox, oy float32) {
+	if fx.waveAmp != 0 && fx.wavePeriod > 0 {
+		// each character trails the previous one by a tick
+		oy += fx.waveAmp * float32(math.Sin(2*math.Pi*float64(fx.tick-n)/float64(fx.wavePeriod)))
+	}
+	if fx.shake != 0 {
+		ox += fx.shake * (2*float32(RandomSeed(seed))/float32(IMax) - 1)
+		oy += fx.shake * (2*float32(RandomSeed(seed))/float32(IMax) - 1)
+	}
+	return
+}
+
+// ownPal reports whether a glyph is drawn with its sprite's own palette.
+// In case of mismatched color depth between bank palette and sprite own
+// palette, mugen 1.1 uses the latter, ignoring bank
+func (f *Fnt) ownPal(bank, bt int32, c rune) bool {
+	return len(f.palettes) != 0 && len(f.coldepth) > int(bank) &&
+		f.images[bt][c].img[0].coldepth != 32 &&
+		f.coldepth[bank] != f.images[bt][c].img[0].coldepth
+}
+
 func (f *Fnt) drawChar(
 	x, y,
 	xscl, yscl float32,
 	bank, bt int32,
 	c rune, pal []uint32,
 	window *[4]int32,
-	palfx *PalFX,
+	palfx *PalFX, alpha float32,
+	tf *TextTransform, rc [2]float32,
 ) float32 {
 	if c == ' ' {
 		return float32(f.Size[0]) * xscl
@@ -443,51 +1072,106 @@ func (f *Fnt) drawChar(
 		return 0
 	}
 
-	// in case of mismatched color depth between bank palette and
-	// sprite own palette, mugen 1.1 uses the latter, ignoring bank
-	if len(f.palettes) != 0 && len(f.coldepth) > int(bank) &&
-		f.images[bt][c].img[0].coldepth != 32 &&
-		f.coldepth[bank] != f.images[bt][c].img[0].coldepth {
-		pal = f.images[bt][c].img[0].Pal[:] //palfx.getFxPal(f.images[bt][c].img[0].Pal[:], false)
+	var paltex *Texture
+	if f.ownPal(bank, bt, c) {
+		pal = f.images[bt][c].img[0].Pal[:]
+		if spr.coldepth <= 8 {
+			paltex = spr.CachePalette(pal)
+		}
+	} else if spr.coldepth <= 8 {
+		if paltex = f.bankPalTex(bank); paltex == nil {
+			return 0
+		}
 	}
 
 	x -= xscl * float32(spr.Offset[0])
 	y -= yscl * float32(spr.Offset[1])
-	if spr.coldepth <= 8 && f.paltex == nil {
-		f.paltex = spr.CachePalette(pal)
+	// fading keeps the alpha blend of opaque text, with the destination
+	// showing through as alpha drops
+	trans := int32(255*alpha)*sys.brightness>>8 | 1<<9
+	if alpha < 1 {
+		trans |= (255 - int32(255*alpha)) << 10
 	}
 	rp := RenderParams{
-		spr.Tex, f.paltex, spr.Size,
+		spr.Tex, paltex, spr.Size,
 		-x * sys.widthScale, -y * sys.heightScale, notiling,
 		xscl * sys.widthScale, xscl * sys.widthScale,
 		yscl * sys.heightScale, 1, 0, 1, 1,
 		Rotation{},
-		0, sys.brightness*255>>8 | 1<<9, 0,
-		palfx, window, 0, 0,
+		0, trans, 0,
+		palfx, -1, window, 0, 0,
 		0, 0, -xscl * float32(spr.Offset[0]), -yscl * float32(spr.Offset[1]),
 	}
+	if !tf.IsZero() {
+		// Every glyph shares the text anchor as rotation center, so the
+		// string turns as a whole. Shearing moves each glyph by its height
+		// above the anchor, then slants the glyph itself
+		x += tf.xshear * (rc[1] - y)
+		rp.x, rp.y = (rc[0]-x)*sys.widthScale, (rc[1]-y)*sys.heightScale
+		rp.rxadd = -tf.xshear * sys.widthScale / sys.heightScale
+		rp.rot.angle = tf.angle
+		rp.rcx, rp.rcy = rc[0]*sys.widthScale, rc[1]*sys.heightScale
+	}
 	RenderSprite(rp)
-	return float32(spr.Size[0]) * xscl
+	return float32(f.images[bt][c].w) * xscl
 }
 
 func (f *Fnt) Print(txt string, x, y, xscl, yscl float32, bank, align int32,
 	window *[4]int32, palfx *PalFX, frgba [4]float32) {
 	if !sys.frameSkip {
 		if f.Type == "truetype" {
-			f.DrawTtf(txt, x, y, xscl, yscl, align, true, window, frgba)
+			f.DrawTtf(txt, x, y, xscl, yscl, bank, align, 0, true, window, frgba, -1)
+		} else {
+			f.DrawText(txt, x, y, xscl, yscl, bank, align, 0, window, palfx, nil, nil)
+		}
+	}
+}
+
+// replaceMissing returns txt with the characters the font doesn't have
+// replaced by spaces. A multibyte character becomes a single space, so the
+// byte offsets of the color changes are moved along with the text
+func (f *Fnt) replaceMissing(txt string, bt int32, colors []textColor) string {
+	var sb strings.Builder
+	var ci int
+	for i, c := range txt {
+		for ; ci < len(colors) && colors[ci].pos <= i; ci++ {
+			colors[ci].pos = sb.Len()
+		}
+		if c != ' ' && c != '\n' && f.images[bt][c] == nil {
+			sb.WriteByte(' ')
 		} else {
-			f.DrawText(txt, x, y, xscl, yscl, bank, align, window, palfx)
+			sb.WriteRune(c)
 		}
 	}
+	for ; ci < len(colors); ci++ {
+		colors[ci].pos = sb.Len()
+	}
+	return sb.String()
 }
 
-// DrawText prints on screen a specified text with the current font sprites
+// DrawText prints on screen a specified text with the current font sprites.
+// A non-nil tf rotates and shears the text around its anchor, and a non-nil
+// fx animates its characters. Lines are always aligned on the full text.
+// Align 2 justifies the text: it is wrapped to width, or to the window when
+// width is 0, and every line but the last of a paragraph is stretched to
+// fill it
 func (f *Fnt) DrawText(txt string, x, y, xscl, yscl float32, bank, align int32,
-	window *[4]int32, palfx *PalFX) {
+	width float32, window *[4]int32, palfx *PalFX, tf *TextTransform, fx *TextEffects) {
 
 	if len(txt) == 0 {
 		return
 	}
+	var stretch []bool
+	if align == 2 {
+		if width <= 0 {
+			width = textSpace(window, x, align)
+		}
+		if xscl > 0 {
+			txt, stretch = f.justifyLines(txt, int32(width/xscl), bank)
+		}
+		align = 1
+	}
+	txt, colors := parseMarkup(txt)
 
 	var bt int32
 	if f.BankType == "sprite" {
@@ -497,40 +1181,129 @@ func (f *Fnt) DrawText(txt string, x, y, xscl, yscl float32, bank, align int32,
 		bank = 0
 	}
 
-	// not existing characters treated as space
-	for i, c := range txt {
-		if c != ' ' && f.images[bt][c] == nil {
-			//txt = strings.Replace(txt, string(c), " ", -1)
-			txt = txt[:i] + string(' ') + txt[i+1:]
-		}
+	txt = f.replaceMissing(txt, bt, colors)
+
+	var rc [2]float32
+	if tf != nil {
+		rc = [...]float32{x + tf.anchor[0] + float32(sys.gameWidth-320)/2,
+			y + tf.anchor[1] + float32(sys.gameHeight-240)}
 	}
 
 	x += float32(f.offset[0])*xscl + float32(sys.gameWidth-320)/2
 	y += float32(f.offset[1]-int32(f.Size[1])+1)*yscl + float32(sys.gameHeight-240)
 
-	if align == 0 {
-		x -= float32(f.TextWidth(txt, bank)) * xscl * 0.5
-	} else if align < 0 {
-		x -= float32(f.TextWidth(txt, bank)) * xscl
-	}
-
 	var pal []uint32
 	if len(f.palettes) != 0 {
-		pal = f.palettes[bank][:] //palfx.getFxPal(f.palettes[bank][:], false)
+		pal = f.palettes[bank][:]
+	}
+	// markup switches banks, hex colors only apply to truetype fonts
+	var stack [][2]int32
+	setColor := func(tc textColor) {
+		if tc.isEnd() {
+			if len(stack) > 0 {
+				bank, bt = stack[len(stack)-1][0], stack[len(stack)-1][1]
+				stack = stack[:len(stack)-1]
+			}
+		} else {
+			stack = append(stack, [...]int32{bank, bt})
+			if tc.bank >= 0 {
+				if f.BankType == "sprite" {
+					if f.images[tc.bank] != nil {
+						bt = tc.bank
+					}
+				} else if int(tc.bank) < len(f.palettes) {
+					bank = tc.bank
+				}
+			}
+		}
+		if len(f.palettes) != 0 {
+			pal = f.palettes[bank][:]
+		}
 	}
 
-	f.paltex = nil
-	for _, c := range txt {
-		x += f.drawChar(x, y, xscl, yscl, bank, bt, c, pal, window, palfx) + xscl*float32(f.Spacing[0])
+	var prev rune
+	var n, seed int32
+	var pos, ci int
+	reveal := fx.revealed()
+	alpha := float32(1)
+	if fx != nil && fx.alpha > 0 {
+		alpha = MinF(fx.alpha, 1)
+	}
+	if fx != nil {
+		// same offsets whenever the same tick is drawn
+		seed = fx.seed + fx.tick*7919
+	}
+	// each line is aligned on its own
+	for li, line := range strings.Split(txt, "\n") {
+		lx := x
+		if align == 0 {
+			lx -= float32(f.textWidth(line, bank)) * xscl * 0.5
+		} else if align < 0 {
+			lx -= float32(f.textWidth(line, bank)) * xscl
+		}
+		// the space left on a stretched line is shared between its gaps.
+		// Each gap's offset is taken from the total rather than summed up,
+		// so the last word ends exactly at the width
+		var extra, jx float32
+		var gaps, k int
+		if li < len(stretch) && stretch[li] {
+			if gaps = strings.Count(line, " "); gaps > 0 {
+				extra = MaxF(0, width-float32(f.textWidth(line, bank))*xscl)
+			}
+		}
+		for i, c := range line {
+			for ; ci < len(colors) && colors[ci].pos <= pos+i; ci++ {
+				setColor(colors[ci])
+			}
+			if i > 0 {
+				lx += xscl * float32(f.kern(prev, c))
+			}
+			prev = c
+			if reveal >= 0 && n >= reveal {
+				return
+			}
+			var ox, oy float32
+			if fx != nil {
+				ox, oy = fx.offset(n, &seed)
+			}
+			lx += f.drawChar(lx+jx+ox*xscl, y+oy*yscl, xscl, yscl, bank, bt, c, pal, window, palfx, alpha, tf, rc) +
+				xscl*float32(f.Spacing[0])
+			if c == ' ' && gaps > 0 {
+				k++
+				jx = extra * float32(k) / float32(gaps)
+			}
+			n++
+		}
+		pos += len(line) + 1
+		y += f.lineHeight(yscl)
 	}
 }
 
-func (f *Fnt) DrawTtf(txt string, x, y, xscl, yscl float32, align int32,
-	blend bool, window *[4]int32, frgba [4]float32) {
+// DrawTtf prints on screen a specified text with the current truetype font.
+// The bank's color from the font's [Colors] section is used unless the
+// caller changed frgba from its white default, keeping frgba's alpha as a
+// fade on top of the bank's. The font's shadow and outline
+// are drawn beneath the text, without changing its metrics. Align 2
+// justifies the text as in DrawText. With reveal 0 or more, only that many
+// characters are drawn, for the typewriter effect, still placed as the whole
+// lines would be
+func (f *Fnt) DrawTtf(txt string, x, y, xscl, yscl float32, bank, align int32,
+	width float32, blend bool, window *[4]int32, frgba [4]float32, reveal int32) {
 
 	if len(txt) == 0 {
 		return
 	}
+	scl := (xscl + yscl) / 2
+	var stretch []bool
+	if align == 2 {
+		if width <= 0 {
+			width = textSpace(window, x, align)
+		}
+		if scl > 0 {
+			txt, stretch = f.justifyLines(txt, int32(width/scl), bank)
+		}
+		align = 1
+	}
 
 	x += float32(f.offset[0])*xscl + float32(sys.gameWidth-320)/2
 	//y += float32(f.offset[1]-int32(f.Size[1])+1)*yscl + float32(sys.gameHeight-240)
@@ -538,8 +1311,127 @@ func (f *Fnt) DrawTtf(txt string, x, y, xscl, yscl float32, align int32,
 	win := [4]int32{(*window)[0], sys.scrrect[3] - ((*window)[1] + (*window)[3]),
 		(*window)[2], (*window)[3]}
 
+	txt, colors := parseMarkup(txt)
+	fade := frgba[3]
+	if c, ok := f.bankColor[bank]; ok && frgba[0] == 1 && frgba[1] == 1 && frgba[2] == 1 {
+		c[3] *= fade
+		frgba = c
+	}
+	var stack [][4]float32
+	setColor := func(tc textColor) {
+		if tc.isEnd() {
+			if len(stack) > 0 {
+				frgba = stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+			}
+			return
+		}
+		stack = append(stack, frgba)
+		if tc.hex {
+			frgba = tc.rgba
+			frgba[3] *= fade
+		} else if c, ok := f.bankColor[tc.bank]; ok {
+			frgba = c
+			frgba[3] *= fade
+		}
+	}
+
+	var pos, ci int
+	var n int32
+	for li, line := range strings.Split(txt, "\n") {
+		justify := li < len(stretch) && stretch[li] && strings.Contains(line, " ")
+		// bytes of the line that the typewriter shows
+		cut := len(line)
+		if reveal >= 0 {
+			for i := range line {
+				if n >= reveal {
+					cut = i
+					break
+				}
+				n++
+			}
+			if cut == 0 {
+				return
+			}
+		}
+		if len(colors) == 0 && !justify && cut == len(line) {
+			f.printTtf(x, y, xscl, yscl, align, blend, win, line, frgba)
+		} else {
+			// colored runs and, on stretched lines, words are printed left
+			// aligned one after another, starting where the whole line would
+			lw := f.ttf.Width(scl, "%s", line)
+			lx := x
+			if align == 0 {
+				lx -= lw * 0.5
+			} else if align < 0 {
+				lx -= lw
+			}
+			var extra, jx float32
+			var gaps, k int
+			if justify {
+				gaps = strings.Count(line, " ")
+				extra = MaxF(0, width-lw)
+			}
+			for start := 0; ; {
+				for ; ci < len(colors) && colors[ci].pos <= pos+start; ci++ {
+					setColor(colors[ci])
+				}
+				end := cut
+				if ci < len(colors) && colors[ci].pos < pos+end {
+					end = colors[ci].pos - pos
+				}
+				if justify {
+					if sp := strings.IndexByte(line[start:end], ' '); sp >= 0 {
+						end = start + sp + 1
+					}
+				}
+				f.printTtf(lx+jx, y, xscl, yscl, 1, blend, win, line[start:end], frgba)
+				lx += f.ttf.Width(scl, "%s", line[start:end])
+				if justify && line[end-1] == ' ' {
+					k++
+					jx = extra * float32(k) / float32(gaps)
+				}
+				if start = end; start >= cut {
+					break
+				}
+			}
+			if cut < len(line) {
+				return
+			}
+		}
+		pos += len(line) + 1
+		y += f.lineHeight(yscl)
+	}
+}
+
+// printTtf prints a single line of truetype text, beneath its shadow and
+// outline
+func (f *Fnt) printTtf(x, y, xscl, yscl float32, align int32, blend bool,
+	win [4]int32, line string, frgba [4]float32) {
+	if len(line) == 0 {
+		return
+	}
+	scl := (xscl + yscl) / 2
+	if f.shadowOffset != [2]int32{} {
+		c := f.shadowColor
+		f.ttf.SetColor(c[0], c[1], c[2], c[3]*frgba[3])
+		f.ttf.Printf(x+float32(f.shadowOffset[0])*xscl, y+float32(f.shadowOffset[1])*yscl,
+			scl, align, blend, win, "%s", line)
+	}
+	if f.outline > 0 {
+		c := f.outlineColor
+		f.ttf.SetColor(c[0], c[1], c[2], c[3]*frgba[3])
+		for ox := -f.outline; ox <= f.outline; ox++ {
+			for oy := -f.outline; oy <= f.outline; oy++ {
+				if ox != 0 || oy != 0 {
+					f.ttf.Printf(x+float32(ox)*xscl, y+float32(oy)*yscl,
+						scl, align, blend, win, "%s", line)
+				}
+			}
+		}
+	}
 	f.ttf.SetColor(frgba[0], frgba[1], frgba[2], frgba[3])
-	f.ttf.Printf(x, y, (xscl+yscl)/2, align, blend, win, "%s", txt) //x, y, scale, align, blend, window, string, printf args
+	f.ttf.Printf(x, y, scl, align, blend, win, "%s", line) //x, y, scale, align, blend, window, string, printf args
 }
 
 type TextSprite struct {
@@ -554,6 +1446,11 @@ type TextSprite struct {
 	layerno          int16      // text sctrl
 	localScale       float32    // text sctrl
 	offsetX          int32      // text sctrl
+	fadein, fadeout  int32      // text sctrl
+	wrap             bool       // break lines at the window edge
+	justifyWidth     float32    // align 2, 0 to use the window's
+	transform        TextTransform
+	effects          TextEffects
 }
 
 func NewTextSprite() *TextSprite {
@@ -570,7 +1467,7 @@ func NewTextSprite() *TextSprite {
 		localScale: 1,
 		offsetX:    0,
 	}
-	ts.palfx.setColor(255, 255, 255)
+	ts.palfx.setColorMul(255, 255, 255)
 	return ts
 }
 
@@ -591,17 +1488,102 @@ func (ts *TextSprite) SetWindow(x, y, w, h float32) {
 }
 
 func (ts *TextSprite) SetColor(r, g, b int32) {
-	ts.palfx.setColor(r, g, b)
+	ts.palfx.setColorMul(r, g, b)
 	ts.frgba = [...]float32{float32(r) / 255, float32(g) / 255,
 		float32(b) / 255, 1.0}
 }
 
+// wrapWidth returns the space left for text between the x position and the
+// window edges, in font units
+func (ts *TextSprite) wrapWidth() int32 {
+	w := textSpace(&ts.window, ts.x, ts.align)
+	if ts.align == 2 && ts.justifyWidth > 0 {
+		w = ts.justifyWidth
+	}
+	scl := ts.xscl
+	if ts.fnt.Type == "truetype" {
+		scl = (ts.xscl + ts.yscl) / 2
+	}
+	if scl <= 0 {
+		return 0
+	}
+	return Max(1, int32(w/scl))
+}
+
+// displayText returns the text as drawn, after wrapping. Justified text is
+// wrapped by the font when drawn, which needs the paragraph breaks
+func (ts *TextSprite) displayText() string {
+	if ts.wrap && ts.align != 2 {
+		return strings.Join(ts.fnt.WrapText(ts.text, ts.wrapWidth(), ts.bank), "\n")
+	}
+	return ts.text
+}
+
+// Bounds returns the rectangle that the text covers when drawn, as x, y,
+// width and height
+func (ts *TextSprite) Bounds() [4]float32 {
+	if ts.fnt == nil {
+		return [4]float32{}
+	}
+	var b [4]float32
+	if ts.align == 2 {
+		txt, stretch := ts.fnt.justifyLines(ts.text, ts.wrapWidth(), ts.bank)
+		b = ts.fnt.TextBounds(txt, ts.bank, ts.xscl, ts.yscl)
+		for _, s := range stretch {
+			if s {
+				w := ts.justifyWidth
+				if w <= 0 {
+					w = textSpace(&ts.window, ts.x, ts.align)
+				}
+				b[2] = MaxF(b[2], w)
+				break
+			}
+		}
+	} else {
+		b = ts.fnt.TextBounds(ts.displayText(), ts.bank, ts.xscl, ts.yscl)
+	}
+	b[0] += ts.x
+	b[1] += ts.y
+	if ts.align == 0 {
+		b[0] -= b[2] / 2
+	} else if ts.align < 0 {
+		b[0] -= b[2]
+	}
+	return b
+}
+
+// fade returns the opacity from the fade-in and fade-out times. Fade-in counts
+// the ticks since the text appeared, fade-out the ticks left of removetime
+func (ts *TextSprite) fade() float32 {
+	a := float32(1)
+	if ts.fadein > 0 && ts.effects.tick < ts.fadein {
+		a = float32(ts.effects.tick) / float32(ts.fadein)
+	}
+	if ts.fadeout > 0 && ts.removetime > 0 && ts.removetime <= ts.fadeout {
+		a = MinF(a, float32(ts.removetime-1)/float32(ts.fadeout))
+	}
+	return a
+}
+
 func (ts *TextSprite) Draw() {
 	if !sys.frameSkip && ts.fnt != nil {
+		alpha := ts.fade()
+		if alpha <= 0 {
+			return
+		}
+		ts.effects.alpha = alpha
+		txt := ts.displayText()
 		if ts.fnt.Type == "truetype" {
-			ts.fnt.DrawTtf(ts.text, ts.x, ts.y, ts.xscl, ts.yscl, ts.align, true, &ts.window, ts.frgba)
+			if !ts.transform.IsZero() && !ts.transform.ttfWarned {
+				ts.transform.ttfWarned = true
+				sys.appendToConsole("WARNING: Text angle and xshear aren't supported with truetype fonts, the text is drawn unrotated")
+				sys.errLog.Printf("Text angle and xshear aren't supported with truetype fonts: %v", ts.text)
+			}
+			frgba := ts.frgba
+			frgba[3] *= alpha
+			ts.fnt.DrawTtf(txt, ts.x, ts.y, ts.xscl, ts.yscl, ts.bank, ts.align, ts.justifyWidth, true, &ts.window, frgba, ts.effects.revealed())
 		} else {
-			ts.fnt.DrawText(ts.text, ts.x, ts.y, ts.xscl, ts.yscl, ts.bank, ts.align, &ts.window, ts.palfx)
+			ts.fnt.DrawText(txt, ts.x, ts.y, ts.xscl, ts.yscl, ts.bank, ts.align, ts.justifyWidth, &ts.window, ts.palfx, &ts.transform, &ts.effects)
 		}
 	}
 }
@@ -0,0 +1,596 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+// A truetype font whose characters are all 10 pixels wide, recording what
+// it prints.
+type testTtf struct {
+	printed []testTtfPrint
+}
+
+type testTtfPrint struct {
+	x, y  float32
+	align int32
+	text  string
+}
+
+func (f *testTtf) SetColor(red, green, blue, alpha float32) {}
+
+func (f *testTtf) Width(scale float32, fs string, argv ...interface{}) float32 {
+	return 10 * scale * float32(utf8.RuneCountInString(fmt.Sprintf(fs, argv...)))
+}
+
+func (f *testTtf) Printf(x, y, scale float32, align int32, blend bool, window [4]int32, fs string, argv ...interface{}) error {
+	f.printed = append(f.printed, testTtfPrint{x, y, align, fmt.Sprintf(fs, argv...)})
+	return nil
+}
+
+func TestDrawTtfTypewriter(t *testing.T) {
+	window := [4]int32{0, 0, 320, 240}
+	for _, tc := range []struct {
+		reveal int32
+		want   []testTtfPrint
+	}{
+		{-1, []testTtfPrint{{100, 0, 0, "abc"}, {100, 10, 0, "défg"}}},
+		{0, nil},
+		{2, []testTtfPrint{{85, 0, 1, "ab"}}},
+		// A partly shown line starts where the whole line would, so the
+		// text doesn't move as it's revealed
+		{5, []testTtfPrint{{100, 0, 0, "abc"}, {80, 10, 1, "dé"}}},
+		{7, []testTtfPrint{{100, 0, 0, "abc"}, {100, 10, 0, "défg"}}},
+	} {
+		ttf := &testTtf{}
+		f := &Fnt{Type: "truetype", ttf: ttf, Size: [2]uint16{10, 10}}
+		f.DrawTtf("abc\ndéfg", 100, 0, 1, 1, 0, 0, 0, true, &window, [4]float32{1, 1, 1, 1}, tc.reveal)
+		if fmt.Sprint(ttf.printed) != fmt.Sprint(tc.want) {
+			t.Errorf("reveal %v: printed %v, want %v", tc.reveal, ttf.printed, tc.want)
+		}
+	}
+}
+
+// Ragged lines are each aligned on their own, one line height apart. Plain
+// lines pass the alignment on, colored ones are placed by DrawTtf.
+func TestDrawTtfMultiline(t *testing.T) {
+	window := [4]int32{0, 0, 320, 240}
+	for _, tc := range []struct {
+		txt   string
+		align int32
+		want  []testTtfPrint
+	}{
+		{"ab\nabcd\n\nabc", 1, []testTtfPrint{{100, 0, 1, "ab"}, {100, 12, 1, "abcd"}, {100, 36, 1, "abc"}}},
+		{"ab\nabcd\n\nabc", 0, []testTtfPrint{{100, 0, 0, "ab"}, {100, 12, 0, "abcd"}, {100, 36, 0, "abc"}}},
+		{"ab\nabcd\n\nabc", -1, []testTtfPrint{{100, 0, -1, "ab"}, {100, 12, -1, "abcd"}, {100, 36, -1, "abc"}}},
+		{"{color:#ff0000}ab{/color}\nabcd\n\nabc", 1,
+			[]testTtfPrint{{100, 0, 1, "ab"}, {100, 12, 1, "abcd"}, {100, 36, 1, "abc"}}},
+		{"{color:#ff0000}ab{/color}\nabcd\n\nabc", 0,
+			[]testTtfPrint{{90, 0, 1, "ab"}, {80, 12, 1, "abcd"}, {85, 36, 1, "abc"}}},
+		{"{color:#ff0000}ab{/color}\nabcd\n\nabc", -1,
+			[]testTtfPrint{{80, 0, 1, "ab"}, {60, 12, 1, "abcd"}, {70, 36, 1, "abc"}}},
+	} {
+		ttf := &testTtf{}
+		f := &Fnt{Type: "truetype", ttf: ttf, Size: [2]uint16{10, 10}, Spacing: [2]int32{0, 2}}
+		f.DrawTtf(tc.txt, 100, 0, 1, 1, 0, tc.align, 0, true, &window, [4]float32{1, 1, 1, 1}, -1)
+		if fmt.Sprint(ttf.printed) != fmt.Sprint(tc.want) {
+			t.Errorf("%q, align %v: printed %v, want %v", tc.txt, tc.align, ttf.printed, tc.want)
+		}
+	}
+}
+
+// Justified lines have the space left shared between their gaps, so the last
+// word ends exactly at the width. The last line of each paragraph stays left
+// aligned.
+func TestDrawTtfJustify(t *testing.T) {
+	window := [4]int32{0, 0, 320, 240}
+	for _, tc := range []struct {
+		txt   string
+		width float32
+		want  []testTtfPrint
+	}{
+		{"a b c d e f g h", 100, []testTtfPrint{{0, 0, 1, "a "}, {22.5, 0, 1, "b "}, {45, 0, 1, "c "},
+			{67.5, 0, 1, "d "}, {90, 0, 1, "e"}, {0, 12, 1, "f g h"}}},
+		{"aa bb cc dd ee\nff gg", 100, []testTtfPrint{{0, 0, 1, "aa "}, {40, 0, 1, "bb "}, {80, 0, 1, "cc"},
+			{0, 12, 1, "dd ee"}, {0, 24, 1, "ff gg"}}},
+		// A single word has no gap to stretch
+		{"abcdefgh ij", 100, []testTtfPrint{{0, 0, 1, "abcdefgh"}, {0, 12, 1, "ij"}}},
+	} {
+		ttf := &testTtf{}
+		f := &Fnt{Type: "truetype", ttf: ttf, Size: [2]uint16{10, 10}, Spacing: [2]int32{0, 2}}
+		f.DrawTtf(tc.txt, 0, 0, 1, 1, 0, 2, tc.width, true, &window, [4]float32{1, 1, 1, 1}, -1)
+		if fmt.Sprint(ttf.printed) != fmt.Sprint(tc.want) {
+			t.Errorf("%q: printed %v, want %v", tc.txt, ttf.printed, tc.want)
+		}
+	}
+}
+
+// Each paragraph is wrapped on its own, and all its lines but the last are
+// marked to be stretched.
+func TestFntJustifyLines(t *testing.T) {
+	f := &Fnt{Type: "bitmap", BankType: "palette", Size: [2]uint16{8, 10}, Spacing: [2]int32{1, 2},
+		images: map[int32]map[rune]*FntCharImage{0: {'a': {w: 6}, 'b': {w: 4}}}}
+	txt, stretch := f.justifyLines("aa bb aa bb\naa bb aa\n\nab", 40, 0)
+	if want := "aa bb\naa bb\naa bb\naa\n\nab"; txt != want {
+		t.Errorf("wrapped to %q, want %q", txt, want)
+	}
+	if want := []bool{true, false, true, false, false, false}; fmt.Sprint(stretch) != fmt.Sprint(want) {
+		t.Errorf("stretched %v, want %v", stretch, want)
+	}
+}
+
+func TestFntTextMetrics(t *testing.T) {
+	f := &Fnt{Type: "bitmap", BankType: "palette", Size: [2]uint16{8, 10}, Spacing: [2]int32{1, 2},
+		images: map[int32]map[rune]*FntCharImage{0: {'a': {w: 6}, 'b': {w: 4}}}}
+	for _, tc := range []struct {
+		txt           string
+		width, height int32
+		lines         int32
+	}{
+		{"ab", 11, 10, 1},
+		{"ab\naaab\n", 25, 34, 3},
+		{"aaab\nb", 25, 22, 2},
+		{"", 0, 10, 1},
+	} {
+		if w, h, n := f.TextWidth(tc.txt, 0), f.TextHeight(tc.txt), f.LineCount(tc.txt); w != tc.width || h != tc.height || n != tc.lines {
+			t.Errorf("%q: width %v, height %v, %v lines, want %v, %v, %v", tc.txt, w, h, n, tc.width, tc.height, tc.lines)
+		}
+	}
+}
+
+func TestFntTextBounds(t *testing.T) {
+	// 8x8 glyphs, 1 apart
+	f, err := loadFntV1("testdata/font/utf8map.fnt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := f.Metrics(); m != (FntMetrics{LineHeight: 8, Baseline: 7, Ascent: 7, Descent: 1}) {
+		t.Errorf("metrics %+v", m)
+	}
+	ttf := &Fnt{Type: "truetype", ttf: &testTtf{}, Size: [2]uint16{10, 10}, Spacing: [2]int32{0, 2},
+		ascent: 8, descent: 2}
+	if m := ttf.Metrics(); m != (FntMetrics{LineHeight: 12, Baseline: 8, Ascent: 8, Descent: 2}) {
+		t.Errorf("truetype metrics %+v", m)
+	}
+	for _, tc := range []struct {
+		name       string
+		f          *Fnt
+		txt        string
+		xscl, yscl float32
+		want       [4]float32
+	}{
+		{"one glyph", f, "A", 1, 1, [4]float32{0, -7, 8, 8}},
+		{"two glyphs", f, "AB", 1, 1, [4]float32{0, -7, 17, 8}},
+		{"two lines", f, "A\nAB", 1, 1, [4]float32{0, -7, 17, 16}},
+		{"scaled", f, "A\nAB", 2, 3, [4]float32{0, -21, 34, 48}},
+		{"truetype", ttf, "ab\nc", 1, 1, [4]float32{0, -8, 20, 22}},
+	} {
+		if got := tc.f.TextBounds(tc.txt, 0, tc.xscl, tc.yscl); got != tc.want {
+			t.Errorf("%v: bounds %v, want %v", tc.name, got, tc.want)
+		}
+	}
+	// The offset moves the glyphs, and the baseline with them
+	f.offset = [2]int32{2, 1}
+	if got, want := f.TextBounds("AB", 0, 2, 1), [4]float32{4, -6, 34, 8}; got != want {
+		t.Errorf("offset: bounds %v, want %v", got, want)
+	}
+	f.offset = [2]int32{}
+	// Text sprites add their position and alignment
+	ts := &TextSprite{text: "AB", fnt: f, x: 100, y: 50, xscl: 1, yscl: 1}
+	for _, tc := range []struct {
+		align int32
+		want  [4]float32
+	}{
+		{1, [4]float32{100, 43, 17, 8}},
+		{0, [4]float32{91.5, 43, 17, 8}},
+		{-1, [4]float32{83, 43, 17, 8}},
+	} {
+		ts.align = tc.align
+		if got := ts.Bounds(); got != tc.want {
+			t.Errorf("align %v: bounds %v, want %v", tc.align, got, tc.want)
+		}
+	}
+}
+
+func TestFntOwnPal(t *testing.T) {
+	// Bank 0 is an 8 bit palette and bank 1 a 5 bit one
+	f := &Fnt{palettes: make([][256]uint32, 2), coldepth: []byte{8, 5},
+		images: map[int32]map[rune]*FntCharImage{0: {
+			'a': {img: []Sprite{{coldepth: 8}}},
+			'b': {img: []Sprite{{coldepth: 5}}},
+			'c': {img: []Sprite{{coldepth: 32}}},
+		}}}
+	for _, tc := range []struct {
+		bank int32
+		c    rune
+		want bool
+	}{
+		{0, 'a', false},
+		{0, 'b', true},
+		{0, 'c', false},
+		{1, 'a', true},
+		{1, 'b', false},
+		{1, 'c', false},
+	} {
+		if got := f.ownPal(tc.bank, 0, tc.c); got != tc.want {
+			t.Errorf("bank %v, %q: own palette %v, want %v", tc.bank, tc.c, got, tc.want)
+		}
+	}
+	// Fonts without bank palettes never switch
+	f.palettes = nil
+	if f.ownPal(0, 0, 'b') {
+		t.Errorf("own palette picked with no bank palettes")
+	}
+}
+
+func TestParseMarkup(t *testing.T) {
+	bank := func(pos int, b int32) textColor { return textColor{pos: pos, bank: b} }
+	end := func(pos int) textColor { return textColor{pos: pos, bank: -1} }
+	for _, tc := range []struct {
+		name   string
+		txt    string
+		want   string
+		colors []textColor
+	}{
+		{"plain", "FIRST ATTACK", "FIRST ATTACK", nil},
+		{"bank", "{color:2}FIRST{/color} ATTACK", "FIRST ATTACK", []textColor{bank(0, 2), end(5)}},
+		{"hex", "a{color:#ff000080}b", "ab",
+			[]textColor{{pos: 1, bank: -1, rgba: [4]float32{1, 0, 0, 128.0 / 255}, hex: true}}},
+		{"hex without alpha", "{color:#00ff00}a", "a",
+			[]textColor{{pos: 0, bank: -1, rgba: [4]float32{0, 1, 0, 1}, hex: true}}},
+		{"nested", "{color:1}a{color:2}b{/color}c{/color}", "abc",
+			[]textColor{bank(0, 1), bank(1, 2), end(2), end(3)}},
+		{"unclosed", "{color:1}ab", "ab", []textColor{bank(0, 1)}},
+		{"stray end", "a{/color}b", "ab", []textColor{end(1)}},
+		{"no argument", "{color:}a", "{color:}a", nil},
+		{"unknown tag", "{colour:1}a", "{colour:1}a", nil},
+		{"short hex", "{color:#12}a", "{color:#12}a", nil},
+		{"bad hex", "{color:#gg0000}a", "{color:#gg0000}a", nil},
+		{"negative bank", "{color:-1}a", "{color:-1}a", nil},
+		{"no closing brace", "a{color:1", "a{color:1", nil},
+		{"empty braces", "a{}b", "a{}b", nil},
+		{"escaped brace", "{{color:1}}", "{color:1}}", nil},
+		{"escape then tag", "{{{color:1}a", "{a", []textColor{bank(1, 1)}},
+	} {
+		got, colors := parseMarkup(tc.txt)
+		if got != tc.want {
+			t.Errorf("%v: text %q, want %q", tc.name, got, tc.want)
+		}
+		if fmt.Sprint(colors) != fmt.Sprint(tc.colors) {
+			t.Errorf("%v: colors %v, want %v", tc.name, colors, tc.colors)
+		}
+	}
+}
+
+// Markup takes no room, so alignment only sees the drawn characters
+func TestTextWidthMarkup(t *testing.T) {
+	f := &Fnt{Type: "truetype", ttf: &testTtf{}}
+	for _, tc := range []struct {
+		txt  string
+		want int32
+	}{
+		{"ab", 20},
+		{"{color:1}ab{/color}", 20},
+		{"{color:1}a{color:#ff0000}b{/color}", 20},
+		{"{color:1}ab", 20},
+		{"{colour:1}ab", 120},
+		{"{{", 10},
+		{"{color:1}a\nabc{/color}", 30},
+	} {
+		if got := f.TextWidth(tc.txt, 0); got != tc.want {
+			t.Errorf("%q: width %v, want %v", tc.txt, got, tc.want)
+		}
+	}
+}
+
+// Characters the font doesn't have become one space each, however many
+// bytes they take, and the color changes after them stay on the same
+// characters.
+func TestFntReplaceMissing(t *testing.T) {
+	f := &Fnt{Type: "bitmap", BankType: "palette", Size: [2]uint16{4, 8},
+		images: map[int32]map[rune]*FntCharImage{0: {'a': {w: 4}, 'é': {w: 4}}}}
+	for _, tc := range []struct {
+		txt  string
+		want string
+		pos  []int
+	}{
+		{"aéa", "aéa", nil},
+		{"a日本a\nb", "a  a\n ", nil},
+		{"日{color:1}a{/color}b", " a ", []int{1, 2}},
+		{"a{color:1}日本{/color}", "a  ", []int{1, 3}},
+	} {
+		txt, colors := parseMarkup(tc.txt)
+		txt = f.replaceMissing(txt, 0, colors)
+		var pos []int
+		for _, c := range colors {
+			pos = append(pos, c.pos)
+		}
+		if txt != tc.want || fmt.Sprint(pos) != fmt.Sprint(tc.pos) {
+			t.Errorf("%q: replaced to %q with colors at %v, want %q at %v", tc.txt, txt, pos, tc.want, tc.pos)
+		}
+	}
+}
+
+func TestWrapText(t *testing.T) {
+	// Characters 10 wide, spaces included
+	ttf := &Fnt{Type: "truetype", ttf: &testTtf{}}
+	// Characters 4 wide, 1 apart, spaces as wide as Size[0]
+	bitmap := &Fnt{Type: "bitmap", BankType: "palette", Size: [2]uint16{4, 8}, Spacing: [2]int32{1, 0},
+		images: map[int32]map[rune]*FntCharImage{0: {'a': {w: 4}}}}
+	for _, tc := range []struct {
+		name     string
+		f        *Fnt
+		txt      string
+		maxWidth int32
+		want     []string
+	}{
+		{"fits", ttf, "ab cd", 50, []string{"ab cd"}},
+		{"one over", ttf, "abc de", 50, []string{"abc", "de"}},
+		{"exact fit before a break", ttf, "ab cd efg", 50, []string{"ab cd", "efg"}},
+		{"overlong word", ttf, "abcdefghijkl", 50, []string{"abcde", "fghij", "kl"}},
+		{"overlong word after a word", ttf, "ab abcdefg", 50, []string{"ab", "abcde", "fg"}},
+		{"trailing spaces that fit", ttf, "abc  ", 50, []string{"abc  "}},
+		{"trailing spaces that don't", ttf, "abc de   ", 50, []string{"abc", "de"}},
+		{"paragraphs", ttf, "abc de\nf", 50, []string{"abc", "de", "f"}},
+		{"spacing, exact fit", bitmap, "aa aa", 24, []string{"aa aa"}},
+		{"spacing, one over", bitmap, "aa aa", 23, []string{"aa", "aa"}},
+		// Markup is zero-width and never split
+		{"tag inside an overlong word", ttf, "abcd{color:1}efgh", 50, []string{"abcd{color:1}e", "fgh"}},
+		{"tag at the break", ttf, "abcde{/color}fg", 50, []string{"abcde{/color}", "fg"}},
+		{"tag first", ttf, "{color:#ff0000}abcdefg", 50, []string{"{color:#ff0000}abcde", "fg"}},
+		{"escaped brace", ttf, "abcd{{ef", 50, []string{"abcd{{", "ef"}},
+		{"not a tag", ttf, "ab{color:x}", 50, []string{"ab{co", "lor:x", "}"}},
+		{"tagged words", ttf, "{color:1}abc{/color} de", 50, []string{"{color:1}abc{/color}", "de"}},
+	} {
+		if got := tc.f.WrapText(tc.txt, tc.maxWidth, 0); fmt.Sprintf("%q", got) != fmt.Sprintf("%q", tc.want) {
+			t.Errorf("%v: wrapped to %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+// The wrap width is in font units, so text scaled up twice wraps at half
+// the window's width.
+func TestTextSpriteWrapScale(t *testing.T) {
+	widthScale, gameWidth := sys.widthScale, sys.gameWidth
+	sys.widthScale, sys.gameWidth = 1, 320
+	defer func() { sys.widthScale, sys.gameWidth = widthScale, gameWidth }()
+	ts := &TextSprite{text: "abc de", fnt: &Fnt{Type: "truetype", ttf: &testTtf{}}, align: 1,
+		xscl: 1, yscl: 1, window: [4]int32{0, 0, 100, 240}, wrap: true}
+	for _, tc := range []struct {
+		scl  float32
+		want string
+	}{
+		{1, "abc de"},
+		{2, "abc\nde"},
+	} {
+		ts.xscl, ts.yscl = tc.scl, tc.scl
+		if got := ts.displayText(); got != tc.want {
+			t.Errorf("scale %v: %q, want %q", tc.scl, got, tc.want)
+		}
+	}
+}
+
+func TestTtfTransformWarnsOnce(t *testing.T) {
+	console, rows := len(sys.consoleText), sys.consoleRows
+	sys.consoleRows = console + 10
+	t.Cleanup(func() { sys.consoleText, sys.consoleRows = sys.consoleText[:console], rows })
+	window := [4]int32{0, 0, 320, 240}
+	ttf := &testTtf{}
+	ts := &TextSprite{text: "abc", fnt: &Fnt{Type: "truetype", ttf: ttf}, xscl: 1, yscl: 1,
+		window: window, frgba: [4]float32{1, 1, 1, 1}}
+	ts.transform.angle = 30
+	ts.Draw()
+	ts.Draw()
+	if got := len(sys.consoleText) - console; got != 1 {
+		t.Errorf("%v warnings, want 1", got)
+	}
+	// Still drawn, unrotated
+	if len(ttf.printed) != 2 {
+		t.Errorf("printed %v", ttf.printed)
+	}
+}
+
+func TestParseFntRune(t *testing.T) {
+	for _, tc := range []struct {
+		s    string
+		want rune
+		ok   bool
+	}{
+		{"A", 'A', true},
+		{"7", '7', true}, // a single digit is the digit itself
+		{"é", 'é', true},
+		{"中", '中', true},
+		{"😀", '😀', true},
+		{"\xe9", 'é', true}, // latin-1, from older fonts
+		{"0x41", 'A', true},
+		{"0X1F600", '😀', true},
+		{"65", 'A', true},
+		{"9731", '☃', true},
+		{"0xZZ", 0, false},
+		{"0x110000", 0x110000, false},
+		{"-5", -5, false},
+		{"AB", 0, false},
+	} {
+		if c, ok := parseFntRune(tc.s); c != tc.want || ok != tc.ok {
+			t.Errorf("parseFntRune(%q) = %q, %v, want %q, %v", tc.s, c, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestLoadFntV1Map(t *testing.T) {
+	f, err := loadFntV1("testdata/font/utf8map.fnt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Size != [2]uint16{8, 8} || f.Spacing != [2]int32{1, 0} || len(f.palettes) != 1 {
+		t.Errorf("size %v, spacing %v, %v palettes", f.Size, f.Spacing, len(f.palettes))
+	}
+	want := map[rune]uint16{'A': 0, 'é': 8, '中': 16, '😀': 24, 'B': 0, '☃': 8}
+	for c, ofs := range want {
+		if fci := f.images[0][c]; fci == nil {
+			t.Errorf("%q not mapped", c)
+		} else if fci.ofs != ofs || fci.w != 8 {
+			t.Errorf("%q at %v, %v wide, want %v, 8", c, fci.ofs, fci.w, ofs)
+		}
+	}
+	// The invalid entry is skipped, not mapped to a truncated code
+	if len(f.images[0]) != len(want) {
+		t.Errorf("%v characters mapped, want %v", len(f.images[0]), len(want))
+	}
+}
+
+func TestLoadFntV2Kerning(t *testing.T) {
+	f, err := loadFntV2("testdata/font/kerning.def", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[[2]rune]int32{{'A', 'V'}: -2, {'T', 'o'}: -1, {'é', 'e'}: 1, {'中', '文'}: 3, {'V', 'A'}: -3}
+	if len(f.kerning) != len(want) {
+		t.Errorf("%v kerning pairs, want %v: %v", len(f.kerning), len(want), f.kerning)
+	}
+	for p, k := range want {
+		if got := f.kern(p[0], p[1]); got != k {
+			t.Errorf("kern(%q, %q) = %v, want %v", p[0], p[1], got, k)
+		}
+	}
+}
+
+// copyFntFixture copies a font fixture into a temporary directory, so that
+// its cache entries and modification time belong to the test
+func copyFntFixture(t testing.TB, name string) string {
+	data, err := os.ReadFile(filepath.Join("testdata/font", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(filename, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+// dropMainThreadTasks empties sys.mainThreadTask without running the tasks,
+// which upload textures and need a GL context. Returns how many there were
+func dropMainThreadTasks() (n int) {
+	for {
+		select {
+		case <-sys.mainThreadTask:
+			n++
+		default:
+			return
+		}
+	}
+}
+
+func TestLoadFntShared(t *testing.T) {
+	filename := copyFntFixture(t, "utf8map.fnt")
+	dropMainThreadTasks()
+	defer dropMainThreadTasks()
+	f1, err := loadFnt(filename, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dropMainThreadTasks() < len(f1.palettes) {
+		t.Errorf("bank palette uploads not queued")
+	}
+	f2, _ := loadFnt(filename, -1)
+	if f1 != f2 {
+		t.Errorf("second load returned a new font")
+	}
+	if n := dropMainThreadTasks(); n != 0 {
+		t.Errorf("cached load queued %v uploads", n)
+	}
+	// Bank textures are read while the main thread sets them, and are seen
+	// through every holder of the font. A bare Texture stands in for the
+	// upload, which needs a GL context
+	if f1.bankPalTex(0) != nil {
+		t.Errorf("bank texture set before the upload ran")
+	}
+	tex := &Texture{}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f2.bankPalTex(0)
+		}()
+	}
+	f1.setBankPalTex(0, tex)
+	wg.Wait()
+	if f2.bankPalTex(0) != tex {
+		t.Errorf("bank texture not shared")
+	}
+	// A changed file is loaded again, once, however many load it at a time
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(filename, later, later); err != nil {
+		t.Fatal(err)
+	}
+	fs := make([]*Fnt, 4)
+	for i := range fs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			fs[i], _ = loadFnt(filename, -1)
+		}(i)
+	}
+	wg.Wait()
+	if fs[0] == f1 {
+		t.Errorf("changed file not reloaded")
+	}
+	for _, f := range fs[1:] {
+		if f != fs[0] {
+			t.Errorf("concurrent loads returned different fonts")
+		}
+	}
+	if f4, _ := loadFnt(filename, -1); f4 != fs[0] {
+		t.Errorf("reloaded font not cached")
+	}
+}
+
+// Compares loading a font from its files with taking it from the cache
+func BenchmarkLoadFnt(b *testing.B) {
+	filename := copyFntFixture(b, "utf8map.fnt")
+	abs, _ := filepath.Abs(filename)
+	// the fixture's invalid map entry is logged on every load
+	out := sys.errLog.Writer()
+	sys.errLog.SetOutput(io.Discard)
+	defer sys.errLog.SetOutput(out)
+	// Drop the texture uploads that loading queues, so the queue doesn't
+	// fill up; running them would need a GL context
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-sys.mainThreadTask:
+			case <-done:
+				return
+			}
+		}
+	}()
+	b.Run("uncached", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			fntCacheMutex.Lock()
+			delete(FntCache, fntCacheKey{abs, -1})
+			fntCacheMutex.Unlock()
+			if _, err := loadFnt(filename, -1); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("cached", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := loadFnt(filename, -1); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
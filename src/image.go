@@ -10,6 +10,8 @@ import (
 	"math"
 	"os"
 	"runtime"
+	"strconv"
+	"strings"
 	"unsafe"
 )
 
@@ -24,6 +26,66 @@ const (
 	TT_sub
 )
 
+// InvertBlend selects how a PalFX's color inversion interacts with the
+// blending mode of the sprite it is applied to.
+type InvertBlend int32
+
+const (
+	InvertBlendBg       InvertBlend = iota - 3 // BGPalFX, forced Mugen 1.1 behavior
+	InvertBlendMugen11                         // Mugen 1.1 behavior when the parameter is omitted
+	InvertBlendAdd1                            // Add1 compensation without reversing the blend
+	InvertBlendNone                            // Plain color inversion
+	InvertBlendSub                             // Reverse the blend equation
+	InvertBlendSubAdd1                         // Reverse the blend equation with Add1 compensation
+	InvertBlendInverted                        // Effective value only: inversion is done by the blend
+)
+
+// Normalizes a raw invertblend value from content to the given range.
+func clampInvertBlend(v int32, min, max InvertBlend) InvertBlend {
+	return InvertBlend(Clamp(v, int32(min), int32(max)))
+}
+
+// When to restore the character's own invertall during synthesis.
+const (
+	ibKeepCombined = iota
+	ibOwnWhenBlending
+	ibOwnAlways
+)
+
+type invertBlendRule struct {
+	ownInvertall   int
+	inverted       InvertBlend
+	normal         InvertBlend
+	clearInvertall bool
+}
+
+// How the char invertblend combines with the global invertblend when the
+// global PalFX inverts colors, keyed by {char, global}.
+var invertBlendRules = map[[2]InvertBlend]invertBlendRule{
+	{InvertBlendNone, InvertBlendSub}:    {ibOwnWhenBlending, InvertBlendSub, InvertBlendSub, false},
+	{InvertBlendSub, InvertBlendSub}:     {ibOwnWhenBlending, InvertBlendNone, InvertBlendNone, false},
+	{InvertBlendMugen11, InvertBlendSub}: {ibOwnWhenBlending, InvertBlendMugen11, InvertBlendInverted, true},
+	{InvertBlendSubAdd1, InvertBlendSub}: {ibOwnAlways, InvertBlendAdd1, InvertBlendAdd1, false},
+	{InvertBlendAdd1, InvertBlendSub}:    {ibOwnAlways, InvertBlendSubAdd1, InvertBlendSubAdd1, false},
+	// BGPalFX keeps the combined inversion whatever the global invertblend
+	{InvertBlendBg, InvertBlendBg}:      {ibKeepCombined, InvertBlendInverted, InvertBlendBg, false},
+	{InvertBlendBg, InvertBlendMugen11}: {ibKeepCombined, InvertBlendInverted, InvertBlendBg, false},
+	{InvertBlendBg, InvertBlendAdd1}:    {ibKeepCombined, InvertBlendInverted, InvertBlendBg, false},
+	{InvertBlendBg, InvertBlendNone}:    {ibKeepCombined, InvertBlendInverted, InvertBlendBg, false},
+	{InvertBlendBg, InvertBlendSub}:     {ibKeepCombined, InvertBlendInverted, InvertBlendBg, false},
+	{InvertBlendBg, InvertBlendSubAdd1}: {ibKeepCombined, InvertBlendInverted, InvertBlendBg, false},
+}
+
+// PalFXPauseMode controls whether a PalFX keeps animating while the game is
+// paused by Pause or SuperPause.
+type PalFXPauseMode int32
+
+const (
+	PalFXPauseRun    PalFXPauseMode = iota // Advance whenever stepped
+	PalFXPauseFreeze                       // Hold during Pause and SuperPause
+	PalFXPauseSuper                        // Run during SuperPause, hold during Pause
+)
+
 type PalFXDef struct {
 	time        int32
 	color       float32
@@ -33,41 +95,55 @@ type PalFXDef struct {
 	sinmul      [3]int32
 	sincolor    int32
 	sinhue      int32
-	cycletime   [4]int32
+	cycletime   [4]float32
+	sinphase    [4]float32
 	invertall   bool
-	invertblend int32
+	invertblend InvertBlend
 	hue         float32
+	contrast    float32
+	gamma       float32
+	posterize   int32
+	pausemode   PalFXPauseMode
+	palrange    [2]int32
 	interpolate bool
 	iadd        [6]int32
 	imul        [6]int32
 	icolor      [2]float32
 	ihue        [2]float32
+	icontrast   [2]float32
+	igamma      [2]float32
 	itime       int32
 }
 type PalFX struct {
 	PalFXDef
 	remap        []int
 	negType      bool
-	sintime      [4]int32
+	sintime      [4]float32
 	enable       bool
 	eNegType     bool
 	eInvertall   bool
-	eInvertblend int32
+	eInvertblend InvertBlend
 	eAdd         [3]int32
 	eMul         [3]int32
 	eColor       float32
 	eHue         float32
+	eContrast    float32
+	eGamma       float32
+	ePosterize   int32
 	eInterpolate bool
 	eiAdd        [3]int32
 	eiMul        [3]int32
 	eiColor      float32
 	eiHue        float32
+	eiContrast   float32
+	eiGamma      float32
 	eiTime       int32
 }
 
 func newPalFX() *PalFX { return &PalFX{} }
 func (pf *PalFX) clear2(nt bool) {
-	pf.PalFXDef = PalFXDef{color: 1, icolor: [...]float32{1, 1}, mul: [...]int32{256, 256, 256}, imul: [...]int32{256, 256, 256, 256, 256, 256}}
+	pf.PalFXDef = PalFXDef{color: 1, icolor: [...]float32{1, 1}, mul: [...]int32{256, 256, 256}, imul: [...]int32{256, 256, 256, 256, 256, 256},
+		contrast: 1, gamma: 1, icontrast: [...]float32{1, 1}, igamma: [...]float32{1, 1}}
 	pf.negType = nt
 	for i := 0; i < len(pf.sintime); i++ {
 		pf.sintime[i] = 0
@@ -76,9 +152,28 @@ func (pf *PalFX) clear2(nt bool) {
 func (pf *PalFX) clear() {
 	pf.clear2(false)
 }
-func (pf *PalFX) getSynFx(blending int) *PalFX {
+
+// Combines pf with the global layers that apply to it: the PalFX of the given
+// team side (0 or 1, -1 for none) and then sys.allPalFX.
+func (pf *PalFX) getSynFx(blending int, team int) *PalFX {
+	var tfx *PalFX
+	if team >= 0 && team < len(sys.teamPalFX) && sys.teamPalFX[team].enable {
+		tfx = &sys.teamPalFX[team]
+		// Team layers are set from Lua, which also takes the BGPalFX only
+		// mode; treat it as an omitted invertblend like on the other layers
+		if tfx.invertblend < InvertBlendMugen11 {
+			t := *tfx
+			t.invertblend = InvertBlendMugen11
+			if t.eInvertblend != InvertBlendInverted {
+				t.eInvertblend = InvertBlendMugen11
+			}
+			tfx = &t
+		}
+	}
 	if pf == nil || !pf.enable {
-		if blending == -2 && sys.allPalFX.enable {
+		if tfx != nil {
+			pf, tfx = tfx, nil
+		} else if blending == -2 && sys.allPalFX.enable {
 			if pf == nil {
 				pf = newPalFX()
 			}
@@ -88,38 +183,109 @@ func (pf *PalFX) getSynFx(blending int) *PalFX {
 			pf.eAdd = pf.add
 			pf.eColor = pf.color
 			pf.eHue = pf.hue
+			pf.eContrast = pf.contrast
+			pf.eGamma = pf.gamma
+			pf.ePosterize = pf.posterize
 		} else {
 			return &sys.allPalFX
 		}
 	}
-	if !sys.allPalFX.enable {
+	if !sys.allPalFX.enable && tfx == nil {
 		return pf
 	}
 	synth := *pf
-	synth.synthesize(sys.allPalFX, blending)
+	if tfx != nil {
+		synth.synthesize(*tfx, blending)
+	}
+	if sys.allPalFX.enable {
+		synth.synthesize(sys.allPalFX, blending)
+	}
 	return &synth
 }
-func (pf *PalFX) getFxPal(pal []uint32, neg bool) []uint32 {
-	p := pf.getSynFx(0)
-	if !p.enable {
-		return pal
-	}
-	if !p.eNegType {
-		neg = false
+
+// Hue is held in degrees. The hue parameter of state controllers, Lua and
+// layout files keeps the MUGEN style scale where 256 is half a turn, which
+// palFXHueUnit converts from; huedeg takes degrees as they are.
+const palFXHueUnit = 180.0 / 256
+
+// Wraps a hue shift in degrees into the -360..360 range.
+func wrapHue(deg float32) float32 {
+	return float32(math.Mod(float64(deg), 360))
+}
+
+// Rotates the hue of a straight 0..1 color by rad radians. Matches hue_shift
+// in the shaders.
+func hueShift(c [3]float32, rad float32) [3]float32 {
+	s, co := float32(math.Sin(float64(rad))), float32(math.Cos(float64(rad)))
+	cols := [3][3]float32{
+		{0.167444, 0.329213, -0.496657},
+		{-0.327948, 0.035669, 0.292279},
+		{1.250268, -1.047561, -0.202707},
+	}
+	lum := 0.299*c[0] + 0.587*c[1] + 0.114*c[2]
+	var h [3]float32
+	for j := range h {
+		h[j] = c[j]*co + s*(c[0]*cols[j][0]+c[1]*cols[j][1]+c[2]*cols[j][2]) + lum*(1-co)
+	}
+	return h
+}
+
+// Returns the first and last palette index the effect applies to. An end
+// index of 0 or less leaves the whole palette affected.
+func palRangeBounds(r [2]int32) [2]float32 {
+	if r[1] <= 0 {
+		return [...]float32{0, 255}
 	}
-	var m [3]int32
-	if neg {
+	return [...]float32{float32(r[0]), float32(r[1])}
+}
+
+// EffectiveFX holds the values the palette transform works from, with no
+// references to the PalFX or global state they came from.
+type EffectiveFX struct {
+	neg       bool
+	invertall bool
+	add       [3]int32
+	mul       [3]int32
+	color     float32
+	hue       float32
+	contrast  float32
+	gamma     float32
+	posterize int32
+	palrange  [2]int32
+}
+
+// Collects the current effective values of p. neg only takes effect if the
+// PalFX is of the negating type.
+func (p *PalFX) effectiveFX(neg bool) EffectiveFX {
+	return EffectiveFX{neg: neg && p.eNegType, invertall: p.eInvertall,
+		add: p.eAdd, mul: p.eMul, color: p.eColor, hue: p.eHue, contrast: p.eContrast,
+		gamma: p.eGamma, posterize: p.ePosterize, palrange: p.palrange}
+}
+
+// Runs the palette transform with the effective values of pf as they are,
+// without merging in the team layers or sys.allPalFX.
+func (p *PalFX) applyFxPal(dst, pal []uint32, neg bool) []uint32 {
+	return applyPalFX(p.effectiveFX(neg), pal, dst)
+}
+
+// Transforms each color of src into dst and returns it. dst is reallocated
+// if it is shorter than src; it must not overlap src. Unlike the shader path,
+// a negating trans type inverts add here as well as averaging mul, as MUGEN
+// does for palettes.
+func applyPalFX(fx EffectiveFX, src, dst []uint32) []uint32 {
+	if len(dst) < len(src) {
+		dst = make([]uint32, len(src))
+	}
+	dst = dst[:len(src)]
+	a, m := fx.add, fx.mul
+	if fx.neg {
 		for i := range m {
-			m[i] = (p.eMul[(i+1)%3] + p.eMul[(i+2)%3]) >> 1
+			a[i] = -fx.add[i]
+			m[i] = (fx.mul[(i+1)%3] + fx.mul[(i+2)%3]) >> 1
 		}
-	} else {
-		m = p.eMul
 	}
-	a, sub := p.eAdd, uint32(0)
+	sub := uint32(0)
 	for i := range a {
-		if neg {
-			a[i] *= -1
-		}
 		su := uint32(0)
 		if a[i] < 0 {
 			su = uint32(-Max(-255, a[i]))
@@ -129,15 +295,29 @@ func (pf *PalFX) getFxPal(pal []uint32, neg bool) []uint32 {
 		a[i] = Min(255*256*256/Max(1, m[i]), a[i])
 		sub |= su << uint(i*8)
 	}
-	for i, c := range pal {
+	r := palRangeBounds(fx.palrange)
+	for i, c := range src {
+		if float32(i) < r[0] || float32(i) > r[1] {
+			dst[i] = c
+			continue
+		}
 		alpha := c & 0xff000000
-		if p.eInvertall {
+		if fx.hue != 0 {
+			// Same direction as the shader path, which gets the negated angle
+			h := hueShift([...]float32{float32(c&0xff) / 255, float32(c>>8&0xff) / 255,
+				float32(c>>16&0xff) / 255}, -fx.hue*math.Pi/180)
+			c = alpha
+			for j := range h {
+				c |= uint32(ClampF(h[j], 0, 1)*255+0.5) << uint(j*8)
+			}
+		}
+		if fx.invertall {
 			c = ^c
 		}
 		ac := float32(c&0xff+c>>8&0xff+c>>16&0xff) / 3
-		c = uint32(float32(c&0xff)+(ac-float32(c&0xff))*(1-p.eColor)) |
-			uint32(float32(c>>8&0xff)+(ac-float32(c>>8&0xff))*(1-p.eColor))<<8 |
-			uint32(float32(c>>16&0xff)+(ac-float32(c>>16&0xff))*(1-p.eColor))<<16
+		c = uint32(float32(c&0xff)+(ac-float32(c&0xff))*(1-fx.color)) |
+			uint32(float32(c>>8&0xff)+(ac-float32(c>>8&0xff))*(1-fx.color))<<8 |
+			uint32(float32(c>>16&0xff)+(ac-float32(c>>16&0xff))*(1-fx.color))<<16
 		tmp := ((^c&sub)<<1 + (^c^sub)&0xfefefefe) & 0x01010100
 		c = (c - sub + tmp) & ^(tmp - tmp>>8)
 		tmp = (c&0xff + uint32(a[0])) * uint32(m[0]) >> 8
@@ -145,17 +325,55 @@ func (pf *PalFX) getFxPal(pal []uint32, neg bool) []uint32 {
 			(((c>>8&0xff)+uint32(a[1]))*uint32(m[1])>>8)<<8
 		tmp = (tmp|uint32(-Btoi(tmp&0xff0000 != 0)<<8))&0xffff |
 			(((c>>16&0xff)+uint32(a[2]))*uint32(m[2])>>8)<<16
-		sys.workpal[i] = tmp | uint32(-Btoi(tmp&0xff000000 != 0)<<16) |
-			alpha
+		c = tmp | uint32(-Btoi(tmp&0xff000000 != 0)<<16)
+		if fx.contrast != 1 || fx.gamma != 1 {
+			c = contrastGamma(c&0xffffff, fx.contrast, fx.gamma)
+		}
+		if fx.posterize > 1 {
+			c = posterize(c&0xffffff, fx.posterize)
+		}
+		dst[i] = c | alpha
+	}
+	return dst
+}
+
+// contrastGamma applies contrast (pivoting at 0.5) followed by gamma to each
+// channel of a 0xBBGGRR color. Matches the contrast/gamma stage of the shaders.
+func contrastGamma(c uint32, contrast, gamma float32) uint32 {
+	g := 1 / MaxF(gamma, 1.0/256)
+	var out uint32
+	for i := 0; i < 3; i++ {
+		v := float32(c>>uint(i*8)&0xff) / 255
+		v = ClampF((v-0.5)*contrast+0.5, 0, 1)
+		v = Pow(v, g)
+		out |= uint32(v*255+0.5) << uint(i*8)
 	}
-	return sys.workpal
+	return out
 }
-func (pf *PalFX) getFcPalFx(transNeg bool, blending int) (neg bool, grayscale float32,
-	add, mul [3]float32, invblend int32, hue float32) {
-	p := pf.getSynFx(blending)
+
+// posterize quantizes each channel of a 0xBBGGRR color to the given number of
+// evenly spaced levels.
+func posterize(c uint32, levels int32) uint32 {
+	n := uint32(levels - 1)
+	var out uint32
+	for i := 0; i < 3; i++ {
+		v := c >> uint(i*8) & 0xff
+		v = (v*n + 127) / 255 * 255 / n
+		out |= v << uint(i*8)
+	}
+	return out
+}
+
+// Returns the shader parameters for the effect. palrange only restricts
+// indexed sprites; 32-bit sprites have no palette and are always affected.
+func (pf *PalFX) getFcPalFx(transNeg bool, blending int, team int) (neg bool, grayscale float32,
+	add, mul [3]float32, invblend int32, hue float32, contrast, gamma, levels float32, palrange [2]float32) {
+	p := pf.getSynFx(blending, team)
 	if !p.enable {
 		neg = false
 		grayscale = 0
+		contrast, gamma = 1, 1
+		palrange = palRangeBounds([2]int32{})
 		for i := range add {
 			add[i] = 0
 		}
@@ -166,8 +384,13 @@ func (pf *PalFX) getFcPalFx(transNeg bool, blending int) (neg bool, grayscale fl
 	}
 	neg = p.eInvertall
 	grayscale = 1 - p.eColor
-	invblend = p.eInvertblend
-	hue = -(p.eHue * 180.0) * (math.Pi / 180.0)
+	invblend = int32(p.eInvertblend)
+	hue = -p.eHue * (math.Pi / 180.0)
+	contrast, gamma = p.eContrast, p.eGamma
+	palrange = palRangeBounds(p.palrange)
+	if p.ePosterize > 1 {
+		levels = float32(p.ePosterize)
+	}
 	if !p.eNegType {
 		transNeg = false
 	}
@@ -184,7 +407,7 @@ func (pf *PalFX) getFcPalFx(transNeg bool, blending int) (neg bool, grayscale fl
 }
 func (pf *PalFX) sinAdd(color *[3]int32) {
 	if pf.cycletime[0] > 1 {
-		st := 2 * math.Pi * float64(pf.sintime[0])
+		st := 2 * math.Pi * float64(pf.sintime[0]+pf.sinphase[0])
 		if pf.cycletime[0] == 2 {
 			st += math.Pi / 2
 		}
@@ -196,7 +419,7 @@ func (pf *PalFX) sinAdd(color *[3]int32) {
 }
 func (pf *PalFX) sinMul(color *[3]int32) {
 	if pf.cycletime[1] > 1 {
-		st := 2 * math.Pi * float64(pf.sintime[1])
+		st := 2 * math.Pi * float64(pf.sintime[1]+pf.sinphase[1])
 		if pf.cycletime[1] == 2 {
 			st += math.Pi / 2
 		}
@@ -208,7 +431,7 @@ func (pf *PalFX) sinMul(color *[3]int32) {
 }
 func (pf *PalFX) sinColor(color *float32) {
 	if pf.cycletime[2] > 1 {
-		st := 2 * math.Pi * float64(pf.sintime[2])
+		st := 2 * math.Pi * float64(pf.sintime[2]+pf.sinphase[2])
 		if pf.cycletime[2] == 2 {
 			st += math.Pi / 2.0
 		}
@@ -220,13 +443,13 @@ func (pf *PalFX) sinColor(color *float32) {
 }
 func (pf *PalFX) sinHueshift(color *float32) {
 	if pf.cycletime[3] > 1 {
-		st := 2 * math.Pi * float64(pf.sintime[3])
+		st := 2 * math.Pi * float64(pf.sintime[3]+pf.sinphase[3])
 		if pf.cycletime[3] == 2 {
 			st += math.Pi / 2.0
 		}
 		sin := math.Sin(st / float64(pf.cycletime[3]))
 
-		(*color) += float32(sin * (float64(pf.sinhue) / 256.0))
+		(*color) += float32(sin * float64(pf.sinhue) * palFXHueUnit)
 
 	}
 }
@@ -245,6 +468,10 @@ func (pf *PalFX) interpolationUpdate() {
 	pf.eColor = pf.eiColor * pf.color
 	pf.eiHue = Lerp(pf.ihue[1], pf.ihue[0], t)
 	pf.eHue = pf.eiHue + pf.hue
+	pf.eiContrast = Lerp(pf.icontrast[1], pf.icontrast[0], t)
+	pf.eContrast = pf.eiContrast * pf.contrast
+	pf.eiGamma = Lerp(pf.igamma[1], pf.igamma[0], t)
+	pf.eGamma = pf.eiGamma * pf.gamma
 }
 func (pf *PalFX) step() {
 	pf.enable = pf.time != 0
@@ -257,10 +484,13 @@ func (pf *PalFX) step() {
 			pf.eAdd = pf.add
 			pf.eColor = pf.color
 			pf.eHue = pf.hue
+			pf.eContrast = pf.contrast
+			pf.eGamma = pf.gamma
 		}
+		pf.ePosterize = pf.posterize
 		pf.eInvertall = pf.invertall
-		if pf.invertblend <= -2 && pf.eInvertall {
-			pf.eInvertblend = 3
+		if pf.invertblend <= InvertBlendMugen11 && pf.eInvertall {
+			pf.eInvertblend = InvertBlendInverted
 		} else {
 			pf.eInvertblend = pf.invertblend
 		}
@@ -269,10 +499,11 @@ func (pf *PalFX) step() {
 		pf.sinMul(&pf.eMul)
 		pf.sinColor(&pf.eColor)
 		pf.sinHueshift(&pf.eHue)
-		if sys.tickFrame() {
+		pf.eHue = wrapHue(pf.eHue)
+		if sys.tickFrame() && !pf.paused() {
 			for i := 0; i < 4; i++ {
 				if pf.cycletime[i] > 0 {
-					pf.sintime[i] = (pf.sintime[i] + 1) % pf.cycletime[i]
+					pf.sintime[i] = float32(math.Mod(float64(pf.sintime[i]+1), float64(pf.cycletime[i])))
 				}
 			}
 			if pf.time > 0 {
@@ -281,6 +512,15 @@ func (pf *PalFX) step() {
 		}
 	}
 }
+func (pf *PalFX) paused() bool {
+	switch pf.pausemode {
+	case PalFXPauseFreeze:
+		return sys.super > 0 || sys.pause > 0
+	case PalFXPauseSuper:
+		return sys.pause > 0 && sys.super <= 0
+	}
+	return false
+}
 func (pf *PalFX) synthesize(pfx PalFX, blending int) {
 	if blending == -2 {
 		for i, a := range pfx.eAdd {
@@ -296,48 +536,31 @@ func (pf *PalFX) synthesize(pfx PalFX, blending int) {
 		pf.eMul[i] = pf.eMul[i] * m / 256
 	}
 
-	pf.eHue += pfx.eHue
+	pf.eHue = wrapHue(pf.eHue + pfx.eHue)
 	pf.eColor *= pfx.eColor
+	pf.eContrast *= pfx.eContrast
+	pf.eGamma *= pfx.eGamma
+	// The coarser of the two quantizations wins
+	if pfx.ePosterize > 1 && (pf.ePosterize <= 1 || pfx.ePosterize < pf.ePosterize) {
+		pf.ePosterize = pfx.ePosterize
+	}
 	pf.eInvertall = pf.eInvertall != pfx.eInvertall
 
 	if pfx.invertall {
-		// Char blend inverse
-		if pfx.invertblend == 1 {
-			if blending != 0 && pf.invertblend > -3 {
+		if r, ok := invertBlendRules[[2]InvertBlend{pf.invertblend, pfx.invertblend}]; ok {
+			if r.ownInvertall == ibOwnAlways || r.ownInvertall == ibOwnWhenBlending && blending != 0 {
 				pf.eInvertall = pf.invertall
 			}
-			switch {
-			case pf.invertblend == 0:
-				pf.eInvertblend = 1
-			case pf.invertblend == 1:
-				pf.eInvertblend = 0
-			case pf.invertblend == -2:
-				if pf.eInvertall {
+			if pf.eInvertall {
+				pf.eInvertblend = r.inverted
+				if r.clearInvertall {
 					pf.eInvertall = false
-					pf.eInvertblend = -2
-				} else {
-					pf.eInvertblend = 3
 				}
-			case pf.invertblend == 2:
-				pf.eInvertall = pf.invertall
-				pf.eInvertblend = -1
-			case pf.invertblend == -1:
-				pf.eInvertall = pf.invertall
-				pf.eInvertblend = 2
-			}
-		}
-
-		// Bg blend inverse
-		if pf.invertblend == -3 {
-			if pf.eInvertall {
-				pf.eInvertblend = 3
 			} else {
-				pf.eInvertall = false
-				pf.eInvertblend = -3
+				pf.eInvertblend = r.normal
 			}
 		}
 	}
-
 }
 
 func (pf *PalFX) setColor(r, g, b int32) {
@@ -348,6 +571,9 @@ func (pf *PalFX) setColor(r, g, b int32) {
 	pf.enable = true
 	pf.eColor = 1
 	pf.eHue = 0
+	pf.eContrast = 1
+	pf.eGamma = 1
+	pf.ePosterize = 0
 	pf.eMul = [...]int32{
 		256 * rNormalized >> 8,
 		256 * gNormalized >> 8,
@@ -355,6 +581,209 @@ func (pf *PalFX) setColor(r, g, b int32) {
 	}
 }
 
+// Tint helpers write the definition rather than the effective fields, so the
+// tint is kept by step() for as long as it is not cleared.
+func (pf *PalFX) beginTint() {
+	if pf.time == 0 {
+		pf.clear()
+		pf.time = -1
+	}
+}
+func (pf *PalFX) endTint() {
+	pf.enable = true
+	pf.eAdd = pf.add
+	pf.eMul = pf.mul
+	pf.eColor = pf.color
+	pf.eHue = pf.hue
+	pf.eContrast = pf.contrast
+	pf.eGamma = pf.gamma
+	pf.ePosterize = pf.posterize
+}
+func (pf *PalFX) setColorAdd(r, g, b int32) {
+	pf.beginTint()
+	pf.add = [...]int32{Clamp(r, -255, 255), Clamp(g, -255, 255), Clamp(b, -255, 255)}
+	pf.endTint()
+}
+func (pf *PalFX) setColorMul(r, g, b int32) {
+	pf.beginTint()
+	pf.mul = [...]int32{
+		256 * Clamp(r, 0, 255) >> 8,
+		256 * Clamp(g, 0, 255) >> 8,
+		256 * Clamp(b, 0, 255) >> 8,
+	}
+	pf.endTint()
+}
+func (pf *PalFX) setTint(add, mul [3]int32) {
+	pf.setColorAdd(add[0], add[1], add[2])
+	pf.setColorMul(mul[0], mul[1], mul[2])
+}
+func (pf *PalFX) clearTint() {
+	pf.clear()
+	pf.enable = false
+}
+
+// MarshalText writes the definition as .def style "key = value" lines.
+// Color, contrast and gamma use the same 256 based units as the state
+// controller parameters; hue is written in degrees.
+func (pfd *PalFXDef) MarshalText() ([]byte, error) {
+	var b strings.Builder
+	i32 := func(key string, v ...int32) {
+		s := make([]string, len(v))
+		for i := range v {
+			s[i] = strconv.Itoa(int(v[i]))
+		}
+		fmt.Fprintf(&b, "%s = %s\n", key, strings.Join(s, ", "))
+	}
+	f32raw := func(key string, v ...float32) {
+		s := make([]string, len(v))
+		for i := range v {
+			s[i] = strconv.FormatFloat(float64(v[i]), 'f', -1, 32)
+		}
+		fmt.Fprintf(&b, "%s = %s\n", key, strings.Join(s, ", "))
+	}
+	f32 := func(key string, v ...float32) {
+		s := make([]float32, len(v))
+		for i := range v {
+			s[i] = v[i] * 256
+		}
+		f32raw(key, s...)
+	}
+	i32("time", pfd.time)
+	i32("add", pfd.add[:]...)
+	i32("mul", pfd.mul[:]...)
+	i32("sinadd", pfd.sinadd[:]...)
+	i32("sinmul", pfd.sinmul[:]...)
+	i32("sincolor", pfd.sincolor)
+	i32("sinhue", pfd.sinhue)
+	f32raw("cycletime", pfd.cycletime[:]...)
+	f32raw("sinphase", pfd.sinphase[:]...)
+	i32("invertall", Btoi(pfd.invertall))
+	i32("invertblend", int32(pfd.invertblend))
+	f32("color", pfd.color)
+	f32raw("hue", pfd.hue)
+	f32("contrast", pfd.contrast)
+	f32("gamma", pfd.gamma)
+	i32("posterize", pfd.posterize)
+	i32("pausemode", int32(pfd.pausemode))
+	i32("palrange", pfd.palrange[:]...)
+	i32("interpolate", Btoi(pfd.interpolate))
+	i32("interpolate.add", pfd.iadd[:]...)
+	i32("interpolate.mul", pfd.imul[:]...)
+	f32("interpolate.color", pfd.icolor[:]...)
+	f32raw("interpolate.hue", pfd.ihue[:]...)
+	f32("interpolate.contrast", pfd.icontrast[:]...)
+	f32("interpolate.gamma", pfd.igamma[:]...)
+	i32("interpolate.time", pfd.itime)
+	return []byte(b.String()), nil
+}
+
+// UnmarshalText parses the output of MarshalText. Keys that are not present
+// keep the neutral defaults.
+func (pfd *PalFXDef) UnmarshalText(text []byte) error {
+	lines, i := SplitAndTrim(string(text), "\n"), 0
+	is := NewIniSection()
+	is.Parse(lines, &i)
+	pfd.read(is)
+	return nil
+}
+func (pfd *PalFXDef) read(is IniSection) {
+	var pf PalFX
+	pf.clear()
+	*pfd = pf.PalFXDef
+	f32 := func(key string, out ...*float32) {
+		tmp, ptr := make([]float32, len(out)), make([]*float32, len(out))
+		for i := range out {
+			tmp[i], ptr[i] = *out[i]*256, &tmp[i]
+		}
+		if is.ReadF32(key, ptr...) {
+			for i := range out {
+				*out[i] = tmp[i] / 256
+			}
+		}
+	}
+	is.ReadI32("time", &pfd.time)
+	is.ReadI32("add", &pfd.add[0], &pfd.add[1], &pfd.add[2])
+	is.ReadI32("mul", &pfd.mul[0], &pfd.mul[1], &pfd.mul[2])
+	is.ReadI32("sinadd", &pfd.sinadd[0], &pfd.sinadd[1], &pfd.sinadd[2])
+	is.ReadI32("sinmul", &pfd.sinmul[0], &pfd.sinmul[1], &pfd.sinmul[2])
+	is.ReadI32("sincolor", &pfd.sincolor)
+	is.ReadI32("sinhue", &pfd.sinhue)
+	is.ReadF32("cycletime", &pfd.cycletime[0], &pfd.cycletime[1],
+		&pfd.cycletime[2], &pfd.cycletime[3])
+	is.ReadF32("sinphase", &pfd.sinphase[0], &pfd.sinphase[1],
+		&pfd.sinphase[2], &pfd.sinphase[3])
+	is.ReadBool("invertall", &pfd.invertall)
+	var n int32
+	if is.ReadI32("invertblend", &n) {
+		pfd.invertblend = clampInvertBlend(n, InvertBlendBg, InvertBlendSubAdd1)
+	}
+	f32("color", &pfd.color)
+	is.ReadF32("hue", &pfd.hue)
+	f32("contrast", &pfd.contrast)
+	f32("gamma", &pfd.gamma)
+	if is.ReadI32("posterize", &n) {
+		if n > 0 {
+			pfd.posterize = Clamp(n, 2, 256)
+		} else {
+			pfd.posterize = 0
+		}
+	}
+	if is.ReadI32("pausemode", &n) {
+		pfd.pausemode = PalFXPauseMode(Clamp(n, int32(PalFXPauseRun), int32(PalFXPauseSuper)))
+	}
+	if is.ReadI32("palrange", &pfd.palrange[0], &pfd.palrange[1]) {
+		pfd.palrange[0] = Clamp(pfd.palrange[0], 0, 255)
+		pfd.palrange[1] = Clamp(pfd.palrange[1], 0, 255)
+	}
+	is.ReadBool("interpolate", &pfd.interpolate)
+	is.ReadI32("interpolate.add", &pfd.iadd[0], &pfd.iadd[1], &pfd.iadd[2],
+		&pfd.iadd[3], &pfd.iadd[4], &pfd.iadd[5])
+	is.ReadI32("interpolate.mul", &pfd.imul[0], &pfd.imul[1], &pfd.imul[2],
+		&pfd.imul[3], &pfd.imul[4], &pfd.imul[5])
+	f32("interpolate.color", &pfd.icolor[0], &pfd.icolor[1])
+	is.ReadF32("interpolate.hue", &pfd.ihue[0], &pfd.ihue[1])
+	f32("interpolate.contrast", &pfd.icontrast[0], &pfd.icontrast[1])
+	f32("interpolate.gamma", &pfd.igamma[0], &pfd.igamma[1])
+	is.ReadI32("interpolate.time", &pfd.itime)
+}
+
+// Loads every [PalFX <name>] section of a file into the preset registry.
+// Preset names are case insensitive and later definitions replace earlier ones.
+func loadPalFXPresets(filename string) error {
+	str, err := LoadText(filename)
+	if err != nil {
+		return err
+	}
+	if sys.palfxPresets == nil {
+		sys.palfxPresets = make(map[string]PalFXDef)
+	}
+	lines, i := SplitAndTrim(str, "\n"), 0
+	for i < len(lines) {
+		is, name, subname := ReadIniSection(lines, &i)
+		if name != "palfx " || len(subname) == 0 {
+			continue
+		}
+		var pfd PalFXDef
+		pfd.read(is)
+		sys.palfxPresets[strings.ToLower(strings.TrimSpace(subname))] = pfd
+	}
+	return nil
+}
+
+// Replaces the definition with a registered preset and restarts the sine
+// cycles. Returns false if no preset with that name has been loaded.
+func (pf *PalFX) ApplyPreset(name string) bool {
+	pfd, ok := sys.palfxPresets[strings.ToLower(name)]
+	if !ok {
+		return false
+	}
+	pf.PalFXDef = pfd
+	for i := range pf.sintime {
+		pf.sintime[i] = 0
+	}
+	return true
+}
+
 type PaletteList struct {
 	palettes   [][]uint32
 	paletteMap []int
@@ -1161,7 +1590,7 @@ func (s *Sprite) Draw(x, y, xscale, yscale, angle float32, fx *PalFX, window *[4
 		s.Tex, s.PalTex, s.Size,
 		-x * sys.widthScale, -y * sys.heightScale, notiling,
 		xscale * sys.widthScale, xscale * sys.widthScale, yscale * sys.heightScale, 1, 0, 1, 1,
-		Rotation{angle, 0, 0}, 0, sys.brightness*255>>8 | 1<<9, 0, fx, window, 0, 0, 0, 0,
+		Rotation{angle, 0, 0}, 0, sys.brightness*255>>8 | 1<<9, 0, fx, -1, window, 0, 0, 0, 0,
 		-xscale * float32(s.Offset[0]), -yscale * float32(s.Offset[1]),
 	}
 	RenderSprite(rp)
@@ -0,0 +1,594 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestPalFXSynthesizePosterize(t *testing.T) {
+	tests := []struct {
+		own, global, want int32
+	}{
+		{0, 0, 0},
+		{0, 16, 16},
+		{8, 0, 8},
+		{8, 4, 4},
+		{4, 8, 4},
+		{8, 1, 8},
+	}
+	for _, tt := range tests {
+		var pf, global PalFX
+		pf.ePosterize, global.ePosterize = tt.own, tt.global
+		pf.synthesize(global, 0)
+		if pf.ePosterize != tt.want {
+			t.Errorf("own %v, global %v: got %v, want %v", tt.own, tt.global, pf.ePosterize, tt.want)
+		}
+	}
+}
+
+// Expected values are worked out by hand from the 8-bit pipeline, so they pin
+// the bit tricks rather than restate them.
+func TestApplyPalFX(t *testing.T) {
+	neutral := EffectiveFX{mul: [...]int32{256, 256, 256}, color: 1, contrast: 1, gamma: 1}
+	tests := []struct {
+		name string
+		edit func(*EffectiveFX)
+		src  []uint32
+		want []uint32
+	}{
+		{"neutral", func(*EffectiveFX) {},
+			[]uint32{0xff102030, 0x00ffffff}, []uint32{0xff102030, 0x00ffffff}},
+		{"invertall", func(fx *EffectiveFX) { fx.invertall = true },
+			[]uint32{0xff102030, 0x000000ff}, []uint32{0xffefdfcf, 0x00ffff00}},
+		{"negative add", func(fx *EffectiveFX) { fx.add = [...]int32{-16, -64, 0} },
+			[]uint32{0x402008, 0x80ff30}, []uint32{0x400000, 0x80bf20}},
+		{"add below -255", func(fx *EffectiveFX) { fx.add = [...]int32{-300, 0, 0} },
+			[]uint32{0x0000ff}, []uint32{0x000000}},
+		{"grayscale", func(fx *EffectiveFX) { fx.color = 0 },
+			[]uint32{0x0000ff, 0x303030}, []uint32{0x555555, 0x303030}},
+		{"half grayscale", func(fx *EffectiveFX) { fx.color = 0.5 },
+			[]uint32{0x0000ff}, []uint32{0x2a2aaa}},
+		{"mul saturation", func(fx *EffectiveFX) { fx.mul = [...]int32{512, 256, 384} },
+			[]uint32{0x808080, 0x101010}, []uint32{0xc080ff, 0x181020}},
+		{"add then mul saturation", func(fx *EffectiveFX) {
+			fx.add = [...]int32{200, 0, 0}
+			fx.mul = [...]int32{512, 256, 256}
+		}, []uint32{0x000001}, []uint32{0x0000ff}},
+		{"negating trans type", func(fx *EffectiveFX) {
+			fx.neg = true
+			fx.add = [...]int32{16, 0, 0}
+			fx.mul = [...]int32{256, 512, 0}
+		}, []uint32{0x404040}, []uint32{0x602030}},
+		{"palrange", func(fx *EffectiveFX) {
+			fx.add = [...]int32{16, 16, 16}
+			fx.palrange = [...]int32{1, 1}
+		}, []uint32{0x101010, 0x101010, 0x101010}, []uint32{0x101010, 0x202020, 0x101010}},
+		{"posterize", func(fx *EffectiveFX) { fx.posterize = 2 },
+			[]uint32{0x7f80ff}, []uint32{0x00ffff}},
+	}
+	for _, tt := range tests {
+		fx := neutral
+		tt.edit(&fx)
+		got := applyPalFX(fx, tt.src, nil)
+		for i := range tt.want {
+			if got[i] != tt.want[i] {
+				t.Errorf("%v: %08x -> %08x, want %08x", tt.name, tt.src[i], got[i], tt.want[i])
+			}
+		}
+	}
+}
+
+// Runs the palette transform of pf merged with the global effects, as the
+// renderer gets them, writing into dst.
+func synFxPal(pf *PalFX, dst, pal []uint32) []uint32 {
+	p := pf.getSynFx(0, -1)
+	if !p.enable {
+		return pal
+	}
+	return p.applyFxPal(dst, pal, false)
+}
+
+// Each transform writes to the buffer it is given, so results held by a
+// caller survive other calls, including ones on other goroutines.
+func TestApplyFxPalNoAlias(t *testing.T) {
+	pal := make([]uint32, 256)
+	for i := range pal {
+		pal[i] = uint32(i) * 0x010101
+	}
+	fx := func(add [3]int32) *PalFX {
+		pf := newPalFX()
+		pf.clear()
+		pf.add, pf.time = add, -1
+		pf.step()
+		return pf
+	}
+	red, blue := fx([...]int32{32, 0, 0}), fx([...]int32{0, 0, 32})
+	r := synFxPal(red, nil, pal)
+	b := synFxPal(blue, nil, pal)
+	if &r[0] == &b[0] || r[0] != 0x000020 || b[0] != 0x200000 {
+		t.Fatalf("interleaved results %06x and %06x", r[0], b[0])
+	}
+	var wg sync.WaitGroup
+	errs := make(chan string, 8)
+	for g := 0; g < 8; g++ {
+		pf, want := red, uint32(0x000020)
+		if g%2 == 1 {
+			pf, want = blue, 0x200000
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			dst := make([]uint32, len(pal))
+			for n := 0; n < 200; n++ {
+				if c := synFxPal(pf, dst, pal)[0]; c != want {
+					errs <- fmt.Sprintf("got %06x, want %06x", c, want)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for e := range errs {
+		t.Error(e)
+	}
+}
+
+func BenchmarkApplyFxPal(b *testing.B) {
+	pal := make([]uint32, 256)
+	for i := range pal {
+		pal[i] = uint32(i) * 0x010101
+	}
+	pf := newPalFX()
+	pf.clear()
+	pf.add, pf.mul, pf.color, pf.time = [...]int32{16, -16, 0}, [...]int32{256, 300, 200}, 0.5, -1
+	pf.step()
+	dst := make([]uint32, len(pal))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		dst = synFxPal(pf, dst, pal)
+	}
+}
+
+// The tint helpers set the definition, so the tint outlives step() until it
+// is cleared. Add applies before mul, as in the palette transform.
+func TestPalFXTint(t *testing.T) {
+	white := []uint32{0xffffffff}
+	pf := newPalFX()
+	pf.setTint([...]int32{-64, 0, 32}, [...]int32{128, 255, 64})
+	for i := 0; i < 3; i++ {
+		// (255-64)*128>>8, 255*255>>8, (255+32)*64>>8
+		if c := synFxPal(pf, nil, white)[0]; c != 0xff47fe5f {
+			t.Errorf("step %v: white tinted to %08x, want ff47fe5f", i, c)
+		}
+		pf.step()
+	}
+	// Either helper keeps what the other set
+	pf.setColorAdd(0, 0, 0)
+	if pf.mul != [...]int32{128, 255, 64} {
+		t.Errorf("mul %v after setting add", pf.mul)
+	}
+	pf.clearTint()
+	pf.step()
+	if c := synFxPal(pf, nil, white)[0]; c != 0xffffffff {
+		t.Errorf("white cleared to %08x", c)
+	}
+	ts := NewTextSprite()
+	ts.SetColor(128, 255, 64)
+	ts.palfx.step()
+	if c := synFxPal(ts.palfx, nil, white)[0]; c != 0xff3ffe7f {
+		t.Errorf("text color %08x after a step, want ff3ffe7f", c)
+	}
+}
+
+func TestPalFXPauseMode(t *testing.T) {
+	defer func(pause, super int32, paused bool, tick, oldTick int) {
+		sys.pause, sys.super, sys.paused, sys.tickCount, sys.oldTickCount = pause, super, paused, tick, oldTick
+	}(sys.pause, sys.super, sys.paused, sys.tickCount, sys.oldTickCount)
+	sys.paused, sys.tickCount, sys.oldTickCount = false, 1, 0
+	for _, tc := range []struct {
+		name         string
+		mode         PalFXPauseMode
+		pause, super int32
+		runs         bool
+	}{
+		{"run", PalFXPauseRun, 0, 0, true},
+		{"run, pause", PalFXPauseRun, 10, 0, true},
+		{"run, superpause", PalFXPauseRun, 0, 10, true},
+		{"freeze", PalFXPauseFreeze, 0, 0, true},
+		{"freeze, pause", PalFXPauseFreeze, 10, 0, false},
+		{"freeze, superpause", PalFXPauseFreeze, 0, 10, false},
+		{"super", PalFXPauseSuper, 0, 0, true},
+		{"super, pause", PalFXPauseSuper, 10, 0, false},
+		{"super, superpause", PalFXPauseSuper, 0, 10, true},
+		{"super, both", PalFXPauseSuper, 10, 10, true},
+	} {
+		sys.pause, sys.super = tc.pause, tc.super
+		pf := newPalFX()
+		pf.clear()
+		pf.time, pf.cycletime[0], pf.pausemode = 10, 40, tc.mode
+		for i := 0; i < 3; i++ {
+			pf.step()
+		}
+		wantTime, wantSin := int32(10), float32(0)
+		if tc.runs {
+			wantTime, wantSin = 7, 3
+		}
+		if pf.time != wantTime || pf.sintime[0] != wantSin {
+			t.Errorf("%v: time %v, sintime %v, want %v, %v", tc.name, pf.time, pf.sintime[0], wantTime, wantSin)
+		}
+	}
+	// Layouts read the mode, clamped to the known ones
+	for _, tc := range []struct {
+		value string
+		want  PalFXPauseMode
+	}{
+		{"1", PalFXPauseFreeze},
+		{"2", PalFXPauseSuper},
+		{"9", PalFXPauseSuper},
+		{"-1", PalFXPauseRun},
+	} {
+		al := &AnimLayout{palfx: newPalFX()}
+		is := NewIniSection()
+		is["palfx.pausemode"] = tc.value
+		al.ReadAnimPalfx("palfx.", is)
+		if al.palfx.pausemode != tc.want {
+			t.Errorf("pausemode = %v read as %v, want %v", tc.value, al.palfx.pausemode, tc.want)
+		}
+	}
+}
+
+// A phase of half the cycle time, given after the cycle time, negates every
+// sine modulator. The old forms without a phase keep starting at 0.
+func TestPalFXSinPhase(t *testing.T) {
+	load := func(phase string) *PalFX {
+		al := &AnimLayout{palfx: newPalFX()}
+		is := NewIniSection()
+		is["palfx.sinadd"] = "100, -60, 30, 40" + phase
+		is["palfx.sinmul"] = "64, 32, -16, 40" + phase
+		is["palfx.sincolor"] = "128, 40" + phase
+		is["palfx.sinhue"] = "64, 40" + phase
+		al.ReadAnimPalfx("palfx.", is)
+		for i := range al.palfx.sintime {
+			al.palfx.sintime[i] = 7
+		}
+		al.palfx.step()
+		return al.palfx
+	}
+	p0, p20 := load(""), load(", 20")
+	if p0.sinphase != [4]float32{} || p20.sinphase != [...]float32{20, 20, 20, 20} {
+		t.Fatalf("sinphase = %v and %v", p0.sinphase, p20.sinphase)
+	}
+	if p0.eAdd[0] == 0 {
+		t.Fatal("no sine contribution at phase 0")
+	}
+	for i := 0; i < 3; i++ {
+		if d := p0.eAdd[i] + p20.eAdd[i]; d < -1 || d > 1 {
+			t.Errorf("add[%v] = %v at phase 0, %v at half a cycle", i, p0.eAdd[i], p20.eAdd[i])
+		}
+		if d := p0.eMul[i] - 256 + p20.eMul[i] - 256; d < -1 || d > 1 {
+			t.Errorf("mul[%v] = %v at phase 0, %v at half a cycle", i, p0.eMul[i], p20.eMul[i])
+		}
+	}
+	if d := p0.eColor - 1 + p20.eColor - 1; AbsF(d) > 1e-4 {
+		t.Errorf("color = %v at phase 0, %v at half a cycle", p0.eColor, p20.eColor)
+	}
+	if d := p0.eHue + p20.eHue; AbsF(d) > 1e-3 {
+		t.Errorf("hue = %v at phase 0, %v at half a cycle", p0.eHue, p20.eHue)
+	}
+}
+
+// A cycle time of 2.5 repeats every 5 ticks, its zero crossings falling
+// between ticks instead of on them. Whole cycle times keep their old values.
+func TestPalFXSinFractionalPeriod(t *testing.T) {
+	defer func(paused bool, tick, oldTick int) {
+		sys.paused, sys.tickCount, sys.oldTickCount = paused, tick, oldTick
+	}(sys.paused, sys.tickCount, sys.oldTickCount)
+	sys.paused, sys.tickCount, sys.oldTickCount = false, 1, 0
+	for _, tc := range []struct {
+		value   string
+		cycle   float32
+		sintime []float32
+		add     []int32
+	}{
+		{"100, 0, 0, 2.5", 2.5, []float32{0, 1, 2, 0.5, 1.5, 0, 1}, []int32{0, 58, -95, 95, -58, 0, 58}},
+		{"100, 0, 0, 4", 4, []float32{0, 1, 2, 3, 0, 1}, []int32{0, 100, 0, -100, 0, 100}},
+	} {
+		al := &AnimLayout{palfx: newPalFX()}
+		is := NewIniSection()
+		is["palfx.sinadd"] = tc.value
+		al.ReadAnimPalfx("palfx.", is)
+		pf := al.palfx
+		if pf.cycletime[0] != tc.cycle {
+			t.Errorf("%v: cycle time %v", tc.value, pf.cycletime[0])
+			continue
+		}
+		pf.time = -1
+		for i := range tc.sintime {
+			st := pf.sintime[0]
+			pf.step()
+			if AbsF(st-tc.sintime[i]) > 1e-5 || pf.eAdd[0] != tc.add[i] {
+				t.Errorf("%v, tick %v: sintime %v, add %v, want %v, %v",
+					tc.value, i, st, pf.eAdd[0], tc.sintime[i], tc.add[i])
+			}
+		}
+	}
+}
+
+// Indexed sprites store the palette index as texel/255, and the sprite shader
+// recovers it with floor(c.r*255+0.5) before comparing it with palrange.
+func TestPalFXPalRange(t *testing.T) {
+	tests := []struct {
+		palrange [2]int32
+		in       func(i int32) bool
+	}{
+		{[2]int32{}, func(int32) bool { return true }},
+		{[2]int32{64, 95}, func(i int32) bool { return i >= 64 && i <= 95 }},
+		{[2]int32{0, 0}, func(int32) bool { return true }},
+		{[2]int32{200, 255}, func(i int32) bool { return i >= 200 }},
+		{[2]int32{10, 10}, func(i int32) bool { return i == 10 }},
+	}
+	for _, tt := range tests {
+		var pf PalFX
+		pf.clear()
+		pf.palrange = tt.palrange
+		pf.time = -1
+		pf.step()
+		_, _, _, _, _, _, _, _, _, r := pf.getFcPalFx(false, 0, -1)
+		for i := int32(0); i < 256; i++ {
+			index := float32(math.Floor(float64(float32(i)/255*255 + 0.5)))
+			if in := index >= r[0] && index <= r[1]; in != tt.in(i) {
+				t.Errorf("palrange %v: index %v affected = %v", tt.palrange, i, in)
+			}
+		}
+	}
+}
+
+func TestPalFXHueDegrees(t *testing.T) {
+	tests := []struct {
+		key, value string
+	}{
+		{"huedeg", "120"},
+		{"huedeg", "480"},
+		{"hue", "170.666667"}, // MUGEN style scale, 256 per half turn
+	}
+	for _, tt := range tests {
+		al := &AnimLayout{palfx: newPalFX()}
+		is := NewIniSection()
+		is["palfx."+tt.key] = tt.value
+		al.ReadAnimPalfx("palfx.", is)
+		if math.Abs(float64(al.palfx.hue-120)) > 1e-3 {
+			t.Errorf("%v = %v: hue = %v, want 120", tt.key, tt.value, al.palfx.hue)
+			continue
+		}
+		al.palfx.step()
+		neg, gray, add, mul, _, hue, contrast, gamma, levels, _ := al.palfx.getFcPalFx(false, 0, -1)
+		k := palFXLUTKey{neg: neg, gray: gray, hue: hue, contrast: contrast,
+			gamma: gamma, levels: levels, add: add, mul: mul}
+		red := [...]float32{1, 0, 0}
+		// The shader rotates hue around the luma axis, so pure red turns into
+		// a darker pure green
+		for _, c := range [][3]float32{hueShift(red, hue), k.apply(red)} {
+			if p := packColor(c); p&0xff != 0 || p>>16&0xff != 0 || p>>8&0xff < 128 {
+				t.Errorf("%v = %v: red rotated to %06x, want green", tt.key, tt.value, p)
+			}
+		}
+	}
+}
+
+// A negating trans type only averages mul on the shader path; add keeps its
+// sign, as 32-bit sprites have always been drawn.
+func TestPalFXTransNeg(t *testing.T) {
+	var pf PalFX
+	pf.clear2(true)
+	pf.add = [...]int32{51, 102, -51}
+	pf.mul = [...]int32{256, 128, 512}
+	pf.time = -1
+	pf.step()
+	_, _, add, mul, _, _, _, _, _, _ := pf.getFcPalFx(true, 0, -1)
+	if want := [...]float32{0.2, 0.4, -0.2}; add != want {
+		t.Errorf("add = %v, want %v", add, want)
+	}
+	if want := [...]float32{1.25, 1.5, 0.75}; mul != want {
+		t.Errorf("mul = %v, want %v", mul, want)
+	}
+}
+
+// The invertblend part of synthesize before it was driven by
+// invertBlendRules, with the raw values it used.
+func oldSynthesizeInvertBlend(pf *PalFX, pfx PalFX, blending int) {
+	pf.eInvertall = pf.eInvertall != pfx.eInvertall
+	if pfx.invertall {
+		// Char blend inverse
+		if pfx.invertblend == 1 {
+			if blending != 0 && pf.invertblend > -3 {
+				pf.eInvertall = pf.invertall
+			}
+			switch {
+			case pf.invertblend == 0:
+				pf.eInvertblend = 1
+			case pf.invertblend == 1:
+				pf.eInvertblend = 0
+			case pf.invertblend == -2:
+				if pf.eInvertall {
+					pf.eInvertall = false
+					pf.eInvertblend = -2
+				} else {
+					pf.eInvertblend = 3
+				}
+			case pf.invertblend == 2:
+				pf.eInvertall = pf.invertall
+				pf.eInvertblend = -1
+			case pf.invertblend == -1:
+				pf.eInvertall = pf.invertall
+				pf.eInvertblend = 2
+			}
+		}
+		// Bg blend inverse
+		if pf.invertblend == -3 {
+			if pf.eInvertall {
+				pf.eInvertblend = 3
+			} else {
+				pf.eInvertall = false
+				pf.eInvertblend = -3
+			}
+		}
+	}
+}
+
+func TestInvertBlendRules(t *testing.T) {
+	for own := InvertBlendBg; own <= InvertBlendSubAdd1; own++ {
+		for global := InvertBlendBg; global <= InvertBlendSubAdd1; global++ {
+			for _, ownInv := range []bool{false, true} {
+				for _, globalInv := range []bool{false, true} {
+					for _, blending := range []int{0, 1, -2} {
+						var pf, pfx PalFX
+						pf.clear()
+						pf.invertblend, pf.invertall, pf.time = own, ownInv, -1
+						pf.step()
+						pfx.clear()
+						pfx.invertblend, pfx.invertall, pfx.time = global, globalInv, -1
+						pfx.step()
+						want := pf
+						oldSynthesizeInvertBlend(&want, pfx, blending)
+						pf.synthesize(pfx, blending)
+						if pf.eInvertall != want.eInvertall || pf.eInvertblend != want.eInvertblend {
+							t.Errorf("own %v/%v, global %v/%v, blending %v: got %v/%v, want %v/%v",
+								own, ownInv, global, globalInv, blending,
+								pf.eInvertblend, pf.eInvertall, want.eInvertblend, want.eInvertall)
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestTeamPalFXInvertBlend(t *testing.T) {
+	defer func() { sys.teamPalFX = [2]PalFX{} }()
+	for _, inv := range []bool{false, true} {
+		tfx := &sys.teamPalFX[0]
+		tfx.clear()
+		tfx.invertblend, tfx.invertall, tfx.time = InvertBlendBg, inv, -1
+		tfx.step()
+		p := (*PalFX)(nil).getSynFx(0, 0)
+		if p.invertblend != InvertBlendMugen11 {
+			t.Errorf("invertall %v: invertblend = %v, want %v", inv, p.invertblend, InvertBlendMugen11)
+		}
+		want := InvertBlendMugen11
+		if inv {
+			want = InvertBlendInverted
+		}
+		if p.eInvertblend != want {
+			t.Errorf("invertall %v: effective invertblend = %v, want %v", inv, p.eInvertblend, want)
+		}
+		if tfx.invertblend != InvertBlendBg {
+			t.Errorf("invertall %v: team layer was modified", inv)
+		}
+	}
+}
+
+func TestPalFXDefTextRoundTrip(t *testing.T) {
+	want := PalFXDef{
+		time:        30,
+		color:       0.75,
+		add:         [...]int32{10, -20, 30},
+		mul:         [...]int32{256, 128, 384},
+		sinadd:      [...]int32{40, -50, 60},
+		sinmul:      [...]int32{-8, 16, 32},
+		sincolor:    64,
+		sinhue:      -96,
+		cycletime:   [...]float32{60, 45.5, 30, 12},
+		sinphase:    [...]float32{0.25, 10, 0, 3.5},
+		invertall:   true,
+		invertblend: InvertBlendSubAdd1,
+		hue:         -135.5,
+		contrast:    1.5,
+		gamma:       0.5,
+		posterize:   4,
+		pausemode:   PalFXPauseSuper,
+		palrange:    [...]int32{64, 95},
+		interpolate: true,
+		iadd:        [...]int32{1, 2, 3, 4, 5, 6},
+		imul:        [...]int32{256, 255, 254, 128, 64, 32},
+		icolor:      [...]float32{1, 0.5},
+		ihue:        [...]float32{90, -90},
+		icontrast:   [...]float32{1, 2},
+		igamma:      [...]float32{0.75, 1.25},
+		itime:       20,
+	}
+	text, err := want.MarshalText()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got PalFXDef
+	if err := got.UnmarshalText(text); err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("round trip changed the definition\ngot  %+v\nwant %+v\ntext:\n%s", got, want, text)
+	}
+}
+
+func TestPalFXDefTextValidation(t *testing.T) {
+	tests := []struct {
+		text  string
+		check func(PalFXDef) bool
+	}{
+		{"invertblend = 7", func(p PalFXDef) bool { return p.invertblend == InvertBlendSubAdd1 }},
+		{"invertblend = -9", func(p PalFXDef) bool { return p.invertblend == InvertBlendBg }},
+		{"posterize = 1", func(p PalFXDef) bool { return p.posterize == 2 }},
+		{"posterize = 1000", func(p PalFXDef) bool { return p.posterize == 256 }},
+		{"posterize = -3", func(p PalFXDef) bool { return p.posterize == 0 }},
+		{"pausemode = 5", func(p PalFXDef) bool { return p.pausemode == PalFXPauseSuper }},
+		{"pausemode = -1", func(p PalFXDef) bool { return p.pausemode == PalFXPauseRun }},
+		{"palrange = -4, 300", func(p PalFXDef) bool { return p.palrange == [2]int32{0, 255} }},
+		{"", func(p PalFXDef) bool { return p.mul == [...]int32{256, 256, 256} && p.gamma == 1 }},
+	}
+	for _, tt := range tests {
+		var pfd PalFXDef
+		if err := pfd.UnmarshalText([]byte(tt.text)); err != nil {
+			t.Errorf("%q: %v", tt.text, err)
+			continue
+		}
+		if !tt.check(pfd) {
+			t.Errorf("%q: got %+v", tt.text, pfd)
+		}
+	}
+}
+
+func TestPalFXPresets(t *testing.T) {
+	defer func(p map[string]PalFXDef) { sys.palfxPresets = p }(sys.palfxPresets)
+	sys.palfxPresets = nil
+	file := filepath.Join(t.TempDir(), "palfx.def")
+	err := os.WriteFile(file, []byte("[PalFX Flash]\ntime = 10\nadd = 255, 255, 255\n"+
+		"[Other]\ntime = 99\n[PalFX Sepia]\ncolor = 0\nmul = 256, 200, 150\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := loadPalFXPresets(file); err != nil {
+		t.Fatal(err)
+	}
+	if len(sys.palfxPresets) != 2 {
+		t.Errorf("%v presets loaded, want 2", len(sys.palfxPresets))
+	}
+	var pf PalFX
+	pf.clear()
+	pf.sintime[0] = 5
+	if !pf.ApplyPreset("FLASH") {
+		t.Fatal("preset Flash not found")
+	}
+	if pf.time != 10 || pf.add != [...]int32{255, 255, 255} || pf.sintime[0] != 0 {
+		t.Errorf("Flash applied as %+v", pf.PalFXDef)
+	}
+	if !pf.ApplyPreset("sepia") || pf.time != 0 || pf.color != 0 || pf.mul != [...]int32{256, 200, 150} {
+		t.Errorf("Sepia applied as %+v", pf.PalFXDef)
+	}
+	if pf.ApplyPreset("other") {
+		t.Error("section without the PalFX prefix was loaded as a preset")
+	}
+}
@@ -210,7 +210,7 @@ func readLbBgTextSnd(pre string, is IniSection,
 }
 func (bts *LbBgTextSnd) step(snd *Snd) {
 	if bts.cnt == bts.sndtime {
-		snd.play(bts.snd, 100, 0, 0, 0, 0)
+		snd.play(bts.snd, 100, 0, 0, 0, 0, 0)
 	}
 	if bts.cnt >= bts.time {
 		bts.bg.Action()
@@ -580,7 +580,7 @@ func (pb *PowerBar) step(ref int, pbr *PowerBar, snd *Snd) {
 	}
 	if level > pbr.prevLevel {
 		i := Min(8, level-1)
-		snd.play(pb.level_snd[i], 100, 0, 0, 0, 0)
+		snd.play(pb.level_snd[i], 100, 0, 0, 0, 0, 0)
 	}
 	pbr.prevLevel = level
 	var fv1 int32
@@ -1769,6 +1769,11 @@ type LifeBarRound struct {
 	shutter_col        uint32
 	callfight_time     int32
 	introState         [2]bool
+	// Music fades as the round is decided and as the next one starts, 0 to
+	// leave it be, and whether it restarts each round
+	bgm_fadeout_time int32
+	bgm_fadein_time  int32
+	bgm_restart      bool
 }
 
 func newLifeBarRound(snd *Snd) *LifeBarRound {
@@ -2064,6 +2069,9 @@ func readLifeBarRound(is IniSection,
 	if is.ReadI32("fadeout.col", &col[0], &col[1], &col[2]) {
 		ro.fadeout_col = uint32(col[0]&0xff<<16 | col[1]&0xff<<8 | col[2]&0xff)
 	}
+	is.ReadI32("bgm.fadeout.time", &ro.bgm_fadeout_time)
+	is.ReadI32("bgm.fadein.time", &ro.bgm_fadein_time)
+	is.ReadBool("bgm.restart", &ro.bgm_restart)
 	is.ReadI32("shutter.time", &ro.shutter_time)
 	col = [...]int32{0, 0, 0}
 	if is.ReadI32("shutter.col", &col[0], &col[1], &col[2]) {
@@ -2112,11 +2120,11 @@ func (ro *LifeBarRound) act() bool {
 				// Announcer round call
 				if ro.swt[0] == 0 {
 					if !sys.consecutiveRounds && sys.roundType[0] == RT_Final && ro.round_final.snd[0] != -1 {
-						ro.snd.play(ro.round_final.snd, 100, 0, 0, 0, 0)
+						ro.snd.play(ro.round_final.snd, 100, 0, 0, 0, 0, 0)
 					} else if int(roundNum) <= len(ro.round) && ro.round[roundNum-1].snd[0] != -1 {
-						ro.snd.play(ro.round[roundNum-1].snd, 100, 0, 0, 0, 0)
+						ro.snd.play(ro.round[roundNum-1].snd, 100, 0, 0, 0, 0, 0)
 					} else {
-						ro.snd.play(ro.round_default.snd, 100, 0, 0, 0, 0)
+						ro.snd.play(ro.round_default.snd, 100, 0, 0, 0, 0, 0)
 					}
 				}
 				ro.swt[0]--
@@ -2166,7 +2174,7 @@ func (ro *LifeBarRound) act() bool {
 				ro.wt[1]--
 			} else if !ro.introState[1] {
 				if ro.swt[1] == 0 {
-					ro.snd.play(ro.fight.snd, 100, 0, 0, 0, 0)
+					ro.snd.play(ro.fight.snd, 100, 0, 0, 0, 0, 0)
 				}
 				ro.swt[1]--
 				if ro.wt[1] <= 0 {
@@ -2197,7 +2205,7 @@ func (ro *LifeBarRound) act() bool {
 			}
 			f := func(ats *AnimTextSnd, t int, delay int32) {
 				if ro.swt[t]+delay == 0 {
-					ro.snd.play(ats.snd, 100, 0, 0, 0, 0)
+					ro.snd.play(ats.snd, 100, 0, 0, 0, 0, 0)
 					ro.swt[t]--
 				}
 				ro.swt[t]--
@@ -3810,6 +3818,7 @@ func (l *Lifebar) step() {
 			l.textsprite[i].Draw()
 			if sys.tickNextFrame() {
 				l.textsprite[i].removetime--
+				l.textsprite[i].effects.tick++
 			}
 		}
 	}
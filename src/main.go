@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"path/filepath"
 	"regexp"
 	"runtime"
 	"strconv"
@@ -54,6 +55,36 @@ func main() {
 
 	processCommandLine()
 
+	// Export the sounds of an SND file, then quit
+	if sndFile, ok := sys.cmdFlags["-dumpsnd"]; ok {
+		outDir := sys.cmdFlags["-dumpdir"]
+		if outDir == "" {
+			outDir = strings.TrimSuffix(sndFile, filepath.Ext(sndFile))
+		}
+		skipped, err := DumpSnd(sndFile, outDir)
+		for _, gn := range skipped {
+			fmt.Printf("Skipped sound %v,%v, which is corrupted or can't be read\n", gn[0], gn[1])
+		}
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	// Build an SND file from a folder of sounds, then quit
+	if dir, ok := sys.cmdFlags["-buildsnd"]; ok {
+		dir = filepath.Clean(dir)
+		skipped, err := BuildSnd(dir, dir+".snd")
+		for _, name := range skipped {
+			fmt.Printf("Skipped %v, which isn't named <group>-<number> or can't be played\n", name)
+		}
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	// Try reading stats
 	if _, err := os.ReadFile("save/stats.json"); err != nil {
 		// If there was an error reading, write an empty json file
@@ -149,7 +180,10 @@ Debug Options:
 -ailevel <level>        Changes game difficulty setting to <level> (1-8)
 -speed <speed>          Changes game speed setting to <speed> (10%%-200%%)
 -stresstest <frameskip> Stability test (AI matches at speed increased by <frameskip>)
--speedtest              Speed test (match speed x100)`
+-speedtest              Speed test (match speed x100)
+-dumpsnd <file>         Exports the sounds of SND <file> and quits
+-dumpdir <dir>          Folder -dumpsnd writes to, by default named after the SND
+-buildsnd <dir>         Builds <dir>.snd from the <group>-<number>.wav files in <dir> and quits`
 				//ShowInfoDialog(text, "I.K.E.M.E.N Command line options")
 				fmt.Printf("I.K.E.M.E.N Command line options\n\n" + text + "\nPress ENTER to exit")
 				var s string
@@ -181,11 +215,31 @@ type configSettings struct {
 	AIRandomColor              bool
 	AISurvivalColor            bool
 	AudioDucking               bool
+	AudioEqFreq                [3]float32
+	AudioEqGain                [3]float32
+	AudioEqQ                   [3]float32
+	AudioFocusLoss             string
+	AudioFocusLossVolume       int
+	AudioLimiterCeiling        float32
+	AudioLimiterLookahead      float32
+	AudioLimiterRelease        float32
+	AudioNormalizer            bool
+	AudioOutputMode            string
+	AudioResampleQualityBgm    int
+	AudioResampleQualitySfx    int
 	AudioSampleRate            int32
 	AutoGuard                  bool
 	BarGuard                   bool
 	BarRedLife                 bool
 	BarStun                    bool
+	BgmDuckAttack              int32
+	BgmDuckPriority            int32
+	BgmDuckRelease             int32
+	BgmDuckVolume              float32
+	BgmLoopCrossfade           int32
+	BgmAnalysisDecay           float32
+	BgmReplayGain              string
+	BgmTimeStretch             bool
 	Borderless                 bool
 	CommonAir                  []string
 	CommonCmd                  []string
@@ -237,6 +291,7 @@ type configSettings struct {
 	NumSimul                   [2]int
 	NumTag                     [2]int
 	NumTurns                   [2]int
+	PalFXLUT                   bool
 	PanningRange               float32
 	PauseMasterVolume          int
 	Players                    int
@@ -252,6 +307,9 @@ type configSettings struct {
 	RoundsNumTag               int32
 	RoundTime                  int32
 	ScreenshotFolder           string
+	SoundNormalize             string
+	SoundNormalizeTarget       float32
+	SoundStreamThreshold       int32
 	StartStage                 string
 	StereoEffects              bool
 	System                     string
@@ -263,6 +321,7 @@ type configSettings struct {
 	TurnsRecoveryBase          float32
 	TurnsRecoveryBonus         float32
 	VolumeBgm                  int
+	VolumeCurve                string
 	VolumeMaster               int
 	VolumeSfx                  int
 	VRetrace                   int
@@ -307,10 +366,8 @@ func setupConfig() configSettings {
 		chkEX(json.Unmarshal(bytes, &tmp), "Error while loading the config file.\n")
 	}
 	// Fix incorrect settings (default values saved into config.json)
-	switch tmp.AudioSampleRate {
-	case 22050, 44100, 48000:
-	default:
-		tmp.AudioSampleRate = 44100
+	if !validAudioSampleRate(int(tmp.AudioSampleRate)) {
+		tmp.AudioSampleRate = 48000
 	}
 	tmp.Framerate = Clamp(tmp.Framerate, 1, 840)
 	tmp.PauseMasterVolume = int(Clamp(int32(tmp.PauseMasterVolume), 0, 100))
@@ -322,6 +379,24 @@ func setupConfig() configSettings {
 	tmp.PanningRange = ClampF(tmp.PanningRange, 0, 100)
 	tmp.Players = int(Clamp(int32(tmp.Players), 1, int32(MaxSimul)*2))
 	tmp.WavChannels = Clamp(tmp.WavChannels, 1, 256)
+	tmp.SoundNormalizeTarget = ClampF(tmp.SoundNormalizeTarget, -60, 0)
+	tmp.SoundStreamThreshold = Max(tmp.SoundStreamThreshold, 0)
+	for i := range tmp.AudioEqGain {
+		tmp.AudioEqFreq[i] = ClampF(tmp.AudioEqFreq[i], 20, 20000)
+		tmp.AudioEqGain[i] = ClampF(tmp.AudioEqGain[i], -24, 24)
+		tmp.AudioEqQ[i] = ClampF(tmp.AudioEqQ[i], 0.1, 10)
+	}
+	tmp.AudioFocusLossVolume = int(Clamp(int32(tmp.AudioFocusLossVolume), 0, 100))
+	tmp.AudioLimiterCeiling = ClampF(tmp.AudioLimiterCeiling, -24, 0)
+	tmp.AudioResampleQualityBgm = int(Clamp(int32(tmp.AudioResampleQualityBgm), 1, 4))
+	tmp.AudioResampleQualitySfx = int(Clamp(int32(tmp.AudioResampleQualitySfx), 1, 4))
+	tmp.AudioLimiterLookahead = ClampF(tmp.AudioLimiterLookahead, 0, 50)
+	tmp.AudioLimiterRelease = ClampF(tmp.AudioLimiterRelease, 1, 5000)
+	tmp.BgmAnalysisDecay = ClampF(tmp.BgmAnalysisDecay, 0, 0.99)
+	tmp.BgmDuckAttack = Max(tmp.BgmDuckAttack, 0)
+	tmp.BgmDuckRelease = Max(tmp.BgmDuckRelease, 0)
+	tmp.BgmDuckVolume = ClampF(tmp.BgmDuckVolume, -60, 0)
+	tmp.BgmLoopCrossfade = Clamp(tmp.BgmLoopCrossfade, 0, 1000)
 	// Save config file, indent with two spaces to match calls to json.encode() in the Lua code
 	cfg, _ := json.MarshalIndent(tmp, "", "  ")
 	chk(os.WriteFile(cfgPath, cfg, 0644))
@@ -341,8 +416,29 @@ func setupConfig() configSettings {
 	sys.allowDebugKeys = tmp.DebugKeys
 	sys.allowDebugMode = tmp.DebugMode
 	sys.audioDucking = tmp.AudioDucking
-	Mp3SampleRate = int(tmp.AudioSampleRate)
+	sys.audioNormalizer = tmp.AudioNormalizer
+	sys.focusLossMode = parseFocusLossMode(tmp.AudioFocusLoss)
+	sys.focusLossVolume = tmp.AudioFocusLossVolume
+	sys.audioOutputMode.mode = parseAudioOutputMode(tmp.AudioOutputMode)
+	sys.bgmResampleQuality = tmp.AudioResampleQualityBgm
+	sys.sfxResampleQuality = tmp.AudioResampleQualitySfx
+	for i := range tmp.AudioEqGain {
+		sys.audioEq.SetBand(i, tmp.AudioEqGain[i], tmp.AudioEqFreq[i], tmp.AudioEqQ[i])
+	}
+	sys.limiterCeiling = tmp.AudioLimiterCeiling
+	sys.limiterLookahead = tmp.AudioLimiterLookahead
+	sys.limiterRelease = tmp.AudioLimiterRelease
+	audioFrequency = int(tmp.AudioSampleRate)
 	sys.bgmVolume = tmp.VolumeBgm
+	sys.volumeCurve = parseVolumeCurve(tmp.VolumeCurve)
+	sys.bgmDucker.priority = tmp.BgmDuckPriority
+	sys.bgmDucker.volume = float64(tmp.BgmDuckVolume)
+	sys.bgmDucker.attack = float64(tmp.BgmDuckAttack)
+	sys.bgmDucker.release = float64(tmp.BgmDuckRelease)
+	sys.bgmLoopCrossfade = tmp.BgmLoopCrossfade
+	sys.replayGainMode = parseReplayGainMode(tmp.BgmReplayGain)
+	sys.bgmTimeStretch = tmp.BgmTimeStretch
+	sys.bgmAnalyzer.decay = tmp.BgmAnalysisDecay
 	sys.maxBgmVolume = tmp.MaxBgmVolume
 	sys.borderless = tmp.Borderless
 	sys.cam.ZoomDelayEnable = tmp.ZoomDelay
@@ -383,6 +479,7 @@ func setupConfig() configSettings {
 	sys.loseTag = tmp.LoseTag
 	sys.masterVolume = tmp.VolumeMaster
 	sys.multisampleAntialiasing = tmp.MSAA
+	sys.palFXLUT = tmp.PalFXLUT
 	sys.pauseMasterVolume = tmp.PauseMasterVolume
 	sys.panningRange = tmp.PanningRange
 	sys.playerProjectileMax = tmp.MaxPlayerProjectile
@@ -397,6 +494,9 @@ func setupConfig() configSettings {
 	} else {
 		sys.screenshotFolder = tmp.ScreenshotFolder
 	}
+	sys.soundStreamThreshold = uint32(tmp.SoundStreamThreshold) * 1024
+	sys.soundNormalize = parseSoundNormalize(tmp.SoundNormalize)
+	sys.soundNormalizeTarget = tmp.SoundNormalizeTarget
 	sys.stereoEffects = tmp.StereoEffects
 	sys.team1VS2Life = tmp.Team1VS2Life / 100
 	sys.vRetrace = tmp.VRetrace
@@ -61,6 +61,7 @@ type RenderParams struct {
 	trans int32  // Mugen transparency blending
 	mask  int32  // Mask for transparency
 	pfx   *PalFX
+	team  int32 // Team side whose PalFX layer applies, -1 for none
 	// Clipping
 	window *[4]int32
 	// Rotation center
@@ -77,6 +78,139 @@ func (rp *RenderParams) IsValid() bool {
 		rp.rxadd+rp.rot.angle+rp.rcx+rp.rcy)
 }
 
+// ------------------------------------------------------------------
+// PalFX lookup tables
+
+// With the PalFXLUT option, 32-bit sprites with an active PalFX can sample a
+// baked color lookup table instead of evaluating every effect in the fragment
+// shader. The table holds palFXLUTSize^3 entries laid out as palFXLUTSize
+// slices of blue side by side. Posterize stays on the scalar path, since
+// interpolating between table entries would smooth out its steps.
+const palFXLUTSize = 16
+
+// At most this many tables are baked per frame; sprites past the budget use
+// the scalar path
+const palFXLUTBakesPerFrame = 4
+
+type palFXLUTKey struct {
+	neg                                bool
+	gray, hue, contrast, gamma, levels float32
+	add, mul                           [3]float32
+}
+
+type palFXLUT struct {
+	tex      *Texture // nil until baked, or a recycled table
+	baked    bool
+	lastUsed int32
+}
+
+var palFXLUTCache = make(map[palFXLUTKey]*palFXLUT)
+var palFXLUTFree []*Texture
+var palFXLUTPurged, palFXLUTBaked int32
+
+func (k *palFXLUTKey) isIdentity() bool {
+	return !k.neg && k.gray == 0 && k.hue == 0 && k.contrast == 1 && k.gamma == 1 &&
+		k.levels <= 1 && k.add == [3]float32{} && k.mul == [...]float32{1, 1, 1}
+}
+
+// Evaluates the same color pipeline as sprite.frag.glsl on a straight color.
+func (k *palFXLUTKey) apply(c [3]float32) [3]float32 {
+	if k.hue != 0 {
+		c = hueShift(c, k.hue)
+	}
+	if k.neg {
+		for i := range c {
+			c[i] = 1 - c[i]
+		}
+	}
+	avg := (c[0] + c[1] + c[2]) / 3
+	for i := range c {
+		c[i] = (c[i] + (avg-c[i])*k.gray + k.add[i]) * k.mul[i]
+	}
+	// Like the shader, neutral values skip these stages altogether
+	if k.contrast != 1 || k.gamma != 1 || k.levels > 1 {
+		for i := range c {
+			c[i] = ClampF((ClampF(c[i], 0, 1)-0.5)*k.contrast+0.5, 0, 1)
+			c[i] = Pow(c[i], 1/MaxF(k.gamma, 1.0/256))
+			if k.levels > 1 {
+				c[i] = float32(math.Floor(float64(c[i]*(k.levels-1)+0.5))) / (k.levels - 1)
+			}
+		}
+	}
+	return c
+}
+
+func (k *palFXLUTKey) bake() []byte {
+	const n = palFXLUTSize
+	data := make([]byte, n*n*n*3)
+	for b := 0; b < n; b++ {
+		for g := 0; g < n; g++ {
+			for r := 0; r < n; r++ {
+				c := k.apply([...]float32{float32(r) / (n - 1), float32(g) / (n - 1), float32(b) / (n - 1)})
+				i := (g*n*n + b*n + r) * 3
+				for j := range c {
+					data[i+j] = byte(c[j]*255 + 0.5)
+				}
+			}
+		}
+	}
+	return data
+}
+
+// Returns the lookup table for the given effect, or nil if the scalar path
+// should be used. An effect is only baked once it has been drawn on two frames
+// in a row, so effects that change every frame, like a sinadd cycle, never
+// churn through tables. Tables that went unused for a frame are recycled.
+func getPalFXLUT(k palFXLUTKey) *Texture {
+	lut, bake := palFXLUTEntry(k)
+	if lut == nil {
+		return nil
+	}
+	if bake {
+		if lut.tex == nil {
+			lut.tex = newTexture(palFXLUTSize*palFXLUTSize, palFXLUTSize, 24, true)
+		}
+		lut.tex.SetData(k.bake())
+	}
+	return lut.tex
+}
+
+// The cache and bake budget behind getPalFXLUT, kept free of GL calls.
+// Returns the entry of k, or nil if it has no table this frame, and whether
+// the table has to be (re)baked into lut.tex, which holds a recycled texture
+// or nil if a new one is needed.
+func palFXLUTEntry(k palFXLUTKey) (lut *palFXLUT, bake bool) {
+	if palFXLUTPurged != sys.frameCounter {
+		for key, lut := range palFXLUTCache {
+			if lut.lastUsed < sys.frameCounter-1 {
+				if lut.tex != nil && len(palFXLUTFree) < palFXLUTBakesPerFrame {
+					palFXLUTFree = append(palFXLUTFree, lut.tex)
+				}
+				delete(palFXLUTCache, key)
+			}
+		}
+		palFXLUTPurged, palFXLUTBaked = sys.frameCounter, 0
+	}
+	lut, ok := palFXLUTCache[k]
+	if !ok {
+		palFXLUTCache[k] = &palFXLUT{lastUsed: sys.frameCounter}
+		return nil, false
+	}
+	if !lut.baked {
+		if lut.lastUsed == sys.frameCounter || palFXLUTBaked >= palFXLUTBakesPerFrame {
+			lut.lastUsed = sys.frameCounter
+			return nil, false
+		}
+		if n := len(palFXLUTFree); n > 0 {
+			lut.tex, palFXLUTFree = palFXLUTFree[n-1], palFXLUTFree[:n-1]
+		}
+		lut.baked, bake = true, true
+		palFXLUTBaked++
+	}
+	lut.lastUsed = sys.frameCounter
+	return lut, bake
+}
+
 func drawQuads(modelview mgl.Mat4, x1, y1, x2, y2, x3, y3, x4, y4 float32) {
 	gfx.SetUniformMatrix("modelview", modelview[:])
 	gfx.SetUniformF("x1x2x4x3", x1, x2, x4, x3) // this uniform is optional
@@ -292,6 +426,8 @@ func RenderSprite(rp RenderParams) {
 	rmInitSub(&rp)
 
 	neg, grayscale, padd, pmul, invblend, hue := false, float32(0), [3]float32{0, 0, 0}, [3]float32{1, 1, 1}, int32(0), float32(0)
+	contrast, gamma, levels := float32(1), float32(1), float32(0)
+	palrange := palRangeBounds([2]int32{})
 	tint := [4]float32{float32(rp.tint&0xff) / 255, float32(rp.tint>>8&0xff) / 255,
 		float32(rp.tint>>16&0xff) / 255, float32(rp.tint>>24&0xff) / 255}
 
@@ -300,7 +436,7 @@ func RenderSprite(rp RenderParams) {
 		//if rp.trans == -2 || rp.trans == -1 || (rp.trans&0xff > 0 && rp.trans>>10&0xff >= 255) {
 		//	blending = true
 		//}
-		neg, grayscale, padd, pmul, invblend, hue = rp.pfx.getFcPalFx(false, int(blending))
+		neg, grayscale, padd, pmul, invblend, hue, contrast, gamma, levels, palrange = rp.pfx.getFcPalFx(false, int(blending), int(rp.team))
 		//if rp.trans == -2 && invblend < 1 {
 		//padd[0], padd[1], padd[2] = -padd[0], -padd[1], -padd[2]
 		//}
@@ -330,6 +466,22 @@ func RenderSprite(rp RenderParams) {
 		gfx.SetUniformI("neg", int(Btoi(neg)))
 		gfx.SetUniformF("gray", grayscale)
 		gfx.SetUniformF("hue", hue)
+		gfx.SetUniformF("contrast", contrast)
+		gfx.SetUniformF("gamma", gamma)
+		gfx.SetUniformF("posterize", levels)
+		gfx.SetUniformF("palrange", palrange[0], palrange[1])
+		useLut := false
+		if rp.paltex == nil && rp.pfx != nil && levels <= 1 && sys.palFXLUT && gfx.SupportsPalFXLUT() {
+			k := palFXLUTKey{neg: neg, gray: grayscale, hue: hue, contrast: contrast,
+				gamma: gamma, add: padd, mul: pmul}
+			if !k.isIdentity() {
+				if lut := getPalFXLUT(k); lut != nil {
+					gfx.SetTexture("lut", lut)
+					useLut = true
+				}
+			}
+		}
+		gfx.SetUniformI("useLut", int(Btoi(useLut)))
 		gfx.SetUniformFv("add", padd[:])
 		gfx.SetUniformFv("mult", pmul[:])
 		gfx.SetUniformFv("tint", tint[:])
@@ -302,13 +302,13 @@ func (r *Renderer) Init() {
 	r.spriteShader = newShaderProgram(vertShader, fragShader, "Main Shader")
 	r.spriteShader.RegisterAttributes("position", "uv")
 	r.spriteShader.RegisterUniforms("modelview", "projection", "x1x2x4x3",
-		"alpha", "tint", "mask", "neg", "gray", "add", "mult", "isFlat", "isRgba", "isTrapez", "hue")
-	r.spriteShader.RegisterTextures("pal", "tex")
+		"alpha", "tint", "mask", "neg", "gray", "add", "mult", "isFlat", "isRgba", "isTrapez", "hue", "contrast", "gamma", "posterize", "palrange", "useLut")
+	r.spriteShader.RegisterTextures("pal", "tex", "lut")
 
 	// 3D model shader
 	r.modelShader = newShaderProgram(modelVertShader, modelFragShader, "Model Shader")
 	r.modelShader.RegisterAttributes("position", "uv", "vertColor", "joints_0", "joints_1", "weights_0", "weights_1", "morphTargets_0")
-	r.modelShader.RegisterUniforms("modelview", "projection", "baseColorFactor", "add", "mult", "textured", "neg", "gray", "hue", "enableAlpha", "alphaThreshold", "numJoints", "morphTargetWeight", "positionTargetCount", "uvTargetCount")
+	r.modelShader.RegisterUniforms("modelview", "projection", "baseColorFactor", "add", "mult", "textured", "neg", "gray", "hue", "contrast", "gamma", "posterize", "enableAlpha", "alphaThreshold", "numJoints", "morphTargetWeight", "positionTargetCount", "uvTargetCount")
 	r.modelShader.RegisterTextures("tex", "jointMatrices")
 
 	// Compile postprocessing shaders
@@ -400,6 +400,11 @@ func (r *Renderer) Init() {
 	gl.BindFramebuffer(gl.FRAMEBUFFER, 0)
 }
 
+// The sprite shader can apply PalFX to 32-bit sprites through a baked lookup table
+func (r *Renderer) SupportsPalFXLUT() bool {
+	return true
+}
+
 func (r *Renderer) Close() {
 }
 
@@ -180,6 +180,11 @@ func (r *Renderer) Init() {
 	r.pipelineCache = make(map[PipelineParams]*Pipeline)
 }
 
+// The Kinc shaders have no lookup table path, so PalFX stays on the scalar uniforms
+func (r *Renderer) SupportsPalFXLUT() bool {
+	return false
+}
+
 func (r *Renderer) Close() {
 }
 
@@ -222,7 +227,7 @@ func (r *Renderer) SetPipeline(eq BlendEquation, src, dst BlendFunc) {
 		p.u = make(map[string]C.kinc_g4_constant_location_t)
 		p.t = make(map[string]C.kinc_g4_texture_unit_t)
 		p.RegisterUniforms("modelview", "projection", "x1x2x4x3",
-			"alpha", "tint", "mask", "neg", "gray", "add", "mult", "isFlat", "isRgba", "isTrapez", "hue")
+			"alpha", "tint", "mask", "neg", "gray", "add", "mult", "isFlat", "isRgba", "isTrapez", "hue", "contrast", "gamma", "posterize", "palrange")
 		p.RegisterTextures("pal", "tex")
 
 		r.pipelineCache[params] = p
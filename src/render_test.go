@@ -0,0 +1,187 @@
+package main
+
+import "testing"
+
+// A palette with grays, primaries and a few arbitrary colors, as 0xBBGGRR.
+var testPalette = func() []uint32 {
+	pal := make([]uint32, 0, 256+6)
+	for i := uint32(0); i < 256; i++ {
+		pal = append(pal, i|i<<8|i<<16)
+	}
+	return append(pal, 0x0000ff, 0x00ff00, 0xff0000, 0x3080c0, 0xc08030, 0x10f020)
+}()
+
+func unpackColor(c uint32) [3]float32 {
+	return [...]float32{float32(c&0xff) / 255, float32(c>>8&0xff) / 255, float32(c>>16&0xff) / 255}
+}
+
+func packColor(c [3]float32) uint32 {
+	var p uint32
+	for i := range c {
+		p |= uint32(ClampF(c[i], 0, 1)*255+0.5) << uint(i*8)
+	}
+	return p
+}
+
+// Neutral contrast and gamma must leave the add/mul pipeline's output as it
+// was before those stages existed.
+func TestPalFXDefaultContrastGamma(t *testing.T) {
+	var pf PalFX
+	pf.clear()
+	pf.add = [...]int32{40, -20, 0}
+	pf.mul = [...]int32{200, 256, 300}
+	pf.color = 0.5
+	pf.time = -1
+	pf.step()
+	neg, gray, add, mul, _, hue, contrast, gamma, levels, _ := pf.getFcPalFx(false, 0, -1)
+	if contrast != 1 || gamma != 1 || levels != 0 {
+		t.Fatalf("contrast, gamma, levels = %v, %v, %v, want 1, 1, 0", contrast, gamma, levels)
+	}
+	k := palFXLUTKey{neg: neg, gray: gray, hue: hue, contrast: contrast,
+		gamma: gamma, levels: levels, add: add, mul: mul}
+	for _, c := range testPalette {
+		s := unpackColor(c)
+		var want [3]float32
+		avg := (s[0] + s[1] + s[2]) / 3
+		for i := range want {
+			want[i] = (s[i] + (avg-s[i])*gray + add[i]) * mul[i]
+		}
+		if got, want := packColor(k.apply(s)), packColor(want); got != want {
+			t.Errorf("%06x: got %06x, want %06x", c, got, want)
+		}
+	}
+}
+
+// Posterize quantizes after inversion and leaves exactly the requested
+// number of levels per channel.
+func TestPalFXPosterize(t *testing.T) {
+	var pf PalFX
+	pf.clear()
+	pf.invertall = true
+	pf.posterize = 2
+	pf.time = -1
+	pf.step()
+	neg, gray, add, mul, _, hue, contrast, gamma, levels, _ := pf.getFcPalFx(false, 0, -1)
+	if levels != 2 {
+		t.Fatalf("levels = %v, want 2", levels)
+	}
+	k := palFXLUTKey{neg: neg, gray: gray, hue: hue, contrast: contrast,
+		gamma: gamma, levels: levels, add: add, mul: mul}
+	seen := [3]map[uint32]bool{{}, {}, {}}
+	for i := uint32(0); i < 256; i++ {
+		c := packColor(k.apply(unpackColor(i | i<<8 | i<<16)))
+		want := uint32(0)
+		if i < 128 {
+			want = 0xffffff
+		}
+		if c != want {
+			t.Errorf("%v: got %06x, want %06x", i, c, want)
+		}
+		for j := range seen {
+			seen[j][c>>uint(j*8)&0xff] = true
+		}
+	}
+	for j := range seen {
+		if len(seen[j]) != 2 {
+			t.Errorf("channel %v has %v values, want 2", j, len(seen[j]))
+		}
+	}
+}
+
+// The cache is tested through palFXLUTEntry, which makes no GL calls; only
+// getPalFXLUT uploads tables.
+func TestPalFXLUTChurn(t *testing.T) {
+	defer func(fc int32) {
+		sys.frameCounter = fc
+		palFXLUTCache, palFXLUTFree = make(map[palFXLUTKey]*palFXLUT), nil
+	}(sys.frameCounter)
+	still := palFXLUTKey{contrast: 1, gamma: 1, add: [3]float32{0.5}, mul: [...]float32{1, 1, 1}}
+	var baked *palFXLUT
+	for f := int32(0); f < 8; f++ {
+		sys.frameCounter = 100 + f
+		// An effect that changes every frame never gets a table
+		moving := still
+		moving.add[1] = float32(f) / 255
+		if lut, _ := palFXLUTEntry(moving); lut != nil {
+			t.Errorf("frame %v: changing effect was baked", f)
+		}
+		lut, bake := palFXLUTEntry(still)
+		switch {
+		case f == 0 && lut != nil:
+			t.Errorf("frame 0: baked on first use")
+		case f == 1 && (lut == nil || !bake):
+			t.Errorf("frame 1: not baked on second frame")
+		case f > 1 && (lut != baked || bake):
+			t.Errorf("frame %v: table was not reused", f)
+		}
+		if f == 1 {
+			baked = lut
+		}
+		// Drawing the same effect again within a frame changes nothing
+		if again, bake := palFXLUTEntry(still); again != lut || bake {
+			t.Errorf("frame %v: second draw got a different table", f)
+		}
+	}
+	if n := len(palFXLUTCache); n > 3 {
+		t.Errorf("%v cache entries after 8 frames, want at most 3", n)
+	}
+}
+
+func TestPalFXLUTBakeBudget(t *testing.T) {
+	defer func(fc int32) {
+		sys.frameCounter = fc
+		palFXLUTCache, palFXLUTFree = make(map[palFXLUTKey]*palFXLUT), nil
+	}(sys.frameCounter)
+	keys := make([]palFXLUTKey, palFXLUTBakesPerFrame+2)
+	for i := range keys {
+		keys[i] = palFXLUTKey{contrast: 1, gamma: 1, hue: float32(i + 1), mul: [...]float32{1, 1, 1}}
+	}
+	for f := int32(0); f < 3; f++ {
+		sys.frameCounter = 200 + f
+		var got, bakes int
+		for _, k := range keys {
+			if lut, bake := palFXLUTEntry(k); lut != nil {
+				got++
+				if bake {
+					bakes++
+				}
+			}
+		}
+		want := [...]int{0, palFXLUTBakesPerFrame, len(keys)}[f]
+		if got != want {
+			t.Errorf("frame %v: %v tables, want %v", f, got, want)
+		}
+		if bakes > palFXLUTBakesPerFrame {
+			t.Errorf("frame %v: %v bakes, budget is %v", f, bakes, palFXLUTBakesPerFrame)
+		}
+	}
+}
+
+// A table that goes unused for a frame hands its texture to the next bake.
+func TestPalFXLUTRecycle(t *testing.T) {
+	defer func(fc int32) {
+		sys.frameCounter = fc
+		palFXLUTCache, palFXLUTFree = make(map[palFXLUTKey]*palFXLUT), nil
+	}(sys.frameCounter)
+	a := palFXLUTKey{contrast: 1, gamma: 1, hue: 1, mul: [...]float32{1, 1, 1}}
+	b := palFXLUTKey{contrast: 1, gamma: 1, hue: 2, mul: [...]float32{1, 1, 1}}
+	sys.frameCounter = 300
+	palFXLUTEntry(a)
+	sys.frameCounter++
+	lut, bake := palFXLUTEntry(a)
+	if lut == nil || !bake || lut.tex != nil {
+		t.Fatalf("first bake: entry %v, bake %v", lut, bake)
+	}
+	// Stands in for the texture getPalFXLUT would have created
+	tex := &Texture{}
+	lut.tex = tex
+	sys.frameCounter++
+	palFXLUTEntry(b)
+	sys.frameCounter++
+	if lut, bake := palFXLUTEntry(b); lut == nil || !bake || lut.tex != tex {
+		t.Errorf("second bake did not reuse the unused table")
+	}
+	if _, ok := palFXLUTCache[a]; ok {
+		t.Errorf("unused entry was kept")
+	}
+}
@@ -51,6 +51,211 @@ func toUserData(l *lua.LState, argi int) interface{} {
 func userDataError(l *lua.LState, argi int, udtype interface{}) {
 	l.RaiseError("\nArgument %v is not a userdata of type: %T\n", argi, udtype)
 }
+func bgmSlotArg(l *lua.LState, argi int) *Bgm {
+	slot := int(numArg(l, argi))
+	bgm := sys.bgmSlot(slot)
+	if bgm == nil {
+		l.RaiseError("\nInvalid BGM slot: %v\n", slot)
+	}
+	return bgm
+}
+
+// Opens music in bgm with the arguments of playBGM, starting at argi.
+func luaOpenBgm(l *lua.LState, bgm *Bgm, argi int) {
+	var loop, volume, loopstart, loopend, startposition int = 1, 100, 0, 0, 0
+	var freqmul float32 = 1.0
+	crossfade := 0
+	if l.GetTop() >= argi+1 {
+		loop = int(numArg(l, argi+1))
+	}
+	if l.GetTop() >= argi+2 {
+		volume = int(numArg(l, argi+2))
+	}
+	if l.GetTop() >= argi+3 {
+		loopstart = int(numArg(l, argi+3))
+	}
+	if l.GetTop() >= argi+4 && numArg(l, argi+4) > 1 {
+		loopend = int(numArg(l, argi+4))
+	}
+	if l.GetTop() >= argi+5 && numArg(l, argi+5) > 1 {
+		startposition = int(numArg(l, argi+5))
+	}
+	if l.GetTop() >= argi+6 {
+		freqmul = ClampF(float32(numArg(l, argi+6)), 0.01, 5.0)
+	}
+	if l.GetTop() >= argi+7 {
+		crossfade = int(numArg(l, argi+7))
+	}
+	// Optionally resume where saveBGMPosition left the same file
+	if l.GetTop() >= argi+9 && boolArg(l, argi+9) {
+		bgm.Resume(strArg(l, argi), loop, volume, loopstart, loopend, freqmul, crossfade)
+		return
+	}
+	// Optional start position in seconds, used instead of startposition
+	if l.GetTop() >= argi+8 && numArg(l, argi+8) > 0 {
+		bgm.OpenSeconds(strArg(l, argi), loop, volume, loopstart, loopend, float64(numArg(l, argi+8)), freqmul, crossfade)
+		return
+	}
+	bgm.Open(strArg(l, argi), loop, volume, loopstart, loopend, startposition, freqmul, crossfade)
+}
+
+// Pushes the position and length in seconds of the sound playing on c, -1
+// when nothing is, and the loops left after the current one.
+func pushSoundPosition(l *lua.LState, c *SoundChannel) int {
+	if c == nil {
+		l.Push(lua.LNumber(-1))
+		l.Push(lua.LNumber(-1))
+		l.Push(lua.LNumber(0))
+		return 3
+	}
+	l.Push(lua.LNumber(c.PositionSeconds()))
+	l.Push(lua.LNumber(c.LengthSeconds()))
+	l.Push(lua.LNumber(c.LoopsLeft()))
+	return 3
+}
+
+// Reads the keys of a Lua PalFX table into pf, using the same units as the
+// PalFX state controller.
+func readLuaPalFX(l *lua.LState, t *lua.LTable, pf *PalFX) {
+	// A preset replaces the whole definition, so it goes before the other keys
+	if name, ok := t.RawGetString("preset").(lua.LString); ok {
+		time := pf.time
+		if !pf.ApplyPreset(string(name)) {
+			l.RaiseError("\nUnknown PalFX preset: %v\n", name)
+		}
+		// Presets that don't set a time last as long as the caller's default
+		if pf.time == 0 {
+			pf.time = time
+		}
+	}
+	t.ForEach(func(key, value lua.LValue) {
+		switch k := key.(type) {
+		case lua.LString:
+			switch string(k) {
+			case "time":
+				pf.time = int32(lua.LVAsNumber(value))
+			case "add":
+				switch v := value.(type) {
+				case *lua.LTable:
+					v.ForEach(func(key2, value2 lua.LValue) {
+						pf.add[int(lua.LVAsNumber(key2))-1] = int32(lua.LVAsNumber(value2))
+					})
+				}
+			case "mul":
+				switch v := value.(type) {
+				case *lua.LTable:
+					v.ForEach(func(key2, value2 lua.LValue) {
+						pf.mul[int(lua.LVAsNumber(key2))-1] = int32(lua.LVAsNumber(value2))
+					})
+				}
+			case "sinadd":
+				var s [5]float32
+				switch v := value.(type) {
+				case *lua.LTable:
+					v.ForEach(func(key2, value2 lua.LValue) {
+						s[int(lua.LVAsNumber(key2))-1] = float32(lua.LVAsNumber(value2))
+					})
+				}
+				if s[3] < 0 {
+					pf.sinadd[0] = int32(-s[0])
+					pf.sinadd[1] = int32(-s[1])
+					pf.sinadd[2] = int32(-s[2])
+					pf.cycletime[0] = -s[3]
+				} else {
+					pf.sinadd[0] = int32(s[0])
+					pf.sinadd[1] = int32(s[1])
+					pf.sinadd[2] = int32(s[2])
+					pf.cycletime[0] = s[3]
+				}
+				pf.sinphase[0] = s[4]
+			case "sinmul":
+				var s [5]float32
+				switch v := value.(type) {
+				case *lua.LTable:
+					v.ForEach(func(key2, value2 lua.LValue) {
+						s[int(lua.LVAsNumber(key2))-1] = float32(lua.LVAsNumber(value2))
+					})
+				}
+				if s[3] < 0 {
+					pf.sinmul[0] = int32(-s[0])
+					pf.sinmul[1] = int32(-s[1])
+					pf.sinmul[2] = int32(-s[2])
+					pf.cycletime[1] = -s[3]
+				} else {
+					pf.sinmul[0] = int32(s[0])
+					pf.sinmul[1] = int32(s[1])
+					pf.sinmul[2] = int32(s[2])
+					pf.cycletime[1] = s[3]
+				}
+				pf.sinphase[1] = s[4]
+			case "sincolor":
+				var s [3]float32
+				switch v := value.(type) {
+				case *lua.LTable:
+					v.ForEach(func(key2, value2 lua.LValue) {
+						s[int(lua.LVAsNumber(key2))-1] = float32(lua.LVAsNumber(value2))
+					})
+				}
+				if s[1] < 0 {
+					pf.sincolor = int32(-s[0])
+					pf.cycletime[2] = -s[1]
+				} else {
+					pf.sincolor = int32(s[0])
+					pf.cycletime[2] = s[1]
+				}
+				pf.sinphase[2] = s[2]
+			case "sinhue":
+				var s [3]float32
+				switch v := value.(type) {
+				case *lua.LTable:
+					v.ForEach(func(key2, value2 lua.LValue) {
+						s[int(lua.LVAsNumber(key2))-1] = float32(lua.LVAsNumber(value2))
+					})
+				}
+				if s[1] < 0 {
+					pf.sinhue = int32(-s[0])
+					pf.cycletime[3] = -s[1]
+				} else {
+					pf.sinhue = int32(s[0])
+					pf.cycletime[3] = s[1]
+				}
+				pf.sinphase[3] = s[2]
+			case "invertall":
+				pf.invertall = lua.LVAsNumber(value) == 1
+			case "invertblend":
+				pf.invertblend = clampInvertBlend(int32(lua.LVAsNumber(value)), InvertBlendBg, InvertBlendSubAdd1)
+			case "color":
+				pf.color = float32(lua.LVAsNumber(value)) / 256
+			case "hue":
+				pf.hue = wrapHue(float32(lua.LVAsNumber(value)) * palFXHueUnit)
+			case "huedeg":
+				pf.hue = wrapHue(float32(lua.LVAsNumber(value)))
+			case "contrast":
+				pf.contrast = float32(lua.LVAsNumber(value)) / 256
+			case "gamma":
+				pf.gamma = float32(lua.LVAsNumber(value)) / 256
+			case "posterize":
+				pf.posterize = int32(lua.LVAsNumber(value))
+			case "pausemode":
+				pf.pausemode = PalFXPauseMode(Clamp(int32(lua.LVAsNumber(value)), int32(PalFXPauseRun), int32(PalFXPauseSuper)))
+			case "preset":
+			case "palrange":
+				switch v := value.(type) {
+				case *lua.LTable:
+					v.ForEach(func(key2, value2 lua.LValue) {
+						if i := int(lua.LVAsNumber(key2)) - 1; i >= 0 && i < 2 {
+							pf.palrange[i] = Clamp(int32(lua.LVAsNumber(value2)), 0, 255)
+						}
+					})
+				}
+			default:
+				l.RaiseError("\nInvalid table key: %v\n", k)
+			}
+		default:
+			l.RaiseError("\nInvalid table key type: %v\n", fmt.Sprintf("%T\n", key))
+		}
+	})
+}
 
 // -------------------------------------------------------------------------------------------------
 // Register external functions to be called from Lua scripts
@@ -226,109 +431,7 @@ func systemScriptInit(l *lua.LState) {
 		if !ok {
 			userDataError(l, 1, a)
 		}
-		tableArg(l, 2).ForEach(func(key, value lua.LValue) {
-			switch k := key.(type) {
-			case lua.LString:
-				switch string(k) {
-				case "time":
-					a.palfx.time = int32(lua.LVAsNumber(value))
-				case "add":
-					switch v := value.(type) {
-					case *lua.LTable:
-						v.ForEach(func(key2, value2 lua.LValue) {
-							a.palfx.add[int(lua.LVAsNumber(key2))-1] = int32(lua.LVAsNumber(value2))
-						})
-					}
-				case "mul":
-					switch v := value.(type) {
-					case *lua.LTable:
-						v.ForEach(func(key2, value2 lua.LValue) {
-							a.palfx.mul[int(lua.LVAsNumber(key2))-1] = int32(lua.LVAsNumber(value2))
-						})
-					}
-				case "sinadd":
-					var s [4]int32
-					switch v := value.(type) {
-					case *lua.LTable:
-						v.ForEach(func(key2, value2 lua.LValue) {
-							s[int(lua.LVAsNumber(key2))-1] = int32(lua.LVAsNumber(value2))
-						})
-					}
-					if s[3] < 0 {
-						a.palfx.sinadd[0] = -s[0]
-						a.palfx.sinadd[1] = -s[1]
-						a.palfx.sinadd[2] = -s[2]
-						a.palfx.cycletime[0] = -s[3]
-					} else {
-						a.palfx.sinadd[0] = s[0]
-						a.palfx.sinadd[1] = s[1]
-						a.palfx.sinadd[2] = s[2]
-						a.palfx.cycletime[0] = s[3]
-					}
-				case "sinmul":
-					var s [4]int32
-					switch v := value.(type) {
-					case *lua.LTable:
-						v.ForEach(func(key2, value2 lua.LValue) {
-							s[int(lua.LVAsNumber(key2))-1] = int32(lua.LVAsNumber(value2))
-						})
-					}
-					if s[3] < 0 {
-						a.palfx.sinmul[0] = -s[0]
-						a.palfx.sinmul[1] = -s[1]
-						a.palfx.sinmul[2] = -s[2]
-						a.palfx.cycletime[1] = -s[3]
-					} else {
-						a.palfx.sinmul[0] = s[0]
-						a.palfx.sinmul[1] = s[1]
-						a.palfx.sinmul[2] = s[2]
-						a.palfx.cycletime[1] = s[3]
-					}
-				case "sincolor":
-					var s [2]int32
-					switch v := value.(type) {
-					case *lua.LTable:
-						v.ForEach(func(key2, value2 lua.LValue) {
-							s[int(lua.LVAsNumber(key2))-1] = int32(lua.LVAsNumber(value2))
-						})
-					}
-					if s[1] < 0 {
-						a.palfx.sincolor = -s[0]
-						a.palfx.cycletime[2] = -s[1]
-					} else {
-						a.palfx.sincolor = s[0]
-						a.palfx.cycletime[2] = s[1]
-					}
-				case "sinhue":
-					var s [2]int32
-					switch v := value.(type) {
-					case *lua.LTable:
-						v.ForEach(func(key2, value2 lua.LValue) {
-							s[int(lua.LVAsNumber(key2))-1] = int32(lua.LVAsNumber(value2))
-						})
-					}
-					if s[1] < 0 {
-						a.palfx.sinhue = -s[0]
-						a.palfx.cycletime[3] = -s[1]
-					} else {
-						a.palfx.sinhue = s[0]
-						a.palfx.cycletime[3] = s[1]
-					}
-				case "invertall":
-					a.palfx.invertall = lua.LVAsNumber(value) == 1
-				case "invertblend":
-					a.palfx.invertblend = int32(lua.LVAsNumber(value))
-				case "color":
-					a.palfx.color = float32(lua.LVAsNumber(value)) / 256
-				case "hue":
-					a.palfx.hue = float32(lua.LVAsNumber(value)) / 256
-				default:
-					l.RaiseError("\nInvalid table key: %v\n", k)
-				}
-			default:
-				l.RaiseError("\nInvalid table key type: %v\n", fmt.Sprintf("%T\n", key))
-			}
-		})
+		readLuaPalFX(l, tableArg(l, 2), a.palfx)
 		return 0
 	})
 	luaRegister(l, "animSetPos", func(*lua.LState) int {
@@ -497,7 +600,7 @@ func systemScriptInit(l *lua.LState) {
 		}
 		f, lw, lp, stopgh, stopcs := false, false, false, false, false
 		var g, n, ch, vo, priority, lc int32 = -1, 0, -1, 100, 0, 0
-		var loopstart, loopend, startposition int = 0, 0, 0
+		var loopstart, loopend, startposition, startms int = 0, 0, 0, 0
 		var p, fr float32 = 0, 1
 		x := &sys.chars[pn-1][0].pos[0]
 		ls := sys.chars[pn-1][0].localscl
@@ -549,6 +652,9 @@ func systemScriptInit(l *lua.LState) {
 		if l.GetTop() >= 16 { // StopOnChangeState
 			stopcs = boolArg(l, 17)
 		}
+		if l.GetTop() >= 18 { // Start offset in milliseconds, used instead of startposition
+			startms = int(numArg(l, 18))
+		}
 		preffix := ""
 		if f {
 			preffix = "f"
@@ -557,17 +663,25 @@ func systemScriptInit(l *lua.LState) {
 		// If the loopcount is 0, then read the loop parameter
 		if lc == 0 {
 			if lp {
-				sys.chars[pn-1][0].playSound(preffix, lw, -1, g, n, ch, vo, p, fr, ls, x, false, priority, loopstart, loopend, startposition, stopgh, stopcs)
+				sys.chars[pn-1][0].playSound(preffix, lw, -1, g, n, ch, vo, p, fr, ls, x, false, priority, loopstart, loopend, startposition, startms, stopgh, stopcs)
 			} else {
-				sys.chars[pn-1][0].playSound(preffix, lw, 0, g, n, ch, vo, p, fr, ls, x, false, priority, loopstart, loopend, startposition, stopgh, stopcs)
+				sys.chars[pn-1][0].playSound(preffix, lw, 0, g, n, ch, vo, p, fr, ls, x, false, priority, loopstart, loopend, startposition, startms, stopgh, stopcs)
 			}
 
 			// Otherwise, read the loopcount parameter directly
 		} else {
-			sys.chars[pn-1][0].playSound(preffix, lw, lc, g, n, ch, vo, p, fr, ls, x, false, priority, loopstart, loopend, startposition, stopgh, stopcs)
+			sys.chars[pn-1][0].playSound(preffix, lw, lc, g, n, ch, vo, p, fr, ls, x, false, priority, loopstart, loopend, startposition, startms, stopgh, stopcs)
 		}
 		return 0
 	})
+	luaRegister(l, "charSndPosition", func(l *lua.LState) int {
+		// pn, channel
+		pn := int(numArg(l, 1))
+		if pn < 1 || pn > len(sys.chars) || len(sys.chars[pn-1]) == 0 {
+			l.RaiseError("\nPlayer not found: %v\n", pn)
+		}
+		return pushSoundPosition(l, sys.chars[pn-1][0].soundChannels.Get(int32(numArg(l, 2))))
+	})
 	luaRegister(l, "charSndStop", func(l *lua.LState) int {
 		if l.GetTop() == 0 {
 			sys.stopAllSound()
@@ -577,7 +691,7 @@ func systemScriptInit(l *lua.LState) {
 		if pn < 1 || pn > len(sys.chars) || len(sys.chars[pn-1]) == 0 {
 			l.RaiseError("\nPlayer not found: %v\n", pn)
 		}
-		sys.chars[pn-1][0].soundChannels.SetSize(0)
+		sys.chars[pn-1][0].soundChannels.Clear()
 		return 0
 	})
 	luaRegister(l, "charSpriteDraw", func(l *lua.LState) int {
@@ -655,6 +769,14 @@ func systemScriptInit(l *lua.LState) {
 		sys.sel.ClearSelected()
 		return 0
 	})
+	luaRegister(l, "clearTeamPalFX", func(l *lua.LState) int {
+		tn := int(numArg(l, 1))
+		if tn < 1 || tn > 2 {
+			l.RaiseError("\nInvalid team side: %v\n", tn)
+		}
+		sys.teamPalFX[tn-1] = PalFX{}
+		return 0
+	})
 	luaRegister(l, "commandAdd", func(l *lua.LState) int {
 		cl, ok := toUserData(l, 1).(*CommandList)
 		if !ok {
@@ -743,6 +865,15 @@ func systemScriptInit(l *lua.LState) {
 		l.Push(lua.LBool(sys.netInput.IsConnected()))
 		return 1
 	})
+	// Fades from one music slot to another, stopping the first
+	luaRegister(l, "crossfadeBGM", func(l *lua.LState) int {
+		from, to := int(numArg(l, 1)), int(numArg(l, 2))
+		if sys.bgmSlot(from) == nil || sys.bgmSlot(to) == nil {
+			l.RaiseError("\nInvalid BGM slots: %v, %v\n", from, to)
+		}
+		sys.crossfadeBgm(from, to, int(numArg(l, 3)))
+		return 0
+	})
 	luaRegister(l, "dialogueReset", func(*lua.LState) int {
 		for _, p := range sys.chars {
 			if len(p) > 0 {
@@ -839,6 +970,26 @@ func systemScriptInit(l *lua.LState) {
 		l.Push(lua.LBool(true))
 		return 1
 	})
+	luaRegister(l, "fadeInBGM", func(l *lua.LState) int {
+		bgm := &sys.bgm
+		if l.GetTop() >= 2 {
+			bgm = bgmSlotArg(l, 2)
+		}
+		bgm.FadeIn(int(numArg(l, 1)))
+		return 0
+	})
+	luaRegister(l, "fadeOutBGM", func(l *lua.LState) int {
+		stop := true
+		if l.GetTop() >= 2 {
+			stop = boolArg(l, 2)
+		}
+		bgm := &sys.bgm
+		if l.GetTop() >= 3 {
+			bgm = bgmSlotArg(l, 3)
+		}
+		bgm.FadeOut(int(numArg(l, 1)), stop)
+		return 0
+	})
 	luaRegister(l, "fillRect", func(l *lua.LState) int {
 		rect := [4]int32{int32((float32(numArg(l, 1))/sys.luaSpriteScale + float32(sys.gameWidth-320)/2 + sys.luaSpriteOffsetX) * sys.widthScale),
 			int32((float32(numArg(l, 2))/sys.luaSpriteScale + float32(sys.gameHeight-240)) * sys.heightScale),
@@ -1137,11 +1288,15 @@ func systemScriptInit(l *lua.LState) {
 				l.Push(lua.LNumber(winp))
 				l.Push(tbl)
 				if sys.playBgmFlg {
-					sys.bgm.Open("", 1, 100, 0, 0, 0, 1.0)
+					sys.bgm.Open("", 1, 100, 0, 0, 0, 1.0, 0)
+					for i := 1; i < BgmSlots; i++ {
+						sys.bgmSlot(i).Stop(0)
+					}
 					sys.playBgmFlg = false
 				}
 				sys.clearAllSound()
 				sys.allPalFX = *newPalFX()
+				sys.teamPalFX = [2]PalFX{}
 				sys.bgPalFX = *newPalFX()
 				sys.superpmap = *newPalFX()
 				sys.resetGblEffect()
@@ -1571,6 +1726,12 @@ func systemScriptInit(l *lua.LState) {
 		sys.lifebar = *lb
 		return 0
 	})
+	luaRegister(l, "loadPalFXPresets", func(l *lua.LState) int {
+		if err := loadPalFXPresets(strArg(l, 1)); err != nil {
+			l.RaiseError("\nCan't load %v: %v\n", strArg(l, 1), err.Error())
+		}
+		return 0
+	})
 	luaRegister(l, "loadStart", func(l *lua.LState) int {
 		if sys.gameMode != "randomtest" {
 			for k, v := range sys.sel.selected {
@@ -1634,8 +1795,25 @@ func systemScriptInit(l *lua.LState) {
 		return 0
 	})
 	luaRegister(l, "playBGM", func(l *lua.LState) int {
+		luaOpenBgm(l, &sys.bgm, 1)
+		return 0
+	})
+	// Same as playBGM, in the music slot given first
+	luaRegister(l, "playBGMSlot", func(l *lua.LState) int {
+		luaOpenBgm(l, bgmSlotArg(l, 1), 2)
+		return 0
+	})
+	// Same arguments as playBGM, but takes a table of stem files, plus an
+	// optional table of starting stem volumes as the 9th argument
+	luaRegister(l, "playBGMStems", func(l *lua.LState) int {
 		var loop, volume, loopstart, loopend, startposition int = 1, 100, 0, 0, 0
 		var freqmul float32 = 1.0
+		crossfade := 0
+		var files []string
+		var volumes []int
+		tableArg(l, 1).ForEach(func(_, value lua.LValue) {
+			files = append(files, lua.LVAsString(value))
+		})
 		if l.GetTop() >= 2 {
 			loop = int(numArg(l, 2))
 		}
@@ -1654,7 +1832,15 @@ func systemScriptInit(l *lua.LState) {
 		if l.GetTop() >= 7 {
 			freqmul = ClampF(float32(numArg(l, 7)), 0.01, 5.0)
 		}
-		sys.bgm.Open(strArg(l, 1), loop, volume, loopstart, loopend, startposition, freqmul)
+		if l.GetTop() >= 8 {
+			crossfade = int(numArg(l, 8))
+		}
+		if l.GetTop() >= 9 {
+			tableArg(l, 9).ForEach(func(_, value lua.LValue) {
+				volumes = append(volumes, int(lua.LVAsNumber(value)))
+			})
+		}
+		sys.bgm.OpenStems(files, volumes, loop, volume, loopstart, loopend, startposition, freqmul, crossfade)
 		return 0
 	})
 	luaRegister(l, "playerBufReset", func(*lua.LState) int {
@@ -1715,6 +1901,10 @@ func systemScriptInit(l *lua.LState) {
 		}
 		return 0
 	})
+	luaRegister(l, "reinitAudio", func(l *lua.LState) int {
+		l.Push(lua.LBool(ReinitAudio() == nil))
+		return 1
+	})
 	luaRegister(l, "reload", func(*lua.LState) int {
 		sys.reloadFlg = true
 		for i := range sys.reloadCharSlot {
@@ -1789,6 +1979,14 @@ func systemScriptInit(l *lua.LState) {
 		sys.roundResetFlg = true
 		return 0
 	})
+	luaRegister(l, "saveBGMPosition", func(l *lua.LState) int {
+		bgm := &sys.bgm
+		if l.GetTop() >= 1 {
+			bgm = bgmSlotArg(l, 1)
+		}
+		bgm.SavePosition()
+		return 0
+	})
 	luaRegister(l, "screenshot", func(*lua.LState) int {
 		captureScreen()
 		return 0
@@ -1855,9 +2053,37 @@ func systemScriptInit(l *lua.LState) {
 		sys.loadStart()
 		return 0
 	})
+	luaRegister(l, "setBGMAnalysis", func(l *lua.LState) int {
+		sys.bgmAnalysis = boolArg(l, 1)
+		if l.GetTop() >= 2 {
+			sys.bgmAnalyzer.decay = ClampF(float32(numArg(l, 2)), 0, 0.99)
+		}
+		return 0
+	})
+	luaRegister(l, "setBGMCrossfade", func(l *lua.LState) int {
+		sys.bgmCrossfade = int(Max(0, int32(numArg(l, 1))))
+		return 0
+	})
+	luaRegister(l, "setBGMStemVolume", func(l *lua.LState) int {
+		ticks := 0
+		if l.GetTop() >= 3 {
+			ticks = int(numArg(l, 3))
+		}
+		// Stems are numbered from 1, as in the table given to playBGMStems
+		sys.bgm.SetStemVolume(int(numArg(l, 1))-1, int(numArg(l, 2)), ticks)
+		return 0
+	})
 	luaRegister(l, "setBGMFreqMul", func(l *lua.LState) int {
 		freqmul := ClampF(float32(numArg(l, 1)), 0.01, 5.0)
-		sys.bgm.SetFreqMul(freqmul)
+		var glide int32
+		if l.GetTop() >= 2 {
+			glide = int32(numArg(l, 2))
+		}
+		timeStretch := sys.bgmTimeStretch
+		if l.GetTop() >= 3 {
+			timeStretch = boolArg(l, 3)
+		}
+		sys.bgm.SetFreqMul(freqmul, glide, timeStretch)
 		return 0
 	})
 	luaRegister(l, "setBGMLoopPoints", func(l *lua.LState) int {
@@ -1871,6 +2097,17 @@ func systemScriptInit(l *lua.LState) {
 		sys.bgm.SetLoopPoints(loopstart, loopend)
 		return 0
 	})
+	luaRegister(l, "setBGMLoopPointsSeconds", func(l *lua.LState) int {
+		var loopstart, loopend float64 = 0, 0
+		if l.GetTop() >= 1 {
+			loopstart = float64(numArg(l, 1))
+		}
+		if l.GetTop() >= 2 {
+			loopend = float64(numArg(l, 2))
+		}
+		sys.bgm.SetLoopPointsSeconds(loopstart, loopend)
+		return 0
+	})
 	luaRegister(l, "setBGMPosition", func(l *lua.LState) int {
 		var position int = 0
 		if numArg(l, 1) > 1 {
@@ -1879,6 +2116,10 @@ func systemScriptInit(l *lua.LState) {
 		sys.bgm.Seek(position)
 		return 0
 	})
+	luaRegister(l, "setBGMPositionSeconds", func(l *lua.LState) int {
+		sys.bgm.SeekSeconds(float64(numArg(l, 1)))
+		return 0
+	})
 	luaRegister(l, "sffNew", func(l *lua.LState) int {
 		if l.GetTop() == 0 {
 			l.Push(newUserData(l, newSff()))
@@ -1933,6 +2174,42 @@ func systemScriptInit(l *lua.LState) {
 		sys.audioDucking = boolArg(l, 1)
 		return 0
 	})
+	luaRegister(l, "setAudioEq", func(l *lua.LState) int {
+		band := int(numArg(l, 1))
+		if band < 1 || band > 3 {
+			l.RaiseError("\nInvalid EQ band: %v\n", band)
+		}
+		sys.audioEq.SetBand(band-1, ClampF(float32(numArg(l, 2)), -24, 24),
+			ClampF(float32(numArg(l, 3)), 20, 20000), ClampF(float32(numArg(l, 4)), 0.1, 10))
+		return 0
+	})
+	luaRegister(l, "setAudioOutputMode", func(l *lua.LState) int {
+		sys.audioOutputMode.SetMode(parseAudioOutputMode(strArg(l, 1)))
+		return 0
+	})
+	luaRegister(l, "setAudioFocusLoss", func(l *lua.LState) int {
+		sys.focusLossMode = parseFocusLossMode(strArg(l, 1))
+		if l.GetTop() >= 2 {
+			sys.focusLossVolume = int(Clamp(int32(numArg(l, 2)), 0, 100))
+		}
+		return 0
+	})
+	luaRegister(l, "setAudioResampleQuality", func(l *lua.LState) int {
+		sys.bgmResampleQuality = int(Clamp(int32(numArg(l, 1)), 1, 4))
+		sys.sfxResampleQuality = sys.bgmResampleQuality
+		if l.GetTop() >= 2 {
+			sys.sfxResampleQuality = int(Clamp(int32(numArg(l, 2)), 1, 4))
+		}
+		return 0
+	})
+	luaRegister(l, "setAudioSampleRate", func(l *lua.LState) int {
+		rate := int(numArg(l, 1))
+		if !validAudioSampleRate(rate) {
+			l.RaiseError("\nUnsupported sample rate: %v\n", rate)
+		}
+		l.Push(lua.LBool(SetAudioSampleRate(rate) == nil))
+		return 1
+	})
 	luaRegister(l, "setAutoguard", func(l *lua.LState) int {
 		pn := int(numArg(l, 1))
 		if pn < 1 || pn > MaxSimul*2+MaxAttachedChar {
@@ -2254,7 +2531,7 @@ func systemScriptInit(l *lua.LState) {
 		return 0
 	})
 	luaRegister(l, "setPanningRange", func(l *lua.LState) int {
-		sys.panningRange = float32(numArg(l, 1))
+		sys.panningRange = ClampF(float32(numArg(l, 1)), 0, 100)
 		return 0
 	})
 	luaRegister(l, "setPlayers", func(l *lua.LState) int {
@@ -2333,6 +2610,19 @@ func systemScriptInit(l *lua.LState) {
 		}
 		return 0
 	})
+	luaRegister(l, "setTeamPalFX", func(l *lua.LState) int {
+		tn := int(numArg(l, 1))
+		if tn < 1 || tn > 2 {
+			l.RaiseError("\nInvalid team side: %v\n", tn)
+		}
+		pf := &sys.teamPalFX[tn-1]
+		pf.clear()
+		// Lasts until cleared unless the table says otherwise
+		pf.time = -1
+		readLuaPalFX(l, tableArg(l, 2), pf)
+		pf.step()
+		return 0
+	})
 	luaRegister(l, "setTime", func(*lua.LState) int {
 		sys.time = int32(numArg(l, 1))
 		return 0
@@ -2341,20 +2631,33 @@ func systemScriptInit(l *lua.LState) {
 		sys.lifebar.ti.framespercount = int32(numArg(l, 1))
 		return 0
 	})
+	luaRegister(l, "setVolumeCurve", func(l *lua.LState) int {
+		sys.volumeCurve = parseVolumeCurve(strArg(l, 1))
+		sys.eachBgm((*Bgm).UpdateVolume)
+		return 0
+	})
 	luaRegister(l, "setVolumeMaster", func(l *lua.LState) int {
 		sys.masterVolume = int(numArg(l, 1))
-		sys.bgm.UpdateVolume()
+		sys.eachBgm((*Bgm).UpdateVolume)
 		return 0
 	})
 	luaRegister(l, "setVolumeBgm", func(l *lua.LState) int {
 		sys.bgmVolume = int(numArg(l, 1))
-		sys.bgm.UpdateVolume()
+		sys.eachBgm((*Bgm).UpdateVolume)
 		return 0
 	})
 	luaRegister(l, "setVolumeSfx", func(l *lua.LState) int {
 		sys.wavVolume = int(numArg(l, 1))
 		return 0
 	})
+	luaRegister(l, "setVolumePlayer", func(l *lua.LState) int {
+		pn := int(numArg(l, 1))
+		if pn < 1 || pn > len(sys.playerVolume) {
+			l.RaiseError("\nInvalid player number: %v\n", pn)
+		}
+		sys.playerVolume[pn-1] = int32(Clamp(int32(numArg(l, 2)), 0, 100))
+		return 0
+	})
 	luaRegister(l, "setWinCount", func(*lua.LState) int {
 		tn := int(numArg(l, 1))
 		if tn < 1 || tn > 2 {
@@ -2404,7 +2707,7 @@ func systemScriptInit(l *lua.LState) {
 		if l.GetTop() >= 5 {
 			pan = float32(numArg(l, 5))
 		}
-		var loopstart, loopend, startposition int
+		var loopstart, loopend, startposition, startms int
 		if l.GetTop() >= 6 {
 			loopstart = int(numArg(l, 6))
 		}
@@ -2414,7 +2717,10 @@ func systemScriptInit(l *lua.LState) {
 		if l.GetTop() >= 8 {
 			startposition = int(numArg(l, 8))
 		}
-		s.play([...]int32{int32(numArg(l, 2)), int32(numArg(l, 3))}, volumescale, pan, loopstart, loopend, startposition)
+		if l.GetTop() >= 9 {
+			startms = int(numArg(l, 9))
+		}
+		s.play([...]int32{int32(numArg(l, 2)), int32(numArg(l, 3))}, volumescale, pan, loopstart, loopend, startposition, startms)
 		return 0
 	})
 	luaRegister(l, "sndPlaying", func(*lua.LState) int {
@@ -2429,6 +2735,13 @@ func systemScriptInit(l *lua.LState) {
 		l.Push(lua.LBool(f))
 		return 1
 	})
+	luaRegister(l, "sndPosition", func(*lua.LState) int {
+		s, ok := toUserData(l, 1).(*Snd)
+		if !ok {
+			userDataError(l, 1, s)
+		}
+		return pushSoundPosition(l, sys.soundChannels.FindSource(s, [...]int32{int32(numArg(l, 2)), int32(numArg(l, 3))}))
+	})
 	luaRegister(l, "sndStop", func(l *lua.LState) int {
 		s, ok := toUserData(l, 1).(*Snd)
 		if !ok {
@@ -2437,6 +2750,14 @@ func systemScriptInit(l *lua.LState) {
 		s.stop([...]int32{int32(numArg(l, 2)), int32(numArg(l, 3))})
 		return 0
 	})
+	luaRegister(l, "sndStopGroup", func(l *lua.LState) int {
+		s, ok := toUserData(l, 1).(*Snd)
+		if !ok {
+			userDataError(l, 1, s)
+		}
+		s.stopGroup(int32(numArg(l, 2)))
+		return 0
+	})
 	luaRegister(l, "sszRandom", func(l *lua.LState) int {
 		l.Push(lua.LNumber(Random()))
 		return 1
@@ -2445,6 +2766,18 @@ func systemScriptInit(l *lua.LState) {
 		sys.step = true
 		return 0
 	})
+	luaRegister(l, "stopBGM", func(l *lua.LState) int {
+		bgm := &sys.bgm
+		if l.GetTop() >= 1 {
+			bgm = bgmSlotArg(l, 1)
+		}
+		fade := 0
+		if l.GetTop() >= 2 {
+			fade = int(numArg(l, 2))
+		}
+		bgm.Stop(fade)
+		return 0
+	})
 	luaRegister(l, "synchronize", func(*lua.LState) int {
 		if err := sys.synchronize(); err != nil {
 			l.RaiseError(err.Error())
@@ -2459,6 +2792,18 @@ func systemScriptInit(l *lua.LState) {
 		ts.Draw()
 		return 0
 	})
+	luaRegister(l, "textImgGetBounds", func(*lua.LState) int {
+		ts, ok := toUserData(l, 1).(*TextSprite)
+		if !ok {
+			userDataError(l, 1, ts)
+		}
+		b := ts.Bounds()
+		l.Push(lua.LNumber((b[0] - sys.luaSpriteOffsetX) * sys.luaSpriteScale))
+		l.Push(lua.LNumber(b[1] * sys.luaSpriteScale))
+		l.Push(lua.LNumber(b[2] * sys.luaSpriteScale))
+		l.Push(lua.LNumber(b[3] * sys.luaSpriteScale))
+		return 4
+	})
 	luaRegister(l, "textImgNew", func(*lua.LState) int {
 		l.Push(newUserData(l, NewTextSprite()))
 		return 1
@@ -2469,6 +2814,22 @@ func systemScriptInit(l *lua.LState) {
 			userDataError(l, 1, ts)
 		}
 		ts.align = int32(numArg(l, 2))
+		if l.GetTop() >= 3 {
+			ts.justifyWidth = float32(numArg(l, 3)) / sys.luaSpriteScale
+		}
+		return 0
+	})
+	// Truetype text isn't rotated or sheared, see TextTransform
+	luaRegister(l, "textImgSetAngle", func(*lua.LState) int {
+		ts, ok := toUserData(l, 1).(*TextSprite)
+		if !ok {
+			userDataError(l, 1, ts)
+		}
+		ts.transform.angle = float32(numArg(l, 2))
+		if l.GetTop() >= 4 {
+			ts.transform.anchor = [...]float32{float32(numArg(l, 3)) / sys.luaSpriteScale,
+				float32(numArg(l, 4)) / sys.luaSpriteScale}
+		}
 		return 0
 	})
 	luaRegister(l, "textImgSetBank", func(*lua.LState) int {
@@ -2517,6 +2878,17 @@ func systemScriptInit(l *lua.LState) {
 		ts.xscl, ts.yscl = float32(numArg(l, 2))/sys.luaSpriteScale, float32(numArg(l, 3))/sys.luaSpriteScale
 		return 0
 	})
+	luaRegister(l, "textImgSetShake", func(*lua.LState) int {
+		ts, ok := toUserData(l, 1).(*TextSprite)
+		if !ok {
+			userDataError(l, 1, ts)
+		}
+		ts.effects.shake = float32(numArg(l, 2))
+		if l.GetTop() >= 3 {
+			ts.effects.seed = int32(numArg(l, 3))
+		}
+		return 0
+	})
 	luaRegister(l, "textImgSetText", func(*lua.LState) int {
 		ts, ok := toUserData(l, 1).(*TextSprite)
 		if !ok {
@@ -2525,6 +2897,31 @@ func systemScriptInit(l *lua.LState) {
 		ts.text = strArg(l, 2)
 		return 0
 	})
+	luaRegister(l, "textImgSetTick", func(*lua.LState) int {
+		ts, ok := toUserData(l, 1).(*TextSprite)
+		if !ok {
+			userDataError(l, 1, ts)
+		}
+		ts.effects.tick = int32(numArg(l, 2))
+		return 0
+	})
+	luaRegister(l, "textImgSetTypewriter", func(*lua.LState) int {
+		ts, ok := toUserData(l, 1).(*TextSprite)
+		if !ok {
+			userDataError(l, 1, ts)
+		}
+		ts.effects.cps = float32(numArg(l, 2))
+		return 0
+	})
+	luaRegister(l, "textImgSetWave", func(*lua.LState) int {
+		ts, ok := toUserData(l, 1).(*TextSprite)
+		if !ok {
+			userDataError(l, 1, ts)
+		}
+		ts.effects.waveAmp = float32(numArg(l, 2))
+		ts.effects.wavePeriod = int32(numArg(l, 3))
+		return 0
+	})
 	luaRegister(l, "textImgSetWindow", func(*lua.LState) int {
 		ts, ok := toUserData(l, 1).(*TextSprite)
 		if !ok {
@@ -2534,6 +2931,22 @@ func systemScriptInit(l *lua.LState) {
 			float32(numArg(l, 4))/sys.luaSpriteScale, float32(numArg(l, 5))/sys.luaSpriteScale)
 		return 0
 	})
+	luaRegister(l, "textImgSetWrap", func(*lua.LState) int {
+		ts, ok := toUserData(l, 1).(*TextSprite)
+		if !ok {
+			userDataError(l, 1, ts)
+		}
+		ts.wrap = boolArg(l, 2)
+		return 0
+	})
+	luaRegister(l, "textImgSetXShear", func(*lua.LState) int {
+		ts, ok := toUserData(l, 1).(*TextSprite)
+		if !ok {
+			userDataError(l, 1, ts)
+		}
+		ts.transform.xshear = float32(numArg(l, 2))
+		return 0
+	})
 	luaRegister(l, "toggleClsnDraw", func(*lua.LState) int {
 		if !sys.allowDebugMode {
 			return 0
@@ -2545,6 +2958,15 @@ func systemScriptInit(l *lua.LState) {
 		}
 		return 0
 	})
+	luaRegister(l, "toggleSoundDebugDraw", func(*lua.LState) int {
+		sys.soundDebugDraw = !sys.soundDebugDraw
+		sys.resetSoundStats()
+		return 0
+	})
+	luaRegister(l, "toggleAudioRecording", func(*lua.LState) int {
+		sys.audioRecorder.Toggle()
+		return 0
+	})
 	luaRegister(l, "toggleDebugDraw", func(*lua.LState) int {
 		if !sys.allowDebugMode {
 			return 0
@@ -2685,7 +3107,7 @@ func systemScriptInit(l *lua.LState) {
 		if !ok {
 			userDataError(l, 1, s)
 		}
-		sys.soundChannels.Play(s, 100, 0.0, 0, 0, 0)
+		sys.soundChannels.Play(s, 100, 0.0, 0, 0, 0, 0)
 		return 0
 	})
 }
@@ -2865,19 +3287,23 @@ func triggerFunctions(l *lua.LState) {
 		return 1
 	})
 	luaRegister(l, "bgmlength", func(*lua.LState) int {
-		if sys.bgm.streamer == nil {
-			l.Push(lua.LNumber(0))
-		} else {
-			l.Push(lua.LNumber(int32(sys.bgm.streamer.Len())))
-		}
+		l.Push(lua.LNumber(int32(sys.bgm.Length())))
 		return 1
 	})
 	luaRegister(l, "bgmposition", func(*lua.LState) int {
-		if sys.bgm.streamer == nil {
-			l.Push(lua.LNumber(0))
-		} else {
-			l.Push(lua.LNumber(int32(sys.bgm.streamer.Position())))
+		l.Push(lua.LNumber(int32(sys.bgm.Position())))
+		return 1
+	})
+	luaRegister(l, "bgmspectrum", func(*lua.LState) int {
+		tbl := l.NewTable()
+		for _, v := range sys.bgmAnalyzer.bands {
+			tbl.Append(lua.LNumber(v))
 		}
+		l.Push(tbl)
+		return 1
+	})
+	luaRegister(l, "bgmtrackchanged", func(*lua.LState) int {
+		l.Push(lua.LBool(sys.bgm.TrackChanged()))
 		return 1
 	})
 	luaRegister(l, "bgmvar", func(*lua.LState) int {
@@ -2885,11 +3311,20 @@ func triggerFunctions(l *lua.LState) {
 		arg := strings.ToLower(strArg(l, 1))
 
 		// If the streamer is nil, return nil for strings
-		if arg == "filename" {
+		if arg == "filename" || arg == "title" || arg == "artist" || arg == "album" {
 			if sys.bgm.streamer == nil {
 				l.Push(lua.LNil)
 			} else {
-				l.Push(lua.LString(sys.bgm.filename))
+				s, tags := sys.bgm.filename, sys.bgm.Tags()
+				switch arg {
+				case "title":
+					s = tags.title
+				case "artist":
+					s = tags.artist
+				case "album":
+					s = tags.album
+				}
+				l.Push(lua.LString(s))
 			}
 			// Return a number
 		} else {
@@ -2897,8 +3332,14 @@ func triggerFunctions(l *lua.LState) {
 
 			if sys.bgm.streamer != nil {
 				switch arg {
+				case "inloop":
+					ln = lua.LNumber(Btoi(sys.bgm.InLoop()))
 				case "length":
-					ln = lua.LNumber(int32(sys.bgm.streamer.Len()))
+					ln = lua.LNumber(int32(sys.bgm.Length()))
+				case "level":
+					ln = lua.LNumber(sys.bgmAnalyzer.level)
+				case "lengthseconds":
+					ln = lua.LNumber(sys.bgm.LengthSeconds())
 				case "loopend":
 					if sl, ok := sys.bgm.volctrl.Streamer.(*StreamLooper); ok {
 						ln = lua.LNumber(sl.loopend)
@@ -2908,7 +3349,9 @@ func triggerFunctions(l *lua.LState) {
 						ln = lua.LNumber(sl.loopstart)
 					}
 				case "position":
-					ln = lua.LNumber(int32(sys.bgm.streamer.Position()))
+					ln = lua.LNumber(int32(sys.bgm.Position()))
+				case "positionseconds":
+					ln = lua.LNumber(sys.bgm.PositionSeconds())
 				case "startposition":
 					ln = lua.LNumber(int32(sys.bgm.startPos))
 				}
@@ -4411,6 +4854,11 @@ func triggerFunctions(l *lua.LState) {
 		l.Push(lua.LNumber(sys.gameFPS))
 		return 1
 	})
+	luaRegister(l, "soundchannelstats", func(*lua.LState) int {
+		l.Push(lua.LNumber(sys.soundPlaysDropped))
+		l.Push(lua.LNumber(sys.soundChannelsStolen))
+		return 2
+	})
 	luaRegister(l, "gamemode", func(*lua.LState) int {
 		if l.GetTop() == 0 {
 			l.Push(lua.LString(sys.gameMode))
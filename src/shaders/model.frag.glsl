@@ -1,7 +1,7 @@
 uniform sampler2D tex;
 uniform vec4 baseColorFactor;
 uniform vec3 add, mult;
-uniform float gray, hue;
+uniform float gray, hue, contrast, gamma, posterize;
 uniform bool textured;
 uniform bool neg;
 uniform bool enableAlpha;
@@ -44,4 +44,13 @@ void main(void) {
 	if (neg) gl_FragColor.rgb = neg_base - gl_FragColor.rgb;
 	gl_FragColor.rgb = mix(gl_FragColor.rgb, vec3((gl_FragColor.r + gl_FragColor.g + gl_FragColor.b) / 3.0), gray) + add*gl_FragColor.a;
 	gl_FragColor.rgb *= mult;
+	if (contrast != 1.0 || gamma != 1.0 || posterize > 1.0) {
+		vec3 s = clamp(gl_FragColor.rgb / gl_FragColor.a, 0.0, 1.0);
+		s = clamp((s - 0.5) * contrast + 0.5, 0.0, 1.0);
+		s = pow(s, vec3(1.0 / max(gamma, 1.0 / 256.0)));
+		if (posterize > 1.0) {
+			s = floor(s * (posterize - 1.0) + 0.5) / (posterize - 1.0);
+		}
+		gl_FragColor.rgb = s * gl_FragColor.a;
+	}
 }
\ No newline at end of file
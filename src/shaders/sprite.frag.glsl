@@ -1,12 +1,14 @@
 uniform sampler2D tex;
 uniform sampler2D pal;
+uniform sampler2D lut;
 
 uniform vec4 x1x2x4x3;
 uniform vec4 tint;
 uniform vec3 add, mult;
-uniform float alpha, gray, hue;
+uniform float alpha, gray, hue, contrast, gamma, posterize;
+uniform vec2 palrange;
 uniform int mask;
-uniform bool isFlat, isRgba, isTrapez, neg;
+uniform bool isFlat, isRgba, isTrapez, neg, useLut;
 
 varying vec2 texcoord;
 
@@ -20,6 +22,17 @@ vec3 hue_shift(vec3 color, float dhue) {
 	) + dot(vec3(0.299, 0.587, 0.114), color) * (1.0 - c);
 }
 
+// 16x16x16 color table stored as 16 blue slices of 16x16 red/green texels
+vec3 lut_lookup(vec3 color) {
+	float b = color.b * 15.0;
+	float b0 = floor(b);
+	float b1 = min(b0 + 1.0, 15.0);
+	vec2 uv = vec2((color.r * 15.0 + 0.5) / 256.0, (color.g * 15.0 + 0.5) / 16.0);
+	vec3 c0 = texture2D(lut, uv + vec2(b0 / 16.0, 0.0)).rgb;
+	vec3 c1 = texture2D(lut, uv + vec2(b1 / 16.0, 0.0)).rgb;
+	return mix(c0, c1, b - b0);
+}
+
 void main(void) {
 	if (isFlat) {
 		gl_FragColor = tint;
@@ -34,6 +47,19 @@ void main(void) {
 		}
 
 		vec4 c = texture2D(tex, uv);
+		if (useLut) {
+			// Only used for RGBA sprites; the table covers the whole PalFX pipeline
+			if (mask == -1) {
+				c.a = 1.0;
+			}
+			if (c.a > 0.0) {
+				c.rgb = lut_lookup(clamp(c.rgb / c.a, 0.0, 1.0)) * c.a;
+			}
+			c *= alpha;
+			c.rgb = mix(c.rgb, tint.rgb * c.a, tint.a);
+			gl_FragColor = c;
+			return;
+		}
 		vec3 neg_base = vec3(1.0);
 		vec3 final_add = add;
 		vec4 final_mul = vec4(mult, alpha);
@@ -46,10 +72,18 @@ void main(void) {
 			final_add *= c.a;
 			final_mul.rgb *= alpha;
 		} else {
+			float index = floor(c.r * 255.0 + 0.5);
 			c = texture2D(pal, vec2(c.r*0.9966, 0.5));
 			if (mask == -1) {
 				c.a = 1.0;
 			}
+			// Colors outside the palette range skip the PalFX
+			if (index < palrange.x || index > palrange.y) {
+				c.a *= alpha;
+				c.rgb = mix(c.rgb, tint.rgb * c.a, tint.a);
+				gl_FragColor = c;
+				return;
+			}
 		}
 		if (hue != 0) {
 			c.rgb = hue_shift(c.rgb,hue);			
@@ -57,6 +91,19 @@ void main(void) {
 		if (neg) c.rgb = neg_base - c.rgb;
 		c.rgb = mix(c.rgb, vec3((c.r + c.g + c.b) / 3.0), gray) + final_add;
 		c *= final_mul;
+		if (contrast != 1.0 || gamma != 1.0 || posterize > 1.0) {
+			// These stages work on straight color, so undo premultiplication
+			float pm = isRgba ? c.a : 1.0;
+			if (pm > 0.0) {
+				vec3 s = clamp(c.rgb / pm, 0.0, 1.0);
+				s = clamp((s - 0.5) * contrast + 0.5, 0.0, 1.0);
+				s = pow(s, vec3(1.0 / max(gamma, 1.0 / 256.0)));
+				if (posterize > 1.0) {
+					s = floor(s * (posterize - 1.0) + 0.5) / (posterize - 1.0);
+				}
+				c.rgb = s * pm;
+			}
+		}
 
 		// Add a final tint (used for shadows); make sure the result has premultiplied alpha
 		c.rgb = mix(c.rgb, tint.rgb * c.a, tint.a);
@@ -1,11 +1,26 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/sha256"
 	"encoding/binary"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"math"
+	"math/cmplx"
+	"math/rand"
 	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf16"
 
 	"github.com/ikemen-engine/beep"
 	"github.com/ikemen-engine/beep/effects"
@@ -15,16 +30,431 @@ import (
 	"github.com/ikemen-engine/beep/speaker"
 	"github.com/ikemen-engine/beep/vorbis"
 	"github.com/ikemen-engine/beep/wav"
+	"github.com/mewkiz/flac"
 )
 
 const (
-	audioOutLen          = 2048
-	audioFrequency       = 48000
-	audioPrecision       = 4
-	audioResampleQuality = 1
-	audioSoundFont       = "sound/soundfont.sf2" // default path for MIDI soundfont
+	audioOutLen    = 2048
+	audioPrecision = 4
+	audioSoundFont = "sound/soundfont.sf2" // default path for MIDI soundfont
 )
 
+// Output sample rate, from the AudioSampleRate setting. Only changed through
+// SetAudioSampleRate, which reopens the speaker.
+var audioFrequency = 48000
+
+// ------------------------------------------------------------------
+// Output device
+
+// (Re)opens the speaker and plugs the sound output back in. The music resumes
+// from where it was, as nothing reads from it in between. Only the system's
+// default output device is supported: the audio backend (oto) can't list or
+// pick devices, so after plugging in a headset, make it the default device and
+// call this to move the sound over to it.
+func ReinitAudio() error {
+	// Init closes the speaker while holding its lock, which deadlocks if
+	// its update loop is waiting for that lock, so close it first.
+	speaker.Close()
+	if err := speaker.Init(beep.SampleRate(audioFrequency), audioOutLen); err != nil {
+		sys.appendToConsole(fmt.Sprintf("WARNING: Failed to open audio device: %v", err))
+		sys.errLog.Printf("Failed to open audio device: %v", err)
+		return err
+	}
+	if sys.audioOut != nil {
+		speaker.Play(sys.audioOut)
+	}
+	return nil
+}
+
+// Returns whether rate is one of the supported output sample rates.
+func validAudioSampleRate(rate int) bool {
+	switch rate {
+	case 22050, 32000, 44100, 48000, 88200, 96000:
+		return true
+	}
+	return false
+}
+
+// Switches the output to another sample rate without restarting. Everything
+// derived from the rate is worked out again, so that sounds already playing
+// keep their pitch.
+func SetAudioSampleRate(rate int) error {
+	if rate == audioFrequency {
+		return nil
+	}
+	// The file header was written with the old rate
+	sys.audioRecorder.Stop()
+	speaker.Close()
+	audioFrequency = rate
+	sys.audioEq.refresh()
+	if sys.audioLimiter != nil {
+		sys.audioLimiter.setRate()
+	}
+	sys.eachBgm(func(bgm *Bgm) { bgm.setRatio(bgm.freqmul) })
+	sys.soundChannels.refreshRates()
+	for _, ch := range sys.chars {
+		for _, c := range ch {
+			c.soundChannels.refreshRates()
+		}
+	}
+	return ReinitAudio()
+}
+
+// ------------------------------------------------------------------
+// OutputMode
+
+type AudioOutputMode int32
+
+const (
+	AudioStereo AudioOutputMode = iota
+	AudioSwapped
+	AudioMono
+)
+
+func parseAudioOutputMode(s string) AudioOutputMode {
+	switch strings.ToLower(s) {
+	case "swapped":
+		return AudioSwapped
+	case "mono":
+		return AudioMono
+	}
+	return AudioStereo
+}
+
+// Swaps the channels or downmixes them to mono at the very end of the
+// output, so that it applies to music and sound effects alike. Being the
+// end, it also times the mixing, but only while the sound debug display
+// asks for it, so that the default stereo mode passes straight through.
+type OutputMode struct {
+	streamer beep.Streamer
+	mode     AudioOutputMode
+	timed    bool    // set by the debug display, cleared once a buffer is timed
+	load     float64 // time mixing takes, as a share of the time it plays
+}
+
+func (o *OutputMode) Stream(samples [][2]float64) (n int, ok bool) {
+	if o.mode == AudioStereo && !o.timed {
+		return o.streamer.Stream(samples)
+	}
+	var start time.Time
+	if o.timed {
+		start = time.Now()
+	}
+	n, ok = o.streamer.Stream(samples)
+	if o.timed && n > 0 {
+		played := float64(n) / float64(audioFrequency)
+		o.load += (time.Since(start).Seconds()/played - o.load) / 8
+		o.timed = false
+	}
+	switch o.mode {
+	case AudioSwapped:
+		for i := range samples[:n] {
+			samples[i][0], samples[i][1] = samples[i][1], samples[i][0]
+		}
+	case AudioMono:
+		for i := range samples[:n] {
+			m := (samples[i][0] + samples[i][1]) / 2
+			samples[i] = [2]float64{m, m}
+		}
+	}
+	return n, ok
+}
+
+func (o *OutputMode) Err() error {
+	return o.streamer.Err()
+}
+
+func (o *OutputMode) SetMode(mode AudioOutputMode) {
+	speaker.Lock()
+	o.mode = mode
+	speaker.Unlock()
+}
+
+// ------------------------------------------------------------------
+// SoundClock
+
+// Counts the samples the sound effects mixer has mixed. It mixes in chunks
+// no bigger than the mixer's own, so that while a chunk is mixed, pos is the
+// output sample the chunk starts at. Fields must only be used with the
+// speaker locked.
+type SoundClock struct {
+	streamer beep.Streamer
+	pos      int64
+	// Where the last output buffer started, and when it was mixed
+	bufPos  int64
+	bufTime time.Time
+}
+
+func (c *SoundClock) Stream(samples [][2]float64) (n int, ok bool) {
+	c.bufPos, c.bufTime = c.pos, time.Now()
+	for n < len(samples) {
+		end := n + 512
+		if end > len(samples) {
+			end = len(samples)
+		}
+		sn, sok := c.streamer.Stream(samples[n:end])
+		n += sn
+		c.pos += int64(sn)
+		if !sok || sn == 0 {
+			return n, n > 0
+		}
+	}
+	return n, true
+}
+
+func (c *SoundClock) Err() error {
+	return c.streamer.Err()
+}
+
+// Estimates the output sample that plays now, from the time the last
+// buffer was mixed.
+func (c *SoundClock) now() int64 {
+	if c.bufTime.IsZero() {
+		return c.pos
+	}
+	return c.bufPos + int64(time.Since(c.bufTime).Seconds()*float64(audioFrequency))
+}
+
+// Holds a sound back until the output reaches the sample it's due at. Sounds
+// are due a buffer after the tick that played them started, so they start
+// the same time after it wherever the tick fell in the output buffer.
+type soundStart struct {
+	streamer beep.Streamer
+	at       int64
+	started  bool
+}
+
+func (s *soundStart) Stream(samples [][2]float64) (n int, ok bool) {
+	if !s.started {
+		// A sound due further out than a late tick could explain starts
+		// right away
+		wait := s.at - sys.soundClock.pos
+		if wait <= 0 || wait > 2*audioOutLen {
+			s.started = true
+		} else if wait >= int64(len(samples)) {
+			for i := range samples {
+				samples[i] = [2]float64{}
+			}
+			return len(samples), true
+		} else {
+			s.started = true
+			for i := range samples[:wait] {
+				samples[i] = [2]float64{}
+			}
+			n, ok = s.streamer.Stream(samples[wait:])
+			return int(wait) + n, ok
+		}
+	}
+	return s.streamer.Stream(samples)
+}
+
+func (s *soundStart) Err() error {
+	return s.streamer.Err()
+}
+
+// ------------------------------------------------------------------
+// Focus loss
+
+// What the sound does while the window is in the background
+type FocusLossMode int32
+
+const (
+	FocusLossPlay FocusLossMode = iota
+	// Turned down to focusLossVolume percent
+	FocusLossFade
+	// Faded out, then paused
+	FocusLossPause
+)
+
+func parseFocusLossMode(s string) FocusLossMode {
+	switch strings.ToLower(s) {
+	case "fade":
+		return FocusLossFade
+	case "pause":
+		return FocusLossPause
+	}
+	return FocusLossPlay
+}
+
+// Ticks the focus gain takes to ramp down or back up
+const focusFadeTicks = 15
+
+// ------------------------------------------------------------------
+// AudioRecorder
+
+// Passes the final mix through, and copies it into a WAV file while
+// recording. Buffers go to the file through a goroutine, so a slow disk
+// drops buffers instead of stalling playback.
+type AudioRecorder struct {
+	streamer beep.Streamer
+	rec      *audioRecording
+}
+
+type audioRecording struct {
+	path    string
+	file    *os.File
+	buffers chan []byte
+	done    chan struct{}
+	size    uint32
+	dropped int
+}
+
+func (a *AudioRecorder) Stream(samples [][2]float64) (n int, ok bool) {
+	n, ok = a.streamer.Stream(samples)
+	if a.rec != nil {
+		buf := make([]byte, n*4)
+		for i := range samples[:n] {
+			for c := range samples[i] {
+				v := int16(math.Max(-1, math.Min(1, samples[i][c])) * (1<<15 - 1))
+				binary.LittleEndian.PutUint16(buf[i*4+c*2:], uint16(v))
+			}
+		}
+		select {
+		case a.rec.buffers <- buf:
+		default:
+			a.rec.dropped++
+		}
+	}
+	return n, ok
+}
+
+func (a *AudioRecorder) Err() error {
+	return a.streamer.Err()
+}
+
+func (a *AudioRecorder) Recording() bool {
+	return a.rec != nil
+}
+
+// Starts recording to the next free ikemenNNN.wav in the screenshot folder.
+func (a *AudioRecorder) Start() error {
+	if a.rec != nil {
+		return nil
+	}
+	var path string
+	var f *os.File
+	for i := 0; i < 1000 && f == nil; i++ {
+		path = fmt.Sprintf("%sikemen%03d.wav", sys.screenshotFolder, i)
+		// O_EXCL so an existing recording is never truncated
+		var err error
+		if f, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666); err != nil && !os.IsExist(err) {
+			return err
+		}
+	}
+	if f == nil {
+		return Error("No free file name for the audio recording (ikemen000.wav to ikemen999.wav all exist)")
+	}
+	rec := &audioRecording{path: path, file: f, buffers: make(chan []byte, 64), done: make(chan struct{})}
+	// The sizes are filled in by Stop
+	if _, err := f.Write(wavHeader(0)); err != nil {
+		f.Close()
+		return err
+	}
+	go func() {
+		for buf := range rec.buffers {
+			if _, err := rec.file.Write(buf); err == nil {
+				rec.size += uint32(len(buf))
+			}
+		}
+		close(rec.done)
+	}()
+	speaker.Lock()
+	a.rec = rec
+	speaker.Unlock()
+	sys.appendToConsole(fmt.Sprintf("Recording audio to %v", path))
+	return nil
+}
+
+// Stops recording and finishes the WAV file.
+func (a *AudioRecorder) Stop() {
+	speaker.Lock()
+	rec := a.rec
+	a.rec = nil
+	speaker.Unlock()
+	if rec == nil {
+		return
+	}
+	close(rec.buffers)
+	<-rec.done
+	rec.file.Seek(0, io.SeekStart)
+	rec.file.Write(wavHeader(rec.size))
+	rec.file.Close()
+	sys.appendToConsole(fmt.Sprintf("Audio recording saved to %v", rec.path))
+	if rec.dropped > 0 {
+		sys.appendToConsole(fmt.Sprintf("WARNING: %v audio buffers were dropped while recording, as the disk was too slow", rec.dropped))
+		sys.errLog.Printf("%v audio buffers dropped while recording %v", rec.dropped, rec.path)
+	}
+}
+
+func (a *AudioRecorder) Toggle() {
+	if a.Recording() {
+		a.Stop()
+	} else if err := a.Start(); err != nil {
+		sys.appendToConsole(fmt.Sprintf("WARNING: Failed to record audio: %v", err))
+		sys.errLog.Printf("Failed to record audio: %v", err)
+	}
+}
+
+// Returns the header of a 16-bit stereo PCM WAV file at the output rate.
+func wavHeader(size uint32) []byte {
+	h := make([]byte, 44)
+	copy(h[0:], "RIFF")
+	binary.LittleEndian.PutUint32(h[4:], 36+size)
+	copy(h[8:], "WAVEfmt ")
+	binary.LittleEndian.PutUint32(h[16:], 16)
+	binary.LittleEndian.PutUint16(h[20:], 1) // PCM
+	binary.LittleEndian.PutUint16(h[22:], 2)
+	binary.LittleEndian.PutUint32(h[24:], uint32(audioFrequency))
+	binary.LittleEndian.PutUint32(h[28:], uint32(audioFrequency)*4)
+	binary.LittleEndian.PutUint16(h[32:], 4)
+	binary.LittleEndian.PutUint16(h[34:], 16)
+	copy(h[36:], "data")
+	binary.LittleEndian.PutUint32(h[40:], size)
+	return h
+}
+
+// ------------------------------------------------------------------
+// Volume curves
+
+type VolumeCurve int32
+
+const (
+	// The mapping volumes always had: linear for sound effects, and a
+	// steep exponential one for the BGM
+	VolumeCurveLegacy VolumeCurve = iota
+	VolumeCurveLinear
+	// Even steps in dB, from -60 dB up to 0 dB at 100%
+	VolumeCurveLog
+)
+
+func parseVolumeCurve(s string) VolumeCurve {
+	switch strings.ToLower(s) {
+	case "linear":
+		return VolumeCurveLinear
+	case "log", "logarithmic":
+		return VolumeCurveLog
+	}
+	return VolumeCurveLegacy
+}
+
+// Returns the gain of a volume slider at percent, following sys.volumeCurve.
+// Outside of the legacy BGM mapping, every volume slider goes through here.
+func volumeCurveGain(percent int) float64 {
+	p := math.Max(float64(percent)/100, 0)
+	if sys.volumeCurve == VolumeCurveLog {
+		if p == 0 {
+			return 0
+		}
+		return math.Pow(10, 3*(p-1))
+	}
+	return p
+}
+
+// Returns the gain of sound effects from the master and SFX volumes.
+func sfxVolumeGain() float64 {
+	return volumeCurveGain(sys.wavVolume) * volumeCurveGain(sys.masterVolume)
+}
+
 // ------------------------------------------------------------------
 // Normalizer
 
@@ -48,7 +478,7 @@ func (n *Normalizer) Stream(samples [][2]float64) (s int, ok bool) {
 		if sys.audioDucking {
 			n.mul = math.Min(16.0, math.Min(lmul, rmul))
 		} else {
-			n.mul = 0.5 * (float64(sys.wavVolume) * float64(sys.masterVolume) * 0.0001)
+			n.mul = 0.5 * sfxVolumeGain()
 		}
 	}
 	return s, ok
@@ -63,8 +493,9 @@ type NormalizerLR struct {
 }
 
 func (n *NormalizerLR) process(mul float64, sam *float64) float64 {
-	n.bias += (*sam - n.bias) / (audioFrequency/110.0 + 1)
-	n.bias2 += (*sam - n.bias2) / (audioFrequency/112640.0 + 1)
+	rate := float64(audioFrequency)
+	n.bias += (*sam - n.bias) / (rate/110.0 + 1)
+	n.bias2 += (*sam - n.bias2) / (rate/112640.0 + 1)
 	s := (n.bias2 - n.bias) * mul
 	if math.Abs(s) > 1 {
 		mul *= math.Pow(math.Abs(s), -n.edge)
@@ -73,299 +504,3634 @@ func (n *NormalizerLR) process(mul float64, sam *float64) float64 {
 	} else {
 		tmp := (1 - math.Pow(1-math.Abs(s), 64)) * math.Pow(0.5-math.Abs(s), 3)
 		mul += mul * (n.edge*(1/32.0-n.average)/n.gain + tmp*n.gain*(1-n.edge)/32) /
-			(audioFrequency*2/8.0 + 1)
-		n.edgeDelta -= (0.5 - n.average) * n.edge / (audioFrequency * 2)
+			(rate*2/8.0 + 1)
+		n.edgeDelta -= (0.5 - n.average) * n.edge / (rate * 2)
 	}
-	n.gain += (1.0 - n.gain*(math.Abs(s)+1/32.0)) / (audioFrequency * 2)
-	n.average += (math.Abs(s) - n.average) / (audioFrequency * 2)
+	n.gain += (1.0 - n.gain*(math.Abs(s)+1/32.0)) / (rate * 2)
+	n.average += (math.Abs(s) - n.average) / (rate * 2)
 	n.edge = float64(ClampF(float32(n.edge+n.edgeDelta), 0, 1))
 	*sam = s
 	return mul
 }
 
 // ------------------------------------------------------------------
-// Loop Streamer
+// Equalizer
 
-// Based on Loop() from Beep package. It adds support for loop points.
-type StreamLooper struct {
-	s         beep.StreamSeeker
-	loopcount int
-	loopstart int
-	loopend   int
+const (
+	EqLow = iota
+	EqMid
+	EqHigh
+)
+
+// Three-band EQ: a low shelf, a mid peak and a high shelf. Bands at 0 dB are
+// skipped, so the output is untouched when all of them are.
+type Equalizer struct {
+	streamer beep.Streamer
+	bands    [3]biquad
+	settings [3][3]float32 // gain, frequency and Q of each band
+}
+
+type biquad struct {
+	active             bool
+	b0, b1, b2, a1, a2 float64
+	z                  [2][2]float64 // per channel state, kept across buffers
+}
+
+// Sets the gain in dB, frequency in Hz and Q of a band. Safe to call while
+// playing, as the coefficients are swapped under the speaker lock.
+func (e *Equalizer) SetBand(band int, gain, freq, q float32) {
+	if band < EqLow || band > EqHigh {
+		return
+	}
+	e.settings[band] = [3]float32{gain, freq, q}
+	bq := biquad{active: gain != 0}
+	if bq.active {
+		A := math.Pow(10, float64(gain)/40)
+		rate := float64(audioFrequency)
+		w0 := 2 * math.Pi * math.Min(float64(freq), rate*0.45) / rate
+		cos := math.Cos(w0)
+		alpha := math.Sin(w0) / (2 * math.Max(float64(q), 0.1))
+		sq := 2 * math.Sqrt(A) * alpha
+		var b0, b1, b2, a0, a1, a2 float64
+		switch band {
+		case EqLow:
+			b0 = A * ((A + 1) - (A-1)*cos + sq)
+			b1 = 2 * A * ((A - 1) - (A+1)*cos)
+			b2 = A * ((A + 1) - (A-1)*cos - sq)
+			a0 = (A + 1) + (A-1)*cos + sq
+			a1 = -2 * ((A - 1) + (A+1)*cos)
+			a2 = (A + 1) + (A-1)*cos - sq
+		case EqMid:
+			b0 = 1 + alpha*A
+			b1 = -2 * cos
+			b2 = 1 - alpha*A
+			a0 = 1 + alpha/A
+			a1 = -2 * cos
+			a2 = 1 - alpha/A
+		case EqHigh:
+			b0 = A * ((A + 1) + (A-1)*cos + sq)
+			b1 = -2 * A * ((A - 1) + (A+1)*cos)
+			b2 = A * ((A + 1) + (A-1)*cos - sq)
+			a0 = (A + 1) - (A-1)*cos + sq
+			a1 = 2 * ((A - 1) - (A+1)*cos)
+			a2 = (A + 1) - (A-1)*cos - sq
+		}
+		bq.b0, bq.b1, bq.b2, bq.a1, bq.a2 = b0/a0, b1/a0, b2/a0, a1/a0, a2/a0
+	}
+	speaker.Lock()
+	// Keep the state of a band that stays on, so changes don't click
+	if bq.active && e.bands[band].active {
+		bq.z = e.bands[band].z
+	}
+	e.bands[band] = bq
+	speaker.Unlock()
+}
+
+// Works out the coefficients again after the output rate changed.
+func (e *Equalizer) refresh() {
+	for b, st := range e.settings {
+		e.SetBand(b, st[0], st[1], st[2])
+	}
+}
+
+func (e *Equalizer) Stream(samples [][2]float64) (n int, ok bool) {
+	n, ok = e.streamer.Stream(samples)
+	for b := range e.bands {
+		if e.bands[b].active {
+			e.bands[b].process(samples[:n])
+		}
+	}
+	return n, ok
+}
+
+func (e *Equalizer) Err() error {
+	return e.streamer.Err()
+}
+
+// Filters samples in place, in transposed direct form II.
+func (bq *biquad) process(samples [][2]float64) {
+	for i := range samples {
+		for c := 0; c < 2; c++ {
+			x := samples[i][c]
+			y := bq.b0*x + bq.z[c][0]
+			bq.z[c][0] = bq.b1*x - bq.a1*y + bq.z[c][1]
+			bq.z[c][1] = bq.b2*x - bq.a2*y
+			samples[i][c] = y
+		}
+	}
+}
+
+// ------------------------------------------------------------------
+// Limiter
+
+// A lookahead brickwall limiter with a master gain stage in front of it. The
+// output is delayed by the lookahead, so that the gain can already be down
+// when a peak comes out, and never goes over the ceiling. It replaces the
+// Normalizer entirely: with audioDucking the gain stage drops its headroom, so
+// that loud sounds push the mix into the limiter, which then ducks the rest.
+type Limiter struct {
+	streamer beep.Streamer
+	ceiling  float64 // linear
+	release  float64 // per sample smoothing factor
+	gain     float64
+	delay    [][2]float64 // ring buffer, lookahead samples long
+	pos      int
+	// Sliding window minimum of the gain each sample needs, over the
+	// lookahead and the sample being output
+	minGain []float64
+	minAt   []int
+	head    int
+	count   int
+	n       int // samples seen
+	// Settings in ms, kept to size the above again on rate changes
+	lookaheadMs, releaseMs float32
+}
+
+// Makes a limiter with a ceiling in dBFS, lookahead and release in ms.
+func NewLimiter(st beep.Streamer, ceiling, lookahead, release float32) *Limiter {
+	l := &Limiter{streamer: st,
+		ceiling: math.Pow(10, float64(ceiling)/20), lookaheadMs: lookahead, releaseMs: release}
+	l.setRate()
+	return l
+}
+
+// Sizes the lookahead and release for the output rate, starting over from
+// unity gain. Must be called with the speaker locked or closed.
+func (l *Limiter) setRate() {
+	rate := float64(audioFrequency)
+	size := int(float64(l.lookaheadMs) * rate / 1000)
+	l.gain = 1
+	l.release = 1 - math.Exp(-1000/(math.Max(float64(l.releaseMs), 1)*rate))
+	l.delay = make([][2]float64, size)
+	l.minGain = make([]float64, size+1)
+	l.minAt = make([]int, size+1)
+	l.pos, l.head, l.count, l.n = 0, 0, 0, 0
+}
+
+func (l *Limiter) Stream(samples [][2]float64) (n int, ok bool) {
+	n, ok = l.streamer.Stream(samples)
+	// Same level as the Normalizer without audio ducking
+	mul := 0.5 * sfxVolumeGain()
+	if sys.audioDucking {
+		mul *= 2
+	}
+	for i := range samples[:n] {
+		in := [2]float64{samples[i][0] * mul, samples[i][1] * mul}
+		need := 1.0
+		if peak := math.Max(math.Abs(in[0]), math.Abs(in[1])); peak > l.ceiling {
+			need = l.ceiling / peak
+		}
+		min := l.window(need)
+		if min < l.gain {
+			l.gain = min
+		} else {
+			l.gain += (min - l.gain) * l.release
+		}
+		out := in
+		if len(l.delay) > 0 {
+			out = l.delay[l.pos]
+			l.delay[l.pos] = in
+			l.pos = (l.pos + 1) % len(l.delay)
+		}
+		samples[i][0] = out[0] * l.gain
+		samples[i][1] = out[1] * l.gain
+	}
+	return n, ok
+}
+
+// Adds the gain needed by a new sample and returns the lowest one in the
+// window, using a queue of increasing values.
+func (l *Limiter) window(need float64) float64 {
+	size := len(l.minGain)
+	if l.count > 0 && l.minAt[l.head] <= l.n-size {
+		l.head = (l.head + 1) % size
+		l.count--
+	}
+	for l.count > 0 && l.minGain[(l.head+l.count-1)%size] >= need {
+		l.count--
+	}
+	l.minGain[(l.head+l.count)%size] = need
+	l.minAt[(l.head+l.count)%size] = l.n
+	l.count++
+	l.n++
+	return l.minGain[l.head]
+}
+
+func (l *Limiter) Err() error {
+	return l.streamer.Err()
+}
+
+// ------------------------------------------------------------------
+// Fader
+
+// Scales a streamer by a gain that ramps linearly towards a target, one step
+// per sample. Used for BGM fades and crossfades. Fields must only be changed
+// with the speaker locked.
+type Fader struct {
+	streamer beep.Streamer
+	gain     float64
+	target   float64
+	step     float64
+	left     int // samples left in the ramp
+	stop     bool
+	closer   io.Closer // closed once a stopping fade completes
+}
+
+func newFader(st beep.Streamer, gain float64) *Fader {
+	return &Fader{streamer: st, gain: gain, target: gain}
+}
+
+// Ramps the gain to target over the given number of samples. If stop is set,
+// the streamer ends once the ramp is complete.
+func (f *Fader) fadeTo(target float64, samples int, stop bool) {
+	f.target, f.stop, f.left = target, stop, samples
+	if samples <= 0 {
+		f.gain, f.step = target, 0
+	} else {
+		f.step = (target - f.gain) / float64(samples)
+	}
+}
+
+func (f *Fader) Stream(samples [][2]float64) (n int, ok bool) {
+	if f.stop && f.gain == f.target {
+		if f.closer != nil {
+			f.closer.Close()
+			f.closer = nil
+		}
+		return 0, false
+	}
+	n, ok = f.streamer.Stream(samples)
+	for i := range samples[:n] {
+		if f.gain != f.target {
+			f.gain += f.step
+			// Lands on the target exactly, whatever the rounding of step
+			if f.left--; f.left <= 0 || (f.step > 0) == (f.gain > f.target) {
+				f.gain = f.target
+			}
+		}
+		samples[i][0] *= f.gain
+		samples[i][1] *= f.gain
+	}
+	return n, ok
+}
+
+func (f *Fader) Err() error {
+	return f.streamer.Err()
+}
+
+// Converts a duration in ticks to output samples.
+func ticksToSamples(ticks int) int {
+	return ticks * audioFrequency / FPS
+}
+
+// ------------------------------------------------------------------
+// TimeStretch
+
+// Changes the speed of a stream without changing its pitch, by WSOLA. Grains
+// overlapping by half are taken from the input at the new speed, each one
+// moved a little to where it lines up best with the last, and crossfaded.
+// The work per grain is bounded. At speed 1 the stream passes through
+// untouched. Fields must only be changed with the speaker locked.
+type TimeStretch struct {
+	streamer beep.Streamer
+	speed    float64
+	grain    int // in samples, about 40 ms
+	window   []float64
+	active   bool
+	first    bool // no grain to line up with yet
+	// Input from inPos on. Past the end of the stream it's padded with
+	// silence, dataEnd being where the stream ended.
+	in      [][2]float64
+	inPos   int
+	dataEnd int
+	eof     bool
+	pos     float64 // where the next grain would start at this speed
+	last    int     // where the last grain started
+	out     [][2]float64
+	ready   [][2]float64 // output not streamed yet
+}
+
+func newTimeStretch(st beep.Streamer, rate beep.SampleRate, speed float64) *TimeStretch {
+	grain := int(rate) / 24 &^ 1
+	w := make([]float64, grain)
+	for i := range w {
+		w[i] = 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(grain))
+	}
+	return &TimeStretch{streamer: st, speed: speed, grain: grain, window: w}
+}
+
+func (t *TimeStretch) Stream(samples [][2]float64) (n int, ok bool) {
+	for n < len(samples) {
+		if len(t.ready) == 0 {
+			if !t.active && t.speed == 1 {
+				sn, sok := t.streamer.Stream(samples[n:])
+				return n + sn, sok || n+sn > 0
+			}
+			if !t.active {
+				t.start()
+			} else if t.speed == 1 {
+				t.stop()
+				continue
+			}
+			if !t.next() {
+				break
+			}
+		}
+		c := copy(samples[n:], t.ready)
+		t.ready = t.ready[c:]
+		n += c
+	}
+	return n, n > 0
+}
+
+func (t *TimeStretch) Err() error {
+	return t.streamer.Err()
+}
+
+func (t *TimeStretch) start() {
+	t.active, t.first = true, true
+	t.in, t.inPos, t.dataEnd, t.eof = t.in[:0], 0, 0, false
+	t.pos, t.last = 0, 0
+	t.out = make([][2]float64, t.grain)
+}
+
+// Goes back to passing the stream through. The rest of the last grain fades
+// out as the input it came from would fade in, adding up to that input, so
+// the buffered input plays as is before the stream carries on.
+func (t *TimeStretch) stop() {
+	t.active = false
+	from := t.last + t.grain/2
+	if from > t.dataEnd {
+		from = t.dataEnd
+	}
+	t.ready = t.in[from-t.inPos : t.dataEnd-t.inPos]
+}
+
+// Reads input up to end.
+func (t *TimeStretch) fill(end int) {
+	for t.inPos+len(t.in) < end {
+		l, need := len(t.in), end-t.inPos-len(t.in)
+		if cap(t.in) < l+need {
+			in := make([][2]float64, l, 2*(l+need))
+			copy(in, t.in)
+			t.in = in
+		}
+		t.in = t.in[:l+need]
+		if t.eof {
+			for i := range t.in[l:] {
+				t.in[l+i] = [2]float64{}
+			}
+			return
+		}
+		sn, sok := t.streamer.Stream(t.in[l:])
+		t.in = t.in[:l+sn]
+		t.dataEnd = t.inPos + len(t.in)
+		if !sok || sn == 0 {
+			t.eof = true
+		}
+	}
+}
+
+// Adds the next grain, making half a grain of output ready. Returns false
+// once the input is over.
+func (t *TimeStretch) next() bool {
+	half := t.grain / 2
+	tol := half / 4
+	g := int(t.pos)
+	if !t.first {
+		t.fill(g + tol + t.grain)
+		g = t.align(t.last+half, g, tol)
+	}
+	t.fill(g + t.grain)
+	if t.eof && g >= t.dataEnd {
+		return false
+	}
+	copy(t.out, t.out[half:])
+	for i := range t.out[half:] {
+		t.out[half+i] = [2]float64{}
+	}
+	seg := t.in[g-t.inPos : g-t.inPos+t.grain]
+	for i := range seg {
+		w := t.window[i]
+		// Nothing to crossfade the first grain with
+		if t.first && i < half {
+			w = 1
+		}
+		t.out[i][0] += seg[i][0] * w
+		t.out[i][1] += seg[i][1] * w
+	}
+	t.first = false
+	t.last = g
+	t.pos += float64(half) * t.speed
+	t.ready = t.out[:half]
+	// Drop the input no grain can start at anymore
+	keep := g + half
+	if p := int(t.pos) - tol; p < keep {
+		keep = p
+	}
+	if drop := keep - t.inPos; drop > 0 {
+		t.in = append(t.in[:0], t.in[drop:]...)
+		t.inPos = keep
+	}
+	return true
+}
+
+// Finds the grain start within tol of a that lines up best with the input at
+// c, where the last grain carries on. Half a grain is compared, at every
+// 4th sample and every other start, then around the best start.
+func (t *TimeStretch) align(c, a, tol int) int {
+	half := t.grain / 2
+	ref := t.in[c-t.inPos : c-t.inPos+half]
+	lo, hi := a-tol, a+tol
+	if lo < t.inPos {
+		lo = t.inPos
+	}
+	if hi < lo {
+		return lo
+	}
+	score := func(g int) float64 {
+		cand := t.in[g-t.inPos : g-t.inPos+half]
+		var dot, energy float64
+		for i := 0; i < half; i += 4 {
+			r, s := ref[i][0]+ref[i][1], cand[i][0]+cand[i][1]
+			dot += r * s
+			energy += s * s
+		}
+		return dot / math.Sqrt(energy+1e-9)
+	}
+	best, bestScore := a, math.Inf(-1)
+	for g := lo; g <= hi; g += 2 {
+		if s := score(g); s > bestScore {
+			best, bestScore = g, s
+		}
+	}
+	for _, g := range [...]int{best - 1, best + 1} {
+		if g >= lo && g <= hi {
+			if s := score(g); s > bestScore {
+				best, bestScore = g, s
+			}
+		}
+	}
+	return best
+}
+
+// ------------------------------------------------------------------
+// Loop Streamer
+
+// Based on Loop() from Beep package. It adds support for loop points.
+type StreamLooper struct {
+	s         beep.StreamSeeker
+	loopcount int
+	loopstart int
+	loopend   int
+	// Called from the audio goroutine, with the speaker locked, once the
+	// loop count runs out
+	onEnd func()
+	// Set when the stream gave nothing from one loop to the next, which
+	// would otherwise loop forever
+	stalled bool
+	// Samples before the loop end that are crossfaded with the ones after
+	// the loop start, and those samples, read when first needed
+	fade int
+	head [][2]float64
+	err  error // set when seeking back to the loop start failed
+}
+
+// Makes a looper. With a fade above 0, the last fade samples of each loop
+// are crossfaded with its first ones, hiding clicks at loop points that
+// aren't sample perfect.
+//
+// Some decoders can't tell the length of their stream, and report 0. The
+// loop end can't be checked against it then, and the stream is read until
+// it ends rather than up to the loop end.
+func newStreamLooper(s beep.StreamSeeker, loopcount, loopstart, loopend, fade int) *StreamLooper {
+	length := s.Len()
+	if loopstart < 0 || length > 0 && loopstart >= length {
+		loopstart = 0
+	}
+	if length > 0 && loopend > length {
+		loopend = length
+	}
+	if loopend <= 0 {
+		// Not set, loop up to the end
+		loopend = length
+	} else if loopend-loopstart <= 1 {
+		sys.errLog.Printf("Loop region %v-%v is empty, looping the whole stream instead", loopstart, loopend)
+		loopstart, loopend = 0, length
+	}
+	if fade < 0 {
+		fade = 0
+	}
+	return &StreamLooper{
+		s:         s,
+		loopcount: loopcount,
+		loopstart: loopstart,
+		loopend:   loopend,
+		fade:      fade,
+	}
+}
+
+// Moves the stream to where playback starts, clamped to the stream. A start
+// past the loop end plays from the loop start, as the looper only ever reads
+// up to the loop end.
+func (b *StreamLooper) start(pos int) error {
+	length := b.s.Len()
+	if pos <= 0 {
+		return nil
+	}
+	if length > 0 && pos > length {
+		pos = length
+	}
+	if b.loopend < length && pos >= b.loopend {
+		pos = b.loopstart
+	}
+	return b.s.Seek(pos)
+}
+
+// Returns where the loop ends, and the length of its crossfade for the
+// current pass, 0 when there is none.
+func (b *StreamLooper) fadeRegion() (end, fade int) {
+	end = b.loopend
+	if end > b.s.Len() {
+		end = b.s.Len()
+	}
+	// No fade into a loop that won't happen, or longer than half the loop
+	if b.loopcount == 1 || b.fade*2 > end-b.loopstart {
+		return end, 0
+	}
+	return end, b.fade
+}
+
+// Reads the samples the crossfade fades into, putting the stream back where
+// it was.
+func (b *StreamLooper) readHead(fade int) {
+	pos := b.s.Position()
+	b.head = make([][2]float64, fade)
+	if b.s.Seek(b.loopstart) == nil {
+		for n := 0; n < fade; {
+			sn, sok := b.s.Stream(b.head[n:])
+			n += sn
+			if !sok || sn == 0 {
+				break
+			}
+		}
+	}
+	b.s.Seek(pos)
+}
+
+// Mixes the head of the loop into samples read from pos on, over the
+// crossfade at the end of the loop.
+func (b *StreamLooper) crossfade(samples [][2]float64, pos, end, fade int) {
+	from := end - fade
+	for i := range samples {
+		j := pos + i - from
+		if j < 0 || j >= fade {
+			continue
+		}
+		if b.head == nil {
+			b.readHead(fade)
+		}
+		t := (float64(j) + 0.5) / float64(fade)
+		samples[i][0] = samples[i][0]*(1-t) + b.head[j][0]*t
+		samples[i][1] = samples[i][1]*(1-t) + b.head[j][1]*t
+	}
+}
+
+func (b *StreamLooper) Stream(samples [][2]float64) (n int, ok bool) {
+	if b.loopcount == 0 || b.Err() != nil {
+		return 0, false
+	}
+	emptyLoops := 0
+	for len(samples) > 0 {
+		// Never read past the loop end, so that the loop point is sample exact
+		toRead := len(samples)
+		if b.loopend < b.s.Len() && b.loopend-b.s.Position() < toRead {
+			toRead = b.loopend - b.s.Position()
+		}
+		end, fade := b.fadeRegion()
+		pos := b.s.Position()
+		sn, sok := 0, false
+		if toRead > 0 {
+			sn, sok = b.s.Stream(samples[:toRead])
+		}
+		if fade > 0 && pos+sn > end-fade {
+			b.crossfade(samples[:sn], pos, end, fade)
+		}
+		samples = samples[sn:]
+		n += sn
+		if sn > 0 {
+			emptyLoops = 0
+		}
+		// The loop end may be the end of the stream, which then ends the pass
+		// right away rather than on the next, empty read
+		if !sok || sn == 0 || (b.loopend > 0 && b.loopend <= b.s.Len() && b.s.Position() >= b.loopend) {
+			if sn == 0 {
+				if emptyLoops++; emptyLoops > 1 {
+					b.stalled, b.loopcount = true, 0
+					break
+				}
+			}
+			if b.loopcount > 0 {
+				b.loopcount--
+			}
+			if b.loopcount == 0 {
+				if b.onEnd != nil {
+					b.onEnd()
+				}
+				break
+			}
+			// The crossfade already played the start of the loop
+			start := b.loopstart
+			if fade > 0 && b.s.Position() >= end && b.head != nil {
+				start += fade
+			}
+			if err := b.s.Seek(start); err != nil {
+				// Can't loop, so end as if the loop count ran out
+				b.err, b.loopcount = err, 0
+				if b.onEnd != nil {
+					b.onEnd()
+				}
+				break
+			}
+		}
+	}
+	return n, true
+}
+
+// Reports whether all loops were played, or looping had to stop.
+func (b *StreamLooper) Done() bool {
+	return b.loopcount == 0
+}
+
+// Returns how many more times the loop plays after the current pass, 0 once
+// the last one has started, or -1 when it loops forever.
+func (b *StreamLooper) LoopsLeft() int {
+	if b.loopcount < 0 {
+		return -1
+	}
+	return int(Max(int32(b.loopcount)-1, 0))
+}
+
+func (b *StreamLooper) Err() error {
+	if b.err != nil {
+		return b.err
+	}
+	return b.s.Err()
+}
+
+func (b *StreamLooper) Len() int {
+	return b.s.Len()
+}
+
+func (b *StreamLooper) Position() int {
+	return b.s.Position()
+}
+
+func (b *StreamLooper) Seek(p int) error {
+	return b.s.Seek(p)
+}
+
+// ------------------------------------------------------------------
+// FLAC decoder
+
+// Streams a FLAC file. Unlike the beep decoder it seeks to the exact sample:
+// the stream can only seek to the start of a frame, so the rest of the way is
+// decoded and discarded, and samples left over from before the seek are
+// dropped.
+type flacDecoder struct {
+	stream *flac.Stream
+	buf    [][2]float64
+	mem    [][2]float64
+	pos    int
+	err    error
+}
+
+func decodeFlac(r io.ReadSeeker) (beep.StreamSeekCloser, beep.Format, error) {
+	stream, err := flac.NewSeek(r)
+	if err != nil {
+		return nil, beep.Format{}, err
+	}
+	format := beep.Format{
+		SampleRate:  beep.SampleRate(stream.Info.SampleRate),
+		NumChannels: int(stream.Info.NChannels),
+		Precision:   int(stream.Info.BitsPerSample+7) / 8,
+	}
+	return &flacDecoder{stream: stream}, format, nil
+}
+
+func (d *flacDecoder) Stream(samples [][2]float64) (n int, ok bool) {
+	if d.err != nil || (d.Len() > 0 && d.pos >= d.Len()) {
+		return 0, false
+	}
+	for n < len(samples) {
+		if len(d.buf) == 0 {
+			if err := d.refill(); err != nil {
+				if err != io.EOF {
+					d.err = err
+				}
+				break
+			}
+		}
+		c := copy(samples[n:], d.buf)
+		d.buf = d.buf[c:]
+		n += c
+	}
+	d.pos += n
+	return n, n > 0
+}
+
+// Returns the factor that scales samples of bps bits to -1 to 1. The shift
+// is done in 64 bits, as 32-bit samples overflow an int32 one.
+func flacSampleScale(bps uint8) float64 {
+	return 1 / float64(int64(1)<<(bps-1))
+}
+
+// Decodes the next frame into the buffer.
+func (d *flacDecoder) refill() error {
+	frame, err := d.stream.ParseNext()
+	if err != nil {
+		return err
+	}
+	n := len(frame.Subframes[0].Samples)
+	if cap(d.mem) < n {
+		d.mem = make([][2]float64, n)
+	}
+	d.buf = d.mem[:n]
+	q := flacSampleScale(d.stream.Info.BitsPerSample)
+	right := 0
+	if len(frame.Subframes) > 1 {
+		right = 1
+	}
+	for i := range d.buf {
+		d.buf[i][0] = float64(frame.Subframes[0].Samples[i]) * q
+		d.buf[i][1] = float64(frame.Subframes[right].Samples[i]) * q
+	}
+	return nil
+}
+
+func (d *flacDecoder) Err() error {
+	return d.err
+}
+
+func (d *flacDecoder) Len() int {
+	return int(d.stream.Info.NSamples)
+}
+
+func (d *flacDecoder) Position() int {
+	return d.pos
+}
+
+func (d *flacDecoder) Seek(p int) error {
+	if p < 0 || (d.Len() > 0 && p > d.Len()) {
+		return Error(fmt.Sprintf("flac: seek position %v out of range [0, %v]", p, d.Len()))
+	}
+	d.buf, d.err = nil, nil
+	if d.Len() > 0 && p == d.Len() {
+		d.pos = p
+		return nil
+	}
+	start, err := d.stream.Seek(uint64(p))
+	if err != nil {
+		d.err = err
+		return err
+	}
+	d.pos = int(start)
+	for d.pos < p {
+		if len(d.buf) == 0 {
+			if err := d.refill(); err != nil {
+				d.err = err
+				return err
+			}
+		}
+		skip := len(d.buf)
+		if p-d.pos < skip {
+			skip = p - d.pos
+		}
+		d.buf = d.buf[skip:]
+		d.pos += skip
+	}
+	return nil
+}
+
+func (d *flacDecoder) Close() error {
+	return d.stream.Close()
+}
+
+// ------------------------------------------------------------------
+// BgmStems
+
+// Mixes synchronized stems, files of the same length and sample rate, into
+// one stream. The stems are always read and seeked together, so the single
+// StreamLooper above them keeps them sample aligned. Each stem has its own
+// Fader so that it can be faded in and out.
+type BgmStems struct {
+	stems []beep.StreamSeekCloser
+	gains []*Fader
+	buf   [][2]float64
+}
+
+func (bs *BgmStems) add(s beep.StreamSeekCloser, gain float64) {
+	bs.stems = append(bs.stems, s)
+	bs.gains = append(bs.gains, newFader(s, gain))
+}
+
+func (bs *BgmStems) Stream(samples [][2]float64) (n int, ok bool) {
+	if len(bs.gains) == 0 {
+		return 0, false
+	}
+	// The first stem decides how much is read, the others follow it exactly
+	n, ok = bs.gains[0].Stream(samples)
+	if cap(bs.buf) < n {
+		bs.buf = make([][2]float64, n)
+	}
+	for _, g := range bs.gains[1:] {
+		buf := bs.buf[:n]
+		got := 0
+		for got < n {
+			sn, sok := g.Stream(buf[got:])
+			got += sn
+			if !sok || sn == 0 {
+				break
+			}
+		}
+		for i := range buf[:got] {
+			samples[i][0] += buf[i][0]
+			samples[i][1] += buf[i][1]
+		}
+	}
+	return n, ok
+}
+
+func (bs *BgmStems) Err() error {
+	for _, s := range bs.stems {
+		if err := s.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the length of the shortest stem.
+func (bs *BgmStems) Len() int {
+	n := 0
+	for i, s := range bs.stems {
+		if i == 0 || s.Len() < n {
+			n = s.Len()
+		}
+	}
+	return n
+}
+
+func (bs *BgmStems) Position() int {
+	if len(bs.stems) == 0 {
+		return 0
+	}
+	return bs.stems[0].Position()
+}
+
+// Seeks every stem to p. Must be called with the speaker locked, like any
+// other Seek on a playing streamer, so that no stem is read in between.
+func (bs *BgmStems) Seek(p int) (err error) {
+	for _, s := range bs.stems {
+		if serr := s.Seek(p); serr != nil && err == nil {
+			err = serr
+		}
+	}
+	return err
+}
+
+func (bs *BgmStems) Close() (err error) {
+	for _, s := range bs.stems {
+		if cerr := s.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// ------------------------------------------------------------------
+// BgmIntro
+
+// Plays an intro file followed by a loop file as a single timeline, the loop
+// file starting at the intro's length. The start of the loop file is decoded
+// ahead of time, so that moving on from the intro doesn't wait on the
+// decoder.
+type BgmIntro struct {
+	intro   beep.StreamSeekCloser
+	loop    beep.StreamSeekCloser
+	head    [][2]float64
+	headPos int
+	inLoop  bool
+}
+
+func newBgmIntro(intro, loop beep.StreamSeekCloser) *BgmIntro {
+	bi := &BgmIntro{intro: intro, loop: loop, head: make([][2]float64, audioOutLen)}
+	got := 0
+	for got < len(bi.head) {
+		n, ok := loop.Stream(bi.head[got:])
+		got += n
+		if !ok || n == 0 {
+			break
+		}
+	}
+	bi.head = bi.head[:got]
+	return bi
+}
+
+func (bi *BgmIntro) Stream(samples [][2]float64) (n int, ok bool) {
+	for len(samples) > 0 {
+		var sn int
+		if !bi.inLoop {
+			var sok bool
+			sn, sok = bi.intro.Stream(samples)
+			if !sok || sn == 0 {
+				bi.inLoop, bi.headPos = true, 0
+				if bi.loop.Position() != len(bi.head) {
+					bi.loop.Seek(len(bi.head))
+				}
+			}
+		} else if bi.headPos < len(bi.head) {
+			sn = copy(samples, bi.head[bi.headPos:])
+			bi.headPos += sn
+		} else {
+			var sok bool
+			sn, sok = bi.loop.Stream(samples)
+			if !sok || sn == 0 {
+				break
+			}
+		}
+		samples = samples[sn:]
+		n += sn
+	}
+	return n, n > 0
+}
+
+func (bi *BgmIntro) Err() error {
+	if err := bi.intro.Err(); err != nil {
+		return err
+	}
+	return bi.loop.Err()
+}
+
+func (bi *BgmIntro) Len() int {
+	return bi.intro.Len() + bi.loop.Len()
+}
+
+func (bi *BgmIntro) Position() int {
+	if !bi.inLoop {
+		return bi.intro.Position()
+	}
+	if bi.headPos < len(bi.head) {
+		return bi.intro.Len() + bi.headPos
+	}
+	return bi.intro.Len() + bi.loop.Position()
+}
+
+func (bi *BgmIntro) Seek(p int) error {
+	if p < bi.intro.Len() {
+		bi.inLoop = false
+		return bi.intro.Seek(p)
+	}
+	bi.inLoop = true
+	p -= bi.intro.Len()
+	// Within the decoded head only the read position changes; the loop file
+	// itself waits right after it
+	if p < len(bi.head) {
+		bi.headPos = p
+		p = len(bi.head)
+	} else {
+		bi.headPos = len(bi.head)
+	}
+	if bi.loop.Position() == p {
+		return nil
+	}
+	return bi.loop.Seek(p)
+}
+
+func (bi *BgmIntro) Close() error {
+	err := bi.intro.Close()
+	if lerr := bi.loop.Close(); err == nil {
+		err = lerr
+	}
+	return err
+}
+
+// ------------------------------------------------------------------
+// BgmPlaylist
+
+type BgmPlaylistMode int32
+
+const (
+	BgmPlaylistSequential BgmPlaylistMode = iota
+	BgmPlaylistShuffle
+	BgmPlaylistRandom
+)
+
+// An ordered list of tracks that Bgm works through as each one ends.
+type BgmPlaylist struct {
+	tracks []string
+	mode   BgmPlaylistMode
+	order  []int
+	pos    int
+	last   int
+}
+
+func newBgmPlaylist(tracks []string, mode BgmPlaylistMode) BgmPlaylist {
+	return BgmPlaylist{tracks: tracks, mode: mode, last: -1}
+}
+
+// Returns the track to play next. Shuffle plays every track once in random
+// order before reshuffling, random picks any track other than the last one.
+// Music choice must not touch the game's random seed, or replays and
+// netplay would desync.
+func (pl *BgmPlaylist) next() string {
+	n := len(pl.tracks)
+	if n == 0 {
+		return ""
+	}
+	var i int
+	switch pl.mode {
+	case BgmPlaylistShuffle:
+		if pl.pos >= len(pl.order) {
+			pl.order = rand.Perm(n)
+			pl.pos = 0
+			// Don't repeat a track across the reshuffle
+			if n > 1 && pl.order[0] == pl.last {
+				pl.order[0], pl.order[n-1] = pl.order[n-1], pl.order[0]
+			}
+		}
+		i = pl.order[pl.pos]
+		pl.pos++
+	case BgmPlaylistRandom:
+		i = rand.Intn(n)
+		if n > 1 && i == pl.last {
+			i = (i + 1 + rand.Intn(n-1)) % n
+		}
+	default:
+		i = pl.pos % n
+		pl.pos = i + 1
+	}
+	pl.last = i
+	return pl.tracks[i]
+}
+
+func parseBgmPlaylistMode(s string) BgmPlaylistMode {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "shuffle":
+		return BgmPlaylistShuffle
+	case "random":
+		return BgmPlaylistRandom
+	}
+	return BgmPlaylistSequential
+}
+
+// ------------------------------------------------------------------
+// BgmDucker
+
+// Lowers the BGM while high priority sounds (announcer, KO) play, and
+// restores it once the last of them ends. Unlike audioDucking in the
+// Normalizer, it only reacts to sounds that ask for it by priority.
+type BgmDucker struct {
+	priority int32   // Lowest sound priority that ducks
+	volume   float64 // Attenuation in dB, 0 to disable
+	attack   float64 // ms
+	release  float64 // ms
+	held     int     // Number of qualifying sounds playing
+	level    float64 // Current attenuation in dB
+}
+
+func (d *BgmDucker) qualifies(priority int32) bool {
+	return d.volume < 0 && priority >= d.priority
+}
+func (d *BgmDucker) hold() {
+	d.held++
+}
+func (d *BgmDucker) unhold() {
+	if d.held > 0 {
+		d.held--
+	}
+}
+
+// Moves the attenuation towards its target, called once per tick.
+func (d *BgmDucker) Tick() {
+	target, length := 0.0, d.release
+	if d.held > 0 {
+		target, length = d.volume, d.attack
+	}
+	if d.level == target {
+		return
+	}
+	step := math.Abs(d.volume) * 1000 / float64(FPS) / math.Max(length, 1)
+	if d.level > target {
+		d.level = math.Max(d.level-step, target)
+	} else {
+		d.level = math.Min(d.level+step, target)
+	}
+	sys.eachBgm((*Bgm).UpdateVolume)
+}
+
+// ------------------------------------------------------------------
+// BgmAnalyzer
+
+const (
+	bgmAnalysisSize  = 1024 // samples per FFT
+	bgmAnalysisBands = 12
+)
+
+// Taps the mixed music for stages that react to it. While enabled, Stream
+// copies what it passes into a ring, and Tick analyses the latest of it
+// outside the speaker lock. When disabled it only costs a flag check.
+type BgmAnalyzer struct {
+	streamer beep.Streamer
+	enabled  bool // only changed with the speaker locked
+	ring     [bgmAnalysisSize][2]float64
+	ringPos  int
+	decay    float32 // part of the last values kept each tick
+	// RMS level and peak of each log-spaced band, from 0 (-60 dBFS and
+	// below) to 1 (0 dBFS)
+	level  float32
+	bands  [bgmAnalysisBands]float32
+	window []float64
+	fft    []complex128
+}
+
+func (a *BgmAnalyzer) Stream(samples [][2]float64) (n int, ok bool) {
+	n, ok = a.streamer.Stream(samples)
+	if a.enabled {
+		for _, s := range samples[:n] {
+			a.ring[a.ringPos] = s
+			a.ringPos = (a.ringPos + 1) % bgmAnalysisSize
+		}
+	}
+	return n, ok
+}
+
+func (a *BgmAnalyzer) Err() error {
+	return a.streamer.Err()
+}
+
+// Analyses the music of the last tick, if enable is set, called once per
+// tick.
+func (a *BgmAnalyzer) Tick(enable bool) {
+	if enable != a.enabled {
+		speaker.Lock()
+		a.enabled, a.ringPos = enable, 0
+		a.ring = [bgmAnalysisSize][2]float64{}
+		speaker.Unlock()
+		a.level, a.bands = 0, [bgmAnalysisBands]float32{}
+	}
+	if !a.enabled {
+		return
+	}
+	var buf [bgmAnalysisSize][2]float64
+	speaker.Lock()
+	copy(buf[:], a.ring[a.ringPos:])
+	copy(buf[bgmAnalysisSize-a.ringPos:], a.ring[:a.ringPos])
+	speaker.Unlock()
+
+	tick := bgmAnalysisSize
+	if n := audioFrequency / FPS; n < tick {
+		tick = n
+	}
+	var sum float64
+	for _, s := range buf[bgmAnalysisSize-tick:] {
+		sum += s[0]*s[0] + s[1]*s[1]
+	}
+	a.level = a.smooth(a.level, math.Sqrt(sum/float64(2*tick)))
+
+	if a.window == nil {
+		a.window = make([]float64, bgmAnalysisSize)
+		for i := range a.window {
+			a.window[i] = 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/bgmAnalysisSize)
+		}
+		a.fft = make([]complex128, bgmAnalysisSize)
+	}
+	for i, s := range buf {
+		a.fft[i] = complex((s[0]+s[1])/2*a.window[i], 0)
+	}
+	fft(a.fft)
+	// Bands from 40 Hz up to 16 kHz or the Nyquist frequency
+	binHz := float64(audioFrequency) / bgmAnalysisSize
+	lo, hi := 40.0, math.Min(16000, float64(audioFrequency)/2)
+	for b := range a.bands {
+		f0 := lo * math.Pow(hi/lo, float64(b)/bgmAnalysisBands)
+		f1 := lo * math.Pow(hi/lo, float64(b+1)/bgmAnalysisBands)
+		k0, k1 := int(math.Ceil(f0/binHz)), int(f1/binHz)
+		if k1 < k0 {
+			k1 = k0
+		}
+		var peak float64
+		for k := k0; k <= k1 && k < bgmAnalysisSize/2; k++ {
+			// A full scale sine peaks at a quarter of the size with the
+			// Hann window
+			peak = math.Max(peak, cmplx.Abs(a.fft[k])*4/bgmAnalysisSize)
+		}
+		a.bands[b] = a.smooth(a.bands[b], peak)
+	}
+}
+
+// Maps an amplitude to the 0 to 1 scale, rising at once and falling by
+// decay from the last value.
+func (a *BgmAnalyzer) smooth(last float32, amp float64) float32 {
+	v := float32(0)
+	if amp > 0 {
+		v = ClampF(float32((20*math.Log10(amp)+60)/60), 0, 1)
+	}
+	if fall := last * a.decay; fall > v {
+		return fall
+	}
+	return v
+}
+
+// In-place radix-2 FFT, len(x) must be a power of two.
+func fft(x []complex128) {
+	n := len(x)
+	for i, j := 1, 0; i < n; i++ {
+		bit := n >> 1
+		for ; j&bit != 0; bit >>= 1 {
+			j ^= bit
+		}
+		j ^= bit
+		if i < j {
+			x[i], x[j] = x[j], x[i]
+		}
+	}
+	for size := 2; size <= n; size <<= 1 {
+		step := cmplx.Exp(complex(0, -2*math.Pi/float64(size)))
+		for start := 0; start < n; start += size {
+			w := complex(1, 0)
+			for k := 0; k < size/2; k++ {
+				u, v := x[start+k], x[start+k+size/2]*w
+				x[start+k], x[start+k+size/2] = u+v, u-v
+				w *= step
+			}
+		}
+	}
+}
+
+// ------------------------------------------------------------------
+// Bgm
+
+type Bgm struct {
+	filename   string
+	bgmVolume  int
+	loop       int
+	streamer   beep.StreamSeekCloser
+	ctrl       *beep.Ctrl
+	volctrl    *effects.Volume
+	fader      *Fader
+	format     string
+	freqmul    float32
+	sampleRate beep.SampleRate
+	startPos   int
+	playlist   BgmPlaylist
+	track      int
+	ended      bool
+	loaded     chan bgmLoad
+	// Fraction of the volume taken away while paused, applied on top of
+	// bgmVolume so that volume changes during the pause aren't lost
+	pausing  bool
+	pauseCut float64
+	glide    freqGlide
+	// With timeStretch, freqmul changes the speed of the music through
+	// stretch, keeping its pitch, instead of resampling it like a tape
+	stretch     *TimeStretch
+	timeStretch bool
+	// Fade in asked for while the music is still loading, see FadeIn
+	fadeInTicks int
+	// Set from Open until the music starts or fails to load. Seeks and loop
+	// points asked for in between are queued in pending, and applied in
+	// order by play.
+	loading bool
+	pending []func()
+	// Loudness correction in dB, from the file's tags or an estimate
+	replayGain float64
+	estimated  chan bgmGain
+	// Tags of the track playing, and whether it started since TrackChanged
+	// was last called
+	tags         BgmTags
+	trackChanged bool
+	saved        bgmSaved // see SavePosition
+}
+
+// Where a track was, kept by SavePosition for Resume.
+type bgmSaved struct {
+	filename string
+	position int
+	loops    int // loop count left, as the StreamLooper had it
+}
+
+// Ticks taken to lower or restore the music volume on pause
+const bgmPauseFadeTicks = 10
+
+// Number of music slots that can play at once. Slot 0 is sys.bgm, the one
+// stages and the single-slot API use.
+const BgmSlots = 2
+
+func newBgm() *Bgm {
+	return &Bgm{loaded: make(chan bgmLoad, 1), estimated: make(chan bgmGain, 4)}
+}
+
+// Starts playing filename. With crossfade above 0, the current music fades
+// out over that many ticks while the new one fades in.
+func (bgm *Bgm) Open(filename string, loop, bgmVolume, bgmLoopStart, bgmLoopEnd, startPosition int, freqmul float32, crossfade int) {
+	bgm.playlist = BgmPlaylist{}
+	bgm.open(filename, loop, bgmVolume, freqmul, bgmLoad{loopstart: bgmLoopStart, loopend: bgmLoopEnd, startPosition: startPosition, crossfade: crossfade})
+}
+
+// Same as Open, with the loop points and start position from a stage's
+// [Music] section, those in seconds taking priority over those in samples.
+func (bgm *Bgm) OpenStage(st *Stage, crossfade int) {
+	bgm.playlist = BgmPlaylist{}
+	bgm.open(st.bgmusic, 1, int(st.bgmvolume), st.bgmfreqmul, bgmLoad{
+		loopstart:     int(st.bgmloopstart),
+		loopend:       int(st.bgmloopend),
+		loopSeconds:   [2]float64{float64(st.bgmloopstartsec), float64(st.bgmloopendsec)},
+		startPosition: int(st.bgmstartposition),
+		startSeconds:  float64(st.bgmstartseconds),
+		crossfade:     crossfade,
+	})
+}
+
+// Remembers where the music is, so that Resume can go back to it once a
+// temporary track, such as a jingle, is over. The position includes the
+// loop count left, so music saved mid-loop resumes mid-loop.
+func (bgm *Bgm) SavePosition() {
+	bgm.saved = bgmSaved{}
+	if bgm.streamer == nil || bgm.volctrl == nil {
+		return
+	}
+	speaker.Lock()
+	bgm.saved = bgmSaved{filename: bgm.filename, position: bgm.streamer.Position()}
+	if sl, ok := bgm.volctrl.Streamer.(*StreamLooper); ok {
+		bgm.saved.loops = sl.loopcount
+	}
+	speaker.Unlock()
+}
+
+// Same as Open, but if filename is the music SavePosition saved, it starts
+// where that was instead of from the start. The saved position is used up
+// then. It is also dropped if, after the track that replaced the saved
+// music, another file is opened without Resume.
+func (bgm *Bgm) Resume(filename string, loop, bgmVolume, bgmLoopStart, bgmLoopEnd int, freqmul float32, crossfade int) {
+	bgm.playlist = BgmPlaylist{}
+	ld := bgmLoad{loopstart: bgmLoopStart, loopend: bgmLoopEnd, crossfade: crossfade, resume: true}
+	if bgm.saved.filename != "" && bgm.saved.filename == filename {
+		ld.startPosition, ld.loops = bgm.saved.position, bgm.saved.loops
+		bgm.saved = bgmSaved{}
+	}
+	bgm.open(filename, loop, bgmVolume, freqmul, ld)
+}
+
+// Same as Open, but with the start position in seconds, for positions
+// written by hand in defs.
+func (bgm *Bgm) OpenSeconds(filename string, loop, bgmVolume, bgmLoopStart, bgmLoopEnd int, startSeconds float64, freqmul float32, crossfade int) {
+	bgm.playlist = BgmPlaylist{}
+	bgm.open(filename, loop, bgmVolume, freqmul, bgmLoad{loopstart: bgmLoopStart, loopend: bgmLoopEnd, startSeconds: startSeconds, crossfade: crossfade})
+}
+
+// Starts playing the first track of a playlist. Each following track is
+// opened by Tick, with the same loop and volume, when the previous one ends.
+func (bgm *Bgm) OpenPlaylist(tracks []string, mode BgmPlaylistMode, loop, bgmVolume int, freqmul float32, crossfade int) {
+	bgm.playlist = newBgmPlaylist(tracks, mode)
+	bgm.open(bgm.playlist.next(), loop, bgmVolume, freqmul, bgmLoad{crossfade: crossfade})
+}
+
+// Starts music that finished loading, and moves on to the next playlist
+// track once the current one has ended. Called once per frame.
+func (bgm *Bgm) Tick() {
+	for len(bgm.loaded) > 0 {
+		if ld := <-bgm.loaded; ld.track != bgm.track {
+			// Superseded by a later Open
+			ld.close()
+		} else if ld.streamer == nil {
+			// Failed to load
+			bgm.loading, bgm.pending = false, nil
+		} else {
+			bgm.play(ld)
+		}
+	}
+	for len(bgm.estimated) > 0 {
+		if g := <-bgm.estimated; g.track == bgm.track {
+			bgm.replayGain = g.gain
+			bgm.UpdateVolume()
+		}
+	}
+	if len(bgm.playlist.tracks) == 0 {
+		return
+	}
+	speaker.Lock()
+	ended := bgm.ended
+	bgm.ended = false
+	speaker.Unlock()
+	if ended {
+		bgm.open(bgm.playlist.next(), bgm.loop, bgm.bgmVolume, bgm.freqmul, bgmLoad{})
+	}
+}
+
+// Advances a freqmul glide started by SetFreqMul. Called once per frame.
+func (bgm *Bgm) tickGlide() {
+	if freqmul, ok := bgm.glide.step(); ok {
+		bgm.setRatio(freqmul)
+	}
+}
+
+// Drops the position SavePosition saved once it is stale. The saved music
+// may be replaced by one temporary track, but opening yet another file, other
+// than through Resume, means the music moved on.
+func (bgm *Bgm) dropStaleSaved(filename string, resume bool) {
+	if !resume && filename != bgm.saved.filename && bgm.filename != bgm.saved.filename {
+		bgm.saved = bgmSaved{}
+	}
+}
+
+func (bgm *Bgm) open(filename string, loop, bgmVolume int, freqmul float32, ld bgmLoad) {
+	bgm.dropStaleSaved(filename, ld.resume)
+	bgm.stop(filename, loop, bgmVolume, freqmul, ld.crossfade)
+	// Special value "" is used to stop music
+	if filename == "" {
+		return
+	}
+	replayGain := sys.replayGainMode
+	bgm.load(ld, func(ld *bgmLoad) (err error) {
+		var format beep.Format
+		filename, soundfont := parseBgmOptions(filename)
+		// "intro|loop" plays the intro file once, then loops the second file
+		if intro, loopFile, ok := strings.Cut(filename, "|"); ok {
+			var bi *BgmIntro
+			if bi, format, ld.format, err = decodeBgmIntro(strings.TrimSpace(intro), strings.TrimSpace(loopFile), soundfont); err != nil {
+				return err
+			}
+			ld.streamer = bi
+			ld.tags = readBgmTags(strings.TrimSpace(intro), ld.format)
+			if ld.loopstart == 0 && ld.loopend == 0 {
+				ld.loopstart = bi.intro.Len()
+			}
+		} else {
+			if ld.streamer, format, ld.format, err = decodeBgm(filename, soundfont); err != nil {
+				return err
+			}
+			ld.sampleRate = format.SampleRate
+			ld.readLoopTags(filename)
+			ld.readReplayGain(filename, replayGain)
+			ld.tags = readBgmTags(filename, ld.format)
+		}
+		ld.sampleRate = format.SampleRate
+		return nil
+	})
+}
+
+// Starts playing a set of synchronized stems, files of the same length and
+// sample rate that are mixed into one track. Stem i starts at volumes[i], or
+// if not given, the first stem at full volume and the rest silent, so that
+// SetStemVolume can bring them in later.
+func (bgm *Bgm) OpenStems(filenames []string, volumes []int, loop, bgmVolume, bgmLoopStart, bgmLoopEnd, startPosition int, freqmul float32, crossfade int) {
+	bgm.playlist = BgmPlaylist{}
+	if len(filenames) == 0 {
+		bgm.open("", loop, bgmVolume, freqmul, bgmLoad{})
+		return
+	}
+	bgm.dropStaleSaved(filenames[0], false)
+	bgm.stop(filenames[0], loop, bgmVolume, freqmul, crossfade)
+	ld := bgmLoad{loopstart: bgmLoopStart, loopend: bgmLoopEnd, startPosition: startPosition, crossfade: crossfade}
+	bgm.load(ld, func(ld *bgmLoad) error {
+		stems := &BgmStems{}
+		for i, filename := range filenames {
+			streamer, format, name, err := decodeBgm(parseBgmOptions(filename))
+			if err == nil && i > 0 && format.SampleRate != ld.sampleRate {
+				streamer.Close()
+				err = Error(fmt.Sprintf("stem sample rate %v does not match %v: %v", format.SampleRate, ld.sampleRate, filename))
+			}
+			if err != nil {
+				stems.Close()
+				return err
+			}
+			if i == 0 {
+				ld.sampleRate, ld.format = format.SampleRate, name
+				file, _ := parseBgmOptions(filename)
+				ld.tags = readBgmTags(file, name)
+			}
+			vol := 0
+			if i == 0 {
+				vol = 100
+			}
+			if i < len(volumes) {
+				vol = volumes[i]
+			}
+			stems.add(streamer, float64(vol)/100)
+		}
+		ld.streamer = stems
+		filename, _ := parseBgmOptions(filenames[0])
+		ld.readLoopTags(filename)
+		return nil
+	})
+}
+
+// Stops the current music, fading it out over crossfade ticks if above 0,
+// and records the parameters of the music about to start.
+func (bgm *Bgm) stop(filename string, loop, bgmVolume int, freqmul float32, crossfade int) {
+	bgm.filename = filename
+	bgm.loop = loop
+	bgm.bgmVolume = bgmVolume
+	bgm.freqmul = freqmul
+	bgm.glide = freqGlide{}
+	bgm.fadeInTicks = 0
+	bgm.loading, bgm.pending = false, nil
+	bgm.tags = BgmTags{}
+	// Starve the current music streamer, or let it fade out on its own.
+	// Bumping the track number keeps a fading track's end from advancing the
+	// playlist.
+	// The files are released once nothing reads from them anymore.
+	speaker.Lock()
+	bgm.track++
+	bgm.ended = false
+	old := bgm.streamer
+	bgm.streamer = nil
+	if bgm.ctrl != nil {
+		if crossfade > 0 && bgm.fader != nil {
+			bgm.fader.fadeTo(0, ticksToSamples(crossfade), true)
+			if old != nil {
+				bgm.fader.closer = old
+			}
+			old = nil
+		} else {
+			bgm.ctrl.Streamer = nil
+		}
+		bgm.fader = nil
+	}
+	if old != nil {
+		old.Close()
+	}
+	speaker.Unlock()
+}
+
+// Splits off the options that may follow a music filename, separated by
+// commas, as in "song.mid, soundfont=bank.sf2".
+func parseBgmOptions(s string) (filename, soundfont string) {
+	parts := strings.Split(s, ",")
+	if len(parts) == 1 {
+		return s, ""
+	}
+	for _, p := range parts[1:] {
+		k, v, ok := strings.Cut(p, "=")
+		if !ok {
+			// Not options, just a comma in the filename
+			return s, ""
+		}
+		switch strings.ToLower(strings.TrimSpace(k)) {
+		case "soundfont":
+			soundfont = strings.TrimSpace(v)
+		}
+	}
+	return strings.TrimSpace(parts[0]), soundfont
+}
+
+// Opens filename with the decoder matching its extension. Also returns the
+// name of the format. MIDI files are rendered with the given soundfont, or
+// the default one if empty.
+func decodeBgm(filename, soundfont string) (streamer beep.StreamSeekCloser, format beep.Format, name string, err error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		// sys.bgm = *newBgm() // removing this gets pause step playsnd to work correctly 100% of the time
+		return nil, format, "", err
+	}
+	if HasExtension(filename, ".ogg") {
+		streamer, format, err = vorbis.Decode(f)
+		name = "ogg"
+	} else if HasExtension(filename, ".mp3") {
+		streamer, format, err = mp3.Decode(f)
+		name = "mp3"
+	} else if HasExtension(filename, ".wav") {
+		streamer, format, err = wav.Decode(f)
+		name = "wav"
+	} else if HasExtension(filename, ".flac") {
+		streamer, format, err = decodeFlac(f)
+		name = "flac"
+	} else if HasExtension(filename, ".opus") {
+		streamer, format, err = decodeOpus(f)
+		name = "opus"
+	} else if HasExtension(filename, ".mid") || HasExtension(filename, ".midi") || HasExtension(filename, ".rmi") {
+		streamer, format, err = decodeMidi(f, soundfont)
+		name = "midi"
+	} else {
+		err = Error(fmt.Sprintf("unsupported file extension: %v", filename))
+	}
+	if err != nil {
+		f.Close()
+		return nil, format, "", err
+	}
+	return streamer, format, name, nil
+}
+
+// Renders a MIDI file, unwrapping it first if it's an RMI file, whatever its
+// extension. A soundfont embedded in an RMI file is used unless one was given.
+func decodeMidi(f *os.File, soundfont string) (beep.StreamSeekCloser, beep.Format, error) {
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, beep.Format{}, err
+	}
+	smf, bank, err := unwrapRmid(data)
+	if err != nil {
+		return nil, beep.Format{}, err
+	}
+	var sf *midi.SoundFont
+	if bank != nil && soundfont == "" {
+		if sf, err = loadEmbeddedSoundFont(bank); err != nil {
+			sys.errLog.Printf("Failed to load the embedded soundfont of %v, using the default one: %v", f.Name(), err)
+		}
+	}
+	if sf == nil {
+		if sf, err = loadBgmSoundFont(soundfont); err != nil {
+			return nil, beep.Format{}, err
+		}
+	}
+	// Everything is in memory now
+	f.Close()
+	return midi.Decode(io.NopCloser(bytes.NewReader(smf)), sf)
+}
+
+// Returns the MIDI data and embedded SF2 bank, if any, of an RMI file (MIDI
+// in a RIFF container). Data that doesn't start with a RIFF header is taken
+// as plain MIDI.
+func unwrapRmid(data []byte) (smf, bank []byte, err error) {
+	if len(data) < 4 || string(data[:4]) != "RIFF" {
+		return data, nil, nil
+	}
+	if len(data) < 12 || string(data[8:12]) != "RMID" {
+		return nil, nil, Error("rmi: RIFF file without the RMID form")
+	}
+	for p := 12; p+8 <= len(data); {
+		id := string(data[p : p+4])
+		size := int(binary.LittleEndian.Uint32(data[p+4:]))
+		if size > len(data)-p-8 {
+			return nil, nil, Error(fmt.Sprintf("rmi: truncated %q chunk", id))
+		}
+		body := data[p+8 : p+8+size]
+		switch {
+		case id == "data":
+			smf = body
+		case id == "RIFF" && size >= 4 && string(body[:4]) == "sfbk":
+			// The SF2 bank is a RIFF file of its own
+			bank = data[p : p+8+size]
+		case id == "RIFF" && size >= 4 && string(body[:4]) == "DLS ":
+			sys.errLog.Printf("rmi: embedded DLS banks aren't supported, using the soundfont instead")
+		}
+		// Chunks are padded to an even size
+		p += 8 + size + size&1
+	}
+	if smf == nil {
+		return nil, nil, Error("rmi: missing \"data\" chunk with the MIDI data")
+	}
+	return smf, bank, nil
+}
+
+// Opens an intro and a loop file as one BgmIntro stream.
+func decodeBgmIntro(introFile, loopFile, soundfont string) (*BgmIntro, beep.Format, string, error) {
+	intro, format, name, err := decodeBgm(introFile, soundfont)
+	if err != nil {
+		return nil, format, "", err
+	}
+	loop, loopFormat, _, err := decodeBgm(loopFile, soundfont)
+	if err == nil && loopFormat.SampleRate != format.SampleRate {
+		loop.Close()
+		err = Error(fmt.Sprintf("loop sample rate %v does not match intro %v: %v", loopFormat.SampleRate, format.SampleRate, loopFile))
+	}
+	if err != nil {
+		intro.Close()
+		return nil, format, "", err
+	}
+	return newBgmIntro(intro, loop), format, name, nil
+}
+
+// Music opened in the background, waiting for Tick to start it. Loop points
+// and positions are in samples of the music file, whatever its rate and the
+// output's. Those given in seconds are converted at the file's rate once it's
+// decoded.
+type bgmLoad struct {
+	track         int
+	streamer      beep.StreamSeekCloser
+	format        string
+	sampleRate    beep.SampleRate
+	loopstart     int
+	loopend       int
+	loopSeconds   [2]float64 // replace loopstart and loopend if above 0
+	startPosition int
+	startSeconds  float64 // replaces startPosition if above 0
+	loops         int     // replaces the loop count if not 0, see Resume
+	resume        bool    // opened by Resume, which keeps the saved position
+	crossfade     int
+	replayGain    float64 // in dB
+	estimateFrom  string  // file to estimate the gain from, if untagged
+	tags          BgmTags
+}
+
+// Gain estimated for a track, once the estimate is done.
+type bgmGain struct {
+	track int
+	gain  float64
+}
+
+// Uses the loop points tagged in an Ogg Vorbis file, or marked in a MIDI
+// file. Loop points given by the caller take priority over the file's tags.
+func (ld *bgmLoad) readLoopTags(filename string) {
+	if ld.loopstart != 0 || ld.loopend != 0 || ld.loopSeconds != [2]float64{} {
+		return
+	}
+	var ls, le int
+	var ok bool
+	switch ld.format {
+	case "ogg":
+		ls, le, ok = readVorbisLoopTags(filename)
+	case "midi":
+		ls, le, ok = readMidiLoopPoints(filename, ld.sampleRate)
+	}
+	if ok {
+		ld.loopstart = int(Clamp(int32(ls), 0, int32(ld.streamer.Len())))
+		// No end, as with a lone CC111, loops up to the end of the file
+		if le > 0 {
+			ld.loopend = int(Clamp(int32(le), int32(ld.loopstart), int32(ld.streamer.Len())))
+		}
+	}
+}
+
+// Opens the music files on a goroutine, so that a slow disk or a large
+// soundfont doesn't stall the game loop. The result is queued for Tick,
+// which drops it if another Open came in the meantime.
+func (bgm *Bgm) load(ld bgmLoad, decode func(ld *bgmLoad) error) {
+	ld.track = bgm.track
+	bgm.loading = true
+	go func() {
+		if err := decode(&ld); err != nil {
+			sys.errLog.Printf("Failed to load bgm: %v", err)
+			// Still queued with no streamer, so that Tick stops waiting
+			ld.close()
+			bgm.deliver(bgmLoad{track: ld.track})
+			return
+		}
+		if ld.startSeconds > 0 {
+			ld.startPosition = secondsToSample(ld.startSeconds, ld.sampleRate, ld.streamer.Len())
+		}
+		if ld.loopSeconds[0] > 0 {
+			ld.loopstart = secondsToSample(ld.loopSeconds[0], ld.sampleRate, ld.streamer.Len())
+		}
+		if ld.loopSeconds[1] > 0 {
+			ld.loopend = secondsToSample(ld.loopSeconds[1], ld.sampleRate, ld.streamer.Len())
+		}
+		bgm.deliver(ld)
+		if ld.estimateFrom != "" {
+			if gain, ok := estimateReplayGain(ld.estimateFrom); ok {
+				select {
+				case bgm.estimated <- bgmGain{ld.track, gain}:
+				default:
+					// Tick is behind, and this is for an old track anyway
+				}
+			}
+		}
+	}()
+}
+
+// Queues loaded music for Tick without waiting for it. Only the latest
+// track can play, so the queue holds one, and whichever of the queued and
+// the new one is older is closed.
+func (bgm *Bgm) deliver(ld bgmLoad) {
+	for {
+		select {
+		case bgm.loaded <- ld:
+			return
+		case old := <-bgm.loaded:
+			if old.track > ld.track {
+				ld, old = old, ld
+			}
+			old.close()
+		}
+	}
+}
+
+// Closes the streamer of music that won't be played.
+func (ld *bgmLoad) close() {
+	if ld.streamer != nil {
+		ld.streamer.Close()
+		ld.streamer = nil
+	}
+}
+
+// Builds the playback chain on top of a loaded streamer and starts it.
+func (bgm *Bgm) play(ld bgmLoad) {
+	loopCount := int(1)
+	if bgm.loop > 0 {
+		loopCount = -1
+	}
+	if ld.loops != 0 {
+		loopCount = ld.loops
+	}
+	bgm.streamer = ld.streamer
+	bgm.format = ld.format
+	bgm.startPos = ld.startPosition
+	streamer := newStreamLooper(bgm.streamer, loopCount, ld.loopstart, ld.loopend,
+		int(float64(ld.sampleRate)*float64(sys.bgmLoopCrossfade)/1000))
+	track := bgm.track
+	streamer.onEnd = func() {
+		if bgm.track == track {
+			bgm.ended = true
+		}
+	}
+	bgm.volctrl = &effects.Volume{Streamer: streamer, Base: 2, Volume: 0, Silent: true}
+	bgm.sampleRate = ld.sampleRate
+	bgm.replayGain = ld.replayGain
+	bgm.tags, bgm.trackChanged = ld.tags, true
+	pitch, speed := bgm.pitchSpeed(bgm.freqmul)
+	bgm.stretch = newTimeStretch(bgm.volctrl, bgm.sampleRate, float64(speed))
+	dstFreq := beep.SampleRate(float32(audioFrequency) / pitch)
+	resampler := beep.Resample(sys.bgmResampleQuality, bgm.sampleRate, dstFreq, bgm.stretch)
+	bgm.ctrl = &beep.Ctrl{Streamer: resampler}
+	bgm.UpdateVolume()
+	bgm.streamer.Seek(ld.startPosition)
+	bgm.fader = newFader(bgm.ctrl, 1)
+	fade := ld.crossfade
+	if bgm.fadeInTicks > fade {
+		fade = bgm.fadeInTicks
+	}
+	bgm.fadeInTicks = 0
+	if fade > 0 {
+		bgm.fader.gain = 0
+		bgm.fader.fadeTo(1, ticksToSamples(fade), false)
+	}
+	speaker.Lock()
+	sys.bgmMix.Add(bgm.fader)
+	speaker.Unlock()
+	pending := bgm.pending
+	bgm.loading, bgm.pending = false, nil
+	for _, f := range pending {
+		f()
+	}
+}
+
+// Converts t seconds to a sample index at the given rate, clamped to
+// [0, length].
+func secondsToSample(t float64, rate beep.SampleRate, length int) int {
+	return int(Clamp(int32(math.Round(t*float64(rate))), 0, int32(length)))
+}
+
+// Reads the LOOPSTART and LOOPLENGTH or LOOPEND comments, in samples, that
+// RPG Maker style music embeds in Ogg Vorbis files.
+func readVorbisLoopTags(filename string) (loopstart, loopend int, ok bool) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	comments, err := readVorbisComments(bufio.NewReader(f))
+	if err != nil {
+		return
+	}
+	if loopstart, err = strconv.Atoi(comments["LOOPSTART"]); err != nil {
+		return 0, 0, false
+	}
+	if l, err := strconv.Atoi(comments["LOOPLENGTH"]); err == nil {
+		return loopstart, loopstart + l, true
+	}
+	if loopend, err = strconv.Atoi(comments["LOOPEND"]); err == nil {
+		return loopstart, loopend, true
+	}
+	return 0, 0, false
+}
+
+// Finds the loop points of a MIDI file, in samples at the given rate. The
+// loop starts at the first controller 111 event, as in RPG Maker, or at a
+// "loopStart" marker, which takes priority; a "loopEnd" marker sets the end.
+func readMidiLoopPoints(filename string, rate beep.SampleRate) (loopstart, loopend int, ok bool) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return
+	}
+	if data, _, err = unwrapRmid(data); err != nil {
+		return
+	}
+	sm, err := readMidiLoopMarks(data)
+	if err != nil || sm.start < 0 {
+		return 0, 0, false
+	}
+	loopstart = int(math.Round(sm.seconds(sm.start) * float64(rate)))
+	if sm.end > sm.start {
+		loopend = int(math.Round(sm.seconds(sm.end) * float64(rate)))
+	}
+	return loopstart, loopend, true
+}
+
+type midiTempo struct {
+	tick       int
+	usPerQuart int
+}
+
+// Loop positions of a MIDI file in ticks, with what's needed to turn ticks
+// into time.
+type midiLoopMarks struct {
+	division int
+	tempos   []midiTempo
+	start    int
+	end      int
+}
+
+// Converts an absolute tick to seconds, following the tempo changes.
+func (m *midiLoopMarks) seconds(tick int) float64 {
+	// SMPTE division: frames per second and ticks per frame
+	if m.division&0x8000 != 0 {
+		fps := float64(-int8(m.division >> 8))
+		if fps == 29 {
+			fps = 29.97
+		}
+		return float64(tick) / (fps * float64(m.division&0xff))
+	}
+	t, last, us := 0.0, 0, 500000
+	for _, tp := range m.tempos {
+		if tp.tick >= tick {
+			break
+		}
+		t += float64(tp.tick-last) * float64(us) / 1e6 / float64(m.division)
+		last, us = tp.tick, tp.usPerQuart
+	}
+	return t + float64(tick-last)*float64(us)/1e6/float64(m.division)
+}
+
+// Scans a standard MIDI file for tempo changes and loop marks.
+func readMidiLoopMarks(data []byte) (*midiLoopMarks, error) {
+	if len(data) < 14 || string(data[:4]) != "MThd" {
+		return nil, Error("midi: invalid header")
+	}
+	hlen := int(binary.BigEndian.Uint32(data[4:]))
+	if hlen < 6 || hlen > len(data)-8 {
+		return nil, Error("midi: invalid header")
+	}
+	m := &midiLoopMarks{division: int(binary.BigEndian.Uint16(data[12:])), start: -1, end: -1}
+	if m.division == 0 {
+		return nil, Error("midi: invalid division")
+	}
+	cc111, marker := -1, -1
+	p := 8 + hlen
+	for p+8 <= len(data) {
+		clen := int(binary.BigEndian.Uint32(data[p+4:]))
+		if clen < 0 || clen > len(data)-p-8 {
+			// A chunk cut short is read as far as it goes
+			clen = len(data) - p - 8
+		}
+		chunk := data[p+8 : p+8+clen]
+		isTrack := string(data[p:p+4]) == "MTrk"
+		p += 8 + clen
+		if !isTrack {
+			continue
+		}
+		// Variable length quantities are at most 4 bytes
+		readVar := func(i *int) int {
+			v := 0
+			for n := 0; n < 4 && *i < len(chunk); n++ {
+				b := chunk[*i]
+				*i++
+				v = v<<7 | int(b&0x7f)
+				if b&0x80 == 0 {
+					break
+				}
+			}
+			return v
+		}
+		tick, status := 0, byte(0)
+		for i := 0; i < len(chunk); {
+			tick += readVar(&i)
+			if i >= len(chunk) {
+				break
+			}
+			if chunk[i]&0x80 != 0 {
+				status = chunk[i]
+				i++
+			}
+			switch {
+			case status == 0xff:
+				if i >= len(chunk) {
+					break
+				}
+				typ := chunk[i]
+				i++
+				n := readVar(&i)
+				if i+n > len(chunk) {
+					n = len(chunk) - i
+				}
+				ev := chunk[i : i+n]
+				i += n
+				if typ == 0x51 && n == 3 {
+					m.tempos = append(m.tempos, midiTempo{tick, int(ev[0])<<16 | int(ev[1])<<8 | int(ev[2])})
+				} else if typ == 0x06 || typ == 0x01 {
+					switch strings.ToLower(strings.TrimSpace(string(ev))) {
+					case "loopstart":
+						if marker < 0 || tick < marker {
+							marker = tick
+						}
+					case "loopend":
+						if m.end < 0 || tick < m.end {
+							m.end = tick
+						}
+					}
+				}
+				// Meta events don't take part in running status
+				status = 0
+			case status == 0xf0 || status == 0xf7:
+				i += readVar(&i)
+				status = 0
+			case status >= 0x80:
+				n := 2
+				if status&0xf0 == 0xc0 || status&0xf0 == 0xd0 {
+					n = 1
+				}
+				if i+n > len(chunk) {
+					i = len(chunk)
+					break
+				}
+				if status&0xf0 == 0xb0 && chunk[i] == 111 && (cc111 < 0 || tick < cc111) {
+					cc111 = tick
+				}
+				i += n
+			default:
+				return nil, Error("midi: invalid event")
+			}
+		}
+	}
+	sort.SliceStable(m.tempos, func(i, j int) bool { return m.tempos[i].tick < m.tempos[j].tick })
+	m.start = cc111
+	if marker >= 0 {
+		m.start = marker
+	}
+	return m, nil
+}
+
+// Returns the user comments from the comment header of an Ogg Vorbis stream,
+// keyed by upper case field name.
+func readVorbisComments(r io.Reader) (map[string]string, error) {
+	pkt, err := readOggPacket(r, 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(pkt) < 7 || pkt[0] != 3 || string(pkt[1:7]) != "vorbis" {
+		return nil, Error("vorbis: comment header not found")
+	}
+	return parseVorbisComments(pkt[7:])
+}
+
+// Parses a list of Vorbis comments, the format also used by the tags of Opus
+// and FLAC files.
+func parseVorbisComments(pkt []byte) (map[string]string, error) {
+	next := func() ([]byte, bool) {
+		if len(pkt) < 4 {
+			return nil, false
+		}
+		n := binary.LittleEndian.Uint32(pkt)
+		if uint32(len(pkt)-4) < n {
+			return nil, false
+		}
+		s := pkt[4 : 4+n]
+		pkt = pkt[4+n:]
+		return s, true
+	}
+	// Vendor string
+	if _, ok := next(); !ok || len(pkt) < 4 {
+		return nil, Error("vorbis: truncated comment header")
+	}
+	count := binary.LittleEndian.Uint32(pkt)
+	pkt = pkt[4:]
+	comments := make(map[string]string)
+	for i := uint32(0); i < count; i++ {
+		c, ok := next()
+		if !ok {
+			// Cut short by maxTagSize, keep what was read
+			if len(comments) > 0 {
+				break
+			}
+			return nil, Error("vorbis: truncated comment header")
+		}
+		if k, v, found := strings.Cut(string(c), "="); found {
+			comments[strings.ToUpper(k)] = strings.TrimSpace(v)
+		}
+	}
+	return comments, nil
+}
+
+// Returns the packet with the given index, counting from 0, at the start of
+// an Ogg stream. Only suited to the header packets of single stream files.
+// Packets are cut at maxTagSize, so that cover art embedded in the comments
+// isn't read in full.
+func readOggPacket(r io.Reader, index int) ([]byte, error) {
+	var seg [255]byte
+	var pkt []byte
+	for {
+		_, _, lacing, err := readOggPageHeader(r)
+		if err != nil {
+			return nil, err
+		}
+		for _, l := range lacing {
+			if _, err := io.ReadFull(r, seg[:l]); err != nil {
+				return nil, err
+			}
+			if index == 0 {
+				pkt = append(pkt, seg[:l]...)
+				if len(pkt) >= maxTagSize {
+					return pkt, nil
+				}
+			}
+			// A segment shorter than 255 bytes ends the packet
+			if l < 255 {
+				if index == 0 {
+					return pkt, nil
+				}
+				index--
+			}
+		}
+	}
+}
+
+// Reads the header of an Ogg page, up to its body. The page's segment sizes
+// are returned as its lacing values, and a granule position of -1 means that
+// no packet ends on the page.
+func readOggPageHeader(r io.Reader) (flags byte, granule int64, lacing []byte, err error) {
+	var hdr [27]byte
+	if _, err = io.ReadFull(r, hdr[:]); err != nil {
+		return
+	}
+	if string(hdr[:4]) != "OggS" {
+		return 0, 0, nil, Error("ogg: invalid page header")
+	}
+	flags = hdr[5]
+	granule = int64(binary.LittleEndian.Uint64(hdr[6:]))
+	lacing = make([]byte, hdr[26])
+	_, err = io.ReadFull(r, lacing)
+	return
+}
+
+// ------------------------------------------------------------------
+// BgmTags
+
+// Most bytes of a tag, or of a single frame or comment block, that are read.
+// Cover art is skipped, or cut short when it can't be.
+const maxTagSize = 1 << 16
+
+// Track details shown by the screenpack, such as in a "now playing" toast.
+type BgmTags struct {
+	title  string
+	artist string
+	album  string
+}
+
+// Reads the title, artist and album tagged in a music file. The title falls
+// back to the file name without extension, so that it's never empty. Failing
+// to read the tags doesn't keep the music from playing.
+func readBgmTags(filename, format string) (t BgmTags) {
+	defer func() {
+		if t.title == "" {
+			t.title = strings.TrimSuffix(filepath.Base(filename), filepath.Ext(filename))
+		}
+	}()
+	f, err := os.Open(filename)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	var comments map[string]string
+	switch format {
+	case "ogg":
+		comments, _ = readVorbisComments(r)
+	case "opus":
+		comments, _ = readOpusTags(r)
+	case "flac":
+		comments, _ = readFlacComments(r)
+	case "mp3":
+		return readID3Tags(f, r)
+	case "wav":
+		return readWavInfo(f)
+	}
+	return BgmTags{comments["TITLE"], comments["ARTIST"], comments["ALBUM"]}
+}
+
+// Reads the text frames of an ID3v2 tag, or the ID3v1 tag at the end of the
+// file if there's none.
+func readID3Tags(f *os.File, r io.Reader) (t BgmTags) {
+	fields := map[string]*string{"TIT2": &t.title, "TPE1": &t.artist, "TALB": &t.album}
+	if readID3Frames(r, func(id string) bool { return fields[id] != nil }, func(id string, body []byte) {
+		if len(body) > 1 {
+			*fields[id] = decodeID3Text(body[0], body[1:])
+		}
+	}) == nil {
+		return
+	}
+	var v1 [128]byte
+	if fi, err := f.Stat(); err != nil || fi.Size() < 128 {
+		return
+	} else if _, err := f.ReadAt(v1[:], fi.Size()-128); err != nil || string(v1[:3]) != "TAG" {
+		return
+	}
+	field := func(b []byte) string {
+		return strings.TrimSpace(decodeLatin1(bytes.TrimRight(b, "\x00")))
+	}
+	return BgmTags{field(v1[3:33]), field(v1[33:63]), field(v1[63:93])}
+}
+
+// Decodes the text of an ID3 text frame, given its encoding as in
+// splitID3Text. Only the first of several null separated values is kept.
+func decodeID3Text(enc byte, b []byte) string {
+	switch enc {
+	case 0, 3:
+		b, _, _ = bytes.Cut(b, []byte{0})
+		if enc == 0 {
+			return strings.TrimSpace(decodeLatin1(b))
+		}
+		return strings.TrimSpace(string(b))
+	case 1, 2:
+		for i := 0; i+1 < len(b); i += 2 {
+			if b[i] == 0 && b[i+1] == 0 {
+				b = b[:i]
+				break
+			}
+		}
+		return strings.TrimSpace(decodeUTF16(b, enc == 2))
+	}
+	return ""
+}
+
+func decodeLatin1(b []byte) string {
+	r := make([]rune, len(b))
+	for i, c := range b {
+		r[i] = rune(c)
+	}
+	return string(r)
+}
+
+// Reads the INFO list of a WAV file. The other chunks, the audio among them,
+// are skipped unread.
+func readWavInfo(f *os.File) (t BgmTags) {
+	var hdr [12]byte
+	if _, err := io.ReadFull(f, hdr[:]); err != nil || string(hdr[:4]) != "RIFF" || string(hdr[8:]) != "WAVE" {
+		return
+	}
+	var ch [8]byte
+	for {
+		if _, err := io.ReadFull(f, ch[:]); err != nil {
+			return
+		}
+		size := int64(binary.LittleEndian.Uint32(ch[4:]))
+		// Chunks are padded to an even size
+		next := size + size&1
+		if string(ch[:4]) != "LIST" || size < 4 || size > maxTagSize {
+			if _, err := f.Seek(next, io.SeekCurrent); err != nil {
+				return
+			}
+			continue
+		}
+		list := make([]byte, next)
+		if _, err := io.ReadFull(f, list); err != nil && err != io.ErrUnexpectedEOF {
+			return
+		}
+		if string(list[:4]) != "INFO" {
+			continue
+		}
+		fields := map[string]*string{"INAM": &t.title, "IART": &t.artist, "IPRD": &t.album}
+		for list = list[4:size]; len(list) >= 8; {
+			n := int(binary.LittleEndian.Uint32(list[4:]))
+			if n > len(list)-8 {
+				break
+			}
+			if p := fields[string(list[:4])]; p != nil {
+				*p = strings.TrimSpace(string(bytes.TrimRight(list[8:8+n], "\x00")))
+			}
+			list = list[Min(int32(8+n+n&1), int32(len(list))):]
+		}
+		return
+	}
+}
+
+// Returns the tags of the music playing.
+func (bgm *Bgm) Tags() BgmTags {
+	return bgm.tags
+}
+
+// Reports whether a new track started since the last call, for the
+// screenpack to show its tags.
+func (bgm *Bgm) TrackChanged() bool {
+	changed := bgm.trackChanged
+	bgm.trackChanged = false
+	return changed
+}
+
+// ------------------------------------------------------------------
+// ReplayGain
+
+type ReplayGainMode int32
+
+const (
+	ReplayGainOff ReplayGainMode = iota
+	ReplayGainTags
+	// Tags, or an estimate of the loudness of the file's start when untagged
+	ReplayGainEstimate
+)
+
+func parseReplayGainMode(s string) ReplayGainMode {
+	switch strings.ToLower(s) {
+	case "tags":
+		return ReplayGainTags
+	case "estimate":
+		return ReplayGainEstimate
+	}
+	return ReplayGainOff
+}
+
+// Seconds of music decoded to estimate the loudness of an untagged file
+const replayGainEstimateSeconds = 20
+
+// Reads the track gain tagged in the music file. Untagged files are left for
+// the load goroutine to estimate, except MIDI, which would need rendering.
+func (ld *bgmLoad) readReplayGain(filename string, mode ReplayGainMode) {
+	if mode == ReplayGainOff {
+		return
+	}
+	if gain, ok := readReplayGainTag(filename, ld.format); ok {
+		ld.replayGain = gain
+	} else if mode == ReplayGainEstimate && ld.format != "midi" {
+		ld.estimateFrom = filename
+	}
+}
+
+// Returns the REPLAYGAIN_TRACK_GAIN of a file in dB. Opus files may give the
+// R128 gain instead, which is relative to -23 LUFS rather than -18.
+func readReplayGainTag(filename, format string) (float64, bool) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return 0, false
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	var comments map[string]string
+	switch format {
+	case "ogg":
+		comments, err = readVorbisComments(r)
+	case "opus":
+		comments, err = readOpusTags(r)
+	case "flac":
+		comments, err = readFlacComments(r)
+	case "mp3":
+		comments, err = readID3UserText(r)
+	default:
+		return 0, false
+	}
+	if err != nil {
+		return 0, false
+	}
+	if gain, ok := parseReplayGainValue(comments["REPLAYGAIN_TRACK_GAIN"]); ok {
+		return gain, true
+	}
+	if q, err := strconv.Atoi(comments["R128_TRACK_GAIN"]); err == nil {
+		return float64(q)/256 + 5, true
+	}
+	return 0, false
+}
+
+// Parses a gain written as "-6.5 dB".
+func parseReplayGainValue(s string) (float64, bool) {
+	s = strings.TrimSpace(s)
+	if len(s) > 2 && strings.EqualFold(s[len(s)-2:], "dB") {
+		s = strings.TrimSpace(s[:len(s)-2])
+	}
+	gain, err := strconv.ParseFloat(s, 64)
+	return gain, err == nil
+}
+
+// Returns the comments from the OpusTags header of an Ogg Opus stream.
+func readOpusTags(r io.Reader) (map[string]string, error) {
+	pkt, err := readOggPacket(r, 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(pkt) < 8 || string(pkt[:8]) != "OpusTags" {
+		return nil, Error("opus: tags header not found")
+	}
+	return parseVorbisComments(pkt[8:])
+}
+
+// Returns the comments from the VORBIS_COMMENT metadata block of a FLAC file.
+func readFlacComments(r io.Reader) (map[string]string, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	if string(hdr[:]) != "fLaC" {
+		return nil, Error("flac: invalid signature")
+	}
+	for {
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return nil, err
+		}
+		size := int64(hdr[1])<<16 | int64(hdr[2])<<8 | int64(hdr[3])
+		// Skip the other blocks unread, pictures among them
+		if hdr[0]&0x7f == 4 {
+			block := make([]byte, Min(int32(size), maxTagSize))
+			if _, err := io.ReadFull(r, block); err != nil {
+				return nil, err
+			}
+			return parseVorbisComments(block)
+		}
+		if _, err := io.CopyN(io.Discard, r, size); err != nil {
+			return nil, err
+		}
+		// The last metadata block has the top bit set
+		if hdr[0]&0x80 != 0 {
+			return nil, Error("flac: no comments")
+		}
+	}
+}
+
+// Returns the user defined text frames (TXXX) of the ID3v2.3 or v2.4 tag at
+// the start of a file, keyed by upper case description.
+func readID3UserText(r io.Reader) (map[string]string, error) {
+	frames := make(map[string]string)
+	err := readID3Frames(r, func(id string) bool { return id == "TXXX" }, func(id string, body []byte) {
+		if len(body) > 1 {
+			if desc, value, ok := splitID3Text(body[0], body[1:]); ok {
+				frames[strings.ToUpper(desc)] = strings.TrimSpace(value)
+			}
+		}
+	})
+	return frames, err
+}
+
+// Passes the frames of the ID3v2.3 or v2.4 tag at the start of a file that
+// want accepts to frame. The others, such as cover art, are skipped unread,
+// as are frames over maxTagSize.
+func readID3Frames(r io.Reader, want func(id string) bool, frame func(id string, body []byte)) error {
+	var hdr [10]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return err
+	}
+	if string(hdr[:3]) != "ID3" || hdr[3] < 3 {
+		return Error("id3: no v2.3 or v2.4 tag")
+	}
+	syncsafe := func(b []byte) int64 {
+		return int64(b[0])<<21 | int64(b[1])<<14 | int64(b[2])<<7 | int64(b[3])
+	}
+	tag := &io.LimitedReader{R: r, N: syncsafe(hdr[6:10])}
+	// Extended header, its size counting itself in v2.4 only
+	if hdr[5]&0x40 != 0 {
+		if _, err := io.ReadFull(tag, hdr[:4]); err != nil {
+			return err
+		}
+		n := int64(binary.BigEndian.Uint32(hdr[:4]))
+		if hdr[3] >= 4 {
+			n = syncsafe(hdr[:4]) - 4
+		}
+		if _, err := io.CopyN(io.Discard, tag, n); err != nil {
+			return Error("id3: truncated tag")
+		}
+	}
+	var fh [10]byte
+	for tag.N >= 10 {
+		if _, err := io.ReadFull(tag, fh[:]); err != nil || fh[0] == 0 {
+			break
+		}
+		id := string(fh[:4])
+		n := int64(binary.BigEndian.Uint32(fh[4:]))
+		if hdr[3] >= 4 {
+			n = syncsafe(fh[4:])
+		}
+		if n > tag.N {
+			break
+		}
+		if !want(id) || n > maxTagSize {
+			if _, err := io.CopyN(io.Discard, tag, n); err != nil {
+				return err
+			}
+			continue
+		}
+		body := make([]byte, n)
+		if _, err := io.ReadFull(tag, body); err != nil {
+			return err
+		}
+		frame(id, body)
+	}
+	return nil
+}
+
+// Splits the two null terminated strings of a TXXX frame, given the frame's
+// text encoding: 0 for Latin-1, 1 for UTF-16 with BOM, 2 for UTF-16BE, 3 for
+// UTF-8.
+func splitID3Text(enc byte, b []byte) (desc, value string, ok bool) {
+	if enc == 0 || enc == 3 {
+		d, v, found := bytes.Cut(b, []byte{0})
+		// Latin-1 only matters outside of ASCII, which the tags we read are
+		return string(d), string(bytes.TrimRight(v, "\x00")), found
+	}
+	if enc != 1 && enc != 2 {
+		return "", "", false
+	}
+	// Find the 2 byte terminator on a code unit boundary
+	for i := 0; i+1 < len(b); i += 2 {
+		if b[i] == 0 && b[i+1] == 0 {
+			return decodeUTF16(b[:i], enc == 2), decodeUTF16(b[i+2:], enc == 2), true
+		}
+	}
+	return "", "", false
+}
+
+// Decodes UTF-16 text, which starts with a BOM unless bigEndian is given.
+func decodeUTF16(b []byte, bigEndian bool) string {
+	if !bigEndian && len(b) >= 2 {
+		bigEndian = b[0] == 0xfe && b[1] == 0xff
+		if bigEndian || b[0] == 0xff && b[1] == 0xfe {
+			b = b[2:]
+		}
+	}
+	u := make([]uint16, 0, len(b)/2)
+	for i := 0; i+1 < len(b); i += 2 {
+		if bigEndian {
+			u = append(u, binary.BigEndian.Uint16(b[i:]))
+		} else {
+			u = append(u, binary.LittleEndian.Uint16(b[i:]))
+		}
+	}
+	for len(u) > 0 && u[len(u)-1] == 0 {
+		u = u[:len(u)-1]
+	}
+	return string(utf16.Decode(u))
+}
+
+// Estimates the gain that brings a file to about the ReplayGain reference
+// level, from the RMS level of its first seconds. Decodes the file a second
+// time, so it runs on the load goroutine.
+func estimateReplayGain(filename string) (float64, bool) {
+	streamer, format, _, err := decodeBgm(filename, "")
+	if err != nil {
+		return 0, false
+	}
+	defer streamer.Close()
+	buf := make([][2]float64, 4096)
+	total := int(format.SampleRate) * replayGainEstimateSeconds
+	var sum float64
+	count := 0
+	for count < total {
+		chunk := buf
+		if total-count < len(chunk) {
+			chunk = chunk[:total-count]
+		}
+		n, ok := streamer.Stream(chunk)
+		for _, s := range chunk[:n] {
+			sum += s[0]*s[0] + s[1]*s[1]
+		}
+		count += n
+		if !ok {
+			break
+		}
+	}
+	if sum == 0 {
+		return 0, false
+	}
+	// Music at the reference level has an RMS level of about -18 dBFS
+	rms := 10 * math.Log10(sum/float64(2*count))
+	return math.Max(math.Min(-18-rms, 12), -12), true
+}
+
+// Loads a song's own soundfont, falling back to the default one if it can't
+// be loaded.
+func loadBgmSoundFont(filename string) (*midi.SoundFont, error) {
+	if filename != "" && filename != audioSoundFont {
+		sf, err := loadSoundFont(filename)
+		if err == nil {
+			return sf, nil
+		}
+		sys.errLog.Printf("Failed to load soundfont, using the default one: %v", err)
+	}
+	return loadSoundFont(audioSoundFont)
+}
+
+// Parsed soundfonts by absolute path, so that songs sharing one don't parse
+// it again. An entry is reloaded when the file's modification time changes.
+// Embedded soundfonts are keyed by content hash instead.
+// Music loads on goroutines, hence the lock.
+type soundFontEntry struct {
+	sf      *midi.SoundFont
+	modTime time.Time
+}
+
+var soundFontCache = struct {
+	sync.Mutex
+	fonts map[string]soundFontEntry
+}{fonts: make(map[string]soundFontEntry)}
+
+func loadSoundFont(filename string) (*midi.SoundFont, error) {
+	if abs, err := filepath.Abs(filename); err == nil {
+		filename = abs
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	soundFontCache.Lock()
+	defer soundFontCache.Unlock()
+	if e, ok := soundFontCache.fonts[filename]; ok && e.modTime.Equal(fi.ModTime()) {
+		return e.sf, nil
+	}
+	soundfont, err := midi.NewSoundFont(f)
+	if err != nil {
+		return nil, err
+	}
+	soundFontCache.fonts[filename] = soundFontEntry{soundfont, fi.ModTime()}
+	return soundfont, nil
+}
+
+// Parses a soundfont embedded in a music file, cached by a hash of its
+// content, as there's no file to key it by.
+func loadEmbeddedSoundFont(bank []byte) (*midi.SoundFont, error) {
+	sum := sha256.Sum256(bank)
+	key := "embedded:" + hex.EncodeToString(sum[:])
+	soundFontCache.Lock()
+	defer soundFontCache.Unlock()
+	if e, ok := soundFontCache.fonts[key]; ok {
+		return e.sf, nil
+	}
+	soundfont, err := midi.NewSoundFont(bytes.NewReader(bank))
+	if err != nil {
+		return nil, err
+	}
+	soundFontCache.fonts[key] = soundFontEntry{soundfont, time.Time{}}
+	return soundfont, nil
+}
+
+func (bgm *Bgm) SetPaused(pause bool) {
+	if bgm.ctrl == nil || bgm.ctrl.Paused == pause {
+		return
+	}
+	speaker.Lock()
+	bgm.ctrl.Paused = pause
+	speaker.Unlock()
+}
+
+// Ramps the music from silence to full over the given number of ticks. A fade
+// out in progress is reversed from its current level instead. Music that is
+// still loading fades in as soon as it starts.
+func (bgm *Bgm) FadeIn(durationTicks int) {
+	if bgm.fader == nil {
+		bgm.fadeInTicks = durationTicks
+		return
+	}
+	speaker.Lock()
+	if bgm.fader.gain >= 1 && bgm.fader.target >= 1 {
+		bgm.fader.gain = 0
+	}
+	bgm.fader.fadeTo(1, ticksToSamples(durationTicks), false)
+	speaker.Unlock()
+}
+
+// Ramps the music down to silence over the given number of ticks, stopping it
+// as the ramp completes if thenStop is set.
+func (bgm *Bgm) FadeOut(durationTicks int, thenStop bool) {
+	if bgm.fader == nil {
+		return
+	}
+	speaker.Lock()
+	bgm.fader.fadeTo(0, ticksToSamples(durationTicks), thenStop)
+	speaker.Unlock()
+}
+
+// Stops the music, fading it out over fadeTicks if above 0. Unlike opening
+// "", nothing is kept, so the music is released as soon as the fade ends.
+func (bgm *Bgm) Stop(fadeTicks int) {
+	bgm.playlist = BgmPlaylist{}
+	bgm.saved = bgmSaved{}
+	bgm.stop("", bgm.loop, bgm.bgmVolume, bgm.freqmul, fadeTicks)
+	bgm.ctrl, bgm.volctrl = nil, nil
+}
+
+// Fades stem index, counting from 0, to vol (0 to 100) over fadeTicks ticks.
+// Does nothing unless the music was opened with OpenStems.
+func (bgm *Bgm) SetStemVolume(index, vol, fadeTicks int) {
+	speaker.Lock()
+	defer speaker.Unlock()
+	if bs, ok := bgm.streamer.(*BgmStems); ok && index >= 0 && index < len(bs.gains) {
+		// The stems play at the file's rate, not the output rate
+		bs.gains[index].fadeTo(float64(vol)/100, fadeTicks*int(bgm.sampleRate)/FPS, false)
+	}
+}
+
+func (bgm *Bgm) UpdateVolume() {
+	if bgm.volctrl == nil {
+		return
+	}
+	// TODO: Throw a debug warning if this triggers
+	if bgm.bgmVolume > sys.maxBgmVolume {
+		sys.errLog.Printf("WARNING: BGM volume set beyond expected range (value: %v). Clamped to MaxBgmVolume", bgm.bgmVolume)
+		bgm.bgmVolume = sys.maxBgmVolume
+	}
+	var volume float64
+	var silent bool
+	if sys.volumeCurve == VolumeCurveLegacy {
+		volume = -5 + float64(sys.bgmVolume)*0.06*(float64(sys.masterVolume)/100)*(float64(bgm.bgmVolume)/100)*(1-bgm.pauseCut)
+		silent = volume <= -5
+	} else {
+		gain := volumeCurveGain(sys.bgmVolume) * volumeCurveGain(sys.masterVolume) *
+			float64(bgm.bgmVolume) / 100 * (1 - bgm.pauseCut)
+		silent = gain <= 0
+		if !silent {
+			volume = math.Log2(gain)
+		}
+	}
+	// Volume is in powers of 2, about 6 dB each
+	volume += (sys.bgmDucker.level + bgm.replayGain) / 6.0206
+	speaker.Lock()
+	bgm.volctrl.Volume = volume
+	bgm.volctrl.Silent = silent
+	speaker.Unlock()
+}
+
+// Ramps the volume towards percent of itself while pausing, or back to full.
+func (bgm *Bgm) tickPause(percent int) {
+	target := 0.0
+	if bgm.pausing {
+		target = 1 - float64(Clamp(int32(percent), 0, 100))/100
+	}
+	if bgm.pauseCut == target {
+		return
+	}
+	if bgm.pauseCut < target {
+		bgm.pauseCut = math.Min(bgm.pauseCut+1.0/bgmPauseFadeTicks, target)
+	} else {
+		bgm.pauseCut = math.Max(bgm.pauseCut-1.0/bgmPauseFadeTicks, target)
+	}
+	bgm.UpdateVolume()
+}
+
+// Changes the playback rate of the music. With glide above 0, the rate
+// moves to freqmul over that many ticks instead of jumping there.
+func (bgm *Bgm) SetFreqMul(freqmul float32, glide int32, timeStretch bool) {
+	changed := bgm.timeStretch != timeStretch
+	bgm.timeStretch = timeStretch
+	if glide > 0 {
+		bgm.glide.start(bgm.freqmul, freqmul, glide)
+		if changed {
+			bgm.setRatio(bgm.freqmul)
+		}
+		return
+	}
+	bgm.glide = freqGlide{}
+	if bgm.freqmul != freqmul || changed {
+		bgm.setRatio(freqmul)
+	}
+}
+
+// Splits freqmul into the pitch the music is resampled to and the speed it's
+// stretched to.
+func (bgm *Bgm) pitchSpeed(freqmul float32) (pitch, speed float32) {
+	if bgm.timeStretch {
+		return 1, freqmul
+	}
+	return freqmul, 1
+}
+
+func (bgm *Bgm) setRatio(freqmul float32) {
+	if bgm.ctrl != nil {
+		pitch, speed := bgm.pitchSpeed(freqmul)
+		srcRate := bgm.sampleRate
+		dstRate := beep.SampleRate(float32(audioFrequency) / pitch)
+		if resampler, ok := bgm.ctrl.Streamer.(*beep.Resampler); ok {
+			speaker.Lock()
+			resampler.SetRatio(float64(srcRate) / float64(dstRate))
+			if bgm.stretch != nil {
+				bgm.stretch.speed = float64(speed)
+			}
+			bgm.freqmul = freqmul
+			speaker.Unlock()
+		}
+	}
+}
+
+// Changes the loop points of the music, in samples, following the same
+// rules as newStreamLooper. A loop end of 0 loops up to the end, points past
+// the end are clamped, points in the wrong order are swapped, and a loop of
+// less than 2 samples is rejected. Music that is still loading gets them
+// once it starts.
+func (bgm *Bgm) SetLoopPoints(bgmLoopStart int, bgmLoopEnd int) error {
+	if bgm.loading {
+		bgm.pending = append(bgm.pending, func() { bgm.SetLoopPoints(bgmLoopStart, bgmLoopEnd) })
+		return nil
+	}
+	if bgm.volctrl == nil {
+		sys.errLog.Printf("Can't set BGM loop points %v-%v, no music is loaded", bgmLoopStart, bgmLoopEnd)
+		return Error("no music loaded")
+	}
+	sl, ok := bgm.volctrl.Streamer.(*StreamLooper)
+	if !ok {
+		return nil
+	}
+	length := sl.Len()
+	bgmLoopStart, bgmLoopEnd = int(Max(int32(bgmLoopStart), 0)), int(Max(int32(bgmLoopEnd), 0))
+	if bgmLoopEnd > 0 && bgmLoopEnd < bgmLoopStart {
+		bgmLoopStart, bgmLoopEnd = bgmLoopEnd, bgmLoopStart
+	}
+	if length > 0 {
+		bgmLoopStart = int(Min(int32(bgmLoopStart), int32(length)))
+		bgmLoopEnd = int(Min(int32(bgmLoopEnd), int32(length)))
+	}
+	if bgmLoopEnd == 0 {
+		bgmLoopEnd = length
+	}
+	if length > 0 && bgmLoopEnd-bgmLoopStart <= 1 {
+		sys.errLog.Printf("Rejected empty BGM loop region %v-%v", bgmLoopStart, bgmLoopEnd)
+		return Error(fmt.Sprintf("empty loop region %v-%v", bgmLoopStart, bgmLoopEnd))
+	}
+	speaker.Lock()
+	if sl.loopstart != bgmLoopStart {
+		sl.head = nil
+	}
+	sl.loopstart = bgmLoopStart
+	sl.loopend = bgmLoopEnd
+	speaker.Unlock()
+	return nil
+}
+
+// Same as SetLoopPoints, in seconds of the music file.
+func (bgm *Bgm) SetLoopPointsSeconds(loopStart, loopEnd float64) error {
+	if bgm.loading {
+		// the file's rate isn't known yet
+		bgm.pending = append(bgm.pending, func() { bgm.SetLoopPointsSeconds(loopStart, loopEnd) })
+		return nil
+	}
+	rate := float64(bgm.sampleRate)
+	return bgm.SetLoopPoints(int(math.Round(loopStart*rate)), int(math.Round(loopEnd*rate)))
+}
+
+// Returns the playback position in samples of the music file, or 0 if no
+// music is loaded.
+func (bgm *Bgm) Position() int {
+	if bgm.streamer == nil {
+		return 0
+	}
+	speaker.Lock()
+	defer speaker.Unlock()
+	return bgm.streamer.Position()
+}
+
+// Returns the length in samples of the music file, or 0 if no music is loaded.
+func (bgm *Bgm) Length() int {
+	if bgm.streamer == nil {
+		return 0
+	}
+	speaker.Lock()
+	defer speaker.Unlock()
+	return bgm.streamer.Len()
+}
+
+func (bgm *Bgm) PositionSeconds() float64 {
+	if bgm.sampleRate == 0 {
+		return 0
+	}
+	return bgm.sampleRate.D(bgm.Position()).Seconds()
+}
+
+func (bgm *Bgm) LengthSeconds() float64 {
+	if bgm.sampleRate == 0 {
+		return 0
+	}
+	return bgm.sampleRate.D(bgm.Length()).Seconds()
+}
+
+// Reports whether playback has reached the loop region, as opposed to still
+// being in the intro before loopstart.
+func (bgm *Bgm) InLoop() bool {
+	if bgm.streamer == nil || bgm.volctrl == nil {
+		return false
+	}
+	speaker.Lock()
+	defer speaker.Unlock()
+	if sl, ok := bgm.volctrl.Streamer.(*StreamLooper); ok {
+		pos := sl.Position()
+		return pos >= sl.loopstart && pos < sl.loopend
+	}
+	return false
+}
+
+func (bgm *Bgm) Seek(positionSample int) {
+	if bgm.loading {
+		bgm.pending = append(bgm.pending, func() { bgm.Seek(positionSample) })
+		return
+	}
+	speaker.Lock()
+	defer speaker.Unlock()
+	if bgm.streamer == nil {
+		return
+	}
+	// Reset to 0 if out of range
+	if positionSample < 0 || positionSample > bgm.streamer.Len() {
+		positionSample = 0
+	}
+	bgm.streamer.Seek(positionSample)
+}
+
+// Seeks to t seconds into the music, using the file's own sample rate.
+func (bgm *Bgm) SeekSeconds(t float64) {
+	if bgm.loading {
+		bgm.pending = append(bgm.pending, func() { bgm.SeekSeconds(t) })
+		return
+	}
+	speaker.Lock()
+	defer speaker.Unlock()
+	if bgm.streamer == nil {
+		return
+	}
+	bgm.streamer.Seek(secondsToSample(t, bgm.sampleRate, bgm.streamer.Len()))
+}
+
+// ------------------------------------------------------------------
+// Sound
+
+type Sound struct {
+	wavData []byte // or Ogg Vorbis data, if ogg is set
+	format  beep.Format
+	length  int
+	ogg     bool
+	// Where the sound is stored in its SND file. Large sounds aren't kept in
+	// memory, but read from there whenever they play, path being set then.
+	path   string
+	offset int64
+	size   uint32
+	// Where the sound came from, for the warning if it turns out corrupted.
+	// A sound shared by several entries has the first one.
+	sndFile string
+	gn      [2]int32
+	broken  bool
+	// Decoded samples, filled in on the first play if the cache allows
+	pcm      [][2]float64
+	pcmTried bool
+	// Loudness normalization gain, worked out on the first play
+	gain     float32
+	gainDone bool
+}
+
+// Sounds by a hash of their data as stored in the SND, so that identical
+// sounds of any SND share one Sound. Emptied by clearSharedSounds, not to
+// keep the sounds of characters that are gone.
+var sharedSounds = struct {
+	sync.Mutex
+	sounds map[[32]byte]*Sound
+}{sounds: make(map[[32]byte]*Sound)}
+
+func clearSharedSounds() {
+	sharedSounds.Lock()
+	sharedSounds.sounds = make(map[[32]byte]*Sound)
+	sharedSounds.Unlock()
+}
+
+// Reads the sound at offset in an SND. A sound with the same data as one
+// already read is returned as is, shared set.
+func readSound(r io.ReaderAt, offset int64, size uint32) (snd *Sound, shared bool, err error) {
+	if f, ok := r.(*os.File); ok && sys.soundStreamThreshold > 0 && size > sys.soundStreamThreshold {
+		snd, err = readStreamedSound(f, offset, size)
+		return snd, false, err
+	}
+	// Like reading the file, an entry cut short by the end of the file is
+	// read as far as it goes
+	wavData := make([]byte, size)
+	if n, err := r.ReadAt(wavData, offset); err != nil && n == 0 {
+		return nil, false, err
+	}
+	sum := sha256.Sum256(wavData)
+	sharedSounds.Lock()
+	defer sharedSounds.Unlock()
+	if s, ok := sharedSounds.sounds[sum]; ok {
+		return s, true, nil
+	}
+	snd, err = readSoundData(wavData)
+	if snd != nil {
+		sharedSounds.sounds[sum] = snd
+	}
+	return snd, false, err
+}
+
+func readSoundData(wavData []byte) (*Sound, error) {
+	// MUGEN plays ADPCM entries, the wav decoder only takes PCM
+	if pcm, ok, err := decodeAdpcmWav(wavData); ok {
+		if err != nil {
+			return nil, err
+		}
+		wavData = pcm
+	}
+	// 32-bit and float data are converted to 16-bit PCM
+	if pcm, ok, err := convertWav(wavData); ok {
+		if err != nil {
+			return nil, err
+		}
+		wavData = pcm
+	}
+	// Ikemen extension: Ogg Vorbis in place of a WAV file
+	ogg := bytes.HasPrefix(wavData, []byte("OggS"))
+	if !ogg {
+		if err := checkWavHeader(wavData); err != nil {
+			return nil, err
+		}
+	}
+	// Decode the header, so that we know the format is OK
+	var s beep.StreamSeekCloser
+	var fmt beep.Format
+	var err error
+	if ogg {
+		s, fmt, err = vorbis.Decode(io.NopCloser(bytes.NewReader(wavData)))
+	} else {
+		s, fmt, err = wav.Decode(bytes.NewReader(wavData))
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Decoding every sample here would double load times, so only check that
+	// the samples the header promises are there. A sound that still turns out
+	// not to play through is disabled when it first stalls.
+	if !ogg && int64(s.Len())*int64(fmt.Width()) > int64(len(wavData)) {
+		return nil, nil
+	}
+	return &Sound{wavData: wavData, format: fmt, length: s.Len(), ogg: ogg}, nil
+}
+
+// Sets up a sound that is streamed from the SND file. Instead of decoding
+// every sample, the header is checked against the size of the entry.
+func readStreamedSound(f *os.File, offset int64, size uint32) (*Sound, error) {
+	snd := &Sound{path: f.Name(), offset: offset, size: size}
+	r := io.NewSectionReader(f, offset, int64(size))
+	var magic [4]byte
+	if _, err := r.ReadAt(magic[:], 0); err != nil {
+		return nil, err
+	}
+	var err error
+	snd.ogg = string(magic[:]) == "OggS"
+	var s beep.StreamSeekCloser
+	if snd.ogg {
+		s, snd.format, err = vorbis.Decode(io.NopCloser(r))
+	} else {
+		s, snd.format, err = wav.Decode(r)
+		// ADPCM and the formats convertWav takes have to be converted as a
+		// whole, so they stay in memory
+		if err != nil {
+			data := make([]byte, size)
+			if _, rerr := r.ReadAt(data, 0); rerr != nil {
+				return nil, rerr
+			}
+			if _, ok, _ := decodeAdpcmWav(data); ok {
+				return readSoundData(data)
+			}
+			if _, ok, _ := convertWav(data); ok {
+				return readSoundData(data)
+			}
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	snd.length = s.Len()
+	// The sound is disabled if its data doesn't fit in the entry, like a
+	// sound that can't be fully played
+	if !snd.ogg && int64(snd.length)*int64(snd.format.Width()) > int64(size) {
+		return nil, nil
+	}
+	return snd, nil
+}
+
+// An SND entry opened for streaming, closed along with its decoder.
+type sndSection struct {
+	*io.SectionReader
+	f *os.File
+}
+
+func (s sndSection) Close() error {
+	return s.f.Close()
+}
+
+// Reads the sound as it's stored in its SND file. The copy of a shared sound
+// in another SND is the same.
+func (s *Sound) storedData() ([]byte, error) {
+	f, err := os.Open(s.sndFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	data := make([]byte, s.size)
+	if _, err := f.ReadAt(data, s.offset); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Returns a new streamer for the sound. Streamers of sounds streamed from
+// disk hold the file open until closed.
+func (s *Sound) GetStreamer() beep.StreamSeeker {
+	if s.path != "" {
+		f, err := os.Open(s.path)
+		if err != nil {
+			sys.errLog.Printf("Failed to open sound: %v", err)
+			return nil
+		}
+		r := sndSection{io.NewSectionReader(f, s.offset, int64(s.size)), f}
+		var streamer beep.StreamSeekCloser
+		if s.ogg {
+			streamer, _, err = vorbis.Decode(r)
+		} else {
+			streamer, _, err = wav.Decode(r)
+		}
+		if err != nil {
+			f.Close()
+			sys.errLog.Printf("Failed to decode sound: %v", err)
+			return nil
+		}
+		return streamer
+	}
+	if s.pcm != nil {
+		return &pcmStreamer{samples: s.pcm}
+	}
+	if !s.pcmTried {
+		s.pcmTried = true
+		if s.decodePCM() {
+			return &pcmStreamer{samples: s.pcm}
+		}
+	}
+	return s.decode()
+}
+
+func (s *Sound) decode() beep.StreamSeeker {
+	if s.ogg {
+		streamer, _, _ := vorbis.Decode(io.NopCloser(bytes.NewReader(s.wavData)))
+		return streamer
+	}
+	streamer, _, _ := wav.Decode(bytes.NewReader(s.wavData))
+	return streamer
 }
 
-func newStreamLooper(s beep.StreamSeeker, loopcount, loopstart, loopend int) beep.Streamer {
-	if loopstart < 0 || loopstart >= s.Len() {
-		loopstart = 0
+// Decoded samples are kept for sounds played from memory, so that later
+// plays skip the decoder, up to this many bytes in total.
+const soundPCMCacheBudget = 64 << 20
+
+var soundPCMCacheUsed int64
+
+// Decodes the whole sound into s.pcm if it fits in the cache budget. The
+// budget is given back once the sound is garbage collected. sharedSounds
+// holds on to every sound read from an SND, so for those that is only after
+// clearSharedSounds, and not when a single character is unloaded.
+func (s *Sound) decodePCM() bool {
+	size := int64(s.length) * 16
+	if atomic.AddInt64(&soundPCMCacheUsed, size) > soundPCMCacheBudget {
+		atomic.AddInt64(&soundPCMCacheUsed, -size)
+		return false
 	}
-	if loopend <= loopstart {
-		loopend = s.Len()
+	pcm := make([][2]float64, s.length)
+	n := 0
+	if st := s.decode(); st != nil {
+		for n < len(pcm) {
+			sn, ok := st.Stream(pcm[n:])
+			n += sn
+			if !ok || sn == 0 {
+				break
+			}
+		}
 	}
-	return &StreamLooper{
-		s:         s,
-		loopcount: loopcount,
-		loopstart: loopstart,
-		loopend:   loopend,
+	// A sound that doesn't decode to its full length is left to the decoder
+	if n < len(pcm) {
+		atomic.AddInt64(&soundPCMCacheUsed, -size)
+		return false
 	}
+	s.pcm = pcm
+	runtime.SetFinalizer(s, func(*Sound) { atomic.AddInt64(&soundPCMCacheUsed, -size) })
+	return true
 }
 
-func (b *StreamLooper) Stream(samples [][2]float64) (n int, ok bool) {
-	if b.loopcount == 0 || b.s.Err() != nil {
-		return 0, false
+type SoundNormalize int32
+
+const (
+	SoundNormalizeOff SoundNormalize = iota
+	SoundNormalizePeak
+	SoundNormalizeRMS
+)
+
+func parseSoundNormalize(s string) SoundNormalize {
+	switch strings.ToLower(s) {
+	case "peak":
+		return SoundNormalizePeak
+	case "rms":
+		return SoundNormalizeRMS
 	}
-	for len(samples) > 0 {
-		sn, sok := b.s.Stream(samples)
-		if !sok || (b.s.Position() >= b.loopend && b.loopend < b.s.Len()) {
-			if b.loopcount > 0 {
-				b.loopcount--
-			}
-			if b.loopcount == 0 {
+	return SoundNormalizeOff
+}
+
+// Most a sound is boosted by loudness normalization, +6 dB, so that sounds
+// that are quiet by design aren't pushed into clipping.
+const soundNormalizeMaxGain = 2
+
+// Returns the gain that brings the sound's peak or RMS level to
+// soundNormalizeTarget, worked out on its first play from the decoded
+// samples, or a decoding pass if they aren't cached. Sounds streamed from
+// disk are left as they are, as measuring them would read them whole.
+func (s *Sound) normalizeGain() float32 {
+	if sys.soundNormalize == SoundNormalizeOff || s.path != "" {
+		return 1
+	}
+	if s.gainDone {
+		return s.gain
+	}
+	s.gain, s.gainDone = 1, true
+	var peak, sum float64
+	count := 0
+	measure := func(samples [][2]float64) {
+		for _, v := range samples {
+			peak = math.Max(peak, math.Max(math.Abs(v[0]), math.Abs(v[1])))
+			sum += v[0]*v[0] + v[1]*v[1]
+		}
+		count += len(samples)
+	}
+	if s.pcm != nil {
+		measure(s.pcm)
+	} else if st := s.decode(); st != nil {
+		buf := make([][2]float64, 4096)
+		for {
+			n, ok := st.Stream(buf)
+			measure(buf[:n])
+			if !ok || n == 0 {
 				break
 			}
-			err := b.s.Seek(b.loopstart)
-			if err != nil {
-				return n, true
-			}
-			continue
 		}
-		samples = samples[sn:]
-		n += sn
 	}
-	return n, true
+	level := peak
+	if sys.soundNormalize == SoundNormalizeRMS && count > 0 {
+		level = math.Sqrt(sum / float64(2*count))
+	}
+	if level > 0 {
+		gain := math.Pow(10, float64(sys.soundNormalizeTarget)/20) / level
+		s.gain = float32(math.Min(gain, soundNormalizeMaxGain))
+	}
+	return s.gain
 }
 
-func (b *StreamLooper) Err() error {
-	return b.s.Err()
+// Streams samples that were decoded ahead of time.
+type pcmStreamer struct {
+	samples [][2]float64
+	pos     int
 }
 
-func (b *StreamLooper) Len() int {
-	return b.s.Len()
+func (p *pcmStreamer) Stream(samples [][2]float64) (n int, ok bool) {
+	n = copy(samples, p.samples[p.pos:])
+	p.pos += n
+	return n, n > 0
 }
 
-func (b *StreamLooper) Position() int {
-	return b.s.Position()
+func (p *pcmStreamer) Err() error {
+	return nil
 }
 
-func (b *StreamLooper) Seek(p int) error {
-	return b.s.Seek(p)
+func (p *pcmStreamer) Len() int {
+	return len(p.samples)
+}
+
+func (p *pcmStreamer) Position() int {
+	return p.pos
+}
+
+func (p *pcmStreamer) Seek(pos int) error {
+	if pos < 0 || pos > len(p.samples) {
+		return fmt.Errorf("seek position %v out of range [%v, %v]", pos, 0, len(p.samples))
+	}
+	p.pos = pos
+	return nil
 }
 
 // ------------------------------------------------------------------
-// Bgm
+// ADPCM
 
-type Bgm struct {
-	filename   string
-	bgmVolume  int
-	volRestore int
-	loop       int
-	streamer   beep.StreamSeekCloser
-	ctrl       *beep.Ctrl
-	volctrl    *effects.Volume
-	format     string
-	freqmul    float32
-	sampleRate beep.SampleRate
-	startPos   int
+const (
+	wavFormatMSADPCM  = 0x0002
+	wavFormatIMAADPCM = 0x0011
+)
+
+var imaStepTable = [89]int32{
+	7, 8, 9, 10, 11, 12, 13, 14, 16, 17, 19, 21, 23, 25, 28, 31, 34, 37, 41,
+	45, 50, 55, 60, 66, 73, 80, 88, 97, 107, 118, 130, 143, 157, 173, 190, 209,
+	230, 253, 279, 307, 337, 371, 408, 449, 494, 544, 598, 658, 724, 796, 876,
+	963, 1060, 1166, 1282, 1411, 1552, 1707, 1878, 2066, 2272, 2499, 2749,
+	3024, 3327, 3660, 4026, 4428, 4871, 5358, 5894, 6484, 7132, 7845, 8630,
+	9493, 10442, 11487, 12635, 13899, 15289, 16818, 18500, 20350, 22385,
+	24623, 27086, 29794, 32767,
 }
 
-func newBgm() *Bgm {
-	return &Bgm{}
+var imaIndexTable = [16]int32{-1, -1, -1, -1, 2, 4, 6, 8, -1, -1, -1, -1, 2, 4, 6, 8}
+
+var msAdpcmAdaptTable = [16]int32{
+	230, 230, 230, 230, 307, 409, 512, 614, 768, 614, 512, 409, 307, 230, 230, 230,
 }
 
-func (bgm *Bgm) Open(filename string, loop, bgmVolume, bgmLoopStart, bgmLoopEnd, startPosition int, freqmul float32) {
-	bgm.filename = filename
-	bgm.loop = loop
-	bgm.bgmVolume = bgmVolume
-	bgm.freqmul = freqmul
-	// Starve the current music streamer
-	if bgm.ctrl != nil {
-		speaker.Lock()
-		bgm.ctrl.Streamer = nil
-		speaker.Unlock()
+var msAdpcmCoefs = [][2]int32{{256, 0}, {512, -256}, {0, 0}, {192, 64}, {240, 0}, {460, -208}, {392, -232}}
+
+// Converts a WAV file holding IMA or Microsoft ADPCM, mono or stereo, to a
+// 16-bit PCM WAV file. ok is false if data isn't an ADPCM WAV file.
+func decodeAdpcmWav(data []byte) (pcm []byte, ok bool, err error) {
+	w, ok := readWavChunks(data)
+	if !ok {
+		return nil, false, nil
 	}
-	// Special value "" is used to stop music
-	if filename == "" {
-		return
+	tag, channels, blockAlign, fmtExt, body := w.tag, w.channels, w.blockAlign, w.fmtExt, w.body
+	if tag != wavFormatMSADPCM && tag != wavFormatIMAADPCM {
+		return nil, false, nil
 	}
-
-	f, err := os.Open(bgm.filename)
-	if err != nil {
-		// sys.bgm = *newBgm() // removing this gets pause step playsnd to work correctly 100% of the time
-		sys.errLog.Printf("Failed to open bgm: %v", err)
-		return
-	}
-	var format beep.Format
-	if HasExtension(bgm.filename, ".ogg") {
-		bgm.streamer, format, err = vorbis.Decode(f)
-		bgm.format = "ogg"
-	} else if HasExtension(bgm.filename, ".mp3") {
-		bgm.streamer, format, err = mp3.Decode(f)
-		bgm.format = "mp3"
-	} else if HasExtension(bgm.filename, ".wav") {
-		bgm.streamer, format, err = wav.Decode(f)
-		bgm.format = "wav"
-		// TODO: Reactivate FLAC support. Check that seeking/looping works correctly.
-		//} else if HasExtension(bgm.filename, ".flac") {
-		//	bgm.streamer, format, err = flac.Decode(f)
-		//	bgm.format = "flac"
-	} else if HasExtension(bgm.filename, ".mid") || HasExtension(bgm.filename, ".midi") {
-		if soundfont, sferr := loadSoundFont(audioSoundFont); sferr != nil {
-			err = sferr
+	if channels < 1 || channels > 2 || blockAlign <= 0 {
+		return nil, true, fmt.Errorf("unsupported ADPCM layout: %v channels, block size %v", channels, blockAlign)
+	}
+	coefs := msAdpcmCoefs
+	if tag == wavFormatMSADPCM && len(fmtExt) >= 4 {
+		// Custom coefficient sets follow the samples per block
+		if num := int(binary.LittleEndian.Uint16(fmtExt[2:])); num > 0 && len(fmtExt) >= 4+num*4 {
+			coefs = make([][2]int32, num)
+			for i := range coefs {
+				coefs[i][0] = int32(int16(binary.LittleEndian.Uint16(fmtExt[4+i*4:])))
+				coefs[i][1] = int32(int16(binary.LittleEndian.Uint16(fmtExt[6+i*4:])))
+			}
+		}
+	}
+	var samples []int16
+	for len(body) > 0 {
+		block := body[:Min(int32(blockAlign), int32(len(body)))]
+		body = body[len(block):]
+		if tag == wavFormatIMAADPCM {
+			samples = decodeImaAdpcmBlock(block, channels, samples)
 		} else {
-			bgm.streamer, format, err = midi.Decode(f, soundfont)
-			bgm.format = "midi"
+			samples = decodeMsAdpcmBlock(block, channels, coefs, samples)
 		}
-	} else {
-		err = Error(fmt.Sprintf("unsupported file extension: %v", bgm.filename))
 	}
-	if err != nil {
-		f.Close()
-		sys.errLog.Printf("Failed to load bgm: %v", err)
-		return
+	// The last block may be padded past the real length
+	if w.total >= 0 && w.total*channels < len(samples) {
+		samples = samples[:w.total*channels]
 	}
+	return pcmWav(channels, w.rate, samples), true, nil
+}
 
-	loopCount := int(1)
-	if loop > 0 {
-		loopCount = -1
+// Decodes one IMA ADPCM block, appending the interleaved samples to out.
+func decodeImaAdpcmBlock(b []byte, ch int, out []int16) []int16 {
+	if len(b) < 4*ch {
+		return out
 	}
-	bgm.startPos = startPosition
-	streamer := newStreamLooper(bgm.streamer, loopCount, bgmLoopStart, bgmLoopEnd)
-	bgm.volctrl = &effects.Volume{Streamer: streamer, Base: 2, Volume: 0, Silent: true}
-	bgm.sampleRate = format.SampleRate
-	dstFreq := beep.SampleRate(audioFrequency / bgm.freqmul)
-	resampler := beep.Resample(audioResampleQuality, bgm.sampleRate, dstFreq, bgm.volctrl)
-	bgm.ctrl = &beep.Ctrl{Streamer: resampler}
-	bgm.UpdateVolume()
-	bgm.streamer.Seek(startPosition)
-	speaker.Play(bgm.ctrl)
+	var pred, idx [2]int32
+	for c := 0; c < ch; c++ {
+		pred[c] = int32(int16(binary.LittleEndian.Uint16(b[4*c:])))
+		idx[c] = Clamp(int32(b[4*c+2]), 0, 88)
+		out = append(out, int16(pred[c]))
+	}
+	// Each channel in turn has 4 bytes of nibbles, low nibble first
+	for b = b[4*ch:]; len(b) >= 4*ch; b = b[4*ch:] {
+		base := len(out)
+		out = append(out, make([]int16, 8*ch)...)
+		for c := 0; c < ch; c++ {
+			for i := 0; i < 8; i++ {
+				nib := b[4*c+i/2] >> (4 * (i & 1)) & 0xf
+				out[base+i*ch+c] = imaAdpcmStep(&pred[c], &idx[c], nib)
+			}
+		}
+	}
+	return out
 }
 
-func loadSoundFont(filename string) (*midi.SoundFont, error) {
-	f, err := os.Open(filename)
-	if err != nil {
-		return nil, err
+func imaAdpcmStep(pred, idx *int32, nib byte) int16 {
+	step := imaStepTable[*idx]
+	diff := step >> 3
+	if nib&4 != 0 {
+		diff += step
 	}
-	soundfont, err := midi.NewSoundFont(f)
-	if err != nil {
-		f.Close()
-		return nil, err
+	if nib&2 != 0 {
+		diff += step >> 1
 	}
-	return soundfont, nil
+	if nib&1 != 0 {
+		diff += step >> 2
+	}
+	if nib&8 != 0 {
+		*pred = Max(*pred-diff, -32768)
+	} else {
+		*pred = Min(*pred+diff, 32767)
+	}
+	*idx = Clamp(*idx+imaIndexTable[nib], 0, 88)
+	return int16(*pred)
 }
 
-func (bgm *Bgm) SetPaused(pause bool) {
-	if bgm.ctrl == nil || bgm.ctrl.Paused == pause {
-		return
+// Decodes one Microsoft ADPCM block, appending the interleaved samples to
+// out.
+func decodeMsAdpcmBlock(b []byte, ch int, coefs [][2]int32, out []int16) []int16 {
+	if len(b) < 7*ch {
+		return out
 	}
-	speaker.Lock()
-	bgm.ctrl.Paused = pause
-	speaker.Unlock()
+	var c1, c2, delta, s1, s2 [2]int32
+	for c := 0; c < ch; c++ {
+		p := int(b[c])
+		if p >= len(coefs) {
+			p = 0
+		}
+		c1[c], c2[c] = coefs[p][0], coefs[p][1]
+		delta[c] = int32(int16(binary.LittleEndian.Uint16(b[ch+2*c:])))
+		s1[c] = int32(int16(binary.LittleEndian.Uint16(b[3*ch+2*c:])))
+		s2[c] = int32(int16(binary.LittleEndian.Uint16(b[5*ch+2*c:])))
+	}
+	// The header holds the first two samples, oldest last
+	for c := 0; c < ch; c++ {
+		out = append(out, int16(s2[c]))
+	}
+	for c := 0; c < ch; c++ {
+		out = append(out, int16(s1[c]))
+	}
+	// High nibble first; in stereo the nibbles alternate between channels
+	c := 0
+	for _, v := range b[7*ch:] {
+		for _, nib := range [2]byte{v >> 4, v & 0xf} {
+			sn := int32(nib)
+			if sn >= 8 {
+				sn -= 16
+			}
+			pred := Clamp((s1[c]*c1[c]+s2[c]*c2[c])/256+sn*delta[c], -32768, 32767)
+			out = append(out, int16(pred))
+			s2[c], s1[c] = s1[c], pred
+			delta[c] = Max(msAdpcmAdaptTable[nib]*delta[c]/256, 16)
+			c = (c + 1) % ch
+		}
+	}
+	return out
 }
 
-func (bgm *Bgm) UpdateVolume() {
-	if bgm.volctrl == nil {
-		return
-	}
-	// TODO: Throw a debug warning if this triggers
-	if bgm.bgmVolume > sys.maxBgmVolume {
-		sys.errLog.Printf("WARNING: BGM volume set beyond expected range (value: %v). Clamped to MaxBgmVolume", bgm.bgmVolume)
-		bgm.bgmVolume = sys.maxBgmVolume
+// Builds a 16-bit PCM WAV file from interleaved samples.
+func pcmWav(channels int, rate uint32, samples []int16) []byte {
+	buf := make([]byte, 44+len(samples)*2)
+	copy(buf, "RIFF")
+	binary.LittleEndian.PutUint32(buf[4:], uint32(len(buf)-8))
+	copy(buf[8:], "WAVEfmt ")
+	binary.LittleEndian.PutUint32(buf[16:], 16)
+	binary.LittleEndian.PutUint16(buf[20:], 1)
+	binary.LittleEndian.PutUint16(buf[22:], uint16(channels))
+	binary.LittleEndian.PutUint32(buf[24:], rate)
+	binary.LittleEndian.PutUint32(buf[28:], rate*uint32(channels)*2)
+	binary.LittleEndian.PutUint16(buf[32:], uint16(channels*2))
+	binary.LittleEndian.PutUint16(buf[34:], 16)
+	copy(buf[36:], "data")
+	binary.LittleEndian.PutUint32(buf[40:], uint32(len(samples)*2))
+	for i, v := range samples {
+		binary.LittleEndian.PutUint16(buf[44+i*2:], uint16(v))
 	}
-	volume := -5 + float64(sys.bgmVolume)*0.06*(float64(sys.masterVolume)/100)*(float64(bgm.bgmVolume)/100)
-	silent := volume <= -5
-	speaker.Lock()
-	bgm.volctrl.Volume = volume
-	bgm.volctrl.Silent = silent
-	speaker.Unlock()
+	return buf
 }
 
-func (bgm *Bgm) SetFreqMul(freqmul float32) {
-	if bgm.freqmul != freqmul {
-		if bgm.ctrl != nil {
-			srcRate := bgm.sampleRate
-			dstRate := beep.SampleRate(audioFrequency / freqmul)
-			if resampler, ok := bgm.ctrl.Streamer.(*beep.Resampler); ok {
-				speaker.Lock()
-				resampler.SetRatio(float64(srcRate) / float64(dstRate))
-				bgm.freqmul = freqmul
-				speaker.Unlock()
+// ------------------------------------------------------------------
+// WAV conversion
+
+const (
+	wavFormatPCM        = 0x0001
+	wavFormatFloat      = 0x0003
+	wavFormatALaw       = 0x0006
+	wavFormatMuLaw      = 0x0007
+	wavFormatExtensible = 0xfffe
+)
+
+// The parts of a WAV file needed to convert it.
+type wavChunks struct {
+	tag, channels, bits, blockAlign int
+	rate                            uint32
+	fmtExt                          []byte // what follows cbSize
+	body                            []byte
+	total                           int // frames, from the fact chunk, or -1
+	hasFmt, hasData                 bool
+}
+
+// Walks the chunks of a WAV file. ok is false if data isn't a WAV file.
+func readWavChunks(data []byte) (w wavChunks, ok bool) {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WAVE" {
+		return w, false
+	}
+	w.total = -1
+	for p := 12; p+8 <= len(data); {
+		id := string(data[p : p+4])
+		n := int(binary.LittleEndian.Uint32(data[p+4:]))
+		end := p + 8 + n
+		if n < 0 || end > len(data) {
+			// Streamed WAVs often give 0xFFFFFFFF as the data size; the
+			// chunk then runs to the end of the file
+			end = len(data)
+		}
+		chunk := data[p+8 : end]
+		switch id {
+		case "fmt ":
+			if len(chunk) < 16 {
+				return w, false
+			}
+			w.tag = int(binary.LittleEndian.Uint16(chunk))
+			w.channels = int(binary.LittleEndian.Uint16(chunk[2:]))
+			w.rate = binary.LittleEndian.Uint32(chunk[4:])
+			w.blockAlign = int(binary.LittleEndian.Uint16(chunk[12:]))
+			w.bits = int(binary.LittleEndian.Uint16(chunk[14:]))
+			if len(chunk) >= 18 {
+				w.fmtExt = chunk[18:]
 			}
+			w.hasFmt = true
+		case "fact":
+			if len(chunk) >= 4 {
+				w.total = int(binary.LittleEndian.Uint32(chunk))
+			}
+		case "data":
+			w.body = chunk
+			w.hasData = true
 		}
+		// Chunks are padded to an even size
+		p = end + n&1
 	}
+	return w, true
 }
 
-func (bgm *Bgm) SetLoopPoints(bgmLoopStart int, bgmLoopEnd int) {
-	// Set both at once, why not
-	if sl, ok := bgm.volctrl.Streamer.(*StreamLooper); ok {
-		if sl.loopstart != bgmLoopStart && sl.loopend != bgmLoopEnd {
-			speaker.Lock()
-			sl.loopstart = bgmLoopStart
-			sl.loopend = bgmLoopEnd
-			speaker.Unlock()
-			// Set one at a time
-		} else {
-			if sl.loopstart != bgmLoopStart {
-				speaker.Lock()
-				sl.loopstart = bgmLoopStart
-				speaker.Unlock()
-			} else if sl.loopend != bgmLoopEnd {
-				speaker.Lock()
-				sl.loopend = bgmLoopEnd
-				speaker.Unlock()
-			}
-		}
+// Checks that data starts with a complete WAV header, the RIFF header, and
+// the fmt and data chunks. Whether the data itself plays is left to the
+// decoder, so that even a header with no samples loads.
+func checkWavHeader(data []byte) error {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WAVE" {
+		return Error("not a WAV file, the RIFF header is missing")
+	}
+	w, ok := readWavChunks(data)
+	if !ok || !w.hasFmt {
+		return Error("WAV file without a complete fmt chunk")
 	}
+	if !w.hasData {
+		return Error("WAV file without a data chunk")
+	}
+	return nil
 }
 
-func (bgm *Bgm) Seek(positionSample int) {
-	speaker.Lock()
-	// Reset to 0 if out of range
-	if positionSample < 0 || positionSample > bgm.streamer.Len() {
-		positionSample = 0
+// Returns the format tag, looking into the sub format of extensible files.
+func (w *wavChunks) format() int {
+	if w.tag == wavFormatExtensible && len(w.fmtExt) >= 8 {
+		return int(binary.LittleEndian.Uint16(w.fmtExt[6:]))
 	}
-	bgm.streamer.Seek(positionSample)
-	speaker.Unlock()
+	return w.tag
 }
 
-// ------------------------------------------------------------------
-// Sound
+// Error for WAV data that can neither be decoded nor converted.
+type wavFormatError string
 
-type Sound struct {
-	wavData []byte
-	format  beep.Format
-	length  int
+func (e wavFormatError) Error() string {
+	return "unsupported WAV format: " + string(e)
 }
 
-func readSound(f *os.File, size uint32) (*Sound, error) {
-	if size < 128 {
-		return nil, fmt.Errorf("wav size is too small")
+// Converts a WAV file in a format the wav decoder doesn't take, 32-bit PCM
+// or 32/64-bit float, to a 16-bit PCM WAV file. ok is false if data isn't a
+// WAV file or the decoder takes it as is; formats that can't be converted
+// either give a wavFormatError.
+func convertWav(data []byte) (pcm []byte, ok bool, err error) {
+	w, ok := readWavChunks(data)
+	if !ok {
+		return nil, false, nil
 	}
-	wavData := make([]byte, size)
-	if _, err := f.Read(wavData); err != nil {
-		return nil, err
+	format := w.format()
+	switch {
+	case format == wavFormatPCM && (w.bits == 8 || w.bits == 16 || w.bits == 24):
+		return nil, false, nil
+	case format == wavFormatMSADPCM || format == wavFormatIMAADPCM:
+		// Converted by decodeAdpcmWav
+		return nil, false, nil
+	case format == wavFormatPCM && w.bits == 32,
+		format == wavFormatFloat && (w.bits == 32 || w.bits == 64):
+	default:
+		return nil, true, wavFormatError(fmt.Sprintf("%v-bit %v", w.bits, wavFormatName(format)))
 	}
-	// Decode the sound at least once, so that we know the format is OK
-	s, fmt, err := wav.Decode(bytes.NewReader(wavData))
-	if err != nil {
-		return nil, err
+	width := w.bits / 8
+	if w.channels < 1 || w.blockAlign != w.channels*width {
+		return nil, true, wavFormatError(fmt.Sprintf("%v-bit %v with %v channels in blocks of %v bytes",
+			w.bits, wavFormatName(format), w.channels, w.blockAlign))
 	}
-	// Check if the file can be fully played
-	var samples [512][2]float64
-	for {
-		sn, _ := s.Stream(samples[:])
-		if sn == 0 {
-			// If sound wasn't able to be fully played, we disable it to avoid engine freezing
-			if s.Position() < s.Len() {
-				return nil, nil
-			}
-			break
+	samples := make([]int16, len(w.body)/width)
+	for i := range samples {
+		b := w.body[i*width:]
+		var v float64
+		switch {
+		case format == wavFormatPCM:
+			v = float64(int32(binary.LittleEndian.Uint32(b))) / (1 << 31)
+		case w.bits == 32:
+			v = float64(math.Float32frombits(binary.LittleEndian.Uint32(b)))
+		default:
+			v = math.Float64frombits(binary.LittleEndian.Uint64(b))
 		}
+		samples[i] = int16(math.Round(math.Max(math.Min(v, 1), -1) * 32767))
 	}
-	return &Sound{wavData, fmt, s.Len()}, nil
+	// Drop a partial frame at the end
+	samples = samples[:len(samples)/w.channels*w.channels]
+	return pcmWav(w.channels, w.rate, samples), true, nil
 }
 
-func (s *Sound) GetStreamer() beep.StreamSeeker {
-	streamer, _, _ := wav.Decode(bytes.NewReader(s.wavData))
-	return streamer
+func wavFormatName(format int) string {
+	switch format {
+	case wavFormatPCM:
+		return "PCM"
+	case wavFormatFloat:
+		return "IEEE float"
+	case wavFormatALaw:
+		return "A-law"
+	case wavFormatMuLaw:
+		return "mu-law"
+	}
+	return fmt.Sprintf("format 0x%04x", format)
 }
 
 // ------------------------------------------------------------------
@@ -388,15 +4154,23 @@ func LoadSnd(filename string) (*Snd, error) {
 // The "keepItem" function allows to filter out unwanted waves.
 // If max > 0, the function returns immediately when a matching entry is found. It also gives up after "max" non-matching entries.
 func LoadSndFiltered(filename string, keepItem func([2]int32) bool, max uint32) (*Snd, error) {
-	s := newSnd()
 	f, err := os.Open(filename)
 	if err != nil {
 		return nil, err
 	}
 	defer func() { chk(f.Close()) }()
+	return LoadSndFilteredFrom(f, filename, keepItem, max)
+}
+
+// Same as LoadSndFiltered, but reads the SND from r, such as a file inside
+// an archive. The filename is only used in messages. Sounds are only
+// streamed from disk when r is an *os.File.
+func LoadSndFilteredFrom(r io.ReaderAt, filename string, keepItem func([2]int32) bool, max uint32) (*Snd, error) {
+	s := newSnd()
+	f := io.NewSectionReader(r, 0, math.MaxInt64)
 	buf := make([]byte, 12)
-	var n int
-	if n, err = f.Read(buf); err != nil {
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.ErrUnexpectedEOF {
 		return nil, err
 	}
 	if string(buf[:n]) != "ElecbyteSnd\x00" {
@@ -423,6 +4197,8 @@ func LoadSndFiltered(filename string, keepItem func([2]int32) bool, max uint32)
 	if max > 0 && max < numberOfSounds {
 		loops = max
 	}
+	oggSounds := 0
+	sharedCount, sharedBytes := 0, 0
 	for i := uint32(0); i < loops; i++ {
 		f.Seek(int64(subHeaderOffset), 0)
 		var nextSubHeaderOffset uint32
@@ -437,41 +4213,195 @@ func LoadSndFiltered(filename string, keepItem func([2]int32) bool, max uint32)
 		if err := read(&num); err != nil {
 			return nil, err
 		}
-		if keepItem(num) {
-			_, ok := s.table[num]
-			if !ok {
-				tmp, err := readSound(f, subFileLength)
-				if err != nil {
-					sys.errLog.Printf("%v sound %v,%v can't be read: %v\n", filename, num[0], num[1], err)
-					if max > 0 {
-						return nil, err
-					}
-				} else {
-					// Sound is corrupted and can't be played, so we export a warning message to the console
-					if tmp == nil {
-						sys.appendToConsole(fmt.Sprintf("WARNING: %v sound %v,%v is corrupted and can't be played, so it was disabled", filename, num[0], num[1]))
-					}
-					s.table[num] = tmp
-					if max > 0 {
-						break
-					}
-				}
-			}
+		if keepItem(num) {
+			_, ok := s.table[num]
+			if !ok {
+				offset, _ := f.Seek(0, io.SeekCurrent)
+				tmp, shared, err := readSound(r, offset, subFileLength)
+				if err != nil {
+					sys.errLog.Printf("%v sound %v,%v can't be read: %v\n", filename, num[0], num[1], err)
+					if _, ok := err.(wavFormatError); ok {
+						sys.appendToConsole(fmt.Sprintf("WARNING: %v sound %v,%v can't be played: %v", filename, num[0], num[1], err))
+					}
+					if max > 0 {
+						return nil, err
+					}
+				} else {
+					// Sound is corrupted and can't be played, so we export a warning message to the console
+					if tmp == nil {
+						sys.appendToConsole(fmt.Sprintf("WARNING: %v sound %v,%v is corrupted and can't be played, so it was disabled", filename, num[0], num[1]))
+					} else if shared {
+						sharedCount++
+						sharedBytes += len(tmp.wavData)
+					} else {
+						tmp.sndFile, tmp.gn = filename, num
+						tmp.offset, tmp.size = offset, subFileLength
+						if tmp.ogg {
+							oggSounds++
+						}
+					}
+					s.table[num] = tmp
+					if max > 0 {
+						break
+					}
+				}
+			}
+		}
+		subHeaderOffset = nextSubHeaderOffset
+	}
+	if oggSounds > 0 {
+		sys.errLog.Printf("%v contains %v Ogg Vorbis sounds, an Ikemen extension that MUGEN can't play\n", filename, oggSounds)
+	}
+	if sharedCount > 0 {
+		sys.appendToConsole(fmt.Sprintf("%v: %v sounds are identical to ones already loaded, saving %v bytes", filename, sharedCount, sharedBytes))
+	}
+	return s, nil
+}
+func (s *Snd) Get(gn [2]int32) *Sound {
+	return s.table[gn]
+}
+
+// Writes every sound of an SND file to outDir, as <group>-<number>.wav, or
+// .ogg for Ogg Vorbis sounds. The files are copied as they're stored in the
+// SND. Returns the sounds that were skipped as they're corrupted or can't be
+// read.
+func DumpSnd(filename, outDir string) (skipped [][2]int32, err error) {
+	var order [][2]int32
+	seen := make(map[[2]int32]bool)
+	snd, err := LoadSndFiltered(filename, func(gn [2]int32) bool {
+		if !seen[gn] {
+			seen[gn] = true
+			order = append(order, gn)
+		}
+		return true
+	}, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		return nil, err
+	}
+	for _, gn := range order {
+		s := snd.table[gn]
+		if s == nil {
+			skipped = append(skipped, gn)
+			continue
+		}
+		data, err := s.storedData()
+		if err != nil {
+			return skipped, err
+		}
+		ext := ".wav"
+		if s.ogg {
+			ext = ".ogg"
+		}
+		name := filepath.Join(outDir, fmt.Sprintf("%v-%v%v", gn[0], gn[1], ext))
+		if err := os.WriteFile(name, data, 0644); err != nil {
+			return skipped, err
+		}
+	}
+	return skipped, nil
+}
+
+// Writes an SND file with the given sounds, in group and number order. The
+// data of each sound is stored as is.
+func WriteSnd(entries map[[2]int32][]byte, filename string) error {
+	keys := make([][2]int32, 0, len(entries))
+	for gn := range entries {
+		keys = append(keys, gn)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i][0] < keys[j][0] || keys[i][0] == keys[j][0] && keys[i][1] < keys[j][1]
+	})
+	var buf bytes.Buffer
+	write := func(x interface{}) {
+		binary.Write(&buf, binary.LittleEndian, x)
+	}
+	// The header is padded to 512 bytes, the rest of it being a comment
+	const headerSize = 512
+	buf.WriteString("ElecbyteSnd\x00")
+	write([2]uint16{0, 1})
+	write(uint32(len(keys)))
+	write(uint32(headerSize))
+	buf.Write(make([]byte, headerSize-buf.Len()))
+	for _, gn := range keys {
+		data := entries[gn]
+		// Each sub-header points to the next one, right after this data
+		next := buf.Len() + 16 + len(data)
+		write(uint32(next))
+		write(uint32(len(data)))
+		write(gn)
+		buf.Write(data)
+	}
+	return os.WriteFile(filename, buf.Bytes(), 0644)
+}
+
+// Reads the sounds of a folder into SND entries. Files are named
+// <group>-<number>.wav, or .ogg for Ogg Vorbis, as DumpSnd writes them.
+// Returns the files that were skipped as their name doesn't fit or they
+// can't be played.
+func readSndDir(dir string) (entries map[[2]int32][]byte, skipped []string, err error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	entries = make(map[[2]int32][]byte)
+	for _, fi := range files {
+		ext := strings.ToLower(filepath.Ext(fi.Name()))
+		if fi.IsDir() || ext != ".wav" && ext != ".ogg" {
+			continue
+		}
+		base := strings.TrimSuffix(fi.Name(), filepath.Ext(fi.Name()))
+		var gn [2]int32
+		if _, err := fmt.Sscanf(base, "%d-%d", &gn[0], &gn[1]); err != nil ||
+			fmt.Sprintf("%v-%v", gn[0], gn[1]) != base {
+			skipped = append(skipped, fi.Name())
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, fi.Name()))
+		if err != nil {
+			return nil, skipped, err
 		}
-		subHeaderOffset = nextSubHeaderOffset
+		// Only sounds that would load from the SND go in
+		if s, err := readSoundData(data); err != nil || s == nil {
+			skipped = append(skipped, fi.Name())
+			continue
+		}
+		entries[gn] = data
 	}
-	return s, nil
+	return entries, skipped, nil
 }
-func (s *Snd) Get(gn [2]int32) *Sound {
-	return s.table[gn]
+
+// Builds an SND file from a folder of sounds, see readSndDir. Returns the
+// files that were left out.
+func BuildSnd(dir, filename string) (skipped []string, err error) {
+	entries, skipped, err := readSndDir(dir)
+	if err != nil {
+		return skipped, err
+	}
+	return skipped, WriteSnd(entries, filename)
 }
-func (s *Snd) play(gn [2]int32, volumescale int32, pan float32, loopstart, loopend, startposition int) bool {
+func (s *Snd) play(gn [2]int32, volumescale int32, pan float32, loopstart, loopend, startposition, startms int) bool {
+	return s.playHandle(gn, volumescale, pan, loopstart, loopend, startposition, startms).Valid()
+}
+
+// Same as play, but returns a handle to control the sound with while it
+// plays.
+func (s *Snd) playHandle(gn [2]int32, volumescale int32, pan float32, loopstart, loopend, startposition, startms int) SoundHandle {
 	sound := s.Get(gn)
-	return sys.soundChannels.Play(sound, volumescale, pan, loopstart, loopend, startposition)
+	h := sys.soundChannels.Play(sound, volumescale, pan, loopstart, loopend, startposition, startms)
+	if c := sys.soundChannels.handleChannel(h); c != nil {
+		c.setSource(s, gn)
+	}
+	return h
 }
 func (s *Snd) stop(gn [2]int32) {
-	sound := s.Get(gn)
-	sys.soundChannels.Stop(sound)
+	sys.soundChannels.StopSource(s, gn)
+}
+
+// Stops every sound of the group that plays from this SND.
+func (s *Snd) stopGroup(group int32) {
+	sys.soundChannels.StopGroup(s, group)
 }
 
 func loadFromSnd(filename string, g, s int32, max uint32) (*Sound, error) {
@@ -493,34 +4423,124 @@ func loadFromSnd(filename string, g, s int32, max uint32) (*Sound, error) {
 type SoundEffect struct {
 	streamer beep.Streamer
 	volume   float32
+	gain     float32 // loudness normalization of the sound, on top of volume
 	ls, p    float32
 	x        *float32
 	priority int32
 	channel  int32
 	loop     int32
-	freqmul  float32
+	owner    int     // Player number, 0 for system sounds
+	freqmul  float32 // Engine factor, e.g. from slowdown
+	pitch    float32 // Per-sound factor, composed with freqmul
+	// Fade out towards a stop, one step per sample
+	fading   bool
+	fadeGain float32
+	fadeStep float32
+	echo     *soundEcho    // nil unless set with SoundChannel.SetEcho
+	lowpass  *soundLowpass // nil unless set with SoundChannel.SetLowpass
+}
+
+// Clamps f to [0, 1], easing into the edges instead of stopping sharply, so
+// that sounds moving off-screen settle at the side they left from.
+func softClamp01(f float32) float32 {
+	const knee = 0.1
+	if f < knee {
+		return knee * float32(math.Exp(float64((f-knee)/knee)))
+	}
+	if f > 1-knee {
+		return 1 - knee*float32(math.Exp(float64((1-knee-f)/knee)))
+	}
+	return f
+}
+
+// Returns the volume multiplier for sounds of a player, 1 for system sounds.
+// Read on every buffer, so that changes apply to sounds already playing.
+func ownerVolume(owner int) float32 {
+	if owner < 1 || owner > len(sys.playerVolume) {
+		return 1
+	}
+	return float32(sys.playerVolume[owner-1]) / 100
+}
+
+// Linear move of a freqmul value over a number of ticks.
+type freqGlide struct {
+	from, to    float32
+	tick, ticks int32
+}
+
+// Starts gliding from the current value to target. A glide already heading
+// to the same target keeps going, so that controllers running every tick
+// don't restart it.
+func (g *freqGlide) start(from, to float32, ticks int32) {
+	if g.tick < g.ticks && g.to == to {
+		return
+	}
+	*g = freqGlide{from: from, to: to, ticks: ticks}
+}
+
+// Advances the glide by one tick and returns the value to apply, or false
+// when no glide is running.
+func (g *freqGlide) step() (float32, bool) {
+	if g.tick >= g.ticks {
+		return 0, false
+	}
+	g.tick++
+	return g.from + (g.to-g.from)*float32(g.tick)/float32(g.ticks), true
+}
+
+// Returns the combined playback rate multiplier.
+func (s *SoundEffect) rate() float32 {
+	return s.freqmul * s.pitch
 }
 
 func (s *SoundEffect) Stream(samples [][2]float64) (n int, ok bool) {
-	// TODO: Test mugen panning in relation to PanningWidth and zoom settings
-	lv, rv := s.volume, s.volume
+	vol := s.volume * s.gain * ownerVolume(s.owner)
+	lv, rv := vol, vol
 	if sys.stereoEffects && (s.x != nil || s.p != 0) {
-		var r float32
+		// Position within the visible camera window, 0 being the left edge
+		// and 1 the right one. The window follows zoom, so on-screen
+		// position is what is heard rather than the world coordinate. A
+		// stage's panningwidth replaces the window's width, centered on it.
+		visible := float32(sys.gameWidth) / MaxF(sys.cam.Scale, 0.01)
+		width := visible
+		if sys.stage != nil && sys.stage.stageCamera.panningwidth > 0 {
+			width = sys.stage.stageCamera.panningwidth * sys.stage.localscl / MaxF(sys.cam.Scale, 0.01)
+		}
+		var f float32
 		if s.x != nil { // pan
-			r = ((sys.xmax - s.ls**s.x) - s.p) / (sys.xmax - sys.xmin)
+			left := sys.cam.ScreenPos[0] + sys.cam.Offset[0] + (visible-width)/2
+			f = (s.ls**s.x + s.p - left) / width
 		} else { // abspan
-			r = ((sys.xmax-sys.xmin)/2 - s.p) / (sys.xmax - sys.xmin)
+			f = 0.5 + s.p/width
 		}
-		sc := sys.panningRange / 100
-		of := (100 - sys.panningRange) / 200
-		lv = ClampF(s.volume*2*(r*sc+of), 0, 512)
-		rv = ClampF(s.volume*2*((1-r)*sc+of), 0, 512)
+		// Keep r in [0, 1] and the range in [0, 100], so that lv + rv stays
+		// 2 * vol and far off sounds don't get louder on one side
+		r := ClampF(1-softClamp01(f), 0, 1)
+		rng := ClampF(sys.panningRange, 0, 100)
+		sc := rng / 100
+		of := (100 - rng) / 200
+		lv = ClampF(vol*2*(r*sc+of), 0, 512)
+		rv = ClampF(vol*2*((1-r)*sc+of), 0, 512)
 	}
 
 	n, ok = s.streamer.Stream(samples)
-	for i := range samples[:n] {
-		samples[i][0] *= float64(lv / 256)
-		samples[i][1] *= float64(rv / 256)
+	if s.fading {
+		for i := range samples[:n] {
+			s.fadeGain = MaxF(s.fadeGain-s.fadeStep, 0)
+			samples[i][0] *= float64(lv / 256 * s.fadeGain)
+			samples[i][1] *= float64(rv / 256 * s.fadeGain)
+		}
+	} else {
+		for i := range samples[:n] {
+			samples[i][0] *= float64(lv / 256)
+			samples[i][1] *= float64(rv / 256)
+		}
+	}
+	if s.lowpass != nil && !s.lowpass.process(samples[:n]) {
+		s.lowpass = nil
+	}
+	if s.echo != nil {
+		s.echo.process(samples[:n])
 	}
 	return n, ok
 }
@@ -529,42 +4549,187 @@ func (s *SoundEffect) Err() error {
 	return s.streamer.Err()
 }
 
+// A feedback delay line. It runs on the samples of the sound before they're
+// resampled, so the delay is measured at the sound's own sample rate.
+type soundEcho struct {
+	delay    float32 // in ms
+	feedback float32
+	wet      float32
+	rate     beep.SampleRate
+	buf      [][2]float64
+	pos      int
+}
+
+// A one-pole low-pass filter. Cutoff changes glide over a few buffers, so
+// that they don't cause zipper noise.
+type soundLowpass struct {
+	coef   float64 // smoothing factor, 1 lets everything through
+	target float64
+	y      [2]float64
+}
+
+// Returns the filter coefficient for a cutoff in Hz, or 1 for no filtering.
+func lowpassCoef(cutoff float32, rate beep.SampleRate) float64 {
+	if cutoff <= 0 || float64(cutoff)*2 >= float64(rate) {
+		return 1
+	}
+	return 1 - math.Exp(-2*math.Pi*float64(cutoff)/float64(rate))
+}
+
+// Filters samples in place. Returns false once the filter has fully opened
+// and can be removed.
+func (lp *soundLowpass) process(samples [][2]float64) bool {
+	if lp.coef != lp.target {
+		lp.coef += (lp.target - lp.coef) / 2
+		if math.Abs(lp.target-lp.coef) < 1e-4 {
+			lp.coef = lp.target
+		}
+	}
+	if lp.coef >= 1 {
+		return false
+	}
+	for i := range samples {
+		lp.y[0] += (samples[i][0] - lp.y[0]) * lp.coef
+		lp.y[1] += (samples[i][1] - lp.y[1]) * lp.coef
+		samples[i] = lp.y
+	}
+	return true
+}
+
+func (e *soundEcho) process(samples [][2]float64) {
+	// Allocated on first use, as the sound may stop before that
+	if e.buf == nil {
+		e.buf = make([][2]float64, int(Max(1, int32(e.delay*float32(e.rate)/1000))))
+	}
+	fb, wet := float64(e.feedback), float64(e.wet)
+	for i := range samples {
+		d := e.buf[e.pos]
+		e.buf[e.pos] = [2]float64{samples[i][0] + d[0]*fb, samples[i][1] + d[1]*fb}
+		samples[i][0] += d[0] * wet
+		samples[i][1] += d[1] * wet
+		if e.pos++; e.pos >= len(e.buf) {
+			e.pos = 0
+		}
+	}
+}
+
 // ------------------------------------------------------------------
 // SoundChannel
 
 type SoundChannel struct {
+	gen               uint32 // bumped on every Play and Stop, see SoundHandle
 	streamer          beep.StreamSeeker
 	sfx               *SoundEffect
 	ctrl              *beep.Ctrl
 	sound             *Sound
 	stopOnGetHit      bool
 	stopOnChangeState bool
+	ownerId           int32      // id of the char that played the sound
+	gn                [2]int32   // group and number of the sound in its SND
+	snd               *Snd       // SND the sound was played from, if known
+	stopping          bool       // fading out, stopped by SoundChannels.Tick
+	ducker            *BgmDucker // held by the sound until released
+	glide             freqGlide  // freqmul glide, stepped by SoundChannels.Tick
 }
 
-func (s *SoundChannel) Play(sound *Sound, loop int32, freqmul float32, loopStart, loopEnd, startPosition int) {
+// Short fade used when sounds are cut off, to avoid clicks
+const soundStopFadeTicks = 2
+
+// Plays sound from startPosition, or from startMs milliseconds in when that's
+// above 0. Positions and loop points are in samples of the sound at its own
+// rate, not the output's, as the looper reads it before it's resampled.
+func (s *SoundChannel) Play(sound *Sound, loop int32, freqmul float32, loopStart, loopEnd, startPosition, startMs int) {
 	if sound == nil {
 		return
 	}
+	s.release()
+	s.gen++
+	s.stopping = false
+	s.glide = freqGlide{}
+	// A sound without samples plays as silence, which is over right away
+	if sound.broken || sound.length == 0 {
+		return
+	}
 	s.sound = sound
+	s.gn, s.snd = sound.gn, nil
 	s.streamer = s.sound.GetStreamer()
+	if s.streamer == nil {
+		s.sound = nil
+		return
+	}
 	loopCount := int(1)
 	if loop < 0 {
 		loopCount = -1
 	} else {
 		loopCount = int(Max(loop, 1))
 	}
-	looper := newStreamLooper(s.streamer, loopCount, loopStart, loopEnd)
-	s.sfx = &SoundEffect{streamer: looper, volume: 256, priority: 0, channel: -1, loop: int32(loopCount), freqmul: freqmul}
+	looper := newStreamLooper(s.streamer, loopCount, loopStart, loopEnd, 0)
+	if startMs > 0 {
+		startPosition = secondsToSample(float64(startMs)/1000, s.sound.format.SampleRate, s.sound.length)
+	}
+	// Seek through the looper before anything reads from the stream, so that
+	// the loop bookkeeping starts from the right place
+	if err := looper.start(startPosition); err != nil {
+		sys.errLog.Printf("Failed to seek sound %v,%v to %v: %v", sound.gn[0], sound.gn[1], startPosition, err)
+	}
+	s.sfx = &SoundEffect{streamer: looper, volume: 256, gain: sound.normalizeGain(), priority: 0, channel: -1, loop: int32(loopCount), freqmul: freqmul, pitch: 1}
 	srcRate := s.sound.format.SampleRate
-	dstRate := beep.SampleRate(audioFrequency / s.sfx.freqmul)
-	resampler := beep.Resample(audioResampleQuality, srcRate, dstRate, s.sfx)
+	dstRate := beep.SampleRate(float32(audioFrequency) / s.sfx.rate())
+	resampler := beep.Resample(sys.sfxResampleQuality, srcRate, dstRate, s.sfx)
 	s.ctrl = &beep.Ctrl{Streamer: resampler}
-	s.streamer.Seek(startPosition)
-	sys.soundMixer.Add(s.ctrl)
+	sys.soundMixer.Add(&soundStart{streamer: s.ctrl, at: sys.soundTickAt})
+}
+
+// Records the SND entry the sound was played as. Entries with the same data
+// share one Sound, which can't tell them apart.
+func (s *SoundChannel) setSource(snd *Snd, gn [2]int32) {
+	s.snd, s.gn = snd, gn
 }
 func (s *SoundChannel) IsPlaying() bool {
 	return s.sound != nil
 }
+
+// Returns the playback position in samples of the sound, or -1 if nothing is
+// playing.
+func (s *SoundChannel) Position() int {
+	if !s.IsPlaying() {
+		return -1
+	}
+	speaker.Lock()
+	defer speaker.Unlock()
+	return s.streamer.Position()
+}
+
+// Same as Position, in seconds.
+func (s *SoundChannel) PositionSeconds() float64 {
+	if pos := s.Position(); pos >= 0 {
+		return s.sound.format.SampleRate.D(pos).Seconds()
+	}
+	return -1
+}
+
+// Returns the length of the sound in seconds, or -1 if nothing is playing.
+// A loop plays over it again, see LoopsLeft.
+func (s *SoundChannel) LengthSeconds() float64 {
+	if !s.IsPlaying() {
+		return -1
+	}
+	return s.sound.format.SampleRate.D(s.sound.length).Seconds()
+}
+
+// Returns the loops left as StreamLooper.LoopsLeft does, or 0 if nothing is
+// playing.
+func (s *SoundChannel) LoopsLeft() int {
+	if !s.IsPlaying() {
+		return 0
+	}
+	speaker.Lock()
+	defer speaker.Unlock()
+	if sl, ok := s.sfx.streamer.(*StreamLooper); ok {
+		return sl.LoopsLeft()
+	}
+	return 0
+}
 func (s *SoundChannel) SetPaused(pause bool) {
 	if s.ctrl == nil || s.ctrl.Paused == pause {
 		return
@@ -579,13 +4744,83 @@ func (s *SoundChannel) Stop() {
 		s.ctrl.Streamer = nil
 		speaker.Unlock()
 	}
+	s.release()
+	s.gen++
+	s.stopping = false
+	s.glide = freqGlide{}
 	s.sound = nil
 }
+
+// Stops the sound after fading it out over fadeTicks ticks. The channel
+// stays busy until the fade is over.
+func (s *SoundChannel) FadeStop(fadeTicks int) {
+	if fadeTicks <= 0 || s.ctrl == nil || s.sfx == nil || s.sound == nil {
+		s.Stop()
+		return
+	}
+	if s.stopping {
+		return
+	}
+	samples := float32(fadeTicks) * float32(s.sound.format.SampleRate) / float32(FPS)
+	speaker.Lock()
+	s.sfx.fading, s.sfx.fadeGain, s.sfx.fadeStep = true, 1, 1/MaxF(samples, 1)
+	speaker.Unlock()
+	s.stopping = true
+}
+
+func (s *SoundChannel) fadedOut() bool {
+	speaker.Lock()
+	defer speaker.Unlock()
+	return s.sfx.fadeGain <= 0
+}
+
+// Reports whether the sound played all its loops, which may end before the
+// end of the file when it has a loop end.
+func (s *SoundChannel) done() bool {
+	speaker.Lock()
+	defer speaker.Unlock()
+	sl, ok := s.sfx.streamer.(*StreamLooper)
+	return ok && sl.Done()
+}
+
+// Reports whether the sound stopped short of its end because the data ran
+// out or couldn't be decoded.
+func (s *SoundChannel) stalled() bool {
+	speaker.Lock()
+	defer speaker.Unlock()
+	if s.streamer.Err() != nil {
+		return true
+	}
+	sl, ok := s.sfx.streamer.(*StreamLooper)
+	return ok && sl.stalled
+}
+
+// Closes the file behind a sound streamed from disk.
+func (s *SoundChannel) release() {
+	if s.ducker != nil {
+		s.ducker.unhold()
+		s.ducker = nil
+	}
+	if c, ok := s.streamer.(io.Closer); ok {
+		speaker.Lock()
+		c.Close()
+		speaker.Unlock()
+	}
+	s.streamer = nil
+}
 func (s *SoundChannel) SetVolume(vol float32) {
 	if s.ctrl != nil {
 		s.sfx.volume = ClampF(vol, 0, 512)
 	}
 }
+
+// Sets the player whose volume setting applies to the sound, starting at 1.
+// It scales the volume on top of SetVolume, which doesn't override it.
+func (s *SoundChannel) SetOwner(owner int) {
+	if s.ctrl != nil {
+		s.sfx.owner = owner
+	}
+}
 func (s *SoundChannel) SetPan(p, ls float32, x *float32) {
 	if s.ctrl != nil {
 		s.sfx.ls = ls
@@ -593,9 +4828,46 @@ func (s *SoundChannel) SetPan(p, ls float32, x *float32) {
 		s.sfx.p = p * ls
 	}
 }
+
+// Adds an echo with the given delay in ms, feedback (0 to 0.9) and wet mix
+// (0 to 1). A delay or wet mix of 0 removes it.
+func (s *SoundChannel) SetEcho(delay, feedback, wet float32) {
+	if s.ctrl == nil || s.sfx == nil || s.sound == nil {
+		return
+	}
+	var echo *soundEcho
+	if delay > 0 && wet > 0 {
+		echo = &soundEcho{delay: delay, feedback: ClampF(feedback, 0, 0.9), wet: ClampF(wet, 0, 1),
+			rate: s.sound.format.SampleRate}
+	}
+	speaker.Lock()
+	s.sfx.echo = echo
+	speaker.Unlock()
+}
+
+// Muffles the sound with a low-pass filter at cutoff Hz, 0 to remove it.
+// The filter starts anew with each sound played on the channel.
+func (s *SoundChannel) SetLowpass(cutoff float32) {
+	if s.ctrl == nil || s.sfx == nil || s.sound == nil {
+		return
+	}
+	target := lowpassCoef(cutoff, s.sound.format.SampleRate)
+	speaker.Lock()
+	if s.sfx.lowpass != nil {
+		s.sfx.lowpass.target = target
+	} else if target < 1 {
+		// Glide down from no filtering
+		s.sfx.lowpass = &soundLowpass{coef: 1, target: target}
+	}
+	speaker.Unlock()
+}
 func (s *SoundChannel) SetPriority(priority int32) {
 	if s.ctrl != nil {
 		s.sfx.priority = priority
+		if s.ducker == nil && s.IsPlaying() && sys.bgmDucker.qualifies(priority) {
+			s.ducker = &sys.bgmDucker
+			s.ducker.hold()
+		}
 	}
 }
 func (s *SoundChannel) SetChannel(channel int32) {
@@ -603,15 +4875,45 @@ func (s *SoundChannel) SetChannel(channel int32) {
 		s.sfx.channel = channel
 	}
 }
-func (s *SoundChannel) SetFreqMul(freqmul float32) {
+
+// Sets the engine factor of the playback rate. With glide above 0, the
+// rate moves there over that many ticks, still composed with the pitch.
+func (s *SoundChannel) SetFreqMul(freqmul float32, glide int32) {
+	if s.sfx == nil {
+		return
+	}
+	if glide > 0 {
+		s.glide.start(s.sfx.freqmul, freqmul, glide)
+		return
+	}
+	s.glide = freqGlide{}
+	if s.sfx.freqmul != freqmul {
+		s.setRate(freqmul, 0)
+	}
+}
+
+// Sets the pitch of the sound itself, which composes with the engine
+// factor set by SetFreqMul instead of replacing it.
+func (s *SoundChannel) SetPitch(pitch float32) {
+	s.setRate(0, pitch)
+}
+
+// Updates either factor (left alone when 0) and applies their product to
+// the resampler.
+func (s *SoundChannel) setRate(freqmul, pitch float32) {
 	if s.ctrl != nil {
 		if s.sound != nil {
-			srcRate := s.sound.format.SampleRate
-			dstRate := beep.SampleRate(audioFrequency / freqmul)
 			if resampler, ok := s.ctrl.Streamer.(*beep.Resampler); ok {
 				speaker.Lock()
+				if freqmul > 0 {
+					s.sfx.freqmul = freqmul
+				}
+				if pitch > 0 {
+					s.sfx.pitch = pitch
+				}
+				srcRate := s.sound.format.SampleRate
+				dstRate := beep.SampleRate(float32(audioFrequency) / s.sfx.rate())
 				resampler.SetRatio(float64(srcRate) / float64(dstRate))
-				s.sfx.freqmul = freqmul
 				speaker.Unlock()
 			}
 		}
@@ -646,6 +4948,9 @@ func (s *SoundChannel) SetLoopPoints(loopstart, loopend int) {
 type SoundChannels struct {
 	channels  []SoundChannel
 	volResume []float32
+	// Size set with SetSize. Channels past it are draining: they get no new
+	// sounds, and are dropped once what they play is over.
+	size int32
 }
 
 func newSoundChannels(size int32) *SoundChannels {
@@ -653,36 +4958,114 @@ func newSoundChannels(size int32) *SoundChannels {
 	s.SetSize(size)
 	return s
 }
+
+// Resizes the set of channels. Shrinking doesn't cut off sounds that are
+// playing; their channels drain and are dropped by Tick as they finish.
 func (s *SoundChannels) SetSize(size int32) {
+	s.size = size
 	if size > s.count() {
 		c := make([]SoundChannel, size-s.count())
 		v := make([]float32, size-s.count())
 		s.channels = append(s.channels, c...)
 		s.volResume = append(s.volResume, v...)
-	} else if size < s.count() {
-		for i := s.count() - 1; i >= size; i-- {
-			s.channels[i].Stop()
-		}
-		s.channels = s.channels[:size]
-		s.volResume = s.volResume[:size]
+	} else {
+		s.trim()
+	}
+}
+
+// Drops the draining channels at the end that are done. Channels are only
+// removed from the end, so that the index of a channel never changes.
+func (s *SoundChannels) trim() {
+	n := s.count()
+	for n > s.size && !s.channels[n-1].IsPlaying() {
+		n--
+	}
+	s.channels = s.channels[:n]
+	s.volResume = s.volResume[:n]
+}
+
+// Stops every sound right away and drops all channels, leaving nothing to
+// drain.
+func (s *SoundChannels) Clear() {
+	for i := range s.channels {
+		s.channels[i].Stop()
 	}
+	s.size = 0
+	s.channels = s.channels[:0]
+	s.volResume = s.volResume[:0]
 }
 func (s *SoundChannels) count() int32 {
 	return int32(len(s.channels))
 }
 func (s *SoundChannels) New(ch int32, lowpriority bool, priority int32) *SoundChannel {
+	sys.soundPlaysRequested++
 	if ch >= 0 && ch < sys.wavChannels {
 		for i := s.count() - 1; i >= 0; i-- {
-			if s.channels[i].IsPlaying() && s.channels[i].sfx.channel == ch {
+			if s.channels[i].IsPlaying() && !s.channels[i].stopping && s.channels[i].sfx.channel == ch {
+				// As in Mugen, a sound restarts its channel over one of equal
+				// priority, unless it's low priority. A lower priority never
+				// interrupts, a higher one always does.
 				if (lowpriority && priority <= s.channels[i].sfx.priority) || priority < s.channels[i].sfx.priority {
+					sys.soundPlaysRejected++
 					return nil
 				}
-				s.channels[i].Stop()
-				return &s.channels[i]
+				// Fade the old sound out, and play the new one on a free channel
+				// if there is one
+				s.channels[i].FadeStop(soundStopFadeTicks)
+				if c := s.free(); c != nil {
+					return c
+				}
+				if i < s.size {
+					s.channels[i].Stop()
+					return &s.channels[i]
+				}
+				break
 			}
 		}
 	}
-	if s.count() < sys.wavChannels {
+	if c := s.free(); c != nil {
+		return c
+	}
+	if c := s.steal(priority); c != nil {
+		sys.soundChannelsStolen++
+		return c
+	}
+	sys.soundPlaysDropped++
+	return nil
+}
+
+// Frees a channel for a sound of the given priority when none are left,
+// taking the lowest priority one, and of those the closest to finishing.
+// Channels with a higher priority than the new sound are never taken.
+func (s *SoundChannels) steal(priority int32) *SoundChannel {
+	var victim *SoundChannel
+	var remaining int
+	for i := int32(0); i < sys.wavChannels && i < s.size && i < s.count(); i++ {
+		c := &s.channels[i]
+		if !c.IsPlaying() || c.sfx == nil || c.sfx.priority > priority {
+			continue
+		}
+		// Looping sounds never finish on their own
+		left := math.MaxInt
+		if c.sfx.loop >= 0 && c.streamer != nil {
+			left = c.streamer.Len() - c.streamer.Position()
+		}
+		// Already fading out sounds go first
+		if c.stopping {
+			left = -1
+		}
+		if victim == nil || c.sfx.priority < victim.sfx.priority ||
+			c.sfx.priority == victim.sfx.priority && left < remaining {
+			victim, remaining = c, left
+		}
+	}
+	if victim != nil {
+		victim.Stop()
+	}
+	return victim
+}
+func (s *SoundChannels) free() *SoundChannel {
+	if s.size < sys.wavChannels {
 		s.SetSize(sys.wavChannels)
 	}
 	for i := sys.wavChannels - 1; i >= 0; i-- {
@@ -693,7 +5076,7 @@ func (s *SoundChannels) New(ch int32, lowpriority bool, priority int32) *SoundCh
 	return nil
 }
 func (s *SoundChannels) reserveChannel() *SoundChannel {
-	for i := range s.channels {
+	for i := int32(0); i < s.size && i < s.count(); i++ {
 		if !s.channels[i].IsPlaying() {
 			return &s.channels[i]
 		}
@@ -703,7 +5086,7 @@ func (s *SoundChannels) reserveChannel() *SoundChannel {
 func (s *SoundChannels) Get(ch int32) *SoundChannel {
 	if ch >= 0 && ch < s.count() {
 		for i := range s.channels {
-			if s.channels[i].IsPlaying() && s.channels[i].sfx != nil && s.channels[i].sfx.channel == ch {
+			if s.channels[i].IsPlaying() && !s.channels[i].stopping && s.channels[i].sfx != nil && s.channels[i].sfx.channel == ch {
 				return &s.channels[i]
 			}
 		}
@@ -711,18 +5094,80 @@ func (s *SoundChannels) Get(ch int32) *SoundChannel {
 	}
 	return nil
 }
-func (s *SoundChannels) Play(sound *Sound, volumescale int32, pan float32, loopStart, loopEnd, startPosition int) bool {
+
+// Refers to one playback of a sound on a channel of a SoundChannels. Once
+// the channel stops or plays something else, the handle no longer refers to
+// anything, even if the same Sound is playing elsewhere.
+type SoundHandle struct {
+	index int
+	gen   uint32
+}
+
+// Reports whether the handle came from a sound that started playing. Use
+// IsPlayingHandle to know if it's still playing.
+func (h SoundHandle) Valid() bool {
+	return h.gen != 0
+}
+
+// Returns the channel the handle refers to, if it's still playing the same
+// sound.
+func (s *SoundChannels) handleChannel(h SoundHandle) *SoundChannel {
+	if !h.Valid() || h.index < 0 || h.index >= len(s.channels) {
+		return nil
+	}
+	if c := &s.channels[h.index]; c.gen == h.gen && c.IsPlaying() {
+		return c
+	}
+	return nil
+}
+func (s *SoundChannels) Play(sound *Sound, volumescale int32, pan float32, loopStart, loopEnd, startPosition, startMs int) SoundHandle {
 	if sound == nil {
-		return false
+		return SoundHandle{}
 	}
 	c := s.reserveChannel()
 	if c == nil {
-		return false
+		return SoundHandle{}
+	}
+	c.Play(sound, 0, 1.0, loopStart, loopEnd, startPosition, startMs)
+	if !c.IsPlaying() {
+		return SoundHandle{}
 	}
-	c.Play(sound, 0, 1.0, loopStart, loopEnd, startPosition)
 	c.SetVolume(float32(volumescale * 64 / 25))
 	c.SetPan(pan, 0, nil)
-	return true
+	for i := range s.channels {
+		if &s.channels[i] == c {
+			return SoundHandle{i, c.gen}
+		}
+	}
+	return SoundHandle{}
+}
+func (s *SoundChannels) IsPlayingHandle(h SoundHandle) bool {
+	return s.handleChannel(h) != nil
+}
+
+// Returns the position of a playing sound in samples, or -1 once it stopped.
+func (s *SoundChannels) PositionHandle(h SoundHandle) int {
+	if c := s.handleChannel(h); c != nil {
+		return c.Position()
+	}
+	return -1
+}
+func (s *SoundChannels) StopHandle(h SoundHandle) {
+	if c := s.handleChannel(h); c != nil {
+		c.Stop()
+	}
+}
+
+// Sets the volume of a playing sound, with the same scale as Play.
+func (s *SoundChannels) SetVolumeHandle(h SoundHandle, volumescale int32) {
+	if c := s.handleChannel(h); c != nil {
+		c.SetVolume(float32(volumescale * 64 / 25))
+	}
+}
+func (s *SoundChannels) SetPanHandle(h SoundHandle, pan float32) {
+	if c := s.handleChannel(h); c != nil {
+		c.SetPan(pan, 0, nil)
+	}
 }
 func (s *SoundChannels) IsPlaying(sound *Sound) bool {
 	for _, v := range s.channels {
@@ -739,19 +5184,113 @@ func (s *SoundChannels) Stop(sound *Sound) {
 		}
 	}
 }
+
+// Returns the first channel playing an entry of an SND, see StopSource.
+func (s *SoundChannels) FindSource(owner *Snd, gn [2]int32) *SoundChannel {
+	for k, v := range s.channels {
+		if v.sound != nil && v.snd == owner && v.gn == gn {
+			return &s.channels[k]
+		}
+	}
+	return nil
+}
+
+// Stops the channels playing an entry of an SND. Other entries may share its
+// Sound, so the channels playing them are told apart by their source.
+func (s *SoundChannels) StopSource(owner *Snd, gn [2]int32) {
+	for k, v := range s.channels {
+		if v.sound != nil && v.snd == owner && v.gn == gn {
+			s.channels[k].Stop()
+		}
+	}
+}
+
+// Fades out the sounds of a group. With an owner, only sounds from that SND
+// are stopped, as the same group may exist in several of them.
+func (s *SoundChannels) StopGroup(owner *Snd, group int32) {
+	for k, v := range s.channels {
+		if v.sound != nil && !v.stopping && v.gn[0] == group && (owner == nil || v.snd == owner) {
+			s.channels[k].FadeStop(soundStopFadeTicks)
+		}
+	}
+}
 func (s *SoundChannels) StopAll() {
 	for k, v := range s.channels {
 		if v.sound != nil {
-			s.channels[k].Stop()
+			s.channels[k].FadeStop(soundStopFadeTicks)
+		}
+	}
+}
+
+// A snapshot of a playing channel, for the debug display.
+type SoundChannelInfo struct {
+	Owner    int32    // id of the char that played it
+	Group    [2]int32 // group and number in its SND
+	Channel  int32
+	Priority int32
+	Position int
+	Length   int
+	Volume   float32
+	Gain     float32 // loudness normalization, see Sound.normalizeGain
+}
+
+type SoundChannelStats struct {
+	Active   int
+	Channels []SoundChannelInfo
+}
+
+// Returns what the channels are playing. Only allocates when called.
+func (s *SoundChannels) Stats() SoundChannelStats {
+	var st SoundChannelStats
+	speaker.Lock()
+	defer speaker.Unlock()
+	for i := range s.channels {
+		c := &s.channels[i]
+		if c.sound == nil || c.sfx == nil || c.streamer == nil {
+			continue
+		}
+		st.Active++
+		st.Channels = append(st.Channels, SoundChannelInfo{Owner: c.ownerId, Group: c.gn,
+			Channel: c.sfx.channel, Priority: c.sfx.priority, Position: c.streamer.Position(),
+			Length: c.streamer.Len(), Volume: c.sfx.volume, Gain: c.sfx.gain})
+	}
+	return st
+}
+
+// Points the resamplers of playing sounds at the current output rate.
+func (s *SoundChannels) refreshRates() {
+	for i := range s.channels {
+		if s.channels[i].IsPlaying() {
+			s.channels[i].setRate(0, 0)
 		}
 	}
 }
 func (s *SoundChannels) Tick() {
 	for i := range s.channels {
 		if s.channels[i].IsPlaying() {
-			if s.channels[i].streamer.Position() >= s.channels[i].sound.length && s.channels[i].sfx.loop != -1 {
+			if s.channels[i].stopping {
+				if s.channels[i].fadedOut() || s.channels[i].done() {
+					s.channels[i].Stop()
+				}
+				continue
+			}
+			if s.channels[i].stalled() {
+				// Sound is corrupted and can't be played, so it's disabled with the same warning as at load time
+				snd := s.channels[i].sound
+				if !snd.broken {
+					snd.broken = true
+					sys.appendToConsole(fmt.Sprintf("WARNING: %v sound %v,%v is corrupted and can't be played, so it was disabled", snd.sndFile, snd.gn[0], snd.gn[1]))
+				}
+				s.channels[i].Stop()
+			} else if s.channels[i].done() {
+				s.channels[i].release()
 				s.channels[i].sound = nil
+			} else if freqmul, ok := s.channels[i].glide.step(); ok {
+				s.channels[i].setRate(freqmul, 0)
 			}
 		}
 	}
+	if s.count() > s.size {
+		s.trim()
+	}
 }
@@ -0,0 +1,16 @@
+//go:build !opus
+
+package main
+
+import (
+	"io"
+
+	"github.com/ikemen-engine/beep"
+)
+
+// Opus needs libopus through cgo, see sound_opus.go. Builds without the opus
+// tag refuse the files, and the caller reports the error as for any file that
+// fails to decode.
+func decodeOpus(r io.ReadSeeker) (beep.StreamSeekCloser, beep.Format, error) {
+	return nil, beep.Format{}, Error("opus: not supported by this build, rebuild with -tags \"opus nolibopusfile\"")
+}
@@ -0,0 +1,285 @@
+//go:build opus
+
+package main
+
+// Opus needs libopus through cgo, so it is only built with the opus tag.
+// Building with -tags "opus nolibopusfile" leaves out the binding's opusfile
+// half, which isn't used: the Ogg pages are read here.
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/ikemen-engine/beep"
+	"gopkg.in/hraban/opus.v2"
+)
+
+// Largest Opus frame, 120 ms at 48 kHz
+const opusMaxFrame = 5760
+
+// Samples decoded ahead of a seek target so that the decoder has converged by
+// then, 80 ms as recommended by RFC 7845
+const opusPreroll = 3840
+
+// An audio page of an Ogg Opus stream.
+type oggPage struct {
+	offset    int64
+	granule   int64 // samples by the end of the page, pre-skip included
+	continued bool  // starts with the rest of a packet from the page before
+}
+
+// Streams an Ogg Opus file, which always decodes at 48 kHz. The audio pages
+// are indexed when the file is opened, so Seek restarts decoding from the last
+// page that begins a preroll before the target, rather than from the start of
+// the file, and decodes forward to the exact sample.
+type opusDecoder struct {
+	r        io.ReadSeeker
+	dec      *opus.Decoder
+	channels int
+	preskip  int
+	length   int
+	pages    []oggPage
+	next     int      // page to read once packets run out
+	packets  [][]byte // packets left from the last page read
+	partial  []byte   // packet that goes on in the next page
+	drop     int      // samples to decode and discard, up to a seek target
+	pcm      []float32
+	buf      [][2]float64
+	mem      [][2]float64
+	pos      int
+	err      error
+}
+
+func decodeOpus(r io.ReadSeeker) (beep.StreamSeekCloser, beep.Format, error) {
+	d := &opusDecoder{r: r, next: -1}
+	if err := d.scan(); err != nil {
+		return nil, beep.Format{}, err
+	}
+	d.pcm = make([]float32, opusMaxFrame*d.channels)
+	if err := d.Seek(0); err != nil {
+		return nil, beep.Format{}, err
+	}
+	return d, beep.Format{SampleRate: 48000, NumChannels: d.channels, Precision: 2}, nil
+}
+
+// Reads the OpusHead packet and indexes the audio pages. The header packets
+// end their pages, so audio always starts on a fresh page. The length is
+// given by the last granule position, less the pre-skip.
+func (d *opusDecoder) scan() error {
+	var offset int64
+	var packets int
+	for {
+		if _, err := d.r.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+		flags, granule, lacing, err := readOggPageHeader(d.r)
+		if err != nil {
+			// a cut off last page is left out
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			return err
+		}
+		var size int
+		for _, l := range lacing {
+			size += int(l)
+		}
+		if packets == 0 {
+			head := make([]byte, size)
+			if _, err := io.ReadFull(d.r, head); err != nil {
+				return err
+			}
+			if len(head) < 19 || string(head[:8]) != "OpusHead" {
+				return Error("opus: OpusHead not found")
+			}
+			d.channels = int(head[9])
+			d.preskip = int(binary.LittleEndian.Uint16(head[10:]))
+			if d.channels < 1 || d.channels > 2 {
+				return Error(fmt.Sprintf("opus: unsupported channel count %v", d.channels))
+			}
+		} else if packets >= 2 {
+			d.pages = append(d.pages, oggPage{offset, granule, flags&1 != 0})
+			if granule >= 0 {
+				d.length = int(granule) - d.preskip
+			}
+		}
+		for _, l := range lacing {
+			if l < 255 {
+				packets++
+			}
+		}
+		offset += int64(27 + len(lacing) + size)
+	}
+	if d.length <= 0 {
+		return Error("opus: no audio")
+	}
+	return nil
+}
+
+func (d *opusDecoder) Stream(samples [][2]float64) (n int, ok bool) {
+	if d.err != nil {
+		return 0, false
+	}
+	// the last page's granule position trims the end of the final packet
+	if rest := d.length - d.pos; len(samples) > rest {
+		samples = samples[:rest]
+	}
+	for n < len(samples) {
+		if len(d.buf) == 0 {
+			if err := d.refill(); err != nil {
+				if err != io.EOF {
+					d.err = err
+				}
+				break
+			}
+			continue
+		}
+		c := copy(samples[n:], d.buf)
+		d.buf = d.buf[c:]
+		n += c
+	}
+	d.pos += n
+	return n, n > 0
+}
+
+// Decodes the next packet into the buffer, less the samples still to drop.
+func (d *opusDecoder) refill() error {
+	pkt, err := d.nextPacket()
+	if err != nil {
+		return err
+	}
+	n, err := d.dec.DecodeFloat32(pkt, d.pcm)
+	if err != nil {
+		return err
+	}
+	if d.drop >= n {
+		d.drop -= n
+		d.buf = nil
+		return nil
+	}
+	if cap(d.mem) < n {
+		d.mem = make([][2]float64, n)
+	}
+	mem := d.mem[:n]
+	right := 0
+	if d.channels > 1 {
+		right = 1
+	}
+	for i := range mem {
+		mem[i][0] = float64(d.pcm[i*d.channels])
+		mem[i][1] = float64(d.pcm[i*d.channels+right])
+	}
+	d.buf, d.drop = mem[d.drop:], 0
+	return nil
+}
+
+// Returns the next packet with audio in it, reading pages as needed.
+func (d *opusDecoder) nextPacket() ([]byte, error) {
+	for {
+		for len(d.packets) > 0 {
+			pkt := d.packets[0]
+			d.packets = d.packets[1:]
+			if len(pkt) > 0 {
+				return pkt, nil
+			}
+		}
+		if d.next >= len(d.pages) {
+			return nil, io.EOF
+		}
+		if err := d.readPage(d.pages[d.next]); err != nil {
+			return nil, err
+		}
+		d.next++
+	}
+}
+
+// Reads the packets of a page, keeping the one that goes on in the next page.
+func (d *opusDecoder) readPage(pg oggPage) error {
+	if _, err := d.r.Seek(pg.offset, io.SeekStart); err != nil {
+		return err
+	}
+	_, _, lacing, err := readOggPageHeader(d.r)
+	if err != nil {
+		return err
+	}
+	var size int
+	for _, l := range lacing {
+		size += int(l)
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(d.r, body); err != nil {
+		return err
+	}
+	pkt := d.partial
+	if !pg.continued {
+		pkt = nil
+	}
+	for _, l := range lacing {
+		pkt = append(pkt, body[:l]...)
+		body = body[l:]
+		if l < 255 {
+			d.packets = append(d.packets, pkt)
+			pkt = nil
+		}
+	}
+	d.partial = pkt
+	return nil
+}
+
+func (d *opusDecoder) Err() error {
+	return d.err
+}
+
+func (d *opusDecoder) Len() int {
+	return d.length
+}
+
+func (d *opusDecoder) Position() int {
+	return d.pos
+}
+
+func (d *opusDecoder) Seek(p int) error {
+	if p < 0 || p > d.length {
+		return Error(fmt.Sprintf("opus: seek position %v out of range [0, %v]", p, d.length))
+	}
+	target := int64(p + d.preskip)
+	// Last page that starts with a whole packet a preroll before the target.
+	// Such a page follows one that ends a packet, so the granule position
+	// before it is known.
+	start, gran := 0, int64(0)
+	for i := 1; i < len(d.pages); i++ {
+		prev := d.pages[i-1].granule
+		if prev > target-opusPreroll {
+			break
+		}
+		if !d.pages[i].continued && prev >= 0 {
+			start, gran = i, prev
+		}
+	}
+	if p >= d.pos && start < d.next {
+		// close enough ahead to decode forward from where the stream is
+		d.drop += p - d.pos
+	} else {
+		dec, err := opus.NewDecoder(48000, d.channels)
+		if err != nil {
+			d.err = err
+			return err
+		}
+		d.dec, d.next, d.packets, d.partial, d.buf = dec, start, nil, nil, nil
+		d.drop = int(target - gran)
+	}
+	if skip := Min(int32(len(d.buf)), int32(d.drop)); skip > 0 {
+		d.buf = d.buf[skip:]
+		d.drop -= int(skip)
+	}
+	d.pos, d.err = p, nil
+	return nil
+}
+
+func (d *opusDecoder) Close() error {
+	if c, ok := d.r.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
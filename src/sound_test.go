@@ -0,0 +1,2711 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ikemen-engine/beep"
+	"github.com/ikemen-engine/beep/effects"
+)
+
+// An in-memory StreamSeekCloser whose sample i is i on both channels, so
+// that the output tells where each sample was read from. With failSeek
+// above 0, that seek and the ones after it fail. With unknownLen, Len
+// reports 0 as some decoders do.
+type testStreamer struct {
+	length, pos int
+	unknownLen  bool
+	seeks       int
+	failSeek    int
+	closed      atomic.Bool // closed on the load goroutines too
+	err         error
+}
+
+func (s *testStreamer) Stream(samples [][2]float64) (n int, ok bool) {
+	for n < len(samples) && s.pos < s.length {
+		samples[n] = [2]float64{float64(s.pos), float64(s.pos)}
+		s.pos++
+		n++
+	}
+	return n, n > 0
+}
+
+func (s *testStreamer) Err() error { return s.err }
+func (s *testStreamer) Len() int {
+	if s.unknownLen {
+		return 0
+	}
+	return s.length
+}
+
+func (s *testStreamer) Position() int { return s.pos }
+func (s *testStreamer) Close() error  { s.closed.Store(true); return nil }
+
+func (s *testStreamer) Seek(p int) error {
+	s.seeks++
+	if s.failSeek > 0 && s.seeks >= s.failSeek {
+		s.err = errors.New("seek failed")
+		return s.err
+	}
+	s.pos = p
+	return nil
+}
+
+// Sets the volumes so that the master gain stage is a plain 0.5, and puts
+// them back when the test ends.
+func setTestVolumes(t *testing.T) {
+	wav, master, curve, ducking := sys.wavVolume, sys.masterVolume, sys.volumeCurve, sys.audioDucking
+	sys.wavVolume, sys.masterVolume, sys.volumeCurve, sys.audioDucking = 100, 100, VolumeCurveLegacy, false
+	t.Cleanup(func() {
+		sys.wavVolume, sys.masterVolume, sys.volumeCurve, sys.audioDucking = wav, master, curve, ducking
+	})
+}
+
+// A 1 kHz sine, amp[i] over the i-th run of n samples.
+func sineBurst(n int, amp ...float64) beep.Streamer {
+	pos := 0
+	return beep.StreamerFunc(func(samples [][2]float64) (int, bool) {
+		for i := range samples {
+			if pos >= n*len(amp) {
+				return i, i > 0
+			}
+			s := amp[pos/n] * math.Sin(2*math.Pi*1000*float64(pos)/float64(audioFrequency))
+			samples[i] = [2]float64{s, s}
+			pos++
+		}
+		return len(samples), true
+	})
+}
+
+// Streams st to the end, in blocks like the speaker does.
+func streamAll(st beep.Streamer) (out []float64) {
+	buf := make([][2]float64, 512)
+	for {
+		n, ok := st.Stream(buf)
+		for _, s := range buf[:n] {
+			out = append(out, s[0])
+		}
+		if !ok {
+			return out
+		}
+	}
+}
+
+func rms(s []float64) float64 {
+	var sum float64
+	for _, v := range s {
+		sum += v * v
+	}
+	return math.Sqrt(sum / float64(len(s)))
+}
+
+func TestLimiterSineBurst(t *testing.T) {
+	setTestVolumes(t)
+	const n = 9600 // 200 ms
+	// 0.5 below the ceiling, then 2.0 (+6 dBFS) after the 0.5 master gain
+	l := NewLimiter(sineBurst(n, 1, 4, 1), -1, 5, 20)
+	out := streamAll(l)
+	if len(out) != 3*n {
+		t.Fatalf("streamed %v samples, want %v", len(out), 3*n)
+	}
+	for i, v := range out {
+		if math.Abs(v) > l.ceiling+1e-9 {
+			t.Fatalf("sample %v = %v, over the ceiling %v", i, v, l.ceiling)
+		}
+	}
+	delay := len(l.delay)
+	// Below the ceiling the signal goes through untouched
+	if got, want := rms(out[delay:n]), 0.5/math.Sqrt2; math.Abs(got-want) > want*0.01 {
+		t.Errorf("quiet rms = %v, want %v", got, want)
+	}
+	// Over it, the sine is scaled down rather than clipped, so the rms is
+	// the one of a sine peaking at the ceiling
+	if got, want := rms(out[n+n/2:2*n]), l.ceiling/math.Sqrt2; math.Abs(got-want) > want*0.01 {
+		t.Errorf("limited rms = %v, want %v", got, want)
+	}
+	// And the gain is back to unity after the release
+	if got, want := rms(out[2*n+n/2:]), 0.5/math.Sqrt2; math.Abs(got-want) > want*0.01 {
+		t.Errorf("released rms = %v, want %v", got, want)
+	}
+}
+
+func TestLimiterAudioDucking(t *testing.T) {
+	setTestVolumes(t)
+	const n = 9600
+	plain := streamAll(NewLimiter(sineBurst(n, 0.05, 4, 0.05), -1, 5, 20))
+	sys.audioDucking = true
+	l := NewLimiter(sineBurst(n, 0.05, 4, 0.05), -1, 5, 20)
+	ducked := streamAll(l)
+	for i, v := range ducked {
+		if math.Abs(v) > l.ceiling+1e-9 {
+			t.Fatalf("sample %v = %v, over the ceiling %v", i, v, l.ceiling)
+		}
+	}
+	delay := len(l.delay)
+	// No Normalizer in the chain: a quiet signal gets a fixed gain, twice the
+	// one without ducking, rather than being brought up adaptively
+	for _, r := range [][2]int{{delay, n}, {2*n + n/2, 3 * n}} {
+		if p, d := rms(plain[r[0]:r[1]]), rms(ducked[r[0]:r[1]]); math.Abs(d-2*p) > p*0.02 {
+			t.Errorf("samples %v-%v: ducked rms = %v, want %v", r[0], r[1], d, 2*p)
+		}
+	}
+	// A loud burst is held at the ceiling by the limiter alone
+	if got, want := rms(ducked[n+n/2:2*n]), l.ceiling/math.Sqrt2; math.Abs(got-want) > want*0.01 {
+		t.Errorf("limited rms = %v, want %v", got, want)
+	}
+}
+
+// Waits for the load goroutines to queue their music for Tick.
+func waitBgmLoaded(t *testing.T, bgm *Bgm) {
+	for start := time.Now(); len(bgm.loaded) == 0; time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("music never finished loading")
+		}
+	}
+}
+
+func setTestBgm(t *testing.T) *Bgm {
+	setTestVolumes(t)
+	quality, bgmVolume, maxBgmVolume := sys.bgmResampleQuality, sys.bgmVolume, sys.maxBgmVolume
+	sys.bgmResampleQuality, sys.bgmVolume, sys.maxBgmVolume = 1, 100, 100
+	t.Cleanup(func() {
+		sys.bgmResampleQuality, sys.bgmVolume, sys.maxBgmVolume = quality, bgmVolume, maxBgmVolume
+		sys.bgmMix.Clear()
+	})
+	return newBgm()
+}
+
+func TestBgmPendingSettings(t *testing.T) {
+	bgm := setTestBgm(t)
+	st := &testStreamer{length: 48000}
+	bgm.stop("test", 1, 100, 1, 0)
+	bgm.load(bgmLoad{}, func(ld *bgmLoad) error {
+		ld.streamer, ld.sampleRate = st, 48000
+		return nil
+	})
+	// Right after Open, before the music has started
+	bgm.Seek(1000)
+	if err := bgm.SetLoopPoints(2000, 4000); err != nil {
+		t.Errorf("SetLoopPoints while loading: %v", err)
+	}
+	bgm.SetLoopPointsSeconds(0.125, 0.25)
+	waitBgmLoaded(t, bgm)
+	bgm.Tick()
+	if bgm.loading || len(bgm.pending) > 0 {
+		t.Fatalf("still loading after Tick")
+	}
+	if st.pos != 1000 {
+		t.Errorf("position = %v, want 1000", st.pos)
+	}
+	sl := bgm.volctrl.Streamer.(*StreamLooper)
+	if sl.loopstart != 6000 || sl.loopend != 12000 {
+		t.Errorf("loop = %v-%v, want 6000-12000", sl.loopstart, sl.loopend)
+	}
+}
+
+func TestBgmSupersededLoad(t *testing.T) {
+	bgm := setTestBgm(t)
+	first, second := &testStreamer{length: 480}, &testStreamer{length: 480}
+	release := make(chan bool)
+	bgm.stop("first", 1, 100, 1, 0)
+	bgm.load(bgmLoad{}, func(ld *bgmLoad) error {
+		<-release
+		ld.streamer, ld.sampleRate = first, 48000
+		return nil
+	})
+	bgm.stop("second", 1, 100, 1, 0)
+	bgm.load(bgmLoad{}, func(ld *bgmLoad) error {
+		ld.streamer, ld.sampleRate = second, 48000
+		return nil
+	})
+	waitBgmLoaded(t, bgm)
+	// The first one finishes last, and must not wait for Tick to be let in
+	close(release)
+	for start := time.Now(); !first.closed.Load(); time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("superseded music was never closed")
+		}
+	}
+	bgm.Tick()
+	if bgm.streamer != second || second.closed.Load() {
+		t.Errorf("the latest music isn't the one playing")
+	}
+}
+
+func TestBgmFailedLoad(t *testing.T) {
+	bgm := setTestBgm(t)
+	bgm.stop("missing", 1, 100, 1, 0)
+	bgm.load(bgmLoad{}, func(ld *bgmLoad) error {
+		return errors.New("not found")
+	})
+	bgm.Seek(1000)
+	waitBgmLoaded(t, bgm)
+	bgm.Tick()
+	if bgm.loading || len(bgm.pending) > 0 || bgm.streamer != nil {
+		t.Errorf("failed load left loading = %v, %v pending", bgm.loading, len(bgm.pending))
+	}
+}
+
+// Gains of the volume sliders at 25, 50, 75 and 100%, with the other
+// sliders at 100%. Legacy keeps sound effects linear and the BGM on its
+// exponential mapping, which peaks at twice the gain.
+func TestVolumeCurves(t *testing.T) {
+	setTestVolumes(t)
+	bgmVolume := sys.bgmVolume
+	defer func() { sys.bgmVolume = bgmVolume }()
+	bgm := &Bgm{bgmVolume: 100, volctrl: &effects.Volume{Base: 2}}
+	for _, tc := range []struct {
+		curve    VolumeCurve
+		sfx, bgm [4]float64
+	}{
+		{VolumeCurveLegacy, [4]float64{0.25, 0.5, 0.75, 1}, [4]float64{0.0884, 0.25, 0.7071, 2}},
+		{VolumeCurveLinear, [4]float64{0.25, 0.5, 0.75, 1}, [4]float64{0.25, 0.5, 0.75, 1}},
+		{VolumeCurveLog, [4]float64{0.005623, 0.031623, 0.177828, 1}, [4]float64{0.005623, 0.031623, 0.177828, 1}},
+	} {
+		sys.volumeCurve = tc.curve
+		for i, percent := range []int{25, 50, 75, 100} {
+			sys.wavVolume, sys.bgmVolume = percent, percent
+			if g := sfxVolumeGain(); math.Abs(g-tc.sfx[i]) > 1e-4 {
+				t.Errorf("curve %v: SFX gain at %v%% is %.6f, want %v", tc.curve, percent, g, tc.sfx[i])
+			}
+			// Applied to playing music right away
+			bgm.UpdateVolume()
+			if g := math.Pow(2, bgm.volctrl.Volume); math.Abs(g-tc.bgm[i]) > 1e-4 || bgm.volctrl.Silent {
+				t.Errorf("curve %v: BGM gain at %v%% is %.6f, want %v", tc.curve, percent, g, tc.bgm[i])
+			}
+		}
+	}
+	// 0% is silent on every curve
+	for _, curve := range []VolumeCurve{VolumeCurveLegacy, VolumeCurveLinear, VolumeCurveLog} {
+		sys.volumeCurve, sys.wavVolume, sys.bgmVolume = curve, 0, 0
+		if bgm.UpdateVolume(); sfxVolumeGain() != 0 || !bgm.volctrl.Silent {
+			t.Errorf("curve %v: SFX gain %v, BGM silent %v at 0%%", curve, sfxVolumeGain(), bgm.volctrl.Silent)
+		}
+	}
+}
+
+// Three sounds from two groups of one SND, and one sound from the same group
+// of another SND: stopping the group fades out only that SND's sounds of it.
+func TestSndStopGroup(t *testing.T) {
+	setTestSoundChannels(t)
+	soundChannels := sys.soundChannels
+	sys.soundChannels = newSoundChannels(4)
+	t.Cleanup(func() { sys.soundChannels = soundChannels })
+	snd, other := newSnd(), newSnd()
+	for _, gn := range [][2]int32{{40, 0}, {40, 1}, {50, 0}} {
+		snd.table[gn] = testSound(100)
+	}
+	other.table[[2]int32{40, 0}] = testSound(100)
+	var handles []SoundHandle
+	for _, gn := range [][2]int32{{40, 0}, {40, 1}, {50, 0}} {
+		handles = append(handles, snd.playHandle(gn, 100, 0, 0, 0, 0, 0))
+	}
+	handles = append(handles, other.playHandle([2]int32{40, 0}, 100, 0, 0, 0, 0, 0))
+	snd.stopGroup(40)
+	for i, want := range []bool{true, true, false, false} {
+		c := sys.soundChannels.handleChannel(handles[i])
+		if c == nil {
+			t.Errorf("sound %v isn't playing", i)
+		} else if c.stopping != want {
+			t.Errorf("sound %v: stopping %v, want %v", i, c.stopping, want)
+		}
+	}
+}
+
+func TestBgmSetLoopPoints(t *testing.T) {
+	out := sys.errLog.Writer()
+	sys.errLog.SetOutput(io.Discard)
+	defer sys.errLog.SetOutput(out)
+	// A file of 100 samples at 100 Hz, looping 10-50
+	for _, tc := range []struct {
+		name               string
+		loopstart, loopend int
+		wantStart, wantEnd int
+		wantErr            bool
+	}{
+		{"valid", 20, 60, 20, 60, false},
+		{"negative start", -5, 60, 0, 60, false},
+		{"end past the end", 20, 500, 20, 100, false},
+		{"swapped", 60, 20, 20, 60, false},
+		{"no end", 20, 0, 20, 100, false},
+		{"start past the end", 500, 0, 10, 50, true},
+		{"empty region", 20, 21, 10, 50, true},
+	} {
+		sl := newStreamLooper(&testStreamer{length: 100}, -1, 10, 50, 0)
+		bgm := &Bgm{volctrl: &effects.Volume{Streamer: sl}, sampleRate: 100}
+		err := bgm.SetLoopPoints(tc.loopstart, tc.loopend)
+		if (err != nil) != tc.wantErr || sl.loopstart != tc.wantStart || sl.loopend != tc.wantEnd {
+			t.Errorf("%v: loop %v-%v, error %v, want %v-%v", tc.name, sl.loopstart, sl.loopend, err, tc.wantStart, tc.wantEnd)
+		}
+	}
+	sl := newStreamLooper(&testStreamer{length: 100}, -1, 10, 50, 0)
+	bgm := &Bgm{volctrl: &effects.Volume{Streamer: sl}, sampleRate: 100}
+	if err := bgm.SetLoopPointsSeconds(0.25, 0.755); err != nil || sl.loopstart != 25 || sl.loopend != 76 {
+		t.Errorf("seconds: loop %v-%v, error %v, want 25-76", sl.loopstart, sl.loopend, err)
+	}
+	if err := (&Bgm{}).SetLoopPoints(10, 50); err == nil {
+		t.Errorf("no music: no error")
+	}
+}
+
+// Marks a channel as playing a sound on ch with the given priority.
+func setTestSound(c *SoundChannel, ch, priority int32) {
+	c.sound = &Sound{length: 1}
+	c.sfx = &SoundEffect{channel: ch, priority: priority, loop: 1}
+}
+
+func TestSoundChannelsNewPriority(t *testing.T) {
+	wavChannels := sys.wavChannels
+	sys.wavChannels = 2
+	t.Cleanup(func() { sys.wavChannels = wavChannels })
+	// A sound of priority 0 plays on channel 0
+	for _, tc := range []struct {
+		lowpriority bool
+		priority    int32
+		interrupts  bool
+	}{
+		{false, 1, true},
+		{true, 1, true},
+		{false, 0, true}, // restarts, as in Mugen
+		{true, 0, false},
+		{false, -1, false},
+		{true, -1, false},
+	} {
+		for _, full := range []bool{false, true} {
+			s := newSoundChannels(2)
+			setTestSound(&s.channels[0], 0, 0)
+			if full {
+				setTestSound(&s.channels[1], 1, 5)
+			}
+			c := s.New(0, tc.lowpriority, tc.priority)
+			if !tc.interrupts {
+				if c != nil || !s.channels[0].IsPlaying() {
+					t.Errorf("lowpriority %v, priority %v, full %v: old sound interrupted", tc.lowpriority, tc.priority, full)
+				}
+				continue
+			}
+			if s.channels[0].IsPlaying() {
+				t.Errorf("lowpriority %v, priority %v, full %v: old sound not stopped", tc.lowpriority, tc.priority, full)
+			}
+			// A free channel is taken if there is one, else the old one is
+			// reused
+			want := &s.channels[1]
+			if full {
+				want = &s.channels[0]
+			}
+			if c != want {
+				t.Errorf("lowpriority %v, priority %v, full %v: got channel %p, want %p", tc.lowpriority, tc.priority, full, c, want)
+			}
+			if full && !s.channels[1].IsPlaying() {
+				t.Errorf("lowpriority %v, priority %v: sound on another channel stopped", tc.lowpriority, tc.priority)
+			}
+		}
+	}
+}
+
+// Streams st in blocks of 7 samples, up to max samples, and returns the
+// position each sample was read from.
+func streamPositions(st beep.Streamer, max int) (out []int) {
+	buf := make([][2]float64, 7)
+	for len(out) < max {
+		n, ok := st.Stream(buf)
+		for _, s := range buf[:n] {
+			out = append(out, int(s[0]))
+		}
+		if !ok || n == 0 {
+			break
+		}
+	}
+	return out
+}
+
+// Returns the positions from..to-1 of each run in turn.
+func runs(r ...[2]int) (out []int) {
+	for _, r := range r {
+		for i := r[0]; i < r[1]; i++ {
+			out = append(out, i)
+		}
+	}
+	return out
+}
+
+// Shrinking keeps the sounds on the channels past the new size playing to
+// the end, without taking new ones, and drops the channels once they're
+// done, from the end so that no index changes.
+func TestSoundChannelsShrink(t *testing.T) {
+	setTestSoundChannels(t)
+	sys.wavChannels = 4
+	s := newSoundChannels(4)
+	var handles []SoundHandle
+	for _, n := range []int{100, 100, 50, 30} {
+		handles = append(handles, s.Play(testSound(n), 100, 0, 0, 0, 0, 0))
+	}
+	s.SetSize(2)
+	if s.count() != 4 {
+		t.Errorf("%v channels right after shrinking, want 4", s.count())
+	}
+	if h := s.Play(testSound(10), 100, 0, 0, 0, 0, 0); h.Valid() {
+		t.Errorf("new sound got draining channel %v", h.index)
+	}
+	for _, tc := range []struct {
+		handle int
+		n      int
+		count  int32
+	}{
+		{3, 30, 3},
+		{2, 50, 2},
+	} {
+		c := s.handleChannel(handles[tc.handle])
+		if c == nil {
+			t.Fatalf("sound %v stopped before its end", tc.handle)
+		}
+		if got := len(streamAll(c.sfx.streamer)); got != tc.n {
+			t.Errorf("sound %v played %v samples, want %v", tc.handle, got, tc.n)
+		}
+		s.Tick()
+		if s.count() != tc.count {
+			t.Errorf("%v channels after sound %v ended, want %v", s.count(), tc.handle, tc.count)
+		}
+	}
+	for _, h := range handles[:2] {
+		if !s.IsPlayingHandle(h) {
+			t.Errorf("sound on channel %v stopped", h.index)
+		}
+	}
+}
+
+func TestStreamLooper(t *testing.T) {
+	for _, tc := range []struct {
+		name               string
+		st                 *testStreamer
+		loopcount          int
+		loopstart, loopend int
+		wantStart, wantEnd int
+		want               []int
+		wantDone, wantErr  bool
+		wantStalled        bool
+	}{
+		{name: "whole stream", st: &testStreamer{length: 10}, loopcount: 2,
+			wantEnd: 10, want: runs([2]int{0, 10}, [2]int{0, 10}), wantDone: true},
+		{name: "loop region", st: &testStreamer{length: 10}, loopcount: 3, loopstart: 2, loopend: 6,
+			wantStart: 2, wantEnd: 6, want: runs([2]int{0, 6}, [2]int{2, 6}, [2]int{2, 6}), wantDone: true},
+		{name: "single pass ignores the loop end", st: &testStreamer{length: 10}, loopcount: 1, loopstart: 2, loopend: 6,
+			wantStart: 2, wantEnd: 6, want: runs([2]int{0, 6}), wantDone: true},
+		{name: "loop start past the end", st: &testStreamer{length: 10}, loopcount: 2, loopstart: 10,
+			wantEnd: 10, want: runs([2]int{0, 10}, [2]int{0, 10}), wantDone: true},
+		{name: "negative loop start", st: &testStreamer{length: 10}, loopcount: 2, loopstart: -3,
+			wantEnd: 10, want: runs([2]int{0, 10}, [2]int{0, 10}), wantDone: true},
+		{name: "loop end past the end", st: &testStreamer{length: 10}, loopcount: 2, loopstart: 4, loopend: 50,
+			wantStart: 4, wantEnd: 10, want: runs([2]int{0, 10}, [2]int{4, 10}), wantDone: true},
+		{name: "empty loop region", st: &testStreamer{length: 10}, loopcount: 2, loopstart: 5, loopend: 6,
+			wantEnd: 10, want: runs([2]int{0, 10}, [2]int{0, 10}), wantDone: true},
+		{name: "loop end before loop start", st: &testStreamer{length: 10}, loopcount: 2, loopstart: 6, loopend: 3,
+			wantEnd: 10, want: runs([2]int{0, 10}, [2]int{0, 10}), wantDone: true},
+		{name: "unknown length", st: &testStreamer{length: 10, unknownLen: true}, loopcount: 2, loopstart: 3,
+			wantStart: 3, want: runs([2]int{0, 10}, [2]int{3, 10}), wantDone: true},
+		{name: "forever", st: &testStreamer{length: 10}, loopcount: -1, loopstart: 5,
+			wantStart: 5, wantEnd: 10, want: runs([2]int{0, 10}, [2]int{5, 10}, [2]int{5, 10}, [2]int{5, 6})},
+		{name: "seek failure", st: &testStreamer{length: 10, failSeek: 1}, loopcount: 3, loopstart: 2, loopend: 6,
+			wantStart: 2, wantEnd: 6, want: runs([2]int{0, 6}), wantDone: true, wantErr: true},
+		{name: "nothing to read", st: &testStreamer{unknownLen: true}, loopcount: -1,
+			want: nil, wantDone: true, wantStalled: true},
+	} {
+		sl := newStreamLooper(tc.st, tc.loopcount, tc.loopstart, tc.loopend, 0)
+		if sl.loopstart != tc.wantStart || sl.loopend != tc.wantEnd {
+			t.Errorf("%v: loop %v-%v, want %v-%v", tc.name, sl.loopstart, sl.loopend, tc.wantStart, tc.wantEnd)
+		}
+		got := streamPositions(sl, len(tc.want)+1)
+		if tc.loopcount < 0 {
+			got = got[:Min(int32(len(got)), int32(len(tc.want)))]
+		}
+		if !equalInts(got, tc.want) {
+			t.Errorf("%v: streamed %v, want %v", tc.name, got, tc.want)
+		}
+		if sl.Done() != tc.wantDone || (sl.Err() != nil) != tc.wantErr || sl.stalled != tc.wantStalled {
+			t.Errorf("%v: done %v, err %v, stalled %v", tc.name, sl.Done(), sl.Err(), sl.stalled)
+		}
+		// Once done, the looper reports it's over rather than streaming
+		// silence forever
+		if tc.wantDone {
+			if n, ok := sl.Stream(make([][2]float64, 4)); n != 0 || ok {
+				t.Errorf("%v: done looper streamed %v, %v", tc.name, n, ok)
+			}
+		}
+	}
+}
+
+// A 441 Hz sine at 44.1 kHz looped a quarter period off jumps by a whole
+// amplitude at the seam, and the crossfade smooths that jump down to about
+// the largest step of the sine itself, 2*pi*441/44100.
+func TestStreamLooperCrossfade(t *testing.T) {
+	const loopend, fade = 1025, 200
+	snd := testSound(2000)
+	for i := range snd.pcm {
+		v := math.Sin(2 * math.Pi * float64(i) / 100)
+		snd.pcm[i] = [2]float64{v, v}
+	}
+	for _, tc := range []struct {
+		fade    int
+		n       int
+		maxJump float64
+	}{
+		{0, 2 * loopend, 1.01},
+		{fade, 2*loopend - fade, 0.07},
+	} {
+		out := streamAll(newStreamLooper(snd.GetStreamer(), 2, 0, loopend, tc.fade))
+		if len(out) != tc.n {
+			t.Errorf("fade %v: streamed %v samples, want %v", tc.fade, len(out), tc.n)
+		}
+		var jump float64
+		for i := 1; i < len(out); i++ {
+			jump = math.Max(jump, math.Abs(out[i]-out[i-1]))
+		}
+		if tc.fade == 0 && jump < 0.99 || jump > tc.maxJump {
+			t.Errorf("fade %v: largest jump %v, want up to %v", tc.fade, jump, tc.maxJump)
+		}
+	}
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// With every band at 0 dB, the EQ passes samples through bit for bit, also
+// after a band was turned on and back off.
+func TestEqualizerBypass(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	in := make([][2]float64, 4096)
+	for i := range in {
+		in[i] = [2]float64{rnd.Float64()*2 - 1, rnd.Float64()*2 - 1}
+	}
+	// Passes on whatever is in the buffer
+	e := Equalizer{streamer: beep.StreamerFunc(func(samples [][2]float64) (int, bool) {
+		return len(samples), true
+	})}
+	for _, on := range []bool{false, true} {
+		if on {
+			e.SetBand(EqMid, 6, 1000, 1)
+			e.Stream(append([][2]float64(nil), in...))
+			e.SetBand(EqMid, 0, 1000, 1)
+		}
+		out := append([][2]float64(nil), in...)
+		e.Stream(out)
+		for i := range in {
+			if out[i] != in[i] {
+				t.Errorf("turned on before %v: sample %v changed from %v to %v", on, i, in[i], out[i])
+				break
+			}
+		}
+	}
+}
+
+// A shelf is at half its gain at its corner frequency, at its full gain
+// well past it, and leaves the other side alone.
+func TestEqualizerShelves(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		band       int
+		gain, freq float32
+		at         float64
+		want       float64 // dB
+	}{
+		{"low shelf at the corner", EqLow, 6, 200, 200, 3},
+		{"low shelf below", EqLow, 6, 200, 20, 6},
+		{"low shelf above", EqLow, 6, 200, 10000, 0},
+		{"high shelf at the corner", EqHigh, -6, 4000, 4000, -3},
+		{"high shelf above", EqHigh, -6, 4000, 20000, -6},
+		{"high shelf below", EqHigh, -6, 4000, 100, 0},
+	} {
+		pos := 0
+		var e Equalizer
+		e.streamer = beep.StreamerFunc(func(samples [][2]float64) (int, bool) {
+			for i := range samples {
+				v := math.Sin(2 * math.Pi * tc.at * float64(pos) / float64(audioFrequency))
+				samples[i] = [2]float64{v, v}
+				pos++
+			}
+			return len(samples), true
+		})
+		e.SetBand(tc.band, tc.gain, tc.freq, 0.707)
+		// Settled, over half a second, a whole number of periods at all
+		// of the above frequencies
+		out := streamAll(beep.Take(audioFrequency, &e))[audioFrequency/2:]
+		if got := 20 * math.Log10(rms(out)*math.Sqrt2); math.Abs(got-tc.want) > 0.3 {
+			t.Errorf("%v: %.2f dB, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+// Returns a sound of n samples at 48 kHz, sample i being i.
+func testSound(n int) *Sound {
+	pcm := make([][2]float64, n)
+	for i := range pcm {
+		pcm[i] = [2]float64{float64(i), float64(i)}
+	}
+	return &Sound{pcm: pcm, pcmTried: true, length: n, gainDone: true, gain: 1,
+		format: beep.Format{SampleRate: 48000, NumChannels: 2, Precision: 2}}
+}
+
+func TestSoundNormalizeGain(t *testing.T) {
+	mode, target := sys.soundNormalize, sys.soundNormalizeTarget
+	defer func() { sys.soundNormalize, sys.soundNormalizeTarget = mode, target }()
+	sys.soundNormalizeTarget = -6
+	pcm := func(v ...float64) [][2]float64 {
+		out := make([][2]float64, 0, 100*len(v))
+		for i := 0; i < 100; i++ {
+			for _, x := range v {
+				out = append(out, [2]float64{x, x})
+			}
+		}
+		return out
+	}
+	// -6 dB is 0.501
+	for _, tc := range []struct {
+		name string
+		mode SoundNormalize
+		pcm  [][2]float64
+		path string
+		want float64
+	}{
+		{"peak", SoundNormalizePeak, pcm(0.4, -0.1), "", 0.501187 / 0.4},
+		{"quiet, capped", SoundNormalizePeak, pcm(0.1, -0.1), "", soundNormalizeMaxGain},
+		{"clipping", SoundNormalizePeak, pcm(1.5, -0.5), "", 0.501187 / 1.5},
+		{"rms", SoundNormalizeRMS, pcm(0.8, -0.2), "", 0.501187 / math.Sqrt(0.34)},
+		{"rms clipping", SoundNormalizeRMS, pcm(2, -2), "", 0.501187 / 2},
+		{"silence", SoundNormalizePeak, pcm(0), "", 1},
+		{"rms silence", SoundNormalizeRMS, pcm(0), "", 1},
+		{"rms no samples", SoundNormalizeRMS, [][2]float64{}, "", 1},
+		{"off", SoundNormalizeOff, pcm(0.1), "", 1},
+		{"streamed", SoundNormalizePeak, pcm(0.1), "stream.wav", 1},
+	} {
+		sys.soundNormalize = tc.mode
+		snd := &Sound{pcm: tc.pcm, pcmTried: true, length: len(tc.pcm), path: tc.path}
+		if g := snd.normalizeGain(); math.Abs(float64(g)-tc.want) > 1e-4 || math.IsInf(float64(g), 0) || math.IsNaN(float64(g)) {
+			t.Errorf("%v: gain %v, want %v", tc.name, g, tc.want)
+		}
+	}
+	// Worked out once, on the first play
+	sys.soundNormalize = SoundNormalizePeak
+	snd := &Sound{pcm: pcm(0.4), pcmTried: true, length: 100}
+	first := snd.normalizeGain()
+	snd.pcm[0] = [2]float64{1, 1}
+	if g := snd.normalizeGain(); g != first {
+		t.Errorf("gain changed from %v to %v", first, g)
+	}
+}
+
+func TestSoundChannelLoopEnd(t *testing.T) {
+	quality, wavChannels := sys.sfxResampleQuality, sys.wavChannels
+	sys.sfxResampleQuality, sys.wavChannels = 1, 1
+	t.Cleanup(func() {
+		sys.sfxResampleQuality, sys.wavChannels = quality, wavChannels
+		sys.soundMixer.Clear()
+	})
+	for _, tc := range []struct {
+		name               string
+		loop               int32
+		loopstart, loopend int
+		want               []int
+	}{
+		// Played twice up to the loop end, never reaching the end of the file
+		{"loop end halfway", 2, 0, 50, runs([2]int{0, 50}, [2]int{0, 50})},
+		// Played once through the whole file, the loop start doesn't matter
+		{"loop start, single pass", 1, 30, 0, runs([2]int{0, 100})},
+	} {
+		s := newSoundChannels(1)
+		c := &s.channels[0]
+		c.Play(testSound(100), tc.loop, 1, tc.loopstart, tc.loopend, 0, 0)
+		var got []int
+		buf := make([][2]float64, 10)
+		for len(got) < 1000 && c.IsPlaying() {
+			n, _ := c.sfx.streamer.Stream(buf)
+			for _, v := range buf[:n] {
+				got = append(got, int(v[0]))
+			}
+			s.Tick()
+			// Still playing until every loop has been read
+			if c.IsPlaying() != (len(got) < len(tc.want)) {
+				t.Errorf("%v: playing %v after %v samples", tc.name, c.IsPlaying(), len(got))
+				break
+			}
+		}
+		if !equalInts(got, tc.want) {
+			t.Errorf("%v: played %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+// Starting after the loop start plays on to the loop end before the first
+// wrap, so the looper sees where the stream was moved to.
+func TestSoundChannelStartPosition(t *testing.T) {
+	setTestSoundChannels(t)
+	for _, tc := range []struct {
+		name           string
+		start, startMs int
+		want           []int
+	}{
+		{"samples", 40, 0, runs([2]int{40, 60}, [2]int{20, 60})},
+		// 1 ms is 48 samples at 48 kHz
+		{"milliseconds", 0, 1, runs([2]int{48, 60}, [2]int{20, 60})},
+		{"milliseconds override samples", 10, 1, runs([2]int{48, 60}, [2]int{20, 60})},
+		// Past the loop end, or clamped to the end of the sound, it starts
+		// from the loop start
+		{"past loop end", 70, 0, runs([2]int{20, 60}, [2]int{20, 60})},
+		{"past the end", 0, 1000, runs([2]int{20, 60}, [2]int{20, 60})},
+	} {
+		s := newSoundChannels(1)
+		c := &s.channels[0]
+		c.Play(testSound(100), 2, 1, 20, 60, tc.start, tc.startMs)
+		if got := streamPositions(c.sfx.streamer, len(tc.want)+1); !equalInts(got, tc.want) {
+			t.Errorf("%v: played %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+// A playing sound reports its position in samples and seconds of its own
+// rate, whether reached by channel, handle or SND entry, and -1 once it
+// stopped.
+func TestSoundChannelPosition(t *testing.T) {
+	setTestSoundChannels(t)
+	channels := sys.soundChannels
+	t.Cleanup(func() { sys.soundChannels = channels })
+	sys.soundChannels = newSoundChannels(2)
+	snd := newSnd()
+	snd.table[[2]int32{5, 1}] = testSound(2400)
+	snd.table[[2]int32{5, 1}].format.SampleRate = 24000
+	h := snd.playHandle([2]int32{5, 1}, 100, 0, 0, 0, 0, 0)
+	c := sys.soundChannels.FindSource(snd, [2]int32{5, 1})
+	if c == nil {
+		t.Fatal("playing sound not found")
+	}
+	if sys.soundChannels.FindSource(snd, [2]int32{5, 2}) != nil {
+		t.Error("found a sound for an entry that isn't playing")
+	}
+	c.sfx.streamer.Stream(make([][2]float64, 1200))
+	if p, s, l := c.Position(), c.PositionSeconds(), c.LengthSeconds(); p != 1200 || s != 0.05 || l != 0.1 {
+		t.Errorf("position %v, %v s of %v s, want 1200, 0.05 s of 0.1 s", p, s, l)
+	}
+	if p := sys.soundChannels.PositionHandle(h); p != 1200 {
+		t.Errorf("position by handle %v, want 1200", p)
+	}
+	c.Stop()
+	if p, s, l := c.Position(), c.PositionSeconds(), c.LengthSeconds(); p != -1 || s != -1 || l != -1 {
+		t.Errorf("position %v, %v s of %v s after stopping, want -1", p, s, l)
+	}
+	if p := sys.soundChannels.PositionHandle(h); p != -1 {
+		t.Errorf("position by handle %v after stopping, want -1", p)
+	}
+	// Loops left after the current pass, 0 once the last one has started
+	c = &newSoundChannels(1).channels[0]
+	c.Play(testSound(100), 3, 1, 0, 0, 0, 0)
+	for _, want := range []int{2, 1, 0} {
+		if got := c.LoopsLeft(); got != want {
+			t.Errorf("loops left %v, want %v", got, want)
+		}
+		c.sfx.streamer.Stream(make([][2]float64, 100))
+	}
+	c.Play(testSound(100), -1, 1, 0, 0, 0, 0)
+	if got := c.LoopsLeft(); got != -1 {
+		t.Errorf("loops left %v looping forever, want -1", got)
+	}
+}
+
+// Sets up the sound effects for Play at the lowest resampling quality, and
+// puts the settings back when the test ends.
+func setTestSoundChannels(t *testing.T) {
+	quality, wavChannels := sys.sfxResampleQuality, sys.wavChannels
+	sys.sfxResampleQuality, sys.wavChannels = 1, 1
+	t.Cleanup(func() {
+		sys.sfxResampleQuality, sys.wavChannels = quality, wavChannels
+		sys.soundMixer.Clear()
+	})
+}
+
+// An impulse through a 1 ms echo at 48 kHz comes back every 48 samples,
+// first at the wet mix, then scaled by the feedback each time round.
+func TestSoundChannelEcho(t *testing.T) {
+	setTestSoundChannels(t)
+	snd := testSound(200)
+	for i := range snd.pcm {
+		snd.pcm[i] = [2]float64{}
+	}
+	snd.pcm[0] = [2]float64{1, 1}
+	s := newSoundChannels(1)
+	c := &s.channels[0]
+	c.Play(snd, 0, 1, 0, 0, 0, 0)
+	if c.sfx.echo != nil {
+		t.Errorf("echo set before SetEcho")
+	}
+	c.SetEcho(1, 0.5, 0.8)
+	if c.sfx.echo == nil || c.sfx.echo.buf != nil {
+		t.Fatalf("SetEcho gave %+v, want an echo with no buffer yet", c.sfx.echo)
+	}
+	want := make([]float64, 200)
+	want[0], want[48], want[96], want[144], want[192] = 1, 0.8, 0.4, 0.2, 0.1
+	var got []float64
+	buf := make([][2]float64, 7)
+	for len(got) < len(want) {
+		n, _ := c.sfx.Stream(buf)
+		if n == 0 {
+			break
+		}
+		for _, v := range buf[:n] {
+			got = append(got, v[0])
+		}
+	}
+	if len(c.sfx.echo.buf) != 48 {
+		t.Errorf("delay line of %v samples, want 48", len(c.sfx.echo.buf))
+	}
+	if len(got) != len(want) {
+		t.Fatalf("streamed %v samples, want %v", len(got), len(want))
+	}
+	for i := range want {
+		if math.Abs(got[i]-want[i]) > 1e-6 {
+			t.Errorf("sample %v is %v, want %v", i, got[i], want[i])
+		}
+	}
+	c.SetEcho(1, 2, 1)
+	if c.sfx.echo.feedback != 0.9 {
+		t.Errorf("feedback %v, want it clamped to 0.9", c.sfx.echo.feedback)
+	}
+	c.SetEcho(0, 0.5, 0.8)
+	if c.sfx.echo != nil {
+		t.Errorf("echo still set after a delay of 0")
+	}
+}
+
+// White noise through a 500 Hz low-pass loses most of its high frequency
+// energy, measured as the energy of the difference between neighbouring
+// samples, which white noise has twice its power of.
+func TestSoundChannelLowpass(t *testing.T) {
+	setTestSoundChannels(t)
+	rnd := rand.New(rand.NewSource(1))
+	snd := testSound(48000)
+	for i := range snd.pcm {
+		v := rnd.Float64()*2 - 1
+		snd.pcm[i] = [2]float64{v, v}
+	}
+	hf := func(s []float64) float64 {
+		var sum float64
+		for i := 1; i < len(s); i++ {
+			sum += (s[i] - s[i-1]) * (s[i] - s[i-1])
+		}
+		return sum / float64(len(s)-1)
+	}
+	s := newSoundChannels(1)
+	c := &s.channels[0]
+	c.Play(snd, 0, 1, 0, 0, 0, 0)
+	c.SetLowpass(500)
+	lp := c.sfx.lowpass
+	if lp == nil || lp.coef != 1 || lp.target >= 1 {
+		t.Fatalf("SetLowpass gave %+v, want a filter gliding down from 1", lp)
+	}
+	out := streamAll(c.sfx)
+	if len(out) != len(snd.pcm) {
+		t.Fatalf("streamed %v samples, want %v", len(out), len(snd.pcm))
+	}
+	if lp.coef != lp.target {
+		t.Errorf("cutoff still gliding at %v, want %v", lp.coef, lp.target)
+	}
+	in := make([]float64, len(snd.pcm))
+	for i := range in {
+		in[i] = snd.pcm[i][0]
+	}
+	// Past the glide
+	if r := hf(out[24000:]) / hf(in[24000:]); r > 0.01 {
+		t.Errorf("high frequency energy ratio %v, want below 0.01", r)
+	}
+	// Opening the filter glides it back up, then removes it
+	c.SetLowpass(0)
+	for i := 0; i < 30 && c.sfx.lowpass != nil; i++ {
+		c.sfx.Stream(make([][2]float64, 16))
+	}
+	if c.sfx.lowpass != nil {
+		t.Errorf("filter kept after opening fully")
+	}
+	// A new sound on the channel starts with no filter state
+	c.SetLowpass(500)
+	c.Play(snd, 0, 1, 0, 0, 0, 0)
+	if c.sfx.lowpass != nil {
+		t.Errorf("filter carried over to the next sound")
+	}
+}
+
+// The per-sound pitch and the engine factor multiply into the resampling
+// ratio, and setting one leaves the other alone.
+func TestSoundChannelPitch(t *testing.T) {
+	setTestSoundChannels(t)
+	s := newSoundChannels(1)
+	c := &s.channels[0]
+	c.Play(testSound(100), 0, 1, 0, 0, 0, 0)
+	resampler := c.ctrl.Streamer.(*beep.Resampler)
+	// The sound is at 48 kHz, so a rate of 1 resamples by this
+	base := 48000 / float64(audioFrequency)
+	for _, tc := range []struct {
+		name           string
+		set            func()
+		freqmul, pitch float32
+		rate           float64
+	}{
+		{"pitch", func() { c.SetPitch(1.2) }, 1, 1.2, 1.2},
+		{"freqmul after pitch", func() { c.SetFreqMul(0.5, 0) }, 0.5, 1.2, 0.6},
+		{"pitch reset", func() { c.SetPitch(1) }, 0.5, 1, 0.5},
+		{"pitch again", func() { c.SetPitch(0.9) }, 0.5, 0.9, 0.45},
+		{"freqmul reset", func() { c.SetFreqMul(1, 0) }, 1, 0.9, 0.9},
+	} {
+		tc.set()
+		if c.sfx.freqmul != tc.freqmul || c.sfx.pitch != tc.pitch {
+			t.Errorf("%v: freqmul %v, pitch %v, want %v, %v", tc.name, c.sfx.freqmul, c.sfx.pitch, tc.freqmul, tc.pitch)
+		}
+		// dstRate is a whole number of Hz, so up to a sample per second off
+		if r := resampler.Ratio() / base; math.Abs(r-tc.rate) > 1e-4 {
+			t.Errorf("%v: rate %v, want %v", tc.name, r, tc.rate)
+		}
+	}
+}
+
+// A sound starts on the output sample it's due at, whatever the buffer sizes
+// the output is mixed in. Sounds due in the past, or further out than a late
+// tick could explain, start right away.
+func TestSoundStart(t *testing.T) {
+	clock := sys.soundClock
+	t.Cleanup(func() { sys.soundClock = clock })
+	for _, tc := range []struct {
+		name      string
+		due       int64
+		bufSize   int
+		wantStart int
+	}{
+		{"within a buffer", 1100, 300, 100},
+		{"buffers later", 3000, 300, 2000},
+		{"over mixer chunks", 3000, 2048, 2000},
+		{"in the past", 500, 300, 0},
+		{"too far out", 1000 + 3*audioOutLen, 300, 0},
+	} {
+		mix := &beep.Mixer{}
+		sys.soundClock = SoundClock{streamer: mix}
+		// Silence up to sample 1000
+		sys.soundClock.Stream(make([][2]float64, 1000))
+		mix.Add(&soundStart{streamer: &testStreamer{length: 1 << 20, pos: 1}, at: tc.due})
+		var out []float64
+		buf := make([][2]float64, tc.bufSize)
+		for len(out) < tc.wantStart+tc.bufSize {
+			n, _ := sys.soundClock.Stream(buf)
+			for _, s := range buf[:n] {
+				out = append(out, s[0])
+			}
+		}
+		start := 0
+		for start < len(out) && out[start] == 0 {
+			start++
+		}
+		if start != tc.wantStart {
+			t.Errorf("%v: started at %v, want %v", tc.name, start, tc.wantStart)
+			continue
+		}
+		// Nothing of the sound is lost to the wait
+		for i, v := range out[start:] {
+			if v != float64(i+1) {
+				t.Errorf("%v: sample %v after the start is %v, want %v", tc.name, i, v, i+1)
+				break
+			}
+		}
+	}
+}
+
+type nopSeekCloser struct{ beep.StreamSeeker }
+
+func (nopSeekCloser) Close() error { return nil }
+
+// Returns a sound of a second of a 5 kHz tone at 22.05 kHz, high enough for
+// the resampling quality to show.
+func testToneSound() *Sound {
+	snd := &Sound{pcm: make([][2]float64, 22050), pcmTried: true, length: 22050, gainDone: true, gain: 1,
+		format: beep.Format{SampleRate: 22050, NumChannels: 2, Precision: 2}}
+	for i := range snd.pcm {
+		v := math.Sin(2 * math.Pi * 5000 * float64(i) / 22050)
+		snd.pcm[i] = [2]float64{v, v}
+	}
+	return snd
+}
+
+// Returns how far the output of st is from the 5 kHz tone at 48 kHz, as the
+// rms of the difference over the rms of the tone, once scaled to fit.
+func toneError(st beep.Streamer) float64 {
+	var out []float64
+	buf := make([][2]float64, 512)
+	for len(out) < 9600 {
+		n, ok := st.Stream(buf)
+		for _, s := range buf[:n] {
+			out = append(out, s[0])
+		}
+		if !ok {
+			break
+		}
+	}
+	// Past the resampler's warm-up
+	var dot, norm float64
+	ideal := make([]float64, len(out))
+	for i := 480; i < len(out); i++ {
+		ideal[i] = math.Sin(2 * math.Pi * 5000 * float64(i) / 48000)
+		dot += out[i] * ideal[i]
+		norm += ideal[i] * ideal[i]
+	}
+	var diff float64
+	for i := 480; i < len(out); i++ {
+		d := out[i] - ideal[i]*dot/norm
+		diff += d * d
+	}
+	return math.Sqrt(diff/norm) / (dot / norm)
+}
+
+// Each quality step resamples cleaner than the one below it, for music and
+// sound effects alike. Streams already playing keep their quality when it
+// changes.
+func TestResampleQuality(t *testing.T) {
+	setTestSoundChannels(t)
+	bgm := setTestBgm(t)
+	play := func(bgmQuality, sfxQuality int) *SoundChannel {
+		sys.bgmResampleQuality, sys.sfxResampleQuality = bgmQuality, sfxQuality
+		c := &newSoundChannels(1).channels[0]
+		c.Play(testToneSound(), 0, 1, 0, 0, 0, 0)
+		bgm.stop("test", 1, 100, 1, 0)
+		bgm.load(bgmLoad{}, func(ld *bgmLoad) error {
+			ld.streamer, ld.sampleRate = nopSeekCloser{testToneSound().GetStreamer()}, 22050
+			return nil
+		})
+		waitBgmLoaded(t, bgm)
+		bgm.Tick()
+		return c
+	}
+	var sfx, music [5]float64
+	for q := 1; q <= 4; q++ {
+		c := play(q, q)
+		sfx[q], music[q] = toneError(c.ctrl), toneError(bgm.ctrl)
+		if q > 1 && (sfx[q] > sfx[q-1]/2 || music[q] > music[q-1]/2) {
+			t.Errorf("quality %v: error %v for sounds, %v for music, want under half of %v, %v",
+				q, sfx[q], music[q], sfx[q-1], music[q-1])
+		}
+	}
+	// Changed while playing, and separately
+	c := play(1, 4)
+	sys.bgmResampleQuality, sys.sfxResampleQuality = 4, 1
+	bgm.Tick()
+	if e := toneError(c.ctrl); math.Abs(e-sfx[4]) > 1e-9 {
+		t.Errorf("sound error %v, want %v of the quality it started with", e, sfx[4])
+	}
+	if e := toneError(bgm.ctrl); math.Abs(e-music[1]) > 1e-9 {
+		t.Errorf("music error %v, want %v of the quality it started with", e, music[1])
+	}
+}
+
+// A tone keeps its pitch when the output switches sample rates while it
+// plays, its resampler being set up for the new rate.
+func TestSoundChannelSampleRate(t *testing.T) {
+	setTestSoundChannels(t)
+	channels, freq := sys.soundChannels, audioFrequency
+	defer func() {
+		sys.soundChannels = channels
+		SetAudioSampleRate(freq)
+	}()
+	sys.errLog.SetOutput(io.Discard)
+	defer sys.errLog.SetOutput(os.Stderr)
+	// Two seconds of 440 Hz at 22.05 kHz, which neither output rate matches
+	snd := &Sound{pcm: make([][2]float64, 44100), pcmTried: true, length: 44100, gainDone: true, gain: 1,
+		format: beep.Format{SampleRate: 22050, NumChannels: 2, Precision: 2}}
+	for i := range snd.pcm {
+		v := math.Sin(2 * math.Pi * 440 * float64(i) / 22050)
+		snd.pcm[i] = [2]float64{v, v}
+	}
+	sys.soundChannels = newSoundChannels(1)
+	c := &sys.soundChannels.channels[0]
+	c.Play(snd, 0, 1, 0, 0, 0, 0)
+	buf := make([][2]float64, 512)
+	for _, rate := range []int{44100, 48000} {
+		// Without an audio device, only reopening the speaker fails
+		SetAudioSampleRate(rate)
+		// Rising zero crossings over half a second of output
+		crossings, prev := 0, 0.0
+		for n := 0; n < rate/2; n += len(buf) {
+			k, _ := c.ctrl.Stream(buf[:Min(int32(len(buf)), int32(rate/2-n))])
+			for _, s := range buf[:k] {
+				if prev < 0 && s[0] >= 0 {
+					crossings++
+				}
+				prev = s[0]
+			}
+		}
+		if crossings < 219 || crossings > 221 {
+			t.Errorf("%v Hz: %v Hz tone, want 440", rate, 2*crossings)
+		}
+	}
+}
+
+// Panning follows the position in the camera window, with a 320 wide view
+// from -160 to 160 at zoom 1, or -80 to 80 at zoom 2.
+func TestSoundEffectPan(t *testing.T) {
+	cam, stage, width, stereo, rng := sys.cam, sys.stage, sys.gameWidth, sys.stereoEffects, sys.panningRange
+	defer func() {
+		sys.cam, sys.stage, sys.gameWidth, sys.stereoEffects, sys.panningRange = cam, stage, width, stereo, rng
+	}()
+	sys.stage, sys.gameWidth, sys.stereoEffects = nil, 320, true
+	ones := beep.StreamerFunc(func(samples [][2]float64) (int, bool) {
+		for i := range samples {
+			samples[i] = [2]float64{1, 1}
+		}
+		return len(samples), true
+	})
+	// At the edges, softClamp01 eases the position to 0.1/e from the side
+	edge := 2 * (1 - 0.1/math.E)
+	for _, tc := range []struct {
+		name   string
+		x, ls  float32
+		scale  float32
+		rng    float32
+		lv, rv float64
+	}{
+		{"left", -160, 1, 1, 100, edge, 2 - edge},
+		{"center", 0, 1, 1, 100, 1, 1},
+		{"right", 160, 1, 1, 100, 2 - edge, edge},
+		{"off-screen left", -1000, 1, 1, 100, 2, 0},
+		{"off-screen right", 1000, 1, 1, 100, 0, 2},
+		{"right, zoomed in", 80, 1, 2, 100, 2 - edge, edge},
+		{"right, localcoord 640", 320, 0.5, 1, 100, 2 - edge, edge},
+		{"off-screen left, range 30", -1000, 1, 1, 30, 1.3, 0.7},
+		{"center, range 30", 0, 1, 1, 30, 1, 1},
+	} {
+		sys.cam.Scale, sys.panningRange = tc.scale, tc.rng
+		sys.cam.ScreenPos[0], sys.cam.Offset[0] = -160/tc.scale, 0
+		x := tc.x
+		s := &SoundEffect{streamer: ones, volume: 256, gain: 1, x: &x, ls: tc.ls, freqmul: 1, pitch: 1}
+		out := make([][2]float64, 1)
+		s.Stream(out)
+		if math.Abs(out[0][0]-tc.lv) > 1e-3 || math.Abs(out[0][1]-tc.rv) > 1e-3 {
+			t.Errorf("%v: volumes %.4f, %.4f, want %.4f, %.4f", tc.name, out[0][0], out[0][1], tc.lv, tc.rv)
+		}
+	}
+}
+
+// Whatever the position, the two sides add up to twice the volume, and
+// neither goes past what the panning range allows. A stage's panningwidth
+// replaces the width of the view, centered on it.
+func TestSoundEffectPanRange(t *testing.T) {
+	cam, stage, width, stereo, rng := sys.cam, sys.stage, sys.gameWidth, sys.stereoEffects, sys.panningRange
+	defer func() {
+		sys.cam, sys.stage, sys.gameWidth, sys.stereoEffects, sys.panningRange = cam, stage, width, stereo, rng
+	}()
+	sys.gameWidth, sys.stereoEffects = 320, true
+	sys.cam.Scale, sys.cam.ScreenPos[0], sys.cam.Offset[0] = 1, -160, 0
+	ones := beep.StreamerFunc(func(samples [][2]float64) (int, bool) {
+		for i := range samples {
+			samples[i] = [2]float64{1, 1}
+		}
+		return len(samples), true
+	})
+	edge := 2 * (1 - 0.1/math.E)
+	at := func(x float32) *float32 { return &x }
+	for _, tc := range []struct {
+		name         string
+		panningwidth float32
+		x            *float32
+		p            float32
+		lv           float64 // at a range of 100
+	}{
+		{"center", 0, at(0), 0, 1},
+		{"off-screen left", 0, at(-5000), 0, 2},
+		{"off-screen right", 0, at(5000), 0, 0},
+		{"abspan beyond the left", 0, nil, -1000, 2},
+		{"abspan beyond the right", 0, nil, 1000, 0},
+		{"abspan within", 0, nil, 80, 0.5},
+		{"panningwidth edge", 160, at(-80), 0, edge},
+		{"panningwidth center", 160, at(0), 0, 1},
+	} {
+		sys.stage = nil
+		if tc.panningwidth > 0 {
+			sys.stage = &Stage{localscl: 1}
+			sys.stage.stageCamera.panningwidth = tc.panningwidth
+		}
+		for _, rng := range []float32{100, 30, 0} {
+			sys.panningRange = rng
+			s := &SoundEffect{streamer: ones, volume: 256, gain: 1, x: tc.x, ls: 1, p: tc.p, freqmul: 1, pitch: 1}
+			out := make([][2]float64, 1)
+			s.Stream(out)
+			lv, rv := out[0][0], out[0][1]
+			// The range scales how far from center each side goes
+			want := 1 + (tc.lv-1)*float64(rng)/100
+			if math.Abs(lv+rv-2) > 1e-4 || math.Abs(lv-want) > 1e-3 {
+				t.Errorf("%v, range %v: volumes %.4f, %.4f, want %.4f, %.4f", tc.name, rng, lv, rv, want, 2-want)
+			}
+		}
+	}
+}
+
+// Writes a mono FLAC file of the given samples and bit depth, in frames of
+// 1024, and returns its path. The frames are stored verbatim, which is all
+// that's needed to test seeking, looping and sample scaling.
+func writeTestFlac(t *testing.T, rate, bits int, samples []int) string {
+	n := len(samples)
+	crc8 := func(b []byte) (crc byte) {
+		for _, v := range b {
+			crc ^= v
+			for i := 0; i < 8; i++ {
+				if crc&0x80 != 0 {
+					crc = crc<<1 ^ 0x07
+				} else {
+					crc <<= 1
+				}
+			}
+		}
+		return crc
+	}
+	crc16 := func(b []byte) (crc uint16) {
+		for _, v := range b {
+			crc ^= uint16(v) << 8
+			for i := 0; i < 8; i++ {
+				if crc&0x8000 != 0 {
+					crc = crc<<1 ^ 0x8005
+				} else {
+					crc <<= 1
+				}
+			}
+		}
+		return crc
+	}
+	buf := []byte("fLaC")
+	// Last metadata block, STREAMINFO, 34 bytes: block sizes, unknown frame
+	// sizes, then 20 bits of rate, 3 of channels-1, 5 of bits-1 and 36 of
+	// sample count, and no MD5
+	buf = append(buf, 0x80, 0, 0, 34, 0x04, 0, 0x04, 0, 0, 0, 0, 0, 0, 0)
+	info := uint64(rate)<<44 | (1-1)<<41 | uint64(bits-1)<<36 | uint64(n)
+	buf = binary.BigEndian.AppendUint64(buf, info)
+	buf = append(buf, make([]byte, 16)...)
+	size := map[int]byte{12: 2, 16: 4, 20: 5, 24: 6}[bits]
+	for num := 0; num*1024 < n; num++ {
+		// Fixed block size of 1024, rate from STREAMINFO, mono
+		fr := []byte{0xff, 0xf8, 0xa0, size << 1, byte(num)}
+		fr = append(fr, crc8(fr))
+		// Verbatim subframe, samples packed MSB first, padded to a byte
+		fr = append(fr, 0x02)
+		var acc uint64
+		var nbits int
+		for i := num * 1024; i < (num+1)*1024; i++ {
+			v := 0
+			if i < n {
+				v = samples[i]
+			}
+			acc = acc<<bits | uint64(v)&(1<<bits-1)
+			for nbits += bits; nbits >= 8; nbits -= 8 {
+				fr = append(fr, byte(acc>>(nbits-8)))
+			}
+		}
+		if nbits > 0 {
+			fr = append(fr, byte(acc<<(8-nbits)))
+		}
+		buf = binary.BigEndian.AppendUint16(append(buf, fr...), crc16(fr))
+	}
+	path := filepath.Join(t.TempDir(), "test.flac")
+	if err := os.WriteFile(path, buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// Samples are scaled by their bit depth, the precision rounded up to whole
+// bytes.
+func TestFlacBitDepths(t *testing.T) {
+	// The decoder logs that it has no test files of 12 and 20 bits
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	for _, bits := range []int{12, 16, 20, 24} {
+		full := 1 << (bits - 1)
+		samples := []int{0, 1, -1, full - 1, -full, full / 2}
+		st, format, _, err := decodeBgm(writeTestFlac(t, 44100, bits, samples), "")
+		if err != nil {
+			t.Errorf("%v bits: %v", bits, err)
+			continue
+		}
+		if format.Precision != (bits+7)/8 {
+			t.Errorf("%v bits: precision %v", bits, format.Precision)
+		}
+		got := streamAll(st)
+		st.Close()
+		for i, v := range samples {
+			if want := float64(v) / float64(full); i >= len(got) || got[i] != want {
+				t.Errorf("%v bits: sample %v decoded as %v, want %v", bits, i, got, want)
+				break
+			}
+		}
+	}
+	// 32 bits is out of the frame header's reach, but scales the same
+	if q := flacSampleScale(32); q != 1.0/(1<<31) {
+		t.Errorf("32 bits scale by %v", q)
+	}
+}
+
+func TestFlacLoop(t *testing.T) {
+	const n, loopstart, loopend = 4096, 1500, 3000
+	ramp := make([]int, n)
+	for i := range ramp {
+		ramp[i] = i
+	}
+	st, format, name, err := decodeBgm(writeTestFlac(t, 44100, 16, ramp), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	if name != "flac" || format.SampleRate != 44100 || st.Len() != n {
+		t.Fatalf("decoded %v at %v Hz, %v samples", name, format.SampleRate, st.Len())
+	}
+	// Both loop points are inside frames, so each loop has to seek to a
+	// frame start and decode forward to the exact sample
+	sl := newStreamLooper(st, 3, loopstart, loopend, 0)
+	var got []int
+	buf := make([][2]float64, 700)
+	for {
+		n, ok := sl.Stream(buf)
+		for _, v := range buf[:n] {
+			got = append(got, int(math.Round(v[0]*32768)))
+		}
+		if !ok || n == 0 {
+			break
+		}
+	}
+	if err := sl.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != loopstart+3*(loopend-loopstart) {
+		t.Errorf("streamed %v samples, want %v", len(got), loopstart+3*(loopend-loopstart))
+	}
+	want := runs([2]int{0, loopend}, [2]int{loopstart, loopend}, [2]int{loopstart, loopend})
+	if !equalInts(got, want) {
+		for i := range got {
+			if i >= len(want) || got[i] != want[i] {
+				t.Errorf("sample %v is %v, want the one from %v", i, got[i], want[i])
+				break
+			}
+		}
+	}
+}
+
+// Writes a mono 16-bit WAV file of n samples, sample i being i, and returns
+// its path.
+func writeTestWav(t *testing.T, n int, rate int) string {
+	buf := []byte("RIFF")
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(36+2*n))
+	buf = append(buf, "WAVEfmt "...)
+	buf = binary.LittleEndian.AppendUint32(buf, 16)
+	buf = binary.LittleEndian.AppendUint16(buf, 1) // PCM
+	buf = binary.LittleEndian.AppendUint16(buf, 1) // mono
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(rate))
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(2*rate))
+	buf = binary.LittleEndian.AppendUint16(buf, 2)
+	buf = binary.LittleEndian.AppendUint16(buf, 16)
+	buf = append(buf, "data"...)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(2*n))
+	for i := 0; i < n; i++ {
+		buf = binary.LittleEndian.AppendUint16(buf, uint16(i))
+	}
+	path := filepath.Join(t.TempDir(), "test.wav")
+	if err := os.WriteFile(path, buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestBgmLoopSecondsAt22050(t *testing.T) {
+	bgm := setTestBgm(t)
+	// One second at 22.05 kHz, looping from 0.25 s to 0.5 s
+	bgm.OpenStage(&Stage{bgmusic: writeTestWav(t, 22050, 22050), bgmvolume: 100, bgmfreqmul: 1,
+		bgmloopstartsec: 0.25, bgmloopendsec: 0.5}, 0)
+	waitBgmLoaded(t, bgm)
+	bgm.Tick()
+	defer bgm.Stop(0)
+	if bgm.fader == nil {
+		t.Fatal("music didn't start")
+	}
+	// Loop points are in samples of the file, at its own rate
+	sl := bgm.volctrl.Streamer.(*StreamLooper)
+	if sl.loopstart != 5513 || sl.loopend != 11025 {
+		t.Errorf("loop = %v-%v, want 5513-11025", sl.loopstart, sl.loopend)
+	}
+	// And the loop is heard at the same time at the output rate: the ramp
+	// drops back at 0.5 s, then every 0.25 s
+	out := make([][2]float64, audioFrequency)
+	for n := 0; n < len(out); {
+		sn, ok := bgm.fader.Stream(out[n:])
+		if !ok {
+			t.Fatal("music ended")
+		}
+		n += sn
+	}
+	var drops []int
+	for i := 1; i < len(out); i++ {
+		// the resampler spreads a drop over two samples
+		if out[i][0] < out[i-1][0]*0.8 && (len(drops) == 0 || drops[len(drops)-1] < i-1) {
+			drops = append(drops, i)
+		}
+	}
+	want := []int{audioFrequency / 2, audioFrequency * 3 / 4, audioFrequency}
+	if len(drops) != len(want) {
+		t.Fatalf("loops heard at %v, want %v", drops, want)
+	}
+	for i := range want {
+		// up to a few samples off, from rounding the loop points to file
+		// samples and from the resampler
+		if drops[i] < want[i]-4 || drops[i] > want[i]+4 {
+			t.Errorf("loop %v heard at %v, want %v", i, drops[i], want[i])
+		}
+	}
+}
+
+func TestBgmSeekSeconds(t *testing.T) {
+	bgm := setTestBgm(t)
+	// Two seconds at 44.1 kHz, starting half a second in
+	bgm.OpenSeconds(writeTestWav(t, 88200, 44100), 1, 100, 0, 0, 0.5, 1, 0)
+	waitBgmLoaded(t, bgm)
+	bgm.Tick()
+	defer bgm.Stop(0)
+	if bgm.streamer == nil {
+		t.Fatal("music didn't start")
+	}
+	if p := bgm.streamer.Position(); p != 22050 {
+		t.Errorf("started at %v, want 22050", p)
+	}
+	for _, tc := range []struct {
+		t    float64
+		want int
+	}{
+		{1, 44100},
+		{0.25, 11025},
+		{5, 88200},
+		{-1, 0},
+	} {
+		bgm.SeekSeconds(tc.t)
+		if p := bgm.streamer.Position(); p != tc.want {
+			t.Errorf("SeekSeconds(%v) went to %v, want %v", tc.t, p, tc.want)
+		}
+	}
+}
+
+func TestBgmResume(t *testing.T) {
+	bgm := setTestBgm(t)
+	defer bgm.Stop(0)
+	stage, jingle, other := writeTestWav(t, 48000, 48000), writeTestWav(t, 4800, 48000), writeTestWav(t, 4800, 48000)
+	started := func(open func()) int {
+		open()
+		waitBgmLoaded(t, bgm)
+		bgm.Tick()
+		if bgm.streamer == nil {
+			t.Fatal("music didn't start")
+		}
+		return bgm.streamer.Position()
+	}
+	play := func(filename string) func() {
+		return func() { bgm.Open(filename, 1, 100, 0, 0, 0, 1, 0) }
+	}
+	resume := func(filename string) func() {
+		return func() { bgm.Resume(filename, 1, 100, 0, 0, 1, 0) }
+	}
+	for _, tc := range []struct {
+		name  string
+		after []func() // opened between saving the stage music and resuming it
+		want  int
+	}{
+		{"after a jingle", []func(){play(jingle)}, 12000},
+		{"after a jingle resumed", []func(){resume(jingle)}, 12000},
+		{"after two tracks", []func(){play(jingle), play(other)}, 0},
+		{"after stems", []func(){play(jingle), func() { bgm.OpenStems([]string{other}, nil, 1, 100, 0, 0, 0, 1, 0) }}, 0},
+	} {
+		started(play(stage))
+		bgm.Seek(12000)
+		bgm.SavePosition()
+		for _, open := range tc.after {
+			started(open)
+		}
+		if p := started(resume(stage)); p != tc.want {
+			t.Errorf("%v: resumed at %v, want %v", tc.name, p, tc.want)
+		}
+	}
+	// The saved position is used up by resuming
+	started(play(jingle))
+	if p := started(resume(stage)); p != 0 {
+		t.Errorf("resumed twice, at %v", p)
+	}
+}
+
+// The music fades out as the round is decided and keeps playing silently,
+// then fades back in at the next round, carrying on or restarting. Music
+// already back at full volume is left alone.
+func TestRoundBgmFade(t *testing.T) {
+	setTestBgm(t)
+	bgm, ro, round, reset := sys.bgm, sys.lifebar.ro, sys.round, sys.roundResetFlg
+	t.Cleanup(func() {
+		sys.bgm, sys.lifebar.ro, sys.round, sys.roundResetFlg = bgm, ro, round, reset
+		sys.bgmRoundFaded = false
+	})
+	buf := make([][2]float64, ticksToSamples(1))
+	// Streams the given number of ticks of music
+	play := func(ticks int) {
+		for i := 0; i < ticks; i++ {
+			sys.bgm.fader.Stream(buf)
+		}
+	}
+	for _, tc := range []struct {
+		name     string
+		restart  bool
+		reopened bool // brought back to full volume by another screen
+	}{
+		{"carry on", false, false},
+		{"restart", true, false},
+		{"reopened", false, true},
+	} {
+		sys.bgm = *newBgm()
+		sys.lifebar.ro = &LifeBarRound{bgm_fadeout_time: 10, bgm_fadein_time: 20, bgm_restart: tc.restart}
+		sys.round, sys.roundResetFlg, sys.bgmRoundFaded = 1, false, false
+		st := &testStreamer{length: 1 << 20}
+		sys.bgm.stop("test", 1, 100, 1, 0)
+		sys.bgm.load(bgmLoad{startPosition: 100}, func(ld *bgmLoad) error {
+			ld.streamer, ld.sampleRate = st, 48000
+			return nil
+		})
+		waitBgmLoaded(t, &sys.bgm)
+		sys.bgm.Tick()
+		play(30)
+		sys.fadeRoundBgm()
+		play(10)
+		// Asked again as the round ends, the fade doesn't start over
+		sys.fadeRoundBgm()
+		if f := sys.bgm.fader; f.gain != 0 || f.target != 0 {
+			t.Errorf("%v: gain %v, target %v after the fade out, want 0", tc.name, f.gain, f.target)
+		}
+		play(20)
+		if tc.reopened {
+			sys.bgm.fader.gain, sys.bgm.fader.target = 1, 1
+		}
+		sys.round = 2
+		sys.startRoundBgm()
+		// Still played while faded out, the resampler reading a little
+		// ahead, unless restarted
+		if played := 100 + 60*ticksToSamples(1); tc.restart && st.pos != 100 || !tc.restart && st.pos < played {
+			t.Errorf("%v: position %v at the next round, played up to %v", tc.name, st.pos, played)
+		}
+		if g := sys.bgm.fader.gain; tc.reopened && g != 1 {
+			t.Errorf("%v: gain %v, want the music left at 1", tc.name, g)
+		}
+		play(20)
+		if f := sys.bgm.fader; f.gain != 1 || f.target != 1 {
+			t.Errorf("%v: gain %v, target %v after the fade in, want 1", tc.name, f.gain, f.target)
+		}
+		if sys.bgmRoundFaded {
+			t.Errorf("%v: still marked faded", tc.name)
+		}
+	}
+}
+
+// Appends a RIFF chunk to buf, padded to an even size.
+func appendChunk(buf []byte, id string, data []byte) []byte {
+	buf = append(buf, id...)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(data)))
+	buf = append(buf, data...)
+	if len(data)&1 != 0 {
+		buf = append(buf, 0)
+	}
+	return buf
+}
+
+// Returns a WAV file at 8 kHz with the given fmt fields and data chunk,
+// with extra chunks, such as fact, between the two.
+func testWavData(tag, channels, blockAlign, bits int, ext, body []byte, extra ...[]byte) []byte {
+	f := binary.LittleEndian.AppendUint16(nil, uint16(tag))
+	f = binary.LittleEndian.AppendUint16(f, uint16(channels))
+	f = binary.LittleEndian.AppendUint32(f, 8000)
+	f = binary.LittleEndian.AppendUint32(f, uint32(8000*blockAlign))
+	f = binary.LittleEndian.AppendUint16(f, uint16(blockAlign))
+	f = binary.LittleEndian.AppendUint16(f, uint16(bits))
+	if ext != nil {
+		f = binary.LittleEndian.AppendUint16(f, uint16(len(ext)))
+		f = append(f, ext...)
+	}
+	buf := appendChunk([]byte("RIFF\x00\x00\x00\x00WAVE"), "fmt ", f)
+	for _, c := range extra {
+		buf = append(buf, c...)
+	}
+	buf = appendChunk(buf, "data", body)
+	binary.LittleEndian.PutUint32(buf[4:], uint32(len(buf)-8))
+	return buf
+}
+
+// Returns an SND file holding the given sounds as 1,0, 1,1 and so on.
+func testSndData(sounds ...[]byte) []byte {
+	buf := []byte("ElecbyteSnd\x00")
+	buf = binary.LittleEndian.AppendUint16(buf, 0)
+	buf = binary.LittleEndian.AppendUint16(buf, 1)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(sounds)))
+	buf = binary.LittleEndian.AppendUint32(buf, 24)
+	for i, data := range sounds {
+		next := len(buf) + 16 + len(data)
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(next))
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(len(data)))
+		buf = binary.LittleEndian.AppendUint32(buf, 1)
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(i))
+		buf = append(buf, data...)
+	}
+	return buf
+}
+
+// An SND read from memory, or from inside a zip, loads the same sounds as
+// the file.
+func TestLoadSndFrom(t *testing.T) {
+	threshold := sys.soundStreamThreshold
+	sys.soundStreamThreshold = 0
+	t.Cleanup(func() {
+		sys.soundStreamThreshold = threshold
+		clearSharedSounds()
+	})
+	var sounds [][]byte
+	for i := 0; i < 3; i++ {
+		sounds = append(sounds, testWavData(wavFormatPCM, 1, 1, 8, nil, bytes.Repeat([]byte{byte(i)}, 10+i)))
+	}
+	data := testSndData(sounds...)
+	filename := filepath.Join(t.TempDir(), "test.snd")
+	if err := os.WriteFile(filename, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	want, err := LoadSnd(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Stored, not compressed, so that the entry can be read in place
+	var zbuf bytes.Buffer
+	zw := zip.NewWriter(&zbuf)
+	w, err := zw.CreateHeader(&zip.FileHeader{Name: "chars/test/test.snd", Method: zip.Store})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(data)
+	zw.Close()
+	zr, err := zip.NewReader(bytes.NewReader(zbuf.Bytes()), int64(zbuf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	offset, err := zr.File[0].DataOffset()
+	if err != nil {
+		t.Fatal(err)
+	}
+	all := func([2]int32) bool { return true }
+	for _, tc := range []struct {
+		name string
+		r    io.ReaderAt
+	}{
+		{"bytes", bytes.NewReader(data)},
+		{"zip", io.NewSectionReader(bytes.NewReader(zbuf.Bytes()), offset, int64(len(data)))},
+	} {
+		// Not the sounds the file load shared
+		clearSharedSounds()
+		snd, err := LoadSndFilteredFrom(tc.r, "test.snd", all, 0)
+		if err != nil {
+			t.Errorf("%v: %v", tc.name, err)
+			continue
+		}
+		if len(snd.table) != len(want.table) || len(snd.table) != len(sounds) {
+			t.Errorf("%v: loaded %v sounds, the file %v", tc.name, len(snd.table), len(want.table))
+		}
+		for gn, w := range want.table {
+			if s := snd.Get(gn); s == nil || !bytes.Equal(s.wavData, w.wavData) || s.length != w.length {
+				t.Errorf("%v: sound %v,%v differs from the file's", tc.name, gn[0], gn[1])
+			}
+		}
+	}
+}
+
+// An SND built from a folder loads back with the same sounds, under the
+// group and number of their file names.
+func TestBuildSnd(t *testing.T) {
+	out := sys.errLog.Writer()
+	sys.errLog.SetOutput(io.Discard)
+	t.Cleanup(func() {
+		sys.errLog.SetOutput(out)
+		clearSharedSounds()
+	})
+	dir := t.TempDir()
+	want := make(map[[2]int32][]byte)
+	for i, gn := range [][2]int32{{1, 0}, {1, 1}, {20, 5}} {
+		// Odd sizes, to check the sub-header offsets
+		data := testWavData(wavFormatPCM, 1, 1, 8, nil, bytes.Repeat([]byte{byte(i)}, 5+i*2))
+		want[gn] = data
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("%v-%v.wav", gn[0], gn[1])), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, data := range map[string][]byte{
+		"notes.txt": []byte("not a sound"),
+		"voice.wav": want[[2]int32{1, 0}],
+		"01-2.wav":  want[[2]int32{1, 0}],
+		"2-0.wav":   []byte("RIFF, but not really"),
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	filename := filepath.Join(t.TempDir(), "test.snd")
+	skipped, err := BuildSnd(dir, filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(skipped)
+	if len(skipped) != 3 || skipped[0] != "01-2.wav" || skipped[1] != "2-0.wav" || skipped[2] != "voice.wav" {
+		t.Errorf("skipped %v", skipped)
+	}
+	snd, err := LoadSnd(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snd.table) != len(want) {
+		t.Errorf("loaded %v sounds, want %v", len(snd.table), len(want))
+	}
+	for gn, data := range want {
+		if s := snd.Get(gn); s == nil || !bytes.Equal(s.wavData, data) {
+			t.Errorf("sound %v,%v didn't load back as it was", gn[0], gn[1])
+		}
+	}
+}
+
+// Each sound of an SND comes out as its own file, byte for byte as stored
+// in the SND, whether it was loaded in memory or left to stream. Corrupted
+// entries are skipped.
+func TestDumpSnd(t *testing.T) {
+	out, threshold := sys.errLog.Writer(), sys.soundStreamThreshold
+	sys.errLog.SetOutput(io.Discard)
+	t.Cleanup(func() {
+		sys.errLog.SetOutput(out)
+		sys.soundStreamThreshold = threshold
+		clearSharedSounds()
+	})
+	var sounds [][]byte
+	for i := 0; i < 3; i++ {
+		// Odd sizes, to check the sub-file offsets
+		sounds = append(sounds, testWavData(wavFormatPCM, 1, 1, 8, nil, bytes.Repeat([]byte{byte(i)}, 5+i*40)))
+	}
+	sounds = append(sounds, []byte("RIFF, but not really"))
+	filename := filepath.Join(t.TempDir(), "test.snd")
+	if err := os.WriteFile(filename, testSndData(sounds...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name      string
+		threshold uint32
+	}{
+		{"in memory", 0},
+		{"streamed", 64},
+	} {
+		clearSharedSounds()
+		sys.soundStreamThreshold = tc.threshold
+		dir := filepath.Join(t.TempDir(), "out")
+		skipped, err := DumpSnd(filename, dir)
+		if err != nil {
+			t.Errorf("%v: %v", tc.name, err)
+			continue
+		}
+		if len(skipped) != 1 || skipped[0] != [2]int32{1, 3} {
+			t.Errorf("%v: skipped %v, want [[1 3]]", tc.name, skipped)
+		}
+		for i, data := range sounds[:3] {
+			got, err := os.ReadFile(filepath.Join(dir, fmt.Sprintf("1-%v.wav", i)))
+			if err != nil {
+				t.Errorf("%v: %v", tc.name, err)
+			} else if !bytes.Equal(got, data) {
+				t.Errorf("%v: sound 1,%v differs from the SND's", tc.name, i)
+			}
+		}
+		if files, _ := os.ReadDir(dir); len(files) != 3 {
+			t.Errorf("%v: wrote %v files, want 3", tc.name, len(files))
+		}
+	}
+}
+
+// A 60 byte WAV of 8 samples, well under the 128 bytes that used to be
+// required, loads and plays, and one with no samples loads as silence.
+func TestSndSmallWav(t *testing.T) {
+	setTestSoundChannels(t)
+	out, rows, text := sys.errLog.Writer(), sys.consoleRows, sys.consoleText
+	sys.errLog.SetOutput(io.Discard)
+	sys.consoleRows, sys.consoleText = 10, nil
+	t.Cleanup(func() {
+		sys.errLog.SetOutput(out)
+		sys.consoleRows, sys.consoleText = rows, text
+		clearSharedSounds()
+	})
+	body := make([]byte, 16)
+	for i := 0; i < 8; i++ {
+		binary.LittleEndian.PutUint16(body[i*2:], uint16(i*1000))
+	}
+	tiny := testWavData(wavFormatPCM, 1, 2, 16, nil, body)
+	if len(tiny) != 60 {
+		t.Fatalf("test WAV is %v bytes", len(tiny))
+	}
+	empty := testWavData(wavFormatPCM, 1, 2, 16, nil, nil)
+	noData := tiny[:36]
+	snd, err := LoadSndFilteredFrom(bytes.NewReader(testSndData(tiny, empty, noData)), "test.snd",
+		func([2]int32) bool { return true }, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := snd.Get([2]int32{1, 0}); s == nil || s.length != 8 {
+		t.Errorf("60 byte WAV loaded as %+v", s)
+	}
+	if s := snd.Get([2]int32{1, 1}); s == nil || s.length != 0 {
+		t.Errorf("empty WAV loaded as %+v", s)
+	}
+	if s := snd.Get([2]int32{1, 2}); s != nil {
+		t.Errorf("WAV without a data chunk loaded")
+	}
+	if len(sys.consoleText) != 0 {
+		t.Errorf("warnings: %q", sys.consoleText)
+	}
+	s := newSoundChannels(1)
+	c := &s.channels[0]
+	c.Play(snd.Get([2]int32{1, 0}), 0, 1, 0, 0, 0, 0)
+	var got []int
+	for _, v := range streamAll(c.sfx.streamer) {
+		got = append(got, int(math.Round(v*32768)))
+	}
+	if want := []int{0, 1000, 2000, 3000, 4000, 5000, 6000, 7000}; !equalInts(got, want) {
+		t.Errorf("played %v, want %v", got, want)
+	}
+	c = &newSoundChannels(1).channels[0]
+	c.Play(snd.Get([2]int32{1, 1}), 0, 1, 0, 0, 0, 0)
+	if c.IsPlaying() {
+		t.Errorf("empty WAV is playing")
+	}
+}
+
+// Chunk sizes past the end of the file, as streamed WAVs write for data,
+// are cut to what is there instead of overflowing.
+func TestReadWavChunksOversized(t *testing.T) {
+	body := []byte{1, 0, 2, 0, 3, 0}
+	for _, size := range []uint32{0xffffffff, 0x80000000, 0x7fffffff, 100} {
+		data := testWavData(wavFormatPCM, 1, 2, 16, nil, body)
+		binary.LittleEndian.PutUint32(data[len(data)-len(body)-4:], size)
+		w, ok := readWavChunks(data)
+		if !ok || !w.hasData || string(w.body) != string(body) {
+			t.Errorf("data size %#x: ok %v, body %v", size, ok, w.body)
+		}
+		if err := checkWavHeader(data); err != nil {
+			t.Errorf("data size %#x: %v", size, err)
+		}
+		// The fmt chunk swallows the rest, so there is no data chunk
+		binary.LittleEndian.PutUint32(data[16:], size)
+		if w, ok := readWavChunks(data); !ok || w.hasData {
+			t.Errorf("fmt size %#x: ok %v, data found", size, ok)
+		}
+	}
+	// One malformed sound fails to load on its own, whatever the decoder
+	for _, data := range [][]byte{
+		testWavData(wavFormatIMAADPCM, 1, 8, 4, []byte{9, 0}, []byte{0, 0, 0, 0, 0x12, 0x34, 0x56, 0x78}),
+		testWavData(wavFormatMSADPCM, 1, 8, 4, []byte{4, 0, 0, 0}, []byte{0, 16, 0, 0, 0, 0, 0, 0x12}),
+		testWavData(wavFormatPCM, 1, 4, 32, nil, []byte{0, 0, 0, 0x40}),
+		testWavData(wavFormatFloat, 1, 8, 64, nil, []byte{0, 0, 0, 0, 0, 0, 0xe0, 0x3f}),
+	} {
+		p := bytes.LastIndex(data, []byte("data"))
+		for _, size := range []uint32{0xffffffff, 0x80000000} {
+			binary.LittleEndian.PutUint32(data[p+4:], size)
+			if _, err := readSoundData(data); err != nil {
+				t.Errorf("format %#x, data size %#x: %v", binary.LittleEndian.Uint16(data[20:]), size, err)
+			}
+		}
+	}
+}
+
+// Returns a format 0 MIDI file at 96 ticks per quarter note and 120 bpm,
+// with a CC111 at tick 96 (0.5 s) and the given events at tick 288 (1.5 s).
+func testMidiData(end ...byte) []byte {
+	trk := []byte{0, 0xff, 0x51, 3, 0x07, 0xa1, 0x20, 0x60, 0xb0, 111, 0, 0x81, 0x40, 0x90, 60, 64}
+	trk = append(trk, end...)
+	trk = append(trk, 0, 0xff, 0x2f, 0)
+	buf := []byte("MThd\x00\x00\x00\x06\x00\x00\x00\x01\x00\x60MTrk")
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(trk)))
+	return append(buf, trk...)
+}
+
+func TestMidiLoopMarksMalformed(t *testing.T) {
+	for _, size := range []uint32{0xffffffff, 0x80000000, 1000} {
+		data := testMidiData()
+		binary.BigEndian.PutUint32(data[18:], size)
+		m, err := readMidiLoopMarks(data)
+		if err != nil || m.start != 96 {
+			t.Errorf("track size %#x: start %v, %v", size, m, err)
+		}
+		data = testMidiData()
+		binary.BigEndian.PutUint32(data[4:], size)
+		if _, err := readMidiLoopMarks(data); err == nil {
+			t.Errorf("header size %#x: no error", size)
+		}
+	}
+}
+
+// A loop start with no end loops from there up to the end of the file.
+func TestMidiLoopTags(t *testing.T) {
+	for _, tc := range []struct {
+		name               string
+		end                []byte
+		loopstart, loopend int
+	}{
+		{"cc111 only", nil, 24000, 0},
+		{"loopEnd marker", append([]byte{0, 0xff, 0x06, 7}, "loopEnd"...), 24000, 72000},
+	} {
+		path := filepath.Join(t.TempDir(), "test.mid")
+		if err := os.WriteFile(path, testMidiData(tc.end...), 0644); err != nil {
+			t.Fatal(err)
+		}
+		ld := bgmLoad{format: "midi", sampleRate: 48000, streamer: &testStreamer{length: 96000}}
+		ld.readLoopTags(path)
+		if ld.loopstart != tc.loopstart || ld.loopend != tc.loopend {
+			t.Errorf("%v: loop %v-%v, want %v-%v", tc.name, ld.loopstart, ld.loopend, tc.loopstart, tc.loopend)
+		}
+		sl := newStreamLooper(ld.streamer, -1, ld.loopstart, ld.loopend, 0)
+		want := tc.loopend
+		if want == 0 {
+			want = 96000
+		}
+		if sl.loopstart != tc.loopstart || sl.loopend != want {
+			t.Errorf("%v: looper %v-%v, want %v-%v", tc.name, sl.loopstart, sl.loopend, tc.loopstart, want)
+		}
+	}
+}
+
+// Two stems read through a loop wrap stay sample aligned: with the second
+// stem brought in at 1000 times the first's gain, every output sample is
+// 1001 times its position only if both stems read the same position.
+func TestBgmStemsLoop(t *testing.T) {
+	a, b := &testStreamer{length: 10}, &testStreamer{length: 10}
+	bs := &BgmStems{}
+	bs.add(a, 1)
+	bs.add(b, 0)
+	bgm := &Bgm{streamer: bs, sampleRate: 48000}
+	bgm.SetStemVolume(1, 100000, 0)
+	bgm.SetStemVolume(2, 100, 0) // No such stem
+	sl := newStreamLooper(bs, 3, 2, 6, 0)
+	want := runs([2]int{0, 6}, [2]int{2, 6}, [2]int{2, 6})
+	buf := make([][2]float64, 3) // Not a divisor of the loop, so reads straddle the wrap
+	var got []int
+	for {
+		n, ok := sl.Stream(buf)
+		for _, s := range buf[:n] {
+			if int(s[0])%1001 != 0 {
+				t.Fatalf("stems out of step, sample %v after %v", s[0], got)
+			}
+			got = append(got, int(s[0])/1001)
+		}
+		if !ok || n == 0 {
+			break
+		}
+	}
+	if !equalInts(got, want) {
+		t.Errorf("streamed %v, want %v", got, want)
+	}
+	if a.seeks != 2 || b.seeks != 2 {
+		t.Errorf("seeks %v and %v, want 2 each", a.seeks, b.seeks)
+	}
+	b.length = 8
+	if bs.Len() != 8 {
+		t.Errorf("length %v, want the shortest stem's 8", bs.Len())
+	}
+}
+
+// Returns the start of an Ogg Vorbis file, an identification header and a
+// comment header with the given comments, on a single page.
+func testOggComments(comments ...string) []byte {
+	le32 := func(b []byte, v int) []byte {
+		return binary.LittleEndian.AppendUint32(b, uint32(v))
+	}
+	id := append([]byte("\x01vorbis"), make([]byte, 23)...)
+	com := le32(append([]byte("\x03vorbis"), 0, 0, 0, 0), len(comments))
+	for _, c := range comments {
+		com = append(le32(com, len(c)), c...)
+	}
+	var lacing, body []byte
+	for _, pkt := range [][]byte{id, com} {
+		for n := len(pkt); ; n -= 255 {
+			lacing = append(lacing, byte(Min(int32(n), 255)))
+			if n < 255 {
+				break
+			}
+		}
+		body = append(body, pkt...)
+	}
+	hdr := append([]byte("OggS"), make([]byte, 22)...)
+	return append(append(append(hdr, byte(len(lacing))), lacing...), body...)
+}
+
+func TestReadBgmTags(t *testing.T) {
+	be32 := func(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+	syncsafe := func(v int) []byte {
+		return []byte{byte(v >> 21 & 0x7f), byte(v >> 14 & 0x7f), byte(v >> 7 & 0x7f), byte(v & 0x7f)}
+	}
+	// ID3v2 tag of the given version, its frames given with their headers
+	id3 := func(ver byte, frames ...[]byte) []byte {
+		body := bytes.Join(frames, nil)
+		return append(append([]byte{'I', 'D', '3', ver, 0, 0}, syncsafe(len(body))...), body...)
+	}
+	frame := func(ver byte, id, text string) []byte {
+		size := be32(uint32(1 + len(text)))
+		if ver >= 4 {
+			size = syncsafe(1 + len(text))
+		}
+		return append(append(append([]byte(id), size...), 0, 0, 3), text...)
+	}
+	id3v1 := make([]byte, 128)
+	copy(id3v1, "TAG")
+	copy(id3v1[3:], "Old Title")
+	copy(id3v1[33:], "Old Artist")
+	long := strings.Repeat("a", 200)
+	wav := func(chunks ...[]byte) []byte {
+		body := append([]byte("WAVE"), bytes.Join(chunks, nil)...)
+		return append(append([]byte("RIFF"), binary.LittleEndian.AppendUint32(nil, uint32(len(body)))...), body...)
+	}
+	info := func(fields ...[]byte) []byte {
+		return appendChunk(nil, "LIST", append([]byte("INFO"), bytes.Join(fields, nil)...))
+	}
+	field := func(id, text string) []byte { return appendChunk(nil, id, []byte(text+"\x00")) }
+	// LIST chunk header claiming size, followed by what there is
+	rawList := func(size uint32, rest ...byte) []byte {
+		return append(append([]byte("LIST"), binary.LittleEndian.AppendUint32(nil, size)...), rest...)
+	}
+	flac := func(block []byte) []byte {
+		hdr := []byte{0x84, byte(len(block) >> 16), byte(len(block) >> 8), byte(len(block))}
+		return append(append([]byte("fLaC"), hdr...), block...)
+	}
+	comments := func(count uint32, c ...string) []byte {
+		b := append(binary.LittleEndian.AppendUint32(nil, 1), 'v')
+		b = binary.LittleEndian.AppendUint32(b, count)
+		for _, s := range c {
+			b = append(binary.LittleEndian.AppendUint32(b, uint32(len(s))), s...)
+		}
+		return b
+	}
+	untagged := BgmTags{title: "song"}
+	for _, tc := range []struct {
+		name   string
+		format string
+		data   []byte
+		want   BgmTags
+	}{
+		{"id3v2.3", "mp3", id3(3, frame(3, "TIT2", "Title"), frame(3, "TPE1", "Artist"), frame(3, "TALB", "Album")),
+			BgmTags{"Title", "Artist", "Album"}},
+		{"id3v2.4 syncsafe sizes", "mp3", id3(4, frame(4, "TPE1", long), frame(4, "TIT2", "Title")),
+			BgmTags{"Title", long, ""}},
+		{"id3v2.3 other frames skipped", "mp3", id3(3, frame(3, "APIC", long), frame(3, "TIT2", "Title")),
+			BgmTags{title: "Title"}},
+		{"id3v2 empty frame", "mp3", id3(3, append([]byte("TIT2"), 0, 0, 0, 0, 0, 0)), untagged},
+		{"id3v2 frame past the tag", "mp3",
+			id3(3, frame(3, "TPE1", "Artist"), append([]byte("TIT2"), 0x7f, 0xff, 0xff, 0xff, 0, 0, 3, 'x')),
+			BgmTags{title: "song", artist: "Artist"}},
+		{"id3v2 tag past the file", "mp3", id3(3, frame(3, "TIT2", "Title"))[:20], untagged},
+		{"id3v2 truncated extended header", "mp3", []byte{'I', 'D', '3', 3, 0, 0x40, 0, 0, 0, 10, 0x7f, 0xff, 0xff, 0xff}, untagged},
+		{"id3v1", "mp3", append(make([]byte, 64), id3v1...), BgmTags{title: "Old Title", artist: "Old Artist"}},
+		{"riff info", "wav", wav(appendChunk(nil, "fmt ", make([]byte, 16)),
+			info(field("INAM", "Title"), field("IART", "Artist"), field("IPRD", "Album"))),
+			BgmTags{"Title", "Artist", "Album"}},
+		{"riff info odd field", "wav", wav(info(field("IART", "Od"), field("INAM", "Title"))),
+			BgmTags{title: "Title", artist: "Od"}},
+		{"riff other list first", "wav", wav(appendChunk(nil, "LIST", []byte("adtl")), info(field("INAM", "Title"))),
+			BgmTags{title: "Title"}},
+		{"riff field past the list", "wav", wav(info(append([]byte("INAM"), 0xff, 0xff, 0, 0, 'x', 0))), untagged},
+		{"riff list past the file", "wav", wav(rawList(1000, []byte("INFOINAM\x06\x00\x00\x00Title\x00")...)),
+			BgmTags{title: "Title"}},
+		{"riff list over the limit", "wav", wav(rawList(0xfffffff0, []byte("INFO")...)), untagged},
+		{"riff list too short", "wav", wav(rawList(2, 'I', 'N'), info(field("INAM", "Title"))), BgmTags{title: "Title"}},
+		{"flac", "flac", flac(comments(2, "TITLE=Title", "ARTIST=Artist")), BgmTags{title: "Title", artist: "Artist"}},
+		{"flac comment past the block", "flac", flac(append(comments(1), 0xff, 0xff, 0xff, 0x7f, 'x')), untagged},
+		{"flac comment count past the block", "flac", flac(comments(0xffffffff, "TITLE=Title")), BgmTags{title: "Title"}},
+		{"flac block past the file", "flac", flac(comments(1, "TITLE=Title"))[:12], untagged},
+	} {
+		path := filepath.Join(t.TempDir(), "song."+tc.format)
+		if err := os.WriteFile(path, tc.data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if got := readBgmTags(path, tc.format); got != tc.want {
+			t.Errorf("%v: %+v, want %+v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestVorbisLoopTags(t *testing.T) {
+	for _, tc := range []struct {
+		name               string
+		comments           []string
+		given              int // loop start given by the caller
+		loopstart, loopend int
+	}{
+		{"loop length", []string{"LOOPSTART=4", "LOOPLENGTH=6"}, 0, 4, 10},
+		{"loop end", []string{"LOOPSTART=4", "LOOPEND=12"}, 0, 4, 12},
+		{"lower case", []string{"title=x", "loopstart=4", "looplength=6"}, 0, 4, 10},
+		{"out of range", []string{"LOOPSTART=-3", "LOOPEND=50"}, 0, 0, 20},
+		{"length past the end", []string{"LOOPSTART=8", "LOOPLENGTH=100"}, 0, 8, 20},
+		{"start only", []string{"LOOPSTART=4"}, 0, 0, 0},
+		{"no tags", nil, 0, 0, 0},
+		{"given loop points win", []string{"LOOPSTART=4", "LOOPLENGTH=6"}, 2, 2, 0},
+	} {
+		path := filepath.Join(t.TempDir(), "test.ogg")
+		if err := os.WriteFile(path, testOggComments(tc.comments...), 0644); err != nil {
+			t.Fatal(err)
+		}
+		ld := bgmLoad{format: "ogg", loopstart: tc.given, streamer: &testStreamer{length: 20}}
+		ld.readLoopTags(path)
+		if ld.loopstart != tc.loopstart || ld.loopend != tc.loopend {
+			t.Errorf("%v: loop %v-%v, want %v-%v", tc.name, ld.loopstart, ld.loopend, tc.loopstart, tc.loopend)
+			continue
+		}
+		// Looping twice plays the file up to the loop end, then the loop
+		end := tc.loopend
+		if end == 0 {
+			end = 20
+		}
+		want := runs([2]int{0, end}, [2]int{tc.loopstart, end})
+		sl := newStreamLooper(ld.streamer, 2, ld.loopstart, ld.loopend, 0)
+		if got := streamPositions(sl, len(want)+1); !equalInts(got, want) {
+			t.Errorf("%v: streamed %v, want %v", tc.name, got, want)
+		}
+	}
+}
+
+func TestUnwrapRmid(t *testing.T) {
+	out := sys.errLog.Writer()
+	sys.errLog.SetOutput(io.Discard)
+	defer sys.errLog.SetOutput(out)
+	smf := testMidiData()
+	rmid := func(chunks ...[]byte) []byte {
+		buf := []byte("RIFF\x00\x00\x00\x00RMID")
+		for _, c := range chunks {
+			buf = append(buf, c...)
+		}
+		binary.LittleEndian.PutUint32(buf[4:], uint32(len(buf)-8))
+		return buf
+	}
+	data := appendChunk(nil, "data", smf)
+	// An odd sized chunk, padded, before the data
+	info := appendChunk(nil, "LIST", []byte("INFOx"))
+	sfbk := appendChunk(nil, "RIFF", []byte("sfbk...."))
+	dls := appendChunk(nil, "RIFF", []byte("DLS ...."))
+	for _, tc := range []struct {
+		name      string
+		data      []byte
+		smf, bank []byte
+		err       string
+	}{
+		{"plain midi", smf, smf, nil, ""},
+		{"data only", rmid(data), smf, nil, ""},
+		{"padded chunk first", rmid(info, data), smf, nil, ""},
+		{"embedded soundfont", rmid(data, sfbk), smf, sfbk, ""},
+		{"embedded dls", rmid(dls, data), smf, nil, ""},
+		{"not rmid", []byte("RIFF\x04\x00\x00\x00WAVE"), nil, nil, "RMID"},
+		{"missing data", rmid(info, sfbk), nil, nil, "\"data\""},
+		{"truncated", rmid(info, data[:len(data)-4]), nil, nil, "truncated \"data\""},
+	} {
+		smf, bank, err := unwrapRmid(tc.data)
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%v: error %v, want one naming %v", tc.name, err, tc.err)
+			}
+			continue
+		}
+		if err != nil || !bytes.Equal(smf, tc.smf) || !bytes.Equal(bank, tc.bank) {
+			t.Errorf("%v: %v bytes of midi, %v of soundfont, error %v", tc.name, len(smf), len(bank), err)
+		}
+	}
+	// The loop marks are read from inside the container
+	path := filepath.Join(t.TempDir(), "test.rmi")
+	if err := os.WriteFile(path, rmid(info, data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if ls, _, ok := readMidiLoopPoints(path, 48000); !ok || ls != 24000 {
+		t.Errorf("rmi loop start %v, %v, want 24000", ls, ok)
+	}
+}
+
+// Returns a soundfont with one preset playing one sample of n silent
+// 16-bit samples, and the terminal records every list needs.
+func testSoundFont(n int) []byte {
+	name := func(s string) []byte { return append([]byte(s), make([]byte, 20-len(s))...) }
+	u16 := func(v ...uint16) (b []byte) {
+		for _, x := range v {
+			b = binary.LittleEndian.AppendUint16(b, x)
+		}
+		return
+	}
+	u32 := func(v ...uint32) (b []byte) {
+		for _, x := range v {
+			b = binary.LittleEndian.AppendUint32(b, x)
+		}
+		return
+	}
+	list := func(typ string, chunks ...[]byte) []byte {
+		return appendChunk(nil, "LIST", append([]byte(typ), bytes.Join(chunks, nil)...))
+	}
+	preset := func(s string, bag uint16) []byte { return append(append(name(s), u16(0, 0, bag)...), u32(0, 0, 0)...) }
+	sample := func(s string, end uint32) []byte {
+		return append(append(name(s), u32(0, end, 0, end, 44100)...), append([]byte{60, 0}, u16(0, 1)...)...)
+	}
+	pdta := list("pdta",
+		appendChunk(nil, "phdr", append(preset("test", 0), preset("EOP", 1)...)),
+		appendChunk(nil, "pbag", u16(0, 0, 1, 0)),
+		appendChunk(nil, "pmod", make([]byte, 10)),
+		appendChunk(nil, "pgen", u16(41, 0, 0, 0)), // instrument 0
+		appendChunk(nil, "inst", append(append(name("test"), u16(0)...), append(name("EOI"), u16(1)...)...)),
+		appendChunk(nil, "ibag", u16(0, 0, 1, 0)),
+		appendChunk(nil, "imod", make([]byte, 10)),
+		appendChunk(nil, "igen", u16(53, 0, 0, 0)), // sample 0
+		appendChunk(nil, "shdr", append(sample("test", uint32(n)), sample("EOS", 0)...)))
+	body := append([]byte("sfbk"), list("INFO", appendChunk(nil, "ifil", u16(2, 1)))...)
+	body = append(body, list("sdta", appendChunk(nil, "smpl", make([]byte, 2*n)))...)
+	return appendChunk(nil, "RIFF", append(body, pdta...))
+}
+
+func TestLoadSoundFontCached(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.sf2")
+	if err := os.WriteFile(path, testSoundFont(100), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sf, err := loadSoundFont(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := loadSoundFont(path); again != sf {
+		t.Errorf("soundfont parsed again")
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if changed, _ := loadSoundFont(path); changed == sf {
+		t.Errorf("changed soundfont taken from the cache")
+	}
+}
+
+// Opens a MIDI file with a soundfont of 4M samples, parsing it each time or
+// taking it from the cache after the first open.
+func BenchmarkSoundFontCache(b *testing.B) {
+	dir := b.TempDir()
+	sfPath, midPath := filepath.Join(dir, "test.sf2"), filepath.Join(dir, "test.mid")
+	if err := os.WriteFile(sfPath, testSoundFont(4<<20), 0644); err != nil {
+		b.Fatal(err)
+	}
+	if err := os.WriteFile(midPath, testMidiData(), 0644); err != nil {
+		b.Fatal(err)
+	}
+	abs, _ := filepath.Abs(sfPath)
+	for _, cached := range []bool{false, true} {
+		name := "uncached"
+		if cached {
+			name = "cached"
+		}
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if !cached {
+					soundFontCache.Lock()
+					delete(soundFontCache.fonts, abs)
+					soundFontCache.Unlock()
+				}
+				st, _, _, err := decodeBgm(midPath, sfPath)
+				if err != nil {
+					b.Fatal(err)
+				}
+				st.Close()
+			}
+		})
+	}
+}
+
+// 100 plays in a row of a short 16-bit sound, read through like the mixer
+// does, decoding every play or from the samples cached on the first one.
+func BenchmarkSoundPlayCached(b *testing.B) {
+	quality, wavChannels := sys.sfxResampleQuality, sys.wavChannels
+	sys.sfxResampleQuality, sys.wavChannels = 1, 1
+	b.Cleanup(func() {
+		sys.sfxResampleQuality, sys.wavChannels = quality, wavChannels
+		sys.soundMixer.Clear()
+	})
+	body := make([]byte, 2*4000)
+	for i := 0; i < len(body); i += 2 {
+		binary.LittleEndian.PutUint16(body[i:], uint16(i*64))
+	}
+	data := testWavData(wavFormatPCM, 1, 2, 16, nil, body)
+	for _, cached := range []bool{false, true} {
+		name := "decoder"
+		if cached {
+			name = "cached"
+		}
+		b.Run(name, func(b *testing.B) {
+			snd, err := readSoundData(data)
+			if err != nil {
+				b.Fatal(err)
+			}
+			s := newSoundChannels(1)
+			c := &s.channels[0]
+			buf := make([][2]float64, 512)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				for n := 0; n < 100; n++ {
+					if !cached {
+						snd.pcm, snd.pcmTried = nil, true
+					}
+					c.Play(snd, 0, 1, 0, 0, 0, 0)
+					for {
+						if sn, _ := c.sfx.streamer.Stream(buf); sn == 0 {
+							break
+						}
+					}
+					sys.soundMixer.Clear()
+				}
+			}
+		})
+	}
+}
+
+func TestConvertWav(t *testing.T) {
+	le32 := func(v ...uint32) (b []byte) {
+		for _, x := range v {
+			b = binary.LittleEndian.AppendUint32(b, x)
+		}
+		return b
+	}
+	f32 := func(v ...float32) (b []byte) {
+		for _, x := range v {
+			b = binary.LittleEndian.AppendUint32(b, math.Float32bits(x))
+		}
+		return b
+	}
+	f64 := func(v ...float64) (b []byte) {
+		for _, x := range v {
+			b = binary.LittleEndian.AppendUint64(b, math.Float64bits(x))
+		}
+		return b
+	}
+	for _, tc := range []struct {
+		name                       string
+		tag, channels, align, bits int
+		body                       []byte
+		ok, fails                  bool
+		want                       []int16
+	}{
+		{"32-bit PCM", wavFormatPCM, 1, 4, 32, le32(0x40000000, 0x80000000, 0x7fffffff, 0),
+			true, false, []int16{16384, -32767, 32767, 0}},
+		{"32-bit float", wavFormatFloat, 1, 4, 32, f32(0.25, -0.5, 1.5, -2),
+			true, false, []int16{8192, -16384, 32767, -32767}},
+		{"64-bit float", wavFormatFloat, 1, 8, 64, f64(0.1, -1, 0),
+			true, false, []int16{3277, -32767, 0}},
+		{"stereo float, partial last frame", wavFormatFloat, 2, 8, 32, f32(0.5, -0.5, 0.25),
+			true, false, []int16{16384, -16384}},
+		{"odd block size", wavFormatPCM, 1, 3, 32, le32(0x40000000),
+			true, true, nil},
+		{"block size of another width", wavFormatFloat, 2, 8, 64, f64(0.5, 0.5),
+			true, true, nil},
+		{"A-law", wavFormatALaw, 1, 1, 8, []byte{0x55},
+			true, true, nil},
+		{"16-bit PCM, decoded as is", wavFormatPCM, 1, 2, 16, []byte{1, 0},
+			false, false, nil},
+	} {
+		pcm, ok, err := convertWav(testWavData(tc.tag, tc.channels, tc.align, tc.bits, nil, tc.body))
+		if ok != tc.ok || (err != nil) != tc.fails {
+			t.Errorf("%v: ok %v, error %v", tc.name, ok, err)
+			continue
+		}
+		if !ok || err != nil {
+			continue
+		}
+		w, _ := readWavChunks(pcm)
+		if w.tag != wavFormatPCM || w.bits != 16 || w.channels != tc.channels || w.rate != 8000 {
+			t.Errorf("%v: converted to %+v", tc.name, w)
+		}
+		got := make([]int16, len(w.body)/2)
+		for i := range got {
+			got[i] = int16(binary.LittleEndian.Uint16(w.body[i*2:]))
+		}
+		if len(got) != len(tc.want) {
+			t.Errorf("%v: got %v, want %v", tc.name, got, tc.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tc.want[i] {
+				t.Errorf("%v: got %v, want %v", tc.name, got, tc.want)
+				break
+			}
+		}
+	}
+}
+
+// Expected samples are worked out by hand from the IMA and Microsoft ADPCM
+// step rules.
+func TestDecodeAdpcmWav(t *testing.T) {
+	fact := func(n uint32) []byte {
+		return appendChunk(nil, "fact", binary.LittleEndian.AppendUint32(nil, n))
+	}
+	imaMono := []byte{0, 0, 0, 0, 0x17, 0x80, 0, 0}
+	for _, tc := range []struct {
+		name                 string
+		tag, channels, align int
+		body                 []byte
+		extra                [][]byte
+		want                 []int16
+	}{
+		{"IMA mono", wavFormatIMAADPCM, 1, 8, imaMono, nil,
+			[]int16{0, 11, 17, 18, 17, 18, 19, 20, 21}},
+		{"IMA stereo", wavFormatIMAADPCM, 2, 16,
+			[]byte{100, 0, 0, 0, 0x9c, 0xff, 0, 0, 0x17, 0x80, 0, 0, 0x0f, 0, 0, 0}, nil,
+			[]int16{100, -100, 111, -111, 117, -109, 118, -108, 117, -107, 118, -106,
+				119, -105, 120, -104, 121, -103}},
+		{"IMA mono, fact", wavFormatIMAADPCM, 1, 8, imaMono, [][]byte{fact(5)},
+			[]int16{0, 11, 17, 18, 17}},
+		{"IMA mono, fact past the last block", wavFormatIMAADPCM, 1, 8,
+			append(append([]byte{}, imaMono...), imaMono...), [][]byte{fact(12)},
+			[]int16{0, 11, 17, 18, 17, 18, 19, 20, 21, 0, 11, 17}},
+		{"MS mono", wavFormatMSADPCM, 1, 9, []byte{0, 16, 0, 100, 0, 50, 0, 0x1f, 0x70}, nil,
+			[]int16{50, 100, 116, 100, 212, 212}},
+		{"MS stereo", wavFormatMSADPCM, 2, 16,
+			[]byte{0, 1, 16, 0, 32, 0, 100, 0, 0xec, 0xff, 50, 0, 0xf6, 0xff, 0x12, 0xf0}, nil,
+			[]int16{50, -10, 100, -20, 116, 34, 100, 88}},
+		{"MS mono, fact", wavFormatMSADPCM, 1, 9, []byte{0, 16, 0, 100, 0, 50, 0, 0x1f, 0x70},
+			[][]byte{fact(3)}, []int16{50, 100, 116}},
+	} {
+		ext := []byte{0, 0, 0, 0}
+		pcm, ok, err := decodeAdpcmWav(testWavData(tc.tag, tc.channels, tc.align, 4, ext, tc.body, tc.extra...))
+		if !ok || err != nil {
+			t.Errorf("%v: ok %v, error %v", tc.name, ok, err)
+			continue
+		}
+		w, _ := readWavChunks(pcm)
+		if w.tag != wavFormatPCM || w.bits != 16 || w.channels != tc.channels {
+			t.Errorf("%v: decoded to %+v", tc.name, w)
+		}
+		got := make([]int16, len(w.body)/2)
+		for i := range got {
+			got[i] = int16(binary.LittleEndian.Uint16(w.body[i*2:]))
+		}
+		if len(got) != len(tc.want) {
+			t.Errorf("%v: got %v, want %v", tc.name, got, tc.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tc.want[i] {
+				t.Errorf("%v: got %v, want %v", tc.name, got, tc.want)
+				break
+			}
+		}
+	}
+	if _, ok, err := decodeAdpcmWav(testWavData(wavFormatIMAADPCM, 3, 12, 4, nil, nil)); !ok || err == nil {
+		t.Errorf("3 channels: ok %v, error %v", ok, err)
+	}
+}
+
+func TestAudioRecorderNoFreeName(t *testing.T) {
+	folder := sys.screenshotFolder
+	defer func() { sys.screenshotFolder = folder }()
+	sys.screenshotFolder = t.TempDir() + "/"
+	for i := 0; i < 1000; i++ {
+		path := fmt.Sprintf("%sikemen%03d.wav", sys.screenshotFolder, i)
+		if err := os.WriteFile(path, []byte("take"), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var a AudioRecorder
+	if err := a.Start(); err == nil || a.Recording() {
+		t.Errorf("started with every name taken, error %v", err)
+	}
+	last := fmt.Sprintf("%sikemen%03d.wav", sys.screenshotFolder, 998)
+	if data, _ := os.ReadFile(last); string(data) != "take" {
+		t.Errorf("existing recording was overwritten with %q", data)
+	}
+}
+
+func TestOutputMode(t *testing.T) {
+	left := beep.StreamerFunc(func(samples [][2]float64) (int, bool) {
+		for i := range samples {
+			samples[i] = [2]float64{1, 0}
+		}
+		return len(samples), true
+	})
+	for _, tc := range []struct {
+		name  string
+		mode  AudioOutputMode
+		timed bool
+		want  [2]float64
+	}{
+		{"stereo", AudioStereo, false, [2]float64{1, 0}},
+		{"stereo timed", AudioStereo, true, [2]float64{1, 0}},
+		{"swapped", AudioSwapped, false, [2]float64{0, 1}},
+		{"mono", AudioMono, false, [2]float64{0.5, 0.5}},
+		{"mono timed", AudioMono, true, [2]float64{0.5, 0.5}},
+	} {
+		o := OutputMode{streamer: left, mode: tc.mode, timed: tc.timed}
+		samples := make([][2]float64, 64)
+		if n, ok := o.Stream(samples); n != len(samples) || !ok {
+			t.Errorf("%v: streamed %v, %v", tc.name, n, ok)
+		}
+		for i, s := range samples {
+			if s != tc.want {
+				t.Errorf("%v: sample %v is %v, want %v", tc.name, i, s, tc.want)
+				break
+			}
+		}
+		if o.timed || (o.load > 0) != tc.timed {
+			t.Errorf("%v: timed %v, load %v", tc.name, o.timed, o.load)
+		}
+	}
+}
+
+// Losing focus ramps the output down over focusFadeTicks, and in pause mode
+// pauses the sounds once it's silent. Regaining focus resumes them at once
+// and ramps back up. Netplay always keeps playing.
+func TestFocusLoss(t *testing.T) {
+	setTestSoundChannels(t)
+	focus, mode, volume, channels := sys.audioFocus, sys.focusLossMode, sys.focusLossVolume, sys.soundChannels
+	t.Cleanup(func() {
+		sys.audioFocus, sys.focusLossMode, sys.focusLossVolume, sys.soundChannels = focus, mode, volume, channels
+		sys.focusLost, sys.focusTarget, sys.focusPaused, sys.netInput = false, 1, false, nil
+	})
+	buf := make([][2]float64, ticksToSamples(1))
+	tick := func(n int) {
+		for i := 0; i < n; i++ {
+			sys.tickFocus()
+			sys.audioFocus.Stream(buf)
+		}
+		sys.tickFocus()
+	}
+	for _, tc := range []struct {
+		name   string
+		mode   FocusLossMode
+		net    bool
+		gain   float64
+		paused bool
+	}{
+		{"play", FocusLossPlay, false, 1, false},
+		{"fade", FocusLossFade, false, 0.25, false},
+		{"pause", FocusLossPause, false, 0, true},
+		{"pause in netplay", FocusLossPause, true, 1, false},
+	} {
+		sys.audioFocus = newFader(&testStreamer{length: 1 << 30}, 1)
+		sys.focusLossMode, sys.focusLossVolume = tc.mode, 25
+		sys.focusTarget, sys.focusPaused, sys.netInput = 1, false, nil
+		if tc.net {
+			sys.netInput = &NetInput{}
+		}
+		sys.soundChannels = newSoundChannels(1)
+		c := &sys.soundChannels.channels[0]
+		c.Play(testSound(100), 0, 1, 0, 0, 0, 0)
+		sys.focusLost = true
+		tick(focusFadeTicks - 1)
+		// Still ramping, so nothing is paused yet
+		if c.ctrl.Paused {
+			t.Errorf("%v: paused before the fade is over", tc.name)
+		}
+		tick(1)
+		if g := sys.audioFocus.gain; math.Abs(g-tc.gain) > 1e-9 {
+			t.Errorf("%v: gain %v after losing focus, want %v", tc.name, g, tc.gain)
+		}
+		if c.ctrl.Paused != tc.paused {
+			t.Errorf("%v: paused %v after losing focus, want %v", tc.name, c.ctrl.Paused, tc.paused)
+		}
+		sys.focusLost = false
+		tick(0)
+		if c.ctrl.Paused {
+			t.Errorf("%v: still paused after regaining focus", tc.name)
+		}
+		tick(focusFadeTicks)
+		if g := sys.audioFocus.gain; math.Abs(g-1) > 1e-9 {
+			t.Errorf("%v: gain %v after regaining focus, want 1", tc.name, g)
+		}
+	}
+}
+
+// A full scale 1 kHz tone peaks in the band from 40 Hz * 400^(6/12) to
+// 40 Hz * 400^(7/12), near 0 dBFS. Silence reads 0 everywhere.
+func TestBgmAnalyzer(t *testing.T) {
+	tone := sineBurst(4*bgmAnalysisSize, 1)
+	silence := beep.Silence(-1)
+	a := &BgmAnalyzer{streamer: tone, decay: 0.5}
+	buf := make([][2]float64, 2*bgmAnalysisSize)
+	a.Tick(true)
+	a.Stream(buf)
+	a.Tick(true)
+	peak := 0
+	for b := range a.bands {
+		if a.bands[b] > a.bands[peak] {
+			peak = b
+		}
+	}
+	if peak != 6 || a.bands[peak] < 0.95 {
+		t.Errorf("peak of %v in band %v, want 6: %v", a.bands[peak], peak, a.bands)
+	}
+	// RMS of a full scale sine, -3 dBFS
+	if want := float32(1 - 3.0103/60); math.Abs(float64(a.level-want)) > 0.01 {
+		t.Errorf("tone level %v, want %v", a.level, want)
+	}
+	// Silence after the tone lets the values fall by the decay each tick
+	level, bands := a.level, a.bands
+	a.streamer = silence
+	a.Stream(buf)
+	a.Tick(true)
+	if a.level != level*0.5 || a.bands[peak] != bands[peak]*0.5 {
+		t.Errorf("level %v, peak %v after a tick of silence, want %v, %v", a.level, a.bands[peak], level*0.5, bands[peak]*0.5)
+	}
+	a = &BgmAnalyzer{streamer: silence}
+	a.Tick(true)
+	a.Stream(buf)
+	a.Tick(true)
+	if a.level != 0 || a.bands != [bgmAnalysisBands]float32{} {
+		t.Errorf("silence read as level %v, bands %v", a.level, a.bands)
+	}
+}
+
+// Two seconds of a 1 kHz tone played at half, normal and double speed take
+// twice, the same and half the time, still at 1 kHz.
+func TestTimeStretch(t *testing.T) {
+	n := 2 * audioFrequency
+	for _, speed := range []float64{0.5, 1, 2} {
+		ts := newTimeStretch(sineBurst(n, 0.5), beep.SampleRate(audioFrequency), speed)
+		out := streamAll(ts)
+		want := float64(n) / speed
+		if d := math.Abs(float64(len(out)) - want); d > float64(ts.grain) {
+			t.Errorf("speed %v: %v samples, want %v", speed, len(out), want)
+		}
+		// Rising zero crossings, leaving out the first and last grain
+		mid := out[ts.grain : len(out)-ts.grain]
+		crossings := 0
+		for i := 1; i < len(mid); i++ {
+			if mid[i-1] < 0 && mid[i] >= 0 {
+				crossings++
+			}
+		}
+		if f := float64(crossings) * float64(audioFrequency) / float64(len(mid)); math.Abs(f-1000) > 10 {
+			t.Errorf("speed %v: %.1f Hz, want 1000", speed, f)
+		}
+	}
+	// Normal speed passes the stream through untouched
+	out, want := streamAll(newTimeStretch(sineBurst(1000, 0.5), beep.SampleRate(audioFrequency), 1)), streamAll(sineBurst(1000, 0.5))
+	if fmt.Sprint(out) != fmt.Sprint(want) {
+		t.Errorf("speed 1 changed the stream")
+	}
+}
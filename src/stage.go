@@ -364,7 +364,7 @@ func (bg *backGround) reset() {
 	bg.bga.sintime = bg.startsint
 	bg.bga.sinlooptime = bg.startsinlt
 	bg.palfx.time = -1
-	bg.palfx.invertblend = -3
+	bg.palfx.invertblend = InvertBlendBg
 }
 func (bg backGround) draw(pos [2]float32, scl, bgscl, lclscl float32,
 	stgscl [2]float32, shakeY float32, isStage bool) {
@@ -457,7 +457,7 @@ func (bg backGround) draw(pos [2]float32, scl, bgscl, lclscl float32,
 	if rect[0] < sys.scrrect[2] && rect[1] < sys.scrrect[3] && rect[0]+rect[2] > 0 && rect[1]+rect[3] > 0 {
 		bg.anim.Draw(&rect, x, y, sclx, scly, bg.xscale[0]*bgscl*(bg.scalestart[0]+xs)*xs3, xbs*bgscl*(bg.scalestart[0]+xs)*xs3, ys*ys3,
 			xras*x/(AbsF(ys*ys3)*lscl[1]*float32(bg.anim.spr.Size[1])*bg.scalestart[1])*sclx_recip*bg.scalestart[1],
-			Rotation{}, float32(sys.gameWidth)/2, bg.palfx, true, 1, false, 1, 0, 0)
+			Rotation{}, float32(sys.gameWidth)/2, bg.palfx, -1, true, 1, false, 1, 0, 0)
 	}
 }
 
@@ -589,7 +589,7 @@ func (bgc *bgCtrl) read(is IniSection, idx int) {
 			bgc.color = bgc.color / 256
 		}
 		if is.ReadF32("hue", &bgc.hue) {
-			bgc.hue = bgc.hue / 256
+			bgc.hue = wrapHue(bgc.hue * palFXHueUnit)
 		}
 	} else if is.ReadF32("value", &bgc.x) {
 		is.readI32ForStage("value", &bgc.v[0], &bgc.v[1], &bgc.v[2])
@@ -707,6 +707,8 @@ type stagePlayer struct {
 type Stage struct {
 	def              string
 	bgmusic          string
+	bgmplaylist      []string
+	bgmplaylistmode  BgmPlaylistMode
 	name             string
 	displayname      string
 	author           string
@@ -739,10 +741,14 @@ type Stage struct {
 	bgmloopstart     int32
 	bgmloopend       int32
 	bgmstartposition int32
+	bgmstartseconds  float32
+	bgmloopstartsec  float32
+	bgmloopendsec    float32
 	bgmfreqmul       float32
 	bgmratiolife     int32
 	bgmtriggerlife   int32
 	bgmtriggeralt    int32
+	bgmanalysis      bool
 	mainstage        bool
 	stageCamera      stageCamera
 	stageTime        int32
@@ -937,6 +943,7 @@ func loadStage(def string, main bool) (*Stage, error) {
 		sec[0].ReadF32("boundhighzoomdelta", &s.stageCamera.boundhighzoomdelta)
 		sec[0].ReadF32("verticalfollowzoomdelta", &s.stageCamera.verticalfollowzoomdelta)
 		sec[0].ReadBool("lowestcap", &s.stageCamera.lowestcap)
+		sec[0].ReadF32("panningwidth", &s.stageCamera.panningwidth)
 		if sys.cam.ZoomMax == 0 {
 			sec[0].ReadF32("zoomin", &s.stageCamera.zoomin)
 		} else {
@@ -959,14 +966,28 @@ func loadStage(def string, main bool) (*Stage, error) {
 	s.bgmfreqmul = 1 // fallback value to allow music to play on legacy stages without a bgmfreqmul parameter
 	if sec := defmap["music"]; len(sec) > 0 {
 		s.bgmusic = sec[0]["bgmusic"]
+		if str, ok := sec[0]["bgmplaylist"]; ok {
+			for _, v := range SplitAndTrim(str, ",") {
+				if v != "" {
+					s.bgmplaylist = append(s.bgmplaylist, v)
+				}
+			}
+		}
+		if str, ok := sec[0]["bgmplaylist.mode"]; ok {
+			s.bgmplaylistmode = parseBgmPlaylistMode(str)
+		}
 		sec[0].ReadI32("bgmvolume", &s.bgmvolume)
 		sec[0].ReadI32("bgmloopstart", &s.bgmloopstart)
 		sec[0].ReadI32("bgmloopend", &s.bgmloopend)
 		sec[0].ReadI32("bgmstartposition", &s.bgmstartposition)
+		sec[0].ReadF32("bgmstartseconds", &s.bgmstartseconds)
+		sec[0].ReadF32("bgmloopstartseconds", &s.bgmloopstartsec)
+		sec[0].ReadF32("bgmloopendseconds", &s.bgmloopendsec)
 		sec[0].ReadF32("bgmfreqmul", &s.bgmfreqmul)
 		sec[0].ReadI32("bgmratio.life", &s.bgmratiolife)
 		sec[0].ReadI32("bgmtrigger.life", &s.bgmtriggerlife)
 		sec[0].ReadI32("bgmtrigger.alt", &s.bgmtriggeralt)
+		sec[0].ReadBool("bgmanalysis", &s.bgmanalysis)
 	}
 	if sec := defmap["bgdef"]; len(sec) > 0 {
 		if sec[0].LoadFile("spr", []string{def, "", sys.motifDir, "data/"}, func(filename string) error {
@@ -1208,17 +1229,17 @@ func (s *Stage) runBgCtrl(bgc *bgCtrl) {
 			bgc.bg[i].palfx.sinadd[0] = bgc.sinadd[0]
 			bgc.bg[i].palfx.sinadd[1] = bgc.sinadd[1]
 			bgc.bg[i].palfx.sinadd[2] = bgc.sinadd[2]
-			bgc.bg[i].palfx.cycletime[0] = bgc.sinadd[3]
+			bgc.bg[i].palfx.cycletime[0] = float32(bgc.sinadd[3])
 			bgc.bg[i].palfx.sinmul[0] = bgc.sinmul[0]
 			bgc.bg[i].palfx.sinmul[1] = bgc.sinmul[1]
 			bgc.bg[i].palfx.sinmul[2] = bgc.sinmul[2]
-			bgc.bg[i].palfx.cycletime[1] = bgc.sinmul[3]
+			bgc.bg[i].palfx.cycletime[1] = float32(bgc.sinmul[3])
 			bgc.bg[i].palfx.sincolor = bgc.sincolor[0]
-			bgc.bg[i].palfx.cycletime[2] = bgc.sincolor[1]
+			bgc.bg[i].palfx.cycletime[2] = float32(bgc.sincolor[1])
 			bgc.bg[i].palfx.sinhue = bgc.sinhue[0]
-			bgc.bg[i].palfx.cycletime[3] = bgc.sinhue[1]
+			bgc.bg[i].palfx.cycletime[3] = float32(bgc.sinhue[1])
 			bgc.bg[i].palfx.invertall = bgc.invall
-			bgc.bg[i].palfx.invertblend = bgc.invblend
+			bgc.bg[i].palfx.invertblend = clampInvertBlend(bgc.invblend, InvertBlendBg, InvertBlendSubAdd1)
 			bgc.bg[i].palfx.color = bgc.color
 			bgc.bg[i].palfx.hue = bgc.hue
 		}
@@ -1364,6 +1385,9 @@ func (s *Stage) action() {
 			b.palfx.eMul = sys.bgPalFX.eMul
 			b.palfx.eColor = sys.bgPalFX.eColor
 			b.palfx.eHue = sys.bgPalFX.eHue
+			b.palfx.eContrast = sys.bgPalFX.eContrast
+			b.palfx.eGamma = sys.bgPalFX.eGamma
+			b.palfx.ePosterize = sys.bgPalFX.ePosterize
 			b.palfx.eInvertall = sys.bgPalFX.eInvertall
 			b.palfx.eInvertblend = sys.bgPalFX.eInvertblend
 			b.palfx.eNegType = sys.bgPalFX.eNegType
@@ -1396,6 +1420,9 @@ func (s *Stage) action() {
 			s.model.pfx.eMul = sys.bgPalFX.eMul
 			s.model.pfx.eColor = sys.bgPalFX.eColor
 			s.model.pfx.eHue = sys.bgPalFX.eHue
+			s.model.pfx.eContrast = sys.bgPalFX.eContrast
+			s.model.pfx.eGamma = sys.bgPalFX.eGamma
+			s.model.pfx.ePosterize = sys.bgPalFX.ePosterize
 			s.model.pfx.eInvertall = sys.bgPalFX.eInvertall
 			s.model.pfx.eInvertblend = sys.bgPalFX.eInvertblend
 			s.model.pfx.eNegType = sys.bgPalFX.eNegType
@@ -1573,7 +1600,7 @@ func (s *Stage) modifyBGCtrl(id int32, t, v [3]int32, x, y float32, src, dst [2]
 				s.bgc[i].color = color / 256
 			}
 			if !math.IsNaN(float64(hue)) {
-				s.bgc[i].hue = hue / 256
+				s.bgc[i].hue = wrapHue(hue * palFXHueUnit)
 			}
 			s.reload = true
 		}
@@ -2357,7 +2384,7 @@ func drawNode(mdl *Model, n *Node, proj, view mgl.Mat4, drawBlended bool) {
 		}
 	}
 
-	neg, grayscale, padd, pmul, invblend, hue := mdl.pfx.getFcPalFx(false, -int(n.trans))
+	neg, grayscale, padd, pmul, invblend, hue, contrast, gamma, levels, _ := mdl.pfx.getFcPalFx(false, -int(n.trans), -1)
 
 	blendEq := BlendAdd
 	src := BlendOne
@@ -2458,6 +2485,9 @@ func drawNode(mdl *Model, n *Node, proj, view mgl.Mat4, drawBlended bool) {
 		gfx.SetModelUniformI("neg", int(Btoi(neg)))
 		gfx.SetModelUniformF("hue", hue)
 		gfx.SetModelUniformF("gray", grayscale)
+		gfx.SetModelUniformF("contrast", contrast)
+		gfx.SetModelUniformF("gamma", gamma)
+		gfx.SetModelUniformF("posterize", levels)
 		gfx.SetModelUniformI("enableAlpha", int(Btoi(mat.alphaMode == AlphaModeBlend)))
 		gfx.SetModelUniformF("alphaThreshold", mat.alphaCutoff)
 		gfx.SetModelUniformFv("baseColorFactor", color[:])
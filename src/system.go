@@ -26,8 +26,7 @@ const (
 )
 
 var (
-	FPS           = 60
-	Mp3SampleRate = 44100
+	FPS = 60
 )
 
 // sys
@@ -70,7 +69,6 @@ var sys = System{
 	cam:              *newCamera(),
 	statusDraw:       true,
 	mainThreadTask:   make(chan func(), 65536),
-	workpal:          make([]uint32, 256),
 	errLog:           log.New(NewLogWriter(), "", log.LstdFlags),
 	keyInput:         KeyUnknown,
 	wavChannels:      256,
@@ -122,8 +120,10 @@ type System struct {
 	debugRef                [2]int // player number, helper index
 	soundMixer              *beep.Mixer
 	bgm                     Bgm
+	bgmSlots                [BgmSlots - 1]Bgm // music slots after bgm
 	soundChannels           *SoundChannels
 	allPalFX, bgPalFX       PalFX
+	teamPalFX               [2]PalFX
 	lifebar                 Lifebar
 	ffx                     map[string]*FightFx
 	ffxRegexp               string
@@ -261,7 +261,7 @@ type System struct {
 	statusDraw              bool
 	mainThreadTask          chan func()
 	explodMax               int
-	workpal                 []uint32
+	palfxPresets            map[string]PalFXDef
 	playerProjectileMax     int
 	errLog                  *log.Logger
 	nomusic                 bool
@@ -279,6 +279,8 @@ type System struct {
 	masterVolume            int
 	wavVolume               int
 	bgmVolume               int
+	bgmCrossfade            int
+	bgmRoundFaded           bool // see fadeRoundBgm
 	audioDucking            bool
 	windowTitle             string
 	screenshotFolder        string
@@ -320,6 +322,7 @@ type System struct {
 	postProcessingShader    int32
 	multisampleAntialiasing bool
 	fontShaderVer           uint
+	palFXLUT                bool
 
 	// External Shader Vars
 	externalShaderList  []string
@@ -378,6 +381,63 @@ type System struct {
 	loopBreak         bool
 	loopContinue      bool
 
+	// SND entries above this many bytes are streamed from disk, 0 to disable
+	soundStreamThreshold uint32
+	// Levels sounds are normalized to as they're first played, in dBFS
+	soundNormalize       SoundNormalize
+	soundNormalizeTarget float32
+	// Sound channel pool usage since the last resetSoundStats, shown by the
+	// debug overlay
+	soundPlaysRequested uint32
+	soundPlaysRejected  uint32 // channel taken by a higher priority sound
+	soundPlaysDropped   uint32 // no channel left to play on
+	soundChannelsStolen uint32
+	soundDebugDraw      bool
+	// Volume percentage of each player's sounds, on top of wavVolume
+	playerVolume [MaxSimul*2 + MaxAttachedChar]int32
+	bgmDucker    BgmDucker
+	// Crossfade at BGM loop points in ms, 0 to disable
+	bgmLoopCrossfade int32
+	// Quality of the resampling of music and sound effects, from 1 to 4.
+	// Higher is cleaner but slower, and only applies to what starts playing.
+	bgmResampleQuality int
+	sfxResampleQuality int
+	replayGainMode     ReplayGainMode
+	volumeCurve        VolumeCurve
+	// Whether freqmul changes of the music keep its pitch by default
+	bgmTimeStretch bool
+	// Output limiter settings, in dBFS and ms. The old Normalizer is used
+	// instead when audioNormalizer is set. audioDucking works with either, but
+	// the limiter does its ducking itself and runs without the Normalizer.
+	audioNormalizer  bool
+	limiterCeiling   float32
+	limiterLookahead float32
+	limiterRelease   float32
+	audioLimiter     *Limiter // nil when the Normalizer is used
+	// Applied to the sound output before the limiter
+	audioEq Equalizer
+	// Sound output chain, played on the default device. Music and sound effects meet in audioMix, the music mixed in bgmMix
+	// first for bgmAnalyzer.
+	audioOut        beep.Streamer
+	audioMix        beep.Mixer
+	bgmMix          beep.Mixer
+	bgmAnalyzer     BgmAnalyzer
+	bgmAnalysis     bool // set from Lua, stages can also ask for it
+	audioRecorder   AudioRecorder
+	audioOutputMode OutputMode
+	// Counts the sound effect samples mixed, and the sample the sounds played
+	// this tick are due at, see soundStart
+	soundClock  SoundClock
+	soundTickAt int64
+	// Ramps the output down while the window is in the background, after the
+	// recorder so that recordings aren't affected
+	audioFocus      *Fader
+	focusLossMode   FocusLossMode
+	focusLossVolume int     // percent, for FocusLossFade
+	focusLost       bool    // set by the window focus callback
+	focusTarget     float64 // gain audioFocus is ramping to
+	focusPaused     bool
+
 	// for avg. FPS calculations
 	gameFPS       float32
 	prevTimestamp float64
@@ -434,8 +494,28 @@ func (s *System) init(w, h int32) *lua.LState {
 	gfx.Init()
 	gfx.BeginFrame(false)
 	// And the audio.
-	speaker.Init(audioFrequency, audioOutLen)
-	speaker.Play(NewNormalizer(s.soundMixer))
+	s.soundClock.streamer = s.soundMixer
+	s.audioEq.streamer = &s.soundClock
+	if s.audioNormalizer {
+		s.audioMix.Add(NewNormalizer(&s.audioEq))
+	} else {
+		s.audioLimiter = NewLimiter(&s.audioEq, s.limiterCeiling, s.limiterLookahead, s.limiterRelease)
+		s.audioMix.Add(s.audioLimiter)
+	}
+	s.bgmAnalyzer.streamer = &s.bgmMix
+	s.audioMix.Add(&s.bgmAnalyzer)
+	s.audioRecorder.streamer = &s.audioMix
+	s.audioFocus = newFader(&s.audioRecorder, 1)
+	s.focusTarget = 1
+	s.audioOutputMode.streamer = s.audioFocus
+	s.audioOut = &s.audioOutputMode
+	ReinitAudio()
+	for i := range s.playerVolume {
+		s.playerVolume[i] = 100
+	}
+	for i := range s.bgmSlots {
+		s.bgmSlots[i] = *newBgm()
+	}
 	l := lua.NewState()
 	l.Options.IncludeGoStackTrace = true
 	l.OpenLibs()
@@ -489,6 +569,7 @@ func (s *System) shutdown() {
 	}
 	gfx.Close()
 	s.window.Close()
+	s.audioRecorder.Stop()
 	speaker.Close()
 }
 func (s *System) setWindowSize(w, h int32) {
@@ -575,6 +656,10 @@ func (s *System) update() bool {
 	return s.await(FPS)
 }
 func (s *System) tickSound() {
+	// The next tick starts now
+	speaker.Lock()
+	s.soundTickAt = s.soundClock.now() + audioOutLen
+	speaker.Unlock()
 	s.soundChannels.Tick()
 	if !s.noSoundFlg {
 		for _, ch := range s.chars {
@@ -584,22 +669,26 @@ func (s *System) tickSound() {
 		}
 	}
 
-	// Always pause if noMusic flag set or pause master volume is 0.
-	s.bgm.SetPaused(s.nomusic || (s.paused && s.pauseMasterVolume == 0))
-
-	// Set BGM volume if paused
-	if s.paused && s.bgm.volRestore == 0 {
-		s.bgm.volRestore = s.bgm.bgmVolume
-		s.bgm.bgmVolume = int(s.pauseMasterVolume * s.bgm.bgmVolume / 100.0)
-		s.bgm.UpdateVolume()
-		s.softenAllSound()
-	} else if !s.paused && s.bgm.volRestore > 0 {
-		// Restore all volume
-		s.bgm.bgmVolume = s.bgm.volRestore
-		s.bgm.volRestore = 0
-		s.bgm.UpdateVolume()
-		s.restoreAllVolume()
+	s.tickFocus()
+	s.eachBgm(func(bgm *Bgm) {
+		bgm.Tick()
+		bgm.tickGlide()
+		// Always pause if noMusic flag set or pause master volume is 0.
+		bgm.SetPaused(s.nomusic || (s.paused && s.pauseMasterVolume == 0) || s.focusPaused)
+	})
+	s.bgmDucker.Tick()
+	s.bgmAnalyzer.Tick(s.bgmAnalysis || s.stage != nil && s.stage.bgmanalysis)
+
+	// Lower the volume while paused, the BGM fading over a few ticks
+	if s.paused != s.bgm.pausing {
+		s.eachBgm(func(bgm *Bgm) { bgm.pausing = s.paused })
+		if s.paused {
+			s.softenAllSound()
+		} else {
+			s.restoreAllVolume()
+		}
 	}
+	s.eachBgm(func(bgm *Bgm) { bgm.tickPause(s.pauseMasterVolume) })
 
 	//if s.FLAC_FrameWait >= 0 {
 	//	if s.FLAC_FrameWait == 0 {
@@ -687,7 +776,7 @@ func (s *System) palfxvar(x int32, y int32) int32 {
 	if pfx.enable {
 		switch x {
 		case -2:
-			n = pfx.eInvertblend
+			n = int32(pfx.eInvertblend)
 		case -1:
 			n = Btoi(pfx.eInvertall)
 		case 0:
@@ -724,7 +813,8 @@ func (s *System) palfxvar2(x int32, y int32) float32 {
 		case 1:
 			n = pfx.eColor
 		case 2:
-			n = pfx.eHue
+			// Reported in the legacy scale, 256 being half a turn
+			n = pfx.eHue / 180
 		default:
 			n = 0
 		}
@@ -877,9 +967,136 @@ func (s *System) resetGblEffect() {
 func (s *System) stopAllSound() {
 	for _, p := range s.chars {
 		for _, c := range p {
-			c.soundChannels.SetSize(0)
+			c.soundChannels.Clear()
+		}
+	}
+}
+
+// Returns a music slot, 0 being bgm, or nil if there's no such slot.
+func (s *System) bgmSlot(slot int) *Bgm {
+	if slot == 0 {
+		return &s.bgm
+	}
+	if slot < 0 || slot >= BgmSlots {
+		return nil
+	}
+	return &s.bgmSlots[slot-1]
+}
+
+// Calls f on every music slot.
+func (s *System) eachBgm(f func(bgm *Bgm)) {
+	f(&s.bgm)
+	for i := range s.bgmSlots {
+		f(&s.bgmSlots[i])
+	}
+}
+
+// Fades the music out as the round is decided, if the lifebar asks for it.
+// The music keeps playing silently for startRoundBgm to bring back, even
+// across the screens between matches, such as in survival.
+func (s *System) fadeRoundBgm() {
+	if t := s.lifebar.ro.bgm_fadeout_time; t > 0 && !s.bgmRoundFaded {
+		s.eachBgm(func(bgm *Bgm) { bgm.FadeOut(int(t), false) })
+		s.bgmRoundFaded = true
+	}
+}
+
+// Brings the music faded by fadeRoundBgm back as a round starts, restarting
+// it from its start position first if the lifebar asks for it. Music still
+// loading fades in as it starts, while music already playing at full volume,
+// opened by another screen in the meantime, is left as is.
+func (s *System) startRoundBgm() {
+	s.eachBgm(func(bgm *Bgm) {
+		if bgm.filename == "" {
+			return
+		}
+		if s.round > 1 && !s.roundResetFlg && s.lifebar.ro.bgm_restart {
+			bgm.Seek(bgm.startPos)
+		}
+		if s.bgmRoundFaded && (bgm.fader == nil || bgm.fader.target < 1) {
+			bgm.FadeIn(int(s.lifebar.ro.bgm_fadein_time))
+		}
+	})
+	s.bgmRoundFaded = false
+}
+
+// Crossfades between two music slots over the given number of ticks. The
+// slot faded out is stopped, and its music released once the fade ends.
+func (s *System) crossfadeBgm(from, to, ticks int) {
+	if from == to {
+		return
+	}
+	if bgm := s.bgmSlot(from); bgm != nil {
+		bgm.Stop(ticks)
+	}
+	if bgm := s.bgmSlot(to); bgm != nil {
+		bgm.FadeIn(ticks)
+	}
+}
+
+// Lists the sounds the debug char's channels are playing.
+func (s *System) drawSoundDebug(put func(x, y *float32, txt string), x, y *float32) {
+	st := s.debugWC.soundChannels.Stats()
+	s.debugFont.SetColor(191, 255, 191)
+	put(x, y, fmt.Sprintf("Sounds: %v/%v; Requested: %v; Rejected: %v; Dropped: %v; Stolen: %v",
+		st.Active, s.wavChannels, s.soundPlaysRequested, s.soundPlaysRejected, s.soundPlaysDropped, s.soundChannelsStolen))
+	speaker.Lock()
+	load := s.audioOutputMode.load
+	s.audioOutputMode.timed = true
+	speaker.Unlock()
+	put(x, y, fmt.Sprintf("Resampling: BGM %v, SFX %v; Mixing: %.1f%% CPU",
+		s.bgmResampleQuality, s.sfxResampleQuality, load*100))
+	for _, c := range st.Channels {
+		put(x, y, fmt.Sprintf("  %v,%v (id %v) Ch: %v; Pri: %v; Pos: %v/%v; Vol: %.0f; Gain: %+.1f dB",
+			c.Group[0], c.Group[1], c.Owner, c.Channel, c.Priority, c.Position, c.Length, c.Volume,
+			20*math.Log10(float64(c.Gain))))
+	}
+}
+func (s *System) resetSoundStats() {
+	s.soundPlaysRequested, s.soundPlaysRejected = 0, 0
+	s.soundPlaysDropped, s.soundChannelsStolen = 0, 0
+}
+
+// Follows the window focus with the output gain, and pauses the sound once
+// it's faded out in FocusLossPause mode. Netplay always keeps playing, so
+// that the sound doesn't change anything about the timing of either side.
+func (s *System) tickFocus() {
+	mode := s.focusLossMode
+	if !s.focusLost || s.netInput != nil {
+		mode = FocusLossPlay
+	}
+	target := 1.0
+	switch mode {
+	case FocusLossFade:
+		target = float64(s.focusLossVolume) / 100
+	case FocusLossPause:
+		target = 0
+	}
+	speaker.Lock()
+	if target != s.focusTarget {
+		s.focusTarget = target
+		s.audioFocus.fadeTo(target, ticksToSamples(focusFadeTicks), false)
+	}
+	faded := s.audioFocus.gain == target
+	speaker.Unlock()
+	// Resume before the gain ramps back up
+	pause := mode == FocusLossPause && faded
+	if !pause && !s.focusPaused {
+		return
+	}
+	s.focusPaused = pause
+	// Sounds paused by the pause menu stay paused
+	pause = pause || s.paused && s.pauseMasterVolume == 0
+	for _, p := range s.chars {
+		for _, c := range p {
+			for i := range c.soundChannels.channels {
+				c.soundChannels.channels[i].SetPaused(pause)
+			}
 		}
 	}
+	for i := range s.soundChannels.channels {
+		s.soundChannels.channels[i].SetPaused(pause)
+	}
 }
 func (s *System) softenAllSound() {
 	for _, p := range s.chars {
@@ -950,7 +1167,7 @@ func (s *System) playerClear(pn int, destroy bool) {
 			if destroy || h.preserve == 0 || (s.roundResetFlg && h.preserve == s.round) {
 				h.destroy()
 			}
-			h.soundChannels.SetSize(0)
+			h.soundChannels.Clear()
 		}
 		if destroy {
 			p.children = p.children[:0]
@@ -964,7 +1181,7 @@ func (s *System) playerClear(pn int, destroy bool) {
 			}
 		}
 		p.targets = p.targets[:0]
-		p.soundChannels.SetSize(0)
+		p.soundChannels.Clear()
 	}
 	s.projs[pn] = s.projs[pn][:0]
 	s.explods[pn] = s.explods[pn][:0]
@@ -1367,6 +1584,9 @@ func (s *System) action() {
 					s.winTeam = int(Btoi(ko[0]))
 				}
 			}
+			if ft == FT_NotYet && s.finish != FT_NotYet {
+				s.fadeRoundBgm()
+			}
 			if ft != s.finish {
 				for i, p := range sys.chars {
 					if len(p) > 0 && ko[^i&1] {
@@ -1524,6 +1744,9 @@ func (s *System) action() {
 			s.xmin = s.cam.minLeft
 		}
 		s.allPalFX.step()
+		for i := range s.teamPalFX {
+			s.teamPalFX[i].step()
+		}
 		//s.bgPalFX.step()
 		s.envShake.next()
 		if s.envcol_time > 0 {
@@ -1632,7 +1855,7 @@ func (s *System) action() {
 	if s.superanim != nil {
 		s.topSprites.add(&SprData{s.superanim, &s.superpmap, s.superpos,
 			[...]float32{s.superfacing, 1}, [2]int32{-1}, 5, Rotation{}, [2]float32{},
-			false, true, s.cgi[s.superplayer].mugenver[0] != 1, 1, 1, 0, 0, [4]float32{0, 0, 0, 0}}, 0, 0, 0, 0)
+			false, true, s.cgi[s.superplayer].mugenver[0] != 1, 1, 1, 0, 0, [4]float32{0, 0, 0, 0}, -1}, 0, 0, 0, 0)
 		if s.superanim.loopend {
 			s.superanim = nil
 		}
@@ -1876,6 +2099,10 @@ func (s *System) drawDebugText() {
 		for _, s := range s.consoleText {
 			put(&x, &y, s)
 		}
+		// Sound channels of the char the data is shown for
+		if s.soundDebugDraw && s.debugWC != nil {
+			s.drawSoundDebug(put, &x, &y)
+		}
 		// Data
 		y = float32(s.gameHeight) - float32(s.debugFont.fnt.Size[1])*sys.debugFont.yscl/s.heightScale*
 			(float32(len(s.listLFunc))+float32(s.clipboardRows)) - 1*s.heightScale
@@ -2161,7 +2388,12 @@ func (s *System) fight() (reload bool) {
 
 	// default bgm playback, used only in Quick VS or if externalized Lua implementaion is disabled
 	if s.round == 1 && (s.gameMode == "" || len(sys.commonLua) == 0) {
-		s.bgm.Open(s.stage.bgmusic, 1, int(s.stage.bgmvolume), int(s.stage.bgmloopstart), int(s.stage.bgmloopend), int(s.stage.bgmstartposition), s.stage.bgmfreqmul)
+		if len(s.stage.bgmplaylist) > 0 {
+			// Each track plays once through, so that the playlist moves on
+			s.bgm.OpenPlaylist(s.stage.bgmplaylist, s.stage.bgmplaylistmode, 0, int(s.stage.bgmvolume), s.stage.bgmfreqmul, s.bgmCrossfade)
+		} else {
+			s.bgm.OpenStage(s.stage, s.bgmCrossfade)
+		}
 	}
 
 	oldWins, oldDraws := s.wins, s.draws
@@ -2203,6 +2435,7 @@ func (s *System) fight() (reload bool) {
 		s.stage.copyStageVars(&oldStageVars)
 		s.resetFrameTime()
 		s.nextRound()
+		s.startRoundBgm()
 		s.roundResetFlg, s.introSkipped = false, false
 		s.reloadFlg, s.reloadStageFlg, s.reloadLifebarFlg = false, false, false
 	}
@@ -3253,6 +3486,7 @@ func (l *Loader) reset() {
 		l.state = LS_NotYet
 	}
 	l.err = nil
+	clearSharedSounds()
 	for i := range sys.cgi {
 		if sys.roundsExisted[i&1] == 0 {
 			sys.cgi[i].drawpalno = -1
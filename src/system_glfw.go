@@ -69,6 +69,7 @@ func (s *System) newWindow(w, h int) (*Window, error) {
 	window.MakeContextCurrent()
 	window.SetKeyCallback(keyCallback)
 	window.SetCharModsCallback(charCallback)
+	window.SetFocusCallback(focusCallback)
 
 	// V-Sync
 	if s.vRetrace >= 0 {
@@ -185,3 +186,7 @@ func keyCallback(_ *glfw.Window, key Key, _ int, action glfw.Action, mk Modifier
 func charCallback(_ *glfw.Window, char rune, mk ModifierKey) {
 	OnTextEntered(string(char))
 }
+
+func focusCallback(_ *glfw.Window, focused bool) {
+	sys.focusLost = !focused
+}
@@ -7,6 +7,7 @@ import (
 	"os"
 
 	findfont "github.com/flopp/go-findfont"
+	"github.com/golang/freetype/truetype"
 	"github.com/ikemen-engine/glfont"
 	"github.com/sqweek/dialog"
 )
@@ -49,6 +50,13 @@ func LoadFntTtf(f *Fnt, fontfile string, filename string, height int32) {
 		panic(err)
 	}
 	f.ttf = ttf
+	// glfont doesn't expose the face metrics, so read them separately
+	if data, err := os.ReadFile(fileDir); err == nil {
+		if face, err := truetype.Parse(data); err == nil {
+			m := truetype.NewFace(face, &truetype.Options{Size: float64(height), DPI: 72}).Metrics()
+			f.ascent, f.descent = int32(m.Ascent.Ceil()), int32(m.Descent.Ceil())
+		}
+	}
 
 	// Create Ttf dummy palettes
 	f.palettes = make([][256]uint32, 1)